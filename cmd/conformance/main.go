@@ -0,0 +1,535 @@
+// Command conformance runs a corpus of makefile snippets under GNU make and
+// hmake and reports where hmake behaves differently, for gating releases on
+// compatibility.
+//
+//	go run ./cmd/conformance -hmake dist/hmake -report dist/conformance.md
+//
+// Each case is a makefile in conformance/cases, run in a directory of its
+// own by each make. A case passes when both print the same and exit alike.
+// Comments at the top of a case may give the arguments to run make with,
+// and the files to create first, oldest first:
+//
+//	# Prerequisites newer than the target remake it
+//	# args: -k out
+//	# files: out in
+//
+// A case listed in conformance/known-failures.txt is expected to fail,
+// and failing one not listed, or passing one that is, fails the run.
+//
+// Cases can be imported from GNU make's own test suite, from the
+// run_make_test calls of its tests/scripts:
+//
+//	go run ./cmd/conformance -import ../make/tests/scripts -o conformance/cases/gnu
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+func main() {
+	makeProgram := flag.String("make", "make", "GNU make program to compare with")
+	hmakeProgram := flag.String("hmake", "dist/hmake", "hmake program to check")
+	cases := flag.String("cases", "conformance/cases", "Directory of cases, searched recursively for *.mk files")
+	known := flag.String("known", "conformance/known-failures.txt", "Cases expected to fail, one name per line")
+	report := flag.String("report", "", "Write the compatibility report to this Markdown file")
+	timeout := flag.Duration("timeout", 10*time.Second, "How long each make may take over a case")
+	verbose := flag.Bool("v", false, "Show how each failing case differs")
+	importDir := flag.String("import", "", "Import cases from the tests/scripts of GNU make's source instead")
+	out := flag.String("o", "conformance/cases/gnu", "Directory to write imported cases to")
+	flag.Parse()
+
+	var err error
+	if *importDir != "" {
+		err = importCases(*importDir, *out)
+	} else {
+		err = run(*makeProgram, *hmakeProgram, *cases, *known, *report, *timeout, *verbose)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "conformance:", err)
+		os.Exit(1)
+	}
+}
+
+// testCase is a makefile to run under both makes
+type testCase struct {
+	name        string
+	description string
+	makefile    string
+	args        []string
+	files       []string
+}
+
+// outcome is what became of a case
+type outcome struct {
+	testCase
+	status string
+
+	// make and hmake are what each did, when they differ
+	make, hmake result
+}
+
+// The statuses of a case
+const (
+	passed       = "pass"
+	failed       = "FAIL"
+	knownFailure = "known failure"
+	fixed        = "FIXED"
+)
+
+// result is what a make printed and how it exited
+type result struct {
+	stdout, stderr string
+	exitCode       int
+}
+
+func run(makeProgram, hmakeProgram, dir, knownFile, reportFile string, timeout time.Duration, verbose bool) error {
+	hmakePath, err := filepath.Abs(hmakeProgram)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(hmakePath); err != nil {
+		return fmt.Errorf("%w; build hmake first", err)
+	}
+	makePath, err := exec.LookPath(makeProgram)
+	if err != nil {
+		return err
+	}
+
+	cases, err := loadCases(dir)
+	if err != nil {
+		return err
+	}
+	knownFailures, err := readKnownFailures(knownFile)
+	if err != nil {
+		return err
+	}
+
+	outcomes := []outcome{}
+	counts := map[string]int{}
+	for _, c := range cases {
+		o, err := runCase(c, makePath, hmakePath, timeout)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		switch {
+		case o.status == passed && knownFailures[c.name]:
+			o.status = fixed
+		case o.status == failed && knownFailures[c.name]:
+			o.status = knownFailure
+		}
+		counts[o.status]++
+		outcomes = append(outcomes, o)
+
+		if o.status != passed {
+			fmt.Printf("%-13s %s\n", o.status, c.name)
+		}
+		if verbose && (o.status == failed || o.status == knownFailure) {
+			fmt.Print(indent(differences(o), "    "))
+		}
+	}
+
+	compatible := 100.0
+	if len(outcomes) > 0 {
+		compatible = 100 * float64(counts[passed]+counts[fixed]) / float64(len(outcomes))
+	}
+	fmt.Printf("\n%d cases: %d pass, %d fail, %d known failures, %d fixed (%.1f%% compatible)\n",
+		len(outcomes), counts[passed], counts[failed], counts[knownFailure], counts[fixed], compatible)
+
+	if reportFile != "" {
+		if err := os.WriteFile(reportFile, []byte(markdownReport(outcomes, compatible)), 0o644); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case counts[failed] > 0:
+		return fmt.Errorf("%d cases fail that aren't known to", counts[failed])
+	case counts[fixed] > 0:
+		return fmt.Errorf("%d known failures pass now; remove them from %s", counts[fixed], knownFile)
+	}
+	return nil
+}
+
+// loadCases reads the *.mk files below dir, in order of name
+func loadCases(dir string) ([]testCase, error) {
+	cases := []testCase{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".mk" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		cases = append(cases, parseCase(strings.TrimSuffix(filepath.ToSlash(rel), ".mk"), string(data)))
+		return nil
+	})
+	sort.Slice(cases, func(i, j int) bool { return cases[i].name < cases[j].name })
+	return cases, err
+}
+
+// parseCase reads the comments heading a case: a description, then any of
+// "args:" and "files:"
+func parseCase(name, makefile string) testCase {
+	c := testCase{name: name, makefile: makefile}
+	for _, line := range strings.Split(makefile, "\n") {
+		comment, ok := strings.CutPrefix(line, "#")
+		if !ok {
+			break
+		}
+		comment = strings.TrimSpace(comment)
+		switch key, value, _ := strings.Cut(comment, ":"); key {
+		case "args":
+			c.args = strings.Fields(value)
+		case "files":
+			c.files = strings.Fields(value)
+		default:
+			if c.description == "" {
+				c.description = comment
+			}
+		}
+	}
+	return c
+}
+
+// readKnownFailures reads the names of the cases expected to fail, skipping
+// blank lines and comments
+func readKnownFailures(file string) (map[string]bool, error) {
+	known := map[string]bool{}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, _, _ := strings.Cut(line, "#"); strings.TrimSpace(name) != "" {
+			known[strings.TrimSpace(name)] = true
+		}
+	}
+	return known, nil
+}
+
+// runCase runs c under each make, each in a fresh directory
+func runCase(c testCase, makePath, hmakePath string, timeout time.Duration) (outcome, error) {
+	o := outcome{testCase: c, status: passed}
+
+	var err error
+	if o.make, err = runMake(c, makePath, nil, timeout); err != nil {
+		return o, err
+	}
+	hmakeArgs := []string{"--summary=never", "--color=never", "--no-wait"}
+	if o.hmake, err = runMake(c, hmakePath, hmakeArgs, timeout); err != nil {
+		return o, err
+	}
+
+	o.make.stdout = normalize(o.make.stdout, makePath)
+	o.make.stderr = normalize(o.make.stderr, makePath)
+	o.hmake.stdout = normalize(o.hmake.stdout, hmakePath)
+	o.hmake.stderr = normalize(o.hmake.stderr, hmakePath)
+	if o.make.stdout != o.hmake.stdout || o.make.exitCode != o.hmake.exitCode {
+		o.status = failed
+	}
+	return o, nil
+}
+
+// runMake runs program over c in a new directory, with its own flags
+// before c's arguments
+func runMake(c testCase, program string, flags []string, timeout time.Duration) (result, error) {
+	dir, err := os.MkdirTemp("", "hmake-conformance-*")
+	if err != nil {
+		return result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(filepath.Join(dir, "Makefile"), []byte(c.makefile), 0o644); err != nil {
+		return result{}, err
+	}
+	// The files are made an hour ago, a second apart, so that their times
+	// are in the order listed and older than anything the recipes write
+	base := time.Now().Add(-time.Hour)
+	for i, name := range c.files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return result{}, err
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			return result{}, err
+		}
+		when := base.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, when, when); err != nil {
+			return result{}, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, program, append(append([]string{"-f", "Makefile"}, flags...), c.args...)...)
+	cmd.Dir = dir
+	cmd.Env = makeEnv()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+
+	// The directory is named as the one the case ran in, whichever it was
+	r := result{stdout: strings.ReplaceAll(stdout.String(), dir, "."), stderr: strings.ReplaceAll(stderr.String(), dir, ".")}
+	var exit *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		r.exitCode = -1
+		r.stderr += fmt.Sprintf("timed out after %s\n", timeout)
+	case errors.As(err, &exit):
+		r.exitCode = exit.ExitCode()
+	case err != nil:
+		return r, err
+	}
+	return r, nil
+}
+
+// makeEnv is the environment without what would change how either make
+// runs: flags passed down by a make running this, and hmake's settings
+func makeEnv() []string {
+	env := []string{}
+	for _, pair := range os.Environ() {
+		name, _, _ := strings.Cut(pair, "=")
+		if name == "MAKEFLAGS" || name == "MFLAGS" || name == "MAKELEVEL" || name == "GNUMAKEFLAGS" || strings.HasPrefix(name, "HMAKE_") {
+			continue
+		}
+		env = append(env, pair)
+	}
+	return env
+}
+
+var (
+	// banner is the line hmake prints as each target starts
+	banner = regexp.MustCompile(`(?m)^\[\d+/\d+\] running commands for target:  .*\n`)
+
+	// prefix starts the messages of either make, which name the program
+	prefix = regexp.MustCompile(`(?m)^(\S*/)?(g?make|hmake)(\[\d+\])?: `)
+)
+
+// normalize drops what's bound to differ between the makes from their
+// output: hmake's progress lines, their names and the path of program
+func normalize(output, program string) string {
+	output = banner.ReplaceAllString(output, "")
+	output = strings.ReplaceAll(output, program, "make")
+	return prefix.ReplaceAllString(output, "make: ")
+}
+
+// differences describes how the makes differed over o
+func differences(o outcome) string {
+	var b strings.Builder
+	if o.make.exitCode != o.hmake.exitCode {
+		fmt.Fprintf(&b, "exit code: make %d, hmake %d\n", o.make.exitCode, o.hmake.exitCode)
+	}
+	if o.make.stdout != o.hmake.stdout {
+		fmt.Fprintf(&b, "make printed:\n%shmake printed:\n%s", indent(o.make.stdout, "  "), indent(o.hmake.stdout, "  "))
+	}
+	if o.make.stderr != o.hmake.stderr {
+		fmt.Fprintf(&b, "make's errors:\n%shmake's errors:\n%s", indent(o.make.stderr, "  "), indent(o.hmake.stderr, "  "))
+	}
+	return b.String()
+}
+
+func indent(s, prefix string) string {
+	if s == "" {
+		return prefix + "(nothing)\n"
+	}
+	return prefix + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n"+prefix) + "\n"
+}
+
+// markdownReport is the report of every case, with the differences of
+// those that failed
+func markdownReport(outcomes []outcome, compatible float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# GNU make compatibility\n\n%.1f%% of %d cases behave as under GNU make.\n\n", compatible, len(outcomes))
+	fmt.Fprintln(&b, "| Case | Result | Description |")
+	fmt.Fprintln(&b, "| --- | --- | --- |")
+	for _, o := range outcomes {
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", o.name, o.status, strings.ReplaceAll(o.description, "|", `\|`))
+	}
+
+	for _, o := range outcomes {
+		if o.status == failed || o.status == knownFailure {
+			fmt.Fprintf(&b, "\n## %s\n\n```makefile\n%s```\n\n```\n%s```\n", o.name, o.makefile, differences(o))
+		}
+	}
+	return b.String()
+}
+
+// importCases writes a case for each run_make_test call in the scripts
+// below dir whose makefile can be read without running Perl
+func importCases(dir, out string) error {
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return err
+	}
+
+	imported, skipped := 0, 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		name := strings.NewReplacer("/", "-", `\`, "-").Replace(filepath.ToSlash(rel))
+		makefile := ""
+		for i, call := range makeTestCalls(string(data)) {
+			if !call.ok {
+				// A call reusing this one's makefile can't be read either
+				makefile = ""
+				skipped++
+				continue
+			}
+			if call.makefile != "" {
+				makefile = call.makefile
+			}
+			if makefile == "" {
+				skipped++
+				continue
+			}
+
+			header := fmt.Sprintf("# Imported from GNU make's tests/scripts/%s, run_make_test %d\n", filepath.ToSlash(rel), i+1)
+			if args := strings.TrimSpace(call.args); args != "" {
+				header += "# args: " + args + "\n"
+			}
+			file := filepath.Join(out, fmt.Sprintf("%s-%d.mk", name, i+1))
+			if err := os.WriteFile(file, []byte(header+makefile), 0o644); err != nil {
+				return err
+			}
+			imported++
+		}
+		return nil
+	})
+	fmt.Printf("Imported %d cases to %s, skipping %d that need Perl\n", imported, out, skipped)
+	return err
+}
+
+// makeTestCall is a run_make_test call: its makefile, empty to reuse the
+// one before, and arguments. ok is false if either couldn't be read.
+type makeTestCall struct {
+	makefile, args string
+	ok             bool
+}
+
+// makeTestCalls finds the run_make_test calls in a Perl test script
+func makeTestCalls(script string) []makeTestCall {
+	calls := []makeTestCall{}
+	for rest := script; ; {
+		i := strings.Index(rest, "run_make_test(")
+		if i < 0 {
+			return calls
+		}
+		rest = rest[i+len("run_make_test("):]
+
+		call := makeTestCall{ok: true}
+		r := bufio.NewReader(strings.NewReader(rest))
+		var ok bool
+		if call.makefile, ok = perlString(r); !ok {
+			call.ok = false
+		} else if call.args, ok = perlString(r); !ok {
+			call.ok = false
+		}
+		if strings.Contains(call.makefile, "#") {
+			call.makefile = strings.NewReplacer("#MAKEFILE#", "Makefile", "#MAKE#", "$(MAKE)", "#PWD#", ".").Replace(call.makefile)
+		}
+		calls = append(calls, call)
+	}
+}
+
+// perlString reads the next argument of a call, if it's a Perl string
+// without interpolation, '...', q!...!, q{...}, or undef, which reads as
+// empty. A comma or the closing parenthesis after it is consumed.
+func perlString(r *bufio.Reader) (string, bool) {
+	skipSpace(r)
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", false
+	}
+
+	var s string
+	var ok bool
+	switch {
+	case c == '\'':
+		s, ok = readQuoted(r, '\'', true)
+	case c == 'q':
+		delim, err := r.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		end := map[byte]byte{'{': '}', '(': ')', '[': ']', '<': '>'}[delim]
+		if end == 0 {
+			end = delim
+		}
+		s, ok = readQuoted(r, end, false)
+	case c == 'u':
+		rest := make([]byte, 4)
+		if _, err := io.ReadFull(r, rest); err != nil || string(rest) != "ndef" {
+			return "", false
+		}
+		ok = true
+	default:
+		return "", false
+	}
+
+	skipSpace(r)
+	if c, err := r.ReadByte(); err != nil || (c != ',' && c != ')') {
+		return "", false
+	}
+	return s, ok
+}
+
+// readQuoted reads up to end, undoing \' and \\ if escapes is set
+func readQuoted(r *bufio.Reader, end byte, escapes bool) (string, bool) {
+	var b strings.Builder
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		if c == end {
+			return b.String(), true
+		}
+		if c == '\\' && escapes {
+			next, err := r.ReadByte()
+			if err != nil {
+				return "", false
+			}
+			if next != end && next != '\\' {
+				b.WriteByte(c)
+			}
+			c = next
+		}
+		b.WriteByte(c)
+	}
+}
+
+func skipSpace(r *bufio.Reader) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			r.UnreadByte()
+			return
+		}
+	}
+}
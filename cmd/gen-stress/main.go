@@ -0,0 +1,63 @@
+// Command gen-stress writes a makefile for stress testing hmake with a
+// large dependency graph: a chain of targets thousands deep, and as many
+// more targets again fanning out from it, each with a few prerequisites.
+// With -width it writes instead a flat one, of that many independent
+// targets under a single goal, for the scheduler's ready queue.
+//
+//	go run ./cmd/gen-stress -targets 100000 -depth 5000 > stress.mk
+//	go run ./cmd/gen-stress -width 100000 > wide.mk
+//	hmake -f stress.mk -n > /dev/null
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	targets := flag.Int("targets", 100000, "Number of targets")
+	depth := flag.Int("depth", 5000, "Length of the longest chain of prerequisites")
+	fanout := flag.Int("fanout", 4, "Prerequisites of each target off the chain")
+	width := flag.Int("width", 0, "If set, write this many independent targets under all instead")
+	flag.Parse()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if *width > 0 {
+		fmt.Fprintln(w, ".PHONY: all")
+		fmt.Fprint(w, "all:")
+		for i := 0; i < *width; i++ {
+			fmt.Fprintf(w, " leaf%d", i)
+		}
+		fmt.Fprintln(w)
+		for i := 0; i < *width; i++ {
+			fmt.Fprintf(w, "leaf%d:\n\t@:\n", i)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, ".PHONY: all")
+	fmt.Fprintf(w, "all: chain%d", *depth-1)
+	for i := *depth; i < *targets; i += 100 {
+		fmt.Fprintf(w, " t%d", i)
+	}
+	fmt.Fprintln(w)
+
+	// The chain, each target depending on the one before
+	fmt.Fprintln(w, "chain0:\n\t@:")
+	for i := 1; i < *depth; i++ {
+		fmt.Fprintf(w, "chain%d: chain%d\n\t@:\n", i, i-1)
+	}
+
+	// The rest, each depending on earlier targets and a link of the chain
+	for i := *depth; i < *targets; i++ {
+		fmt.Fprintf(w, "t%d: chain%d", i, i%*depth)
+		for j := 1; j < *fanout && i-j*7 >= *depth; j++ {
+			fmt.Fprintf(w, " t%d", i-j*7)
+		}
+		fmt.Fprintln(w, "\n\t@:")
+	}
+}
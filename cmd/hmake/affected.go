@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+const affectedUsage = `usage: hmake affected [-since origin/main] [-list] [target...]
+
+Builds only what the files changed since a git revision affect: those
+changed on this branch since it left -since, and those changed, or new,
+in the working tree. A target is affected if it depends, all the way
+down, on a changed file. A target with no recipe, such as "test: test-a
+test-b", stands for its prerequisites, so only those that are affected
+are built. A change to the makefile affects everything. With no targets
+the default goal is used, and with -list the affected targets are
+printed instead of built. Flags before "affected", such as -j and -k,
+apply to the build.`
+
+func init() {
+	register(Command{
+		Name:  "affected",
+		Usage: "Build only the targets affected by the files changed since a git revision",
+		Run:   runAffected,
+	})
+}
+
+func runAffected(args []string) error {
+	fs := flag.NewFlagSet("affected", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), affectedUsage) }
+	since := fs.String("since", "origin/main", "The git revision to compare with, usually the branch merged into")
+	list := fs.Bool("list", false, "Print the affected targets instead of building them")
+
+	mf, goals, err := loadGoals(parseInterspersed(fs, args))
+	if err != nil {
+		return err
+	}
+	changed, err := changedFiles(*since)
+	if err != nil {
+		return err
+	}
+
+	a := &affectedTargets{mf: mf, changed: map[string]bool{}, memo: map[string]bool{}}
+	for _, file := range changed {
+		a.changed[file] = true
+	}
+	for _, file := range append([]string{makefilePath()}, mf.Included...) {
+		a.all = a.all || a.changed[filepath.ToSlash(filepath.Clean(file))]
+	}
+
+	targets := a.choose(goals)
+	if *list {
+		for _, name := range targets {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	switch {
+	case len(targets) == 0:
+		fmt.Printf("hmake: nothing is affected by the changes since %s\n", *since)
+		return nil
+	case a.all:
+		fmt.Printf("hmake: the makefile changed since %s, so everything is affected\n", *since)
+	default:
+		fmt.Printf("hmake: the changes since %s affect %s\n", *since, strings.Join(targets, " "))
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	return runBuild(ctx, mf, targets, buildFlags)
+}
+
+// changedFiles lists the files, relative to the current directory and
+// below it, changed since the point this branch left since, committed or
+// not, and those new and not ignored
+func changedFiles(since string) ([]string, error) {
+	base, err := git("merge-base", since, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := git("diff", "--name-only", "--relative", strings.TrimSpace(base))
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git("ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(diff+"\n"+untracked, "\n") {
+		// hmake's own state isn't part of the project
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, ".hmake/") && !seen[line] {
+			seen[line] = true
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// git runs git, giving what it printed or, on failure, an error with what
+// it said was wrong
+func git(args ...string) (string, error) {
+	out, err := osexec.Command("git", args...).Output()
+	var exit *osexec.ExitError
+	if errors.As(err, &exit) {
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exit.Stderr)))
+	}
+	return string(out), err
+}
+
+// affectedTargets works out which targets depend on changed files
+type affectedTargets struct {
+	mf      *makefile.Makefile
+	changed map[string]bool
+
+	// all is set if the makefile changed, which affects everything
+	all bool
+
+	// memo holds whether each target looked at is affected
+	memo map[string]bool
+}
+
+// affected reports whether name is a changed file, or depends on one
+func (a *affectedTargets) affected(name string) bool {
+	if affected, ok := a.memo[name]; ok {
+		return affected
+	}
+	a.memo[name] = false
+
+	affected := a.all || a.changed[name]
+	for _, dep := range a.mf.Targets[name].Dependencies {
+		if affected {
+			break
+		}
+		affected = a.affected(dep)
+	}
+	a.memo[name] = affected
+	return affected
+}
+
+// choose picks the affected goals to build, in their place the affected
+// prerequisites of those without recipes
+func (a *affectedTargets) choose(goals []string) []string {
+	chosen := []string{}
+	seen := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] || !a.affected(name) {
+			return
+		}
+		seen[name] = true
+
+		t, ok := a.mf.Targets[name]
+		if !ok {
+			return
+		}
+		if len(t.Commands) == 0 && t.Fetch == nil && len(t.Dependencies) > 0 {
+			for _, dep := range t.Dependencies {
+				visit(dep)
+			}
+			return
+		}
+		chosen = append(chosen, name)
+	}
+	for _, goal := range goals {
+		visit(goal)
+	}
+	return chosen
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+func init() {
+	register(Command{
+		Name:  "bench",
+		Usage: "Compare the commands and times of a build under hmake and GNU make",
+		Run:   runBench,
+	})
+}
+
+const benchUsage = `usage: hmake bench [-make make] [-runs 3] [-clean target] [-j jobs] [target...]
+
+Compares the commands GNU make and hmake would run for a dry run of the
+targets, reporting those only one of them runs, then times builds of the
+targets under each. With -clean, the target given is made with GNU make
+before every build, so each builds from scratch; without it, the builds
+after the first measure how long each takes to find nothing to do. The
+commands differing fails, for CI.`
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), benchUsage) }
+	gmake := fs.String("make", "make", "GNU make program to compare with")
+	runs := fs.Int("runs", 3, "Builds to time under each, or 0 to only compare the commands")
+	clean := fs.String("clean", "", "Target made before each build, so that it builds from scratch")
+	jobs := fs.Int("j", 1, "Number of recipes each may run at once")
+	goals := parseInterspersed(fs, args)
+
+	makeCommands, err := makeDryRun(*gmake, goals)
+	if err != nil {
+		return err
+	}
+	hmakeCommands, err := hmakeDryRun(goals)
+	if err != nil {
+		return err
+	}
+	same := reportCommands(os.Stdout, *gmake, makeCommands, hmakeCommands)
+
+	if *runs > 0 {
+		fmt.Println()
+		if err := benchTimes(os.Stdout, *gmake, goals, *runs, *clean, *jobs); err != nil {
+			return err
+		}
+	}
+
+	if !same {
+		return errors.New("hmake and make would run different commands")
+	}
+	return nil
+}
+
+// makeDryRun returns the commands make -n prints, joining those continued
+// over several lines, without make's own messages
+func makeDryRun(program string, goals []string) ([]string, error) {
+	cmd := osexec.Command(program, append([]string{"-n", "-f", makefileName}, goals...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -n: %w\n%s", program, err, strings.TrimSpace(stderr.String()))
+	}
+
+	message := regexp.MustCompile(`^` + regexp.QuoteMeta(filepath.Base(program)) + `(\[\d+\])?: `)
+	commands := []string{}
+	continued := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case continued:
+			commands[len(commands)-1] += "\n" + line
+		case message.MatchString(line):
+			continue
+		default:
+			commands = append(commands, line)
+		}
+		continued = strings.HasSuffix(line, `\`)
+	}
+	return commands, scanner.Err()
+}
+
+// hmakeDryRun returns the commands hmake -n would run, as it logs them
+func hmakeDryRun(goals []string) ([]string, error) {
+	log, err := os.CreateTemp("", "hmake-bench-*.json")
+	if err != nil {
+		return nil, err
+	}
+	log.Close()
+	defer os.Remove(log.Name())
+
+	hmakeArgs := append([]string{"-n", "-f", makefileName, "--log-json=" + log.Name(), "--summary=never", "--color=never"}, goals...)
+	cmd := osexec.Command(makefile.Executable, hmakeArgs...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("hmake -n: %w\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	data, err := os.ReadFile(log.Name())
+	if err != nil {
+		return nil, err
+	}
+	commands := []string{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var e event
+		if err := decoder.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading hmake's events: %w", err)
+		}
+		if e.Event == "command" {
+			commands = append(commands, e.Command)
+		}
+	}
+	return commands, nil
+}
+
+// reportCommands writes how the commands make and hmake would run differ,
+// reporting whether they're the same
+func reportCommands(w io.Writer, program string, makeCommands, hmakeCommands []string) bool {
+	fmt.Fprintln(w, "Commands, from a dry run:")
+	fmt.Fprintf(w, "  %-6s %d\n", program, len(makeCommands))
+	fmt.Fprintf(w, "  %-6s %d\n", "hmake", len(hmakeCommands))
+
+	onlyMake, onlyHmake := difference(makeCommands, hmakeCommands), difference(hmakeCommands, makeCommands)
+	for _, d := range []struct {
+		who      string
+		commands []string
+	}{{program, onlyMake}, {"hmake", onlyHmake}} {
+		if len(d.commands) > 0 {
+			fmt.Fprintf(w, "  Only %s runs:\n", d.who)
+			for _, command := range d.commands {
+				fmt.Fprintf(w, "    %s\n", strings.ReplaceAll(command, "\n", "\n    "))
+			}
+		}
+	}
+
+	switch {
+	case len(onlyMake) > 0 || len(onlyHmake) > 0:
+		return false
+	case slices.Equal(makeCommands, hmakeCommands):
+		fmt.Fprintln(w, "  The same, in the same order")
+	default:
+		// Both orders respect the dependencies, so either is right
+		fmt.Fprintln(w, "  The same, in a different order")
+	}
+	return true
+}
+
+// difference returns the commands of a not in b, counting repeats
+func difference(a, b []string) []string {
+	left := map[string]int{}
+	for _, command := range b {
+		left[command]++
+	}
+	missing := []string{}
+	for _, command := range a {
+		if left[command] > 0 {
+			left[command]--
+		} else {
+			missing = append(missing, command)
+		}
+	}
+	return missing
+}
+
+// benchTimes times runs builds of the goals under make and under hmake,
+// taking turns, making the clean target first if there is one
+func benchTimes(w io.Writer, program string, goals []string, runs int, clean string, jobs int) error {
+	times := map[string][]time.Duration{}
+	tools := []struct {
+		name    string
+		program string
+		args    []string
+	}{
+		{program, program, []string{"-f", makefileName, "-j" + strconv.Itoa(jobs)}},
+		{"hmake", makefile.Executable, []string{"-f", makefileName, "-j", strconv.Itoa(jobs), "--summary=never"}},
+	}
+
+	for i := 0; i < runs; i++ {
+		for _, tool := range tools {
+			if clean != "" {
+				if err := benchRun(program, []string{"-f", makefileName, clean}); err != nil {
+					return fmt.Errorf("%s %s: %w", program, clean, err)
+				}
+			}
+
+			start := time.Now()
+			if err := benchRun(tool.program, append(slices.Clone(tool.args), goals...)); err != nil {
+				return fmt.Errorf("%s: %w", tool.name, err)
+			}
+			times[tool.name] = append(times[tool.name], time.Since(start))
+		}
+	}
+
+	how := "with nothing cleaned between"
+	if clean != "" {
+		how = fmt.Sprintf("making '%s' before each", clean)
+	}
+	fmt.Fprintf(w, "Times, of %d builds each with -j%d, %s:\n", runs, jobs, how)
+	makeMedian := median(times[program])
+	for _, tool := range tools {
+		d := times[tool.name]
+		fmt.Fprintf(w, "  %-6s min %s, median %s", tool.name, round(slices.Min(d)), round(median(d)))
+		if tool.name == "hmake" && makeMedian > 0 {
+			fmt.Fprintf(w, " (%.2fx %s)", float64(median(d))/float64(makeMedian), program)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// benchRun runs a build, with its output dropped unless it fails
+func benchRun(program string, args []string) error {
+	cmd := osexec.Command(program, args...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w\n%s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func median(d []time.Duration) time.Duration {
+	sorted := slices.Clone(d)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// buildTrace records when each target and command ran, from the events of
+// the build, and writes them out once it's over as a Chrome trace for
+// Perfetto or chrome://tracing, or sends them to an OpenTelemetry collector
+type buildTrace struct {
+	mu   sync.Mutex
+	file string
+	otlp string
+
+	mf      *makefile.Makefile
+	started time.Time
+	spans   []*span
+
+	// running holds the span of each target being made, and commands the
+	// span of the command it's running
+	running  map[string]*span
+	commands map[string]*span
+	finished map[string]time.Time
+
+	// lanes says which rows of the trace are taken, so that targets made at
+	// the same time are drawn side by side
+	lanes []bool
+}
+
+// span is a target's recipe or one of its commands
+type span struct {
+	name   string
+	parent *span
+	start  time.Time
+	end    time.Time
+	lane   int
+	err    string
+
+	// wait is how long a target was ready to be made before a job was free
+	wait time.Duration
+}
+
+// tracing is the trace given with --chrome-trace or --otlp-endpoint, if any
+var tracing *buildTrace
+
+func newBuildTrace(file, otlp string) *buildTrace {
+	return &buildTrace{file: file, otlp: strings.TrimSuffix(otlp, "/")}
+}
+
+// begin starts recording a build of mf
+func (b *buildTrace) begin(mf *makefile.Makefile) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mf, b.started, b.spans, b.lanes = mf, time.Now(), nil, nil
+	b.running = map[string]*span{}
+	b.commands = map[string]*span{}
+	b.finished = map[string]time.Time{}
+}
+
+// observe records an event of the build
+func (b *buildTrace) observe(e event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.mf == nil {
+		return
+	}
+
+	switch e.Event {
+	case "target_start":
+		// A target is ready once the last of its prerequisites is made
+		ready := b.started
+		for _, dep := range b.mf.Targets[e.Target].Dependencies {
+			if t, ok := b.finished[dep]; ok && t.After(ready) {
+				ready = t
+			}
+		}
+		s := &span{name: e.Target, start: e.Time, lane: b.takeLane(), wait: e.Time.Sub(ready)}
+		b.running[e.Target] = s
+		b.spans = append(b.spans, s)
+
+	case "command":
+		parent := b.running[e.Target]
+		if parent == nil {
+			return
+		}
+		b.endCommand(e.Target, e.Time)
+		s := &span{name: e.Command, parent: parent, start: e.Time, lane: parent.lane}
+		b.commands[e.Target] = s
+		b.spans = append(b.spans, s)
+
+	case "target_finish":
+		s := b.running[e.Target]
+		if s == nil {
+			return
+		}
+		b.endCommand(e.Target, e.Time)
+		s.end, s.err = e.Time, e.Error
+		b.lanes[s.lane] = false
+		delete(b.running, e.Target)
+		b.finished[e.Target] = e.Time
+
+	case "build_finish":
+		b.finish(e.Time)
+	}
+}
+
+// endCommand ends the span of the command target is running, if any
+func (b *buildTrace) endCommand(target string, at time.Time) {
+	if s := b.commands[target]; s != nil {
+		s.end = at
+		delete(b.commands, target)
+	}
+}
+
+func (b *buildTrace) takeLane() int {
+	for i, taken := range b.lanes {
+		if !taken {
+			b.lanes[i] = true
+			return i
+		}
+	}
+	b.lanes = append(b.lanes, true)
+	return len(b.lanes) - 1
+}
+
+// finish writes the trace of the build that ended at end
+func (b *buildTrace) finish(end time.Time) {
+	// Spans cut short by an interruption end with the build
+	for _, s := range b.spans {
+		if s.end.IsZero() {
+			s.end = end
+		}
+	}
+
+	if b.file != "" {
+		if err := b.writeChrome(end); err != nil {
+			printWarning("hmake: trace: %s", err)
+		}
+	}
+	if b.otlp != "" {
+		if err := b.sendOTLP(end); err != nil {
+			printWarning("hmake: trace: %s", err)
+		}
+	}
+	b.mf = nil
+}
+
+// chromeEvent is an entry of the Trace Event Format
+type chromeEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	Ts   float64        `json:"ts"`
+	Dur  float64        `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+func (b *buildTrace) writeChrome(end time.Time) error {
+	micros := func(t time.Time) float64 { return float64(t.Sub(b.started).Nanoseconds()) / 1e3 }
+
+	trace := []chromeEvent{
+		{Name: "process_name", Ph: "M", Pid: 1, Args: map[string]any{"name": "hmake"}},
+		{Name: "build", Cat: "build", Ph: "X", Ts: 0, Dur: micros(end), Pid: 1, Tid: 0},
+	}
+	for lane := range b.lanes {
+		trace = append(trace, chromeEvent{Name: "thread_name", Ph: "M", Pid: 1, Tid: lane + 1, Args: map[string]any{"name": fmt.Sprintf("job %d", lane+1)}})
+	}
+	for _, s := range b.spans {
+		e := chromeEvent{Name: s.name, Cat: "target", Ph: "X", Ts: micros(s.start), Dur: micros(s.end) - micros(s.start), Pid: 1, Tid: s.lane + 1}
+		if s.parent != nil {
+			e.Cat = "command"
+		} else {
+			e.Args = map[string]any{"wait_ms": float64(s.wait) / float64(time.Millisecond)}
+			if s.err != "" {
+				e.Args["error"] = s.err
+			}
+		}
+		trace = append(trace, e)
+	}
+
+	data, err := json.Marshal(map[string]any{"traceEvents": trace, "displayTimeUnit": "ms"})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.file, data, 0o644)
+}
+
+// otlpSpan is a span as OTLP/HTTP's JSON encoding has it
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// sendOTLP posts the build as a trace, a span for the build with one for
+// each target within it and one for each command within those, to the
+// collector's /v1/traces
+func (b *buildTrace) sendOTLP(end time.Time) error {
+	traceID := randomID(16)
+	nanos := func(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
+
+	root := otlpSpan{TraceID: traceID, SpanID: randomID(8), Name: "build", Kind: 1, Start: nanos(b.started), End: nanos(end)}
+	spans := []otlpSpan{root}
+	ids := map[*span]string{}
+	for _, s := range b.spans {
+		ids[s] = randomID(8)
+		o := otlpSpan{TraceID: traceID, SpanID: ids[s], ParentSpanID: root.SpanID, Name: s.name, Kind: 1, Start: nanos(s.start), End: nanos(s.end)}
+		if s.parent != nil {
+			o.ParentSpanID = ids[s.parent]
+			o.Attributes = []otlpAttribute{{Key: "hmake.command", Value: map[string]any{"stringValue": s.name}}}
+			o.Name = "command"
+		} else {
+			o.Attributes = []otlpAttribute{
+				{Key: "hmake.target", Value: map[string]any{"stringValue": s.name}},
+				{Key: "hmake.wait_ms", Value: map[string]any{"doubleValue": float64(s.wait) / float64(time.Millisecond)}},
+			}
+		}
+		if s.err != "" {
+			o.Status = &otlpStatus{Code: 2, Message: s.err}
+		}
+		spans = append(spans, o)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{
+				{Key: "service.name", Value: map[string]any{"stringValue": "hmake"}},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "hmake"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.otlp+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Headers are given as OpenTelemetry's exporters take them
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if name, value, ok := strings.Cut(pair, "="); ok {
+			req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// randomID returns n random bytes in hex, for trace and span IDs
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/cache"
+)
+
+const cacheUsage = `usage: hmake cache stats
+       hmake cache gc [--max-size=10G] [--max-age=30d]
+
+gc removes the least recently used entries of the local artifact cache
+until it's within the limits. Remote caches are limited by their servers,
+e.g. bazel-remote's --max_size or an S3 lifecycle rule.`
+
+func init() {
+	register(Command{
+		Name:  "cache",
+		Usage: "Show statistics of the artifact cache or trim it",
+		Run:   runCache,
+	})
+}
+
+func runCache(args []string) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+
+	cfg, err := loadConfig()
+	if err == nil {
+		err = cfg.applyFlags(flag.CommandLine)
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.CacheDir == "" {
+		return errors.New("hmake: no cache directory; set cache_dir")
+	}
+	c := cache.New(filepath.Join(cfg.CacheDir, "artifacts"))
+
+	switch args[0] {
+	case "stats":
+		stats, err := c.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Directory: %s\n", c.Dir)
+		fmt.Printf("Entries:   %d\n", stats.Entries)
+		fmt.Printf("Files:     %d\n", stats.Files)
+		fmt.Printf("Size:      %s\n", formatSize(stats.Size))
+		if stats.Entries > 0 {
+			fmt.Printf("Used:      %s to %s\n", stats.Oldest.Format(time.DateTime), stats.Newest.Format(time.DateTime))
+		}
+		if lookups := stats.Hits + stats.Misses; lookups > 0 {
+			fmt.Printf("Hits:      %d of %d (%.0f%%)\n", stats.Hits, lookups, 100*float64(stats.Hits)/float64(lookups))
+		}
+		return nil
+
+	case "gc":
+		fs := flag.NewFlagSet("cache gc", flag.ExitOnError)
+		fs.Usage = func() { fmt.Fprintln(fs.Output(), cacheUsage) }
+		maxSize := fs.String("max-size", "", "Most the cache may hold, e.g. 500M or 10G")
+		maxAge := fs.String("max-age", "", "Remove entries unused for longer, e.g. 30d or 12h")
+		fs.Parse(args[1:])
+
+		var opts cache.GCOptions
+		if *maxSize != "" {
+			if opts.MaxSize, err = parseSize(*maxSize); err != nil {
+				return err
+			}
+		}
+		if *maxAge != "" {
+			if opts.MaxAge, err = parseAge(*maxAge); err != nil {
+				return err
+			}
+		}
+
+		removed, freed, err := c.GC(opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("hmake: removed %d entries, freeing %s\n", removed, formatSize(freed))
+		return nil
+	}
+
+	return errors.New(cacheUsage)
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix,
+// each 1024 times the last
+func parseSize(s string) (int64, error) {
+	n := strings.TrimSuffix(strings.ToUpper(s), "B")
+	shift := 0
+	if i := strings.IndexAny(n, "KMGT"); i >= 0 && i == len(n)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", n[i]) + 1)
+		n = n[:i]
+	}
+
+	size, err := strconv.ParseFloat(n, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(size * float64(int64(1)<<shift)), nil
+}
+
+// parseAge parses a duration, which may also be given in days or weeks
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			if days, err := strconv.ParseFloat(n, 64); err == nil && days >= 0 {
+				return time.Duration(days * float64(unit)), nil
+			}
+		}
+	}
+
+	age, err := time.ParseDuration(s)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return age, nil
+}
+
+func formatSize(n int64) string {
+	size := float64(n)
+	for _, unit := range []string{"B", "KB", "MB", "GB"} {
+		if size < 1024 {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", n)
+			}
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return fmt.Sprintf("%.1f TB", size)
+}
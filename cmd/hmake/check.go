@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+func init() {
+	register(Command{
+		Name:  "check",
+		Usage: "Check the makefile for cycles, missing rules and other mistakes without building",
+		Run:   runCheck,
+	})
+}
+
+// problem is something hmake check found, an error if the build would
+// fail because of it and a warning otherwise
+type problem struct {
+	pos     ast.Pos
+	warning bool
+	message string
+}
+
+func (p problem) String() string {
+	kind := "error"
+	if p.warning {
+		kind = "warning"
+	}
+	if p.pos.Line == 0 {
+		return fmt.Sprintf("%s: %s", kind, p.message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", p.pos.Filename, p.pos.Line, kind, p.message)
+}
+
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	werror := fs.Bool("Werror", false, "Fail on warnings too")
+	fs.Parse(args)
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	problems := checkMakefile(mf)
+	failed := 0
+	for _, p := range problems {
+		if p.warning && !*werror {
+			printWarning("%s", p)
+			continue
+		}
+		printError(p)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d problems found", failed)
+	}
+	return nil
+}
+
+// checkMakefile finds what would go wrong building any of mf's targets,
+// and what looks like a mistake, in the order they appear in the makefile
+func checkMakefile(mf *makefile.Makefile) []problem {
+	problems := []problem{}
+	problems = append(problems, checkPrerequisites(mf)...)
+	problems = append(problems, checkRecipes(mf)...)
+	problems = append(problems, checkUnreachable(mf)...)
+
+	// Cycles go last, as dropping them changes mf
+	for _, cycle := range graph.DropCycles(mf) {
+		problems = append(problems, problem{pos: cycle.Pos[0], message: "Circular dependency: " + strings.Join(cycle.Path, " -> ")})
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i].pos, problems[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Line < b.Line
+	})
+	return problems
+}
+
+// checkPrerequisites finds prerequisites with no rule that aren't files,
+// and those that several pattern rules could make
+func checkPrerequisites(mf *makefile.Makefile) []problem {
+	problems := []problem{}
+	checked := map[string]bool{}
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		if makefile.IsPatternRule(name) || makefile.IsSpecialTarget(name) {
+			continue
+		}
+
+		for _, dep := range t.Dependencies {
+			if _, ok := mf.Targets[dep]; ok || checked[dep] {
+				continue
+			}
+			checked[dep] = true
+			pos := t.DependencyPos[dep]
+
+			patterns := matchingPatterns(mf, dep)
+			if len(patterns) > 1 {
+				problems = append(problems, problem{pos: pos, warning: true, message: fmt.Sprintf(
+					"'%s' matches the pattern rules '%s' equally well; GNU make uses the first", dep, strings.Join(patterns, "', '"))})
+			}
+
+			if _, err := mf.FileSystem().Stat(dep); err != nil {
+				msg := (&build.MissingError{Prerequisite: dep, NeededBy: t.Name}).Error()
+				if len(patterns) > 0 {
+					msg += fmt.Sprintf(" It matches the pattern rule '%s', which hmake doesn't apply yet.", patterns[0])
+				}
+				problems = append(problems, problem{pos: pos, message: msg})
+			}
+		}
+	}
+	return problems
+}
+
+// matchingPatterns returns the pattern rules with recipes that would make
+// name, those with the shortest stem, as GNU make chooses among them
+func matchingPatterns(mf *makefile.Makefile, name string) []string {
+	matching := []string{}
+	shortest := -1
+	for _, pattern := range mf.TargetNames {
+		if !makefile.IsPatternRule(pattern) || len(mf.Targets[pattern].Commands) == 0 {
+			continue
+		}
+		stem, ok := matchPattern(pattern, name)
+		switch {
+		case !ok || (shortest >= 0 && len(stem) > shortest):
+			continue
+		case len(stem) < shortest || shortest < 0:
+			matching = matching[:0]
+			shortest = len(stem)
+		}
+		matching = append(matching, pattern)
+	}
+	return matching
+}
+
+// matchPattern reports whether name matches the pattern, and the stem the
+// % stood for
+func matchPattern(pattern, name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "%")
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// checkRecipes expands every recipe, finding those too large to expand and
+// references to variables with no value. The references are errors with
+// --strict, as the build would fail.
+func checkRecipes(mf *makefile.Makefile) []problem {
+	// A canceled context keeps $(shell) in recipes from running anything;
+	// it expands to nothing instead
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Reported here rather than by any --warn-undefined-variables hook
+	mf.Undefined = nil
+
+	problems := []problem{}
+	seen := map[string]bool{}
+	for _, name := range mf.TargetNames {
+		_, err := mf.ExpandRecipeStrict(ctx, mf.Targets[name])
+		if err == nil {
+			continue
+		}
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var limit *makefile.ExpandLimitError
+			if errors.As(err, &limit) {
+				problems = append(problems, problem{pos: limit.Pos, message: fmt.Sprintf("the recipe of '%s' is too large to expand", name)})
+				continue
+			}
+
+			var undefined *makefile.UndefinedError
+			if !errors.As(err, &undefined) || seen[err.Error()] {
+				continue
+			}
+			seen[err.Error()] = true
+			problems = append(problems, problem{
+				pos:     undefined.Pos,
+				warning: undefinedVariables != "error",
+				message: fmt.Sprintf("undefined variable '%s'", undefined.Name),
+			})
+		}
+	}
+	return problems
+}
+
+// checkUnreachable finds targets no plausible goal needs, most likely left
+// over from something removed
+func checkUnreachable(mf *makefile.Makefile) []problem {
+	needed := map[string]bool{}
+	for _, name := range mf.TargetNames {
+		for _, dep := range mf.Targets[name].Dependencies {
+			needed[dep] = true
+		}
+	}
+
+	problems := []problem{}
+	for _, name := range graph.Unreachable(mf) {
+		msg := fmt.Sprintf("nothing needs target '%s': it isn't the default goal, a prerequisite, phony or documented", name)
+		if needed[name] {
+			msg = fmt.Sprintf("target '%s' is only needed by targets nothing needs", name)
+		}
+		problems = append(problems, problem{pos: mf.Targets[name].Pos, warning: true, message: msg})
+	}
+	return problems
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cleanUsage = `usage: hmake clean [--dry-run] [target...]
+
+Removes the files that builds created, as recorded in .hmake/state.json,
+or only those of the given targets. Files that were there before a
+recipe ran, and files outside the project, are left alone. A clean
+target in the Makefile takes precedence over this command.`
+
+func init() {
+	register(Command{
+		Name:  "clean",
+		Usage: "Remove the files hmake's builds created",
+		Run:   runClean,
+	})
+}
+
+func runClean(args []string) error {
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), cleanUsage) }
+	dryRun := fs.Bool("dry-run", false, "Print the files that would be removed without removing them")
+	fs.BoolVar(dryRun, "n", false, "Short for --dry-run")
+	fs.Parse(args)
+
+	if !*dryRun {
+		unlock, err := lockWorkspace(context.Background(), false)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	names := fs.Args()
+	if len(names) == 0 {
+		names = sortedKeys(state.Targets)
+	}
+
+	for _, name := range names {
+		ts, ok := state.Targets[name]
+		if !ok {
+			return fmt.Errorf("no state recorded for %s", name)
+		}
+
+		for _, out := range ts.Outputs {
+			if !inProject(out) {
+				continue
+			}
+			if _, err := os.Lstat(out); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			fmt.Printf("rm %s\n", out)
+			if *dryRun {
+				continue
+			}
+			if err := os.Remove(out); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			removeEmptyDirs(filepath.Dir(out))
+		}
+
+		if !*dryRun {
+			delete(state.Targets, name)
+		}
+	}
+
+	if *dryRun {
+		return nil
+	}
+	return state.save()
+}
+
+// inProject reports whether name, a target's file, is within the current
+// directory
+func inProject(name string) bool {
+	name = filepath.Clean(name)
+	return !filepath.IsAbs(name) && name != ".." && !strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
+
+// removeEmptyDirs removes dir and its parents within the current directory
+// for as long as they're empty, as they held only what was cleaned
+func removeEmptyDirs(dir string) {
+	for dir != "." && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/ninja"
+	"github.com/hookenz/hmake/pkg/taskfile"
+)
+
+// Command is a subcommand of hmake, e.g. "hmake targets"
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string) error
+
+	// Hidden commands are omitted from completions
+	Hidden bool
+}
+
+// commands holds the subcommands recognised as the first non-flag argument
+var commands = map[string]Command{}
+
+func register(cmd Command) {
+	commands[cmd.Name] = cmd
+}
+
+// lookupCommand finds the subcommand called name. A target of the same name
+// in the Makefile takes precedence so existing makefiles keep working.
+func lookupCommand(name string) (Command, bool) {
+	cmd, ok := commands[name]
+	if !ok {
+		return cmd, false
+	}
+
+	if mf, err := loadMakefile(); err == nil {
+		if _, defined := mf.Targets[name]; defined {
+			return cmd, false
+		}
+	}
+
+	return cmd, true
+}
+
+// inlineSubmakes, set by --inline-submakes, splices the makefiles of
+// "$(MAKE) -C dir" recipes into the one read
+var inlineSubmakes bool
+
+// makefileName is the file given with -f, the Makefile in the current
+// directory by default
+var makefileName = "Makefile"
+
+// commandLineVariables are the variables assigned on the command line,
+// which the makefile sees as it's read
+var commandLineVariables = map[string]string{}
+
+// loadMakefile parses the makefile. A file named *.ninja is read as a ninja
+// build file, and *.yaml or *.toml as a task file. Without a Makefile, an
+// Hmakefile.yaml or similar is used if there is one.
+func loadMakefile() (*makefile.Makefile, error) {
+	mf := makefile.NewMakefile()
+	mf.ParseCache = parseCache
+	mf.Overrides = commandLineVariables
+	if len(profileVariables) > 0 {
+		mf.Overrides = maps.Clone(profileVariables)
+		maps.Copy(mf.Overrides, commandLineVariables)
+	}
+	auditShell(mf)
+
+	mf.Overridden = func(o *makefile.RecipeOverride) {
+		for _, line := range o.Lines() {
+			printWarning("%s", line)
+		}
+	}
+
+	var undefined []error
+	switch undefinedVariables {
+	case "warn":
+		mf.Undefined = warnUndefined()
+	case "error":
+		mf.Undefined = func(err *makefile.UndefinedError) { undefined = append(undefined, err) }
+	}
+
+	filename := makefilePath()
+	if err := parseInto(mf, filename); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", filename, err)
+	}
+
+	if inlineSubmakes {
+		if err := mf.InlineSubmakes(context.Background()); err != nil {
+			return nil, fmt.Errorf("Error inlining sub-makes of %s: %w", filename, err)
+		}
+	}
+
+	// With --strict the recipes' references are checked as they run
+	if len(undefined) > 0 {
+		return nil, errors.Join(undefined...)
+	}
+	if undefinedVariables == "error" {
+		mf.Undefined = nil
+	}
+
+	return mf, nil
+}
+
+// parseInto reads the named makefile into mf, as a ninja build file or task
+// file if it's named as one
+func parseInto(mf *makefile.Makefile, filename string) error {
+	switch {
+	case strings.HasSuffix(filename, ".ninja"):
+		return ninja.Parse(mf, filename)
+	case taskfile.IsTaskfile(filename):
+		return taskfile.Parse(mf, filename)
+	}
+	return mf.Parse(filename)
+}
+
+// profileVariables are the variables of the profiles chosen with
+// --profile, which the makefile sees as it's read, as it does those of
+// the command line, which take precedence
+var profileVariables map[string]string
+
+// loadProfiled is loadMakefile with the variables of the named profiles, of
+// the makefile or configured, set before the makefile is read, so that its
+// := and ?= assignments and conditionals see them. It's first read quietly
+// for the profiles it declares.
+func loadProfiled(profiles []string, configured map[string]map[string]string) (*makefile.Makefile, error) {
+	profileVariables = nil
+	if len(profiles) == 0 {
+		return loadMakefile()
+	}
+
+	declared := makefile.NewMakefile()
+	declared.ParseCache = parseCache
+	declared.Overrides = commandLineVariables
+	auditShell(declared)
+	filename := makefilePath()
+	if err := parseInto(declared, filename); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", filename, err)
+	}
+	variables, err := declared.ProfileVariables(profiles, configured)
+	if err != nil {
+		return nil, err
+	}
+
+	profileVariables = variables
+	return loadMakefile()
+}
+
+// parseCache keeps the parsed makefiles of a process that reads them again
+// as they change: watch mode or the daemon
+var parseCache *makefile.ParseCache
+
+// undefinedVariables is what is done about references to variables with no
+// value: nothing, "warn" with --warn-undefined-variables, or "error" with
+// --strict
+var undefinedVariables string
+
+// warnUndefined returns a function warning of each reference to a variable
+// with no value, once for each place it's written
+func warnUndefined() func(err *makefile.UndefinedError) {
+	var mu sync.Mutex
+	warned := map[string]bool{}
+	return func(err *makefile.UndefinedError) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !warned[err.Error()] {
+			warned[err.Error()] = true
+			printWarning("hmake: warning: %s", err)
+		}
+	}
+}
+
+// makefilePath is the file loadMakefile reads
+func makefilePath() string {
+	if makefileName != "Makefile" {
+		return makefileName
+	}
+	if _, err := os.Stat(makefileName); err == nil {
+		return makefileName
+	}
+	for _, name := range taskfile.Names {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return makefileName
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compactRedraw is how often the running targets' times are brought up to
+// date
+const compactRedraw = 200 * time.Millisecond
+
+// compactUI is --ui=compact: each target's output is held back, shown only
+// if it fails, a line is printed for each target that finishes, and on a
+// terminal a line for each running target is kept at the bottom, counting
+// how long it's been running. Under GitHub Actions the output of targets
+// that succeed goes in a collapsed group instead of being dropped.
+type compactUI struct {
+	mu    sync.Mutex
+	w     io.Writer
+	live  bool
+	total int
+
+	finished int
+	running  map[string]*compactTarget
+
+	// drawn is how many lines of running targets are on the screen
+	drawn int
+	stop  chan struct{}
+}
+
+type compactTarget struct {
+	started time.Time
+	output  bytes.Buffer
+}
+
+// compact is the UI of the current build, if it's compact
+var compact *compactUI
+
+func newCompactUI(w io.Writer, total int, live bool) *compactUI {
+	c := &compactUI{w: w, live: live, total: total, running: map[string]*compactTarget{}, stop: make(chan struct{})}
+	if live {
+		go c.tick()
+	}
+	return c
+}
+
+func (c *compactUI) tick() {
+	ticker := time.NewTicker(compactRedraw)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			c.redraw()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// start notes that t's recipe is running, returning the writer its output
+// is held in
+func (c *compactUI) start(name string) io.Writer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &compactTarget{started: time.Now()}
+	c.running[name] = t
+	c.redraw()
+	return &compactWriter{ui: c, t: t}
+}
+
+// finish prints how name's recipe went, with its output if it failed
+func (c *compactUI) finish(name string, d time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A target that never started, as a prerequisite failed, is only
+	// counted
+	c.finished++
+	t := c.running[name]
+	if t == nil {
+		return
+	}
+	delete(c.running, name)
+
+	c.clear()
+	counter := fmt.Sprintf("[%d/%d]", c.finished, c.total)
+	switch {
+	case err != nil:
+		fmt.Fprintf(c.w, "%s %s %s %s\n", counter, colorize(colorRed, "FAILED"), targetColor(name), round(d))
+		t.writeOutput(c.w)
+	case inGitHubActions && t.output.Len() > 0:
+		fmt.Fprintf(c.w, "::group::%s %s %s\n", counter, name, round(d))
+		t.writeOutput(c.w)
+		fmt.Fprintln(c.w, "::endgroup::")
+	default:
+		fmt.Fprintf(c.w, "%s %s %s\n", counter, targetColor(name), round(d))
+	}
+	c.draw()
+}
+
+// upToDate counts a target that needn't be remade as finished
+func (c *compactUI) upToDate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.finished++
+}
+
+// println prints a line of hmake's own above the running targets
+func (c *compactUI) println(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clear()
+	fmt.Fprintln(c.w, line)
+	c.draw()
+}
+
+// done removes the running targets at the end of the build
+func (c *compactUI) done() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.live {
+		close(c.stop)
+		c.live = false
+		c.clear()
+	}
+}
+
+func (c *compactUI) redraw() {
+	c.clear()
+	c.draw()
+}
+
+// clear erases the lines of running targets
+func (c *compactUI) clear() {
+	if c.drawn > 0 {
+		fmt.Fprintf(c.w, "\033[%dA\033[J", c.drawn)
+		c.drawn = 0
+	}
+}
+
+// draw writes a line for each running target, longest running first
+func (c *compactUI) draw() {
+	if !c.live || len(c.running) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(c.running))
+	for name := range c.running {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return c.running[names[i]].started.Before(c.running[names[j]].started) })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", colorize(colorBold, fmt.Sprintf("[%d/%d] running %d:", c.finished, c.total, len(names))))
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s %s\n", targetColor(name), time.Since(c.running[name].started).Truncate(100*time.Millisecond))
+	}
+	io.WriteString(c.w, b.String())
+	c.drawn = len(names) + 1
+}
+
+// writeOutput writes out the target's output, ending it with a newline
+func (t *compactTarget) writeOutput(w io.Writer) {
+	w.Write(t.output.Bytes())
+	if n := t.output.Len(); n > 0 && t.output.Bytes()[n-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+}
+
+// compactWriter holds the output of a target's recipe
+type compactWriter struct {
+	ui *compactUI
+	t  *compactTarget
+}
+
+func (w *compactWriter) Write(b []byte) (int, error) {
+	w.ui.mu.Lock()
+	defer w.ui.mu.Unlock()
+	return w.t.output.Write(b)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/lint"
+)
+
+const compatUsage = `usage: hmake compat [-output text|json] [makefile...]
+
+Lists every construct of the makefiles that hmake doesn't yet handle as
+GNU make does, with where it is and what hmake does with it instead:
+functions it doesn't implement, directives it ignores,
+special targets, pattern, suffix and static pattern rules, target-specific
+variables, order-only prerequisites and the - and + recipe prefixes, among
+others. The makefiles they include are read too, unless their names have
+references in them. With none given the Makefile is read. It fails if
+anything is found, after a count of each sort of construct.`
+
+// compatDocument is written by hmake compat -output json
+type compatDocument struct {
+	SchemaVersion int               `json:"schema_version"`
+	Constructs    []compatConstruct `json:"constructs"`
+}
+
+type compatConstruct struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func init() {
+	register(Command{
+		Name:  "compat",
+		Usage: "List the constructs of a makefile hmake doesn't yet handle",
+		Run:   runCompat,
+	})
+}
+
+func runCompat(args []string) error {
+	fs := flag.NewFlagSet("compat", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), compatUsage) }
+	output := outputFlag(fs)
+	files := parseInterspersed(fs, args)
+	asJSON, err := wantJSON(*output)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		files = []string{makefilePath()}
+	}
+
+	found := []lint.Diagnostic{}
+	read := map[string]bool{}
+	for len(files) > 0 {
+		file := files[0]
+		files = files[1:]
+		if read[file] {
+			continue
+		}
+		read[file] = true
+
+		f, err := ast.ParseFile(file)
+		if err != nil {
+			return err
+		}
+		found = append(found, lint.Compat(f)...)
+		files = append(files, includedFiles(f)...)
+	}
+
+	if asJSON {
+		doc := compatDocument{SchemaVersion: graph.SchemaVersion, Constructs: []compatConstruct{}}
+		for _, d := range found {
+			doc.Constructs = append(doc.Constructs, compatConstruct{File: d.Pos.Filename, Line: d.Pos.Line, Kind: d.Check, Message: d.Message})
+		}
+		if err := printJSON(os.Stdout, doc); err != nil {
+			return err
+		}
+	} else {
+		counts := map[string]int{}
+		for _, d := range found {
+			fmt.Println(d)
+			counts[d.Check]++
+		}
+		kinds := sortedKeys(counts)
+		sort.SliceStable(kinds, func(i, j int) bool { return counts[kinds[i]] > counts[kinds[j]] })
+		if len(kinds) > 0 {
+			fmt.Println()
+		}
+		for _, kind := range kinds {
+			fmt.Printf("%5d %s\n", counts[kind], kind)
+		}
+	}
+
+	switch {
+	case len(found) == 1:
+		return errors.New("1 construct hmake doesn't handle yet")
+	case len(found) > 1:
+		return fmt.Errorf("%d constructs hmake doesn't handle yet", len(found))
+	}
+	return nil
+}
+
+// includedFiles lists the makefiles f includes that exist, leaving out
+// those named with references, which can't be known without expanding
+func includedFiles(f *ast.File) []string {
+	files := []string{}
+	for _, n := range f.Nodes {
+		d, ok := n.(*ast.Directive)
+		if !ok || (d.Name != "include" && d.Name != "-include" && d.Name != "sinclude") || strings.Contains(d.Args, "$") {
+			continue
+		}
+		for _, name := range strings.Fields(d.Args) {
+			if _, err := os.Stat(name); err == nil {
+				files = append(files, name)
+			}
+		}
+	}
+	return files
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/compdb"
+)
+
+func init() {
+	register(Command{
+		Name:  "compdb",
+		Usage: "Write compile_commands.json for clangd and clang-tidy",
+		Run:   runCompdb,
+	})
+}
+
+func runCompdb(args []string) error {
+	fs := flag.NewFlagSet("compdb", flag.ExitOnError)
+	output := fs.String("o", "compile_commands.json", "File to write, or - for standard output")
+	fs.Parse(args)
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return compdb.Write(os.Stdout, mf)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := compdb.Write(f, mf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
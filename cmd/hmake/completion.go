@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for hmake
+# Install with: source <(hmake completion bash)
+_hmake() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    COMPREPLY=($(compgen -W "$(hmake __complete 2>/dev/null)" -- "$cur"))
+    if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == *= ]]; then
+        compopt -o nospace
+    fi
+}
+complete -F _hmake hmake
+`,
+	"zsh": `#compdef hmake
+# zsh completion for hmake
+# Install with: source <(hmake completion zsh)
+_hmake() {
+    local -a candidates
+    candidates=(${(f)"$(hmake __complete 2>/dev/null)"})
+    compadd -S '' -- ${(M)candidates:#*=}
+    compadd -- ${candidates:#*=}
+}
+compdef _hmake hmake
+`,
+	"fish": `# fish completion for hmake
+# Install with: hmake completion fish | source
+complete -c hmake -f -a '(hmake __complete 2>/dev/null)'
+`,
+}
+
+func init() {
+	register(Command{
+		Name:  "completion",
+		Usage: "Print a shell completion script (bash, zsh or fish)",
+		Run:   runCompletion,
+	})
+	register(Command{
+		Name:   "__complete",
+		Usage:  "Print completion candidates for the Makefile in the current directory",
+		Run:    runComplete,
+		Hidden: true,
+	})
+}
+
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: hmake completion bash|zsh|fish")
+	}
+
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return fmt.Errorf("unsupported shell: %s", args[0])
+	}
+
+	fmt.Print(script)
+	return nil
+}
+
+// runComplete is called by the completion scripts each time the user
+// presses tab, so the candidates always reflect the current Makefile
+func runComplete(args []string) error {
+	mf, err := loadMakefile()
+	if err != nil {
+		mf = makefile.NewMakefile()
+	}
+
+	writeCompletions(os.Stdout, mf)
+	return nil
+}
+
+// writeCompletions prints the targets, variable overrides ("NAME=") and
+// subcommands that can follow "hmake" on the command line
+func writeCompletions(w io.Writer, mf *makefile.Makefile) {
+	words := []string{}
+	for name := range mf.Targets {
+		if !makefile.IsSpecialTarget(name) && !makefile.IsPatternRule(name) {
+			words = append(words, name)
+		}
+	}
+
+	for name := range mf.Variables {
+		words = append(words, name+"=")
+	}
+
+	for name, cmd := range commands {
+		if _, shadowed := mf.Targets[name]; !shadowed && !cmd.Hidden {
+			words = append(words, name)
+		}
+	}
+
+	sort.Strings(words)
+	for _, word := range words {
+		fmt.Fprintln(w, word)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+// config holds the settings that can be given defaults in a config file.
+// Later sources override earlier ones: the user's config file, then the
+// project's, then HMAKE_* environment variables, then the command line.
+type config struct {
+	Jobs     int
+	Shell    string
+	Color    string
+	CacheDir string
+
+	// UI is how builds are shown, "full" or "compact"
+	UI string
+
+	// Cache restores targets made before from the same commands and
+	// inputs out of the artifact cache in CacheDir
+	Cache bool
+
+	// CacheRemote is the URL of a cache shared with other machines, which
+	// turns Cache on. With CacheReadOnly nothing is uploaded to it.
+	CacheRemote   string
+	CacheReadOnly bool
+
+	// EnvFile is a dotenv file loaded into the environment, e.g. ".env"
+	EnvFile string
+
+	// Profiles are named sets of variables, set with
+	// "profile.<name>.<VAR> = value" or under a [profile.<name>] table
+	Profiles map[string]map[string]string
+}
+
+// projectConfigFiles are looked for in the current directory, in order
+var projectConfigFiles = []string{"hmake.toml", ".hmakerc"}
+
+func defaultConfig() config {
+	cfg := config{
+		Jobs:     availableJobs(),
+		Shell:    exec.DefaultShell(),
+		Color:    "auto",
+		UI:       "full",
+		Profiles: map[string]map[string]string{},
+	}
+
+	if dir, err := os.UserCacheDir(); err == nil {
+		cfg.CacheDir = filepath.Join(dir, "hmake")
+	}
+
+	return cfg
+}
+
+// userConfigFiles returns where a user's own settings may be kept
+func userConfigFiles() []string {
+	files := []string{}
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(dir, "hmake", "config.toml"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".hmakerc"))
+	}
+	return files
+}
+
+// loadConfig builds the configuration from the config files and environment.
+// Only the first config file found at each level is read.
+func loadConfig() (config, error) {
+	cfg := defaultConfig()
+
+	for _, files := range [][]string{userConfigFiles(), projectConfigFiles} {
+		for _, file := range files {
+			err := cfg.readFile(file)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return cfg, err
+			}
+			break
+		}
+	}
+
+	for _, key := range []string{"jobs", "shell", "color", "ui", "cache_dir", "cache", "cache_remote", "cache_read_only", "env_file"} {
+		if value, ok := os.LookupEnv("HMAKE_" + strings.ToUpper(key)); ok {
+			if err := cfg.set(key, value); err != nil {
+				return cfg, fmt.Errorf("HMAKE_%s: %w", strings.ToUpper(key), err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// readFile reads "key = value" settings. This is the flat subset of TOML
+// used by hmake.toml; # starts a comment and strings may be quoted.
+func (cfg *config) readFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	table := ""
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", name, lineNo)
+		}
+
+		key = strings.TrimSpace(key)
+		if table != "" {
+			key = table + "." + key
+		}
+
+		if err := cfg.set(key, parseConfigValue(value)); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func parseConfigValue(value string) string {
+	value = strings.TrimSpace(value)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+
+	// Strip a trailing comment from an unquoted value
+	if i := strings.Index(value, "#"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+func (cfg *config) set(key, value string) error {
+	switch key {
+	case "jobs":
+		if value == "auto" {
+			cfg.Jobs = availableJobs()
+			break
+		}
+		jobs, err := strconv.Atoi(value)
+		if err != nil || jobs < 1 {
+			return fmt.Errorf("invalid jobs %q; give a number or auto", value)
+		}
+		cfg.Jobs = jobs
+	case "shell":
+		cfg.Shell = value
+	case "color":
+		if value != "auto" && value != "always" && value != "never" {
+			return fmt.Errorf("color must be auto, always or never, not %q", value)
+		}
+		cfg.Color = value
+	case "ui":
+		if value != "full" && value != "compact" {
+			return fmt.Errorf("ui must be full or compact, not %q", value)
+		}
+		cfg.UI = value
+	case "cache_dir":
+		cfg.CacheDir = value
+	case "cache":
+		cache, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("cache must be true or false, not %q", value)
+		}
+		cfg.Cache = cache
+	case "cache_remote":
+		cfg.CacheRemote = value
+	case "cache_read_only":
+		readOnly, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("cache_read_only must be true or false, not %q", value)
+		}
+		cfg.CacheReadOnly = readOnly
+	case "env_file":
+		cfg.EnvFile = value
+	default:
+		if rest, ok := strings.CutPrefix(key, "profile."); ok {
+			if profile, variable, ok := strings.Cut(rest, "."); ok {
+				if cfg.Profiles[profile] == nil {
+					cfg.Profiles[profile] = map[string]string{}
+				}
+				cfg.Profiles[profile][variable] = value
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	return nil
+}
+
+// configFlags maps the command line flags onto the settings they override
+var configFlags = map[string]string{
+	"j":               "jobs",
+	"shell":           "shell",
+	"color":           "color",
+	"ui":              "ui",
+	"cache-dir":       "cache_dir",
+	"cache":           "cache",
+	"cache-remote":    "cache_remote",
+	"cache-read-only": "cache_read_only",
+	"env-file":        "env_file",
+}
+
+// applyFlags overrides the settings given explicitly on the command line
+func (cfg *config) applyFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := configFlags[f.Name]; ok && err == nil {
+			if e := cfg.set(key, f.Value.String()); e != nil {
+				err = fmt.Errorf("-%s: %w", f.Name, e)
+			}
+		}
+	})
+
+	return err
+}
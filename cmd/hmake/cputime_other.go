@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// childCPUTime isn't known here
+func childCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/protowire"
+)
+
+const daemonUsage = `usage: hmake daemon [-addr 127.0.0.1:7070 | -socket path]
+
+A resident hmake keeps the parsed makefile between builds, reading it again
+only when it changes. It serves the gRPC service hmake.daemon.v1.Daemon, as
+cmd/hmake/daemon.proto in hmake's source defines it: Build, streaming the
+events of a build, Cancel, Graph, Targets and Events, streaming the events
+of every build from then on. Events are those of --log-json.
+
+It's served over TLS, with a certificate made when the daemon starts and
+written to .hmake/daemon.pem for clients to trust. Every call must send a
+token, as "authorization: Bearer <token>" metadata: HMAKE_DAEMON_TOKEN if
+it's set, or else one made up and written to .hmake/daemon.token, which
+only its owner may read. Builds have the options given before "daemon",
+as in hmake -j4 --cache daemon, along with those a call sets.`
+
+// Files the daemon writes for its clients
+var (
+	daemonCertFile  = filepath.Join(".hmake", "daemon.pem")
+	daemonTokenFile = filepath.Join(".hmake", "daemon.token")
+)
+
+// daemonService is the gRPC service the daemon serves
+const daemonService = "/hmake.daemon.v1.Daemon/"
+
+// gRPC status codes the daemon answers with
+const (
+	codeOK                 = 0
+	codeInvalidArgument    = 3
+	codeNotFound           = 5
+	codeFailedPrecondition = 9
+	codeUnimplemented      = 12
+	codeUnauthenticated    = 16
+)
+
+func init() {
+	register(Command{
+		Name:  "daemon",
+		Usage: "Serve builds, graph queries and events to editors and CI agents",
+		Run:   runDaemon,
+	})
+}
+
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), daemonUsage) }
+	addr := fs.String("addr", "127.0.0.1:7070", "Address to listen on")
+	socket := fs.String("socket", "", "Unix socket to listen on instead of an address")
+	fs.Parse(args)
+
+	if err := os.MkdirAll(".hmake", 0o755); err != nil {
+		return err
+	}
+	token := os.Getenv("HMAKE_DAEMON_TOKEN")
+	if token == "" {
+		var err error
+		if token, err = newDaemonToken(); err != nil {
+			return err
+		}
+	}
+	cert, err := newDaemonCertificate()
+	if err != nil {
+		return err
+	}
+
+	var listener net.Listener
+	if *socket != "" {
+		os.Remove(*socket)
+		listener, err = net.Listen("unix", *socket)
+	} else {
+		listener, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	parseCache = makefile.NewParseCache()
+	d := &daemon{token: token, subscribers: map[chan event]bool{}}
+	if _, err := d.makefile(); err != nil {
+		return err
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+
+	server := &http.Server{
+		Handler:   d,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+	go func() {
+		<-ctx.Done()
+		d.cancelBuild()
+		server.Close()
+	}()
+
+	fmt.Printf("hmake: daemon listening on %s, with its certificate in %s\n", listener.Addr(), daemonCertFile)
+	if err := server.ServeTLS(listener, "", ""); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// newDaemonToken makes up a token and writes it where only its owner can
+// read it
+func newDaemonToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	os.Remove(daemonTokenFile)
+	if err := os.WriteFile(daemonTokenFile, []byte(token+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newDaemonCertificate makes a self-signed certificate for the loopback
+// addresses and localhost, writing it out for clients to trust
+func newDaemonCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "hmake daemon"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(daemonCertFile, certPEM, 0o644); err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// daemon is the state kept between requests
+type daemon struct {
+	// token must be sent with every call
+	token string
+
+	mu      sync.Mutex
+	mf      *makefile.Makefile
+	modTime time.Time
+
+	// cancel interrupts the running build, if there is one
+	cancel context.CancelFunc
+
+	subMu       sync.Mutex
+	subscribers map[chan event]bool
+}
+
+// makefile returns the parsed makefile, reading it again if it has changed
+func (d *daemon) makefile() (*makefile.Makefile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info, err := os.Stat(makefilePath())
+	if err != nil {
+		return nil, err
+	}
+	modTime := info.ModTime()
+	if d.mf != nil {
+		modTime = newestModTime(modTime, d.mf.Included)
+	}
+	if d.mf != nil && modTime.Equal(d.modTime) {
+		return d.mf, nil
+	}
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return nil, err
+	}
+	d.mf, d.modTime = mf, newestModTime(info.ModTime(), mf.Included)
+	d.publish(event{Event: "parsed", File: makefilePath(), Targets: len(mf.Targets)})
+	return mf, nil
+}
+
+// newestModTime returns the latest of t and the modification times of the
+// files. One that's gone counts as changed now.
+func newestModTime(t time.Time, files []string) time.Time {
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Now()
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+// subscribe returns a channel receiving every event published until
+// unsubscribe is called. A lossless subscriber is sent every event, holding
+// up the build if need be; others miss the events they're too slow for.
+func (d *daemon) subscribe(lossless bool) chan event {
+	d.subMu.Lock()
+	defer d.subMu.Unlock()
+
+	ch := make(chan event, 256)
+	d.subscribers[ch] = lossless
+	return ch
+}
+
+func (d *daemon) unsubscribe(ch chan event) {
+	d.subMu.Lock()
+	defer d.subMu.Unlock()
+	delete(d.subscribers, ch)
+}
+
+// publish sends e to the subscribers
+func (d *daemon) publish(e event) {
+	e.Time = time.Now()
+
+	d.subMu.Lock()
+	defer d.subMu.Unlock()
+	for ch, lossless := range d.subscribers {
+		if lossless {
+			ch <- e
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// ServeHTTP answers gRPC calls. Anything else, such as a request a web
+// page makes, is turned away before the token is even looked at.
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "hmake daemon only answers gRPC calls", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	c := &call{w: w}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(d.token)) != 1 {
+		c.finish(codeUnauthenticated, "a token must be sent as authorization: Bearer <token>, from "+daemonTokenFile+" or HMAKE_DAEMON_TOKEN")
+		return
+	}
+	req, err := protowire.ReadFrame(r.Body)
+	if err != nil {
+		c.finish(codeInvalidArgument, err.Error())
+		return
+	}
+	fields, err := protowire.Decode(req)
+	if err != nil {
+		c.finish(codeInvalidArgument, err.Error())
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, daemonService) {
+	case "Build":
+		d.handleBuild(r.Context(), c, fields)
+	case "Cancel":
+		var resp protowire.Message
+		resp.Bool(1, d.cancelBuild())
+		c.send(resp)
+		c.finish(codeOK, "")
+	case "Graph":
+		d.handleGraph(c, fields)
+	case "Targets":
+		d.handleTargets(c)
+	case "Events":
+		d.handleEvents(r.Context(), c)
+	default:
+		c.finish(codeUnimplemented, "no method "+r.URL.Path)
+	}
+}
+
+// call is a gRPC call being answered
+type call struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+// send writes a response message
+func (c *call) send(msg protowire.Message) {
+	if !c.started {
+		c.w.Header().Set("Content-Type", "application/grpc")
+		c.w.WriteHeader(http.StatusOK)
+		c.started = true
+	}
+	c.w.Write(protowire.Frame(msg))
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish ends the call with its status: in the trailers after messages,
+// or in the headers of a call that failed straight away
+func (c *call) finish(code int, message string) {
+	prefix := http.TrailerPrefix
+	if !c.started {
+		c.w.Header().Set("Content-Type", "application/grpc")
+		prefix = ""
+	}
+	c.w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		c.w.Header().Set(prefix+"Grpc-Message", url.PathEscape(message))
+	}
+	if !c.started {
+		c.w.WriteHeader(http.StatusOK)
+	}
+}
+
+// buildRequest is a BuildRequest
+type buildRequest struct {
+	targets   []string
+	jobs      int
+	keepGoing bool
+	dryRun    bool
+}
+
+func decodeBuildRequest(fields []protowire.Field) buildRequest {
+	var req buildRequest
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			req.targets = append(req.targets, string(f.Data))
+		case 2:
+			req.jobs = int(int32(f.Varint))
+		case 3:
+			req.keepGoing = f.Varint != 0
+		case 4:
+			req.dryRun = f.Varint != 0
+		}
+	}
+	return req
+}
+
+func (d *daemon) handleBuild(ctx context.Context, c *call, fields []protowire.Field) {
+	req := decodeBuildRequest(fields)
+	mf, err := d.makefile()
+	if err != nil {
+		c.finish(codeFailedPrecondition, err.Error())
+		return
+	}
+	goals := req.targets
+	if len(goals) == 0 {
+		goals = mf.DefaultGoal()
+	}
+	if err := checkGoals(mf, goals); err != nil {
+		c.finish(codeNotFound, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.mu.Lock()
+	if d.cancel != nil {
+		d.mu.Unlock()
+		c.finish(codeFailedPrecondition, "a build is already running")
+		return
+	}
+	d.cancel = cancel
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.cancel = nil
+		d.mu.Unlock()
+	}()
+
+	events := d.subscribe(true)
+	defer d.unsubscribe(events)
+
+	finished := make(chan error, 1)
+	go func() { finished <- d.build(ctx, mf, goals, req) }()
+
+	for {
+		select {
+		case e := <-events:
+			c.send(encodeEvent(e))
+		case err := <-finished:
+			// Whatever was published before the build ended comes first
+			for len(events) > 0 {
+				c.send(encodeEvent(<-events))
+			}
+			d.unsubscribe(events)
+
+			finish := event{Time: time.Now(), Event: "build_finish"}
+			if err != nil {
+				finish.Error = err.Error()
+			}
+			d.publish(finish)
+			c.send(encodeEvent(finish))
+			c.finish(codeOK, "")
+			return
+		}
+	}
+}
+
+// build runs a build with the daemon's build options and those of req,
+// publishing its events
+func (d *daemon) build(ctx context.Context, mf *makefile.Makefile, goals []string, req buildRequest) error {
+	opts := buildFlags
+	if req.jobs > 0 {
+		opts.jobs = req.jobs
+	}
+	opts.keepGoing = opts.keepGoing || req.keepGoing
+	opts.dryRun = opts.dryRun || req.dryRun
+
+	if !opts.dryRun {
+		unlock, err := lockWorkspace(ctx, opts.noWait)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	defer state.saveAfterBuild()
+	state.fingerprint = !opts.noToolFingerprint
+	state.files = mf.FileSystem()
+
+	engine, err := newEngine(mf, opts, state)
+	if err != nil {
+		return err
+	}
+	if engine.Cache != nil {
+		defer engine.Cache.SaveCounts()
+	}
+
+	engine.Output = func(t makefile.Target) (io.Writer, io.Writer) {
+		return &publishWriter{d: d, target: t.Name, stream: "stdout"}, &publishWriter{d: d, target: t.Name, stream: "stderr"}
+	}
+	engine.BeforeTarget = func(t makefile.Target, stdout io.Writer) {
+		state.starting(t)
+		d.publish(event{Event: "target_start", Target: t.Name})
+	}
+	engine.OnCommand = func(t makefile.Target, command string) {
+		d.publish(event{Event: "command", Target: t.Name, Command: command})
+	}
+	engine.AfterTarget = func(t makefile.Target, duration time.Duration, err error) {
+		e := event{Event: "target_finish", Target: t.Name, Duration: float64(duration) / float64(time.Millisecond)}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		d.publish(e)
+
+		// As for a build run from the command line, only the recipes that
+		// ran to an end are recorded
+		var notRemade *build.NotRemadeError
+		var missing *build.MissingError
+		if !opts.dryRun && !errors.As(err, &notRemade) && !errors.As(err, &missing) && !errors.Is(err, context.Canceled) {
+			state.record(t, duration, err)
+		}
+	}
+	engine.UpToDate = func(t makefile.Target) {
+		d.publish(event{Event: "up_to_date", Target: t.Name})
+	}
+
+	return engine.BuildContext(ctx, goals)
+}
+
+// encodeEvent encodes e as an Event
+func encodeEvent(e event) protowire.Message {
+	var m protowire.Message
+	m.Varint(1, uint64(e.Time.UnixNano()))
+	m.String(2, e.Event)
+	m.String(3, e.File)
+	m.Varint(4, uint64(e.Targets))
+	m.String(5, e.Target)
+	m.String(6, e.Command)
+	m.String(7, e.Stream)
+	m.String(8, e.Data)
+	m.Double(9, e.Duration)
+	m.String(10, e.Error)
+	return m
+}
+
+// publishWriter publishes what a recipe writes as output events
+type publishWriter struct {
+	d      *daemon
+	target string
+	stream string
+}
+
+func (p *publishWriter) Write(b []byte) (int, error) {
+	p.d.publish(event{Event: "output", Target: p.target, Stream: p.stream, Data: string(b)})
+	return len(b), nil
+}
+
+func (d *daemon) cancelBuild() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		return false
+	}
+	d.cancel()
+	return true
+}
+
+func (d *daemon) handleGraph(c *call, fields []protowire.Field) {
+	mf, err := d.makefile()
+	if err != nil {
+		c.finish(codeFailedPrecondition, err.Error())
+		return
+	}
+
+	goals := []string{}
+	for _, f := range fields {
+		if f.Num == 1 {
+			goals = append(goals, string(f.Data))
+		}
+	}
+	if err := checkGoals(mf, goals); err != nil {
+		c.finish(codeNotFound, err.Error())
+		return
+	}
+
+	var resp protowire.Message
+	resp.Varint(1, graph.SchemaVersion)
+	for _, n := range graph.Nodes(mf, goals) {
+		var node protowire.Message
+		node.String(1, n.Name)
+		node.String(2, string(n.Kind))
+		for _, dep := range n.Dependencies {
+			node.Bytes(3, []byte(dep))
+		}
+		resp.Message(2, node)
+	}
+	c.send(resp)
+	c.finish(codeOK, "")
+}
+
+func (d *daemon) handleTargets(c *call) {
+	mf, err := d.makefile()
+	if err != nil {
+		c.finish(codeFailedPrecondition, err.Error())
+		return
+	}
+
+	var resp protowire.Message
+	for _, name := range mf.TargetNames {
+		if makefile.IsSpecialTarget(name) || makefile.IsPatternRule(name) {
+			continue
+		}
+		var target protowire.Message
+		target.String(1, name)
+		target.String(2, mf.Targets[name].Description)
+		target.Bool(3, mf.Phony[name])
+		resp.Message(1, target)
+	}
+	c.send(resp)
+	c.finish(codeOK, "")
+}
+
+func (d *daemon) handleEvents(ctx context.Context, c *call) {
+	events := d.subscribe(false)
+	defer d.unsubscribe(events)
+
+	// The headers go at once, so the client knows it's subscribed
+	c.w.Header().Set("Content-Type", "application/grpc")
+	c.w.WriteHeader(http.StatusOK)
+	c.started = true
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case e := <-events:
+			c.send(encodeEvent(e))
+		case <-ctx.Done():
+			c.finish(codeOK, "")
+			return
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// maxDashboardLog is how much of each target's output the dashboard keeps
+const maxDashboardLog = 1 << 20
+
+// dashboard follows the build through its events and serves it as a web
+// page, for --serve
+type dashboard struct {
+	mu      sync.Mutex
+	mf      *makefile.Makefile
+	goals   []string
+	plan    []string
+	history map[string]targetState
+
+	started  time.Time
+	finished bool
+	err      string
+	targets  map[string]*dashboardTarget
+}
+
+// dashboardTarget is what the dashboard knows of a target in this build
+type dashboardTarget struct {
+	Name         string     `json:"name"`
+	Status       string     `json:"status"`
+	Dependencies []string   `json:"dependencies"`
+	Started      *time.Time `json:"started,omitempty"`
+	Duration     float64    `json:"duration_ms,omitempty"`
+	LastDuration float64    `json:"last_duration_ms,omitempty"`
+	Error        string     `json:"error,omitempty"`
+
+	log strings.Builder
+}
+
+// dash is the dashboard given with --serve, if any
+var dash *dashboard
+
+// serveDashboard starts serving the dashboard on addr
+func serveDashboard(addr string) (*dashboard, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dashboard{targets: map[string]*dashboardTarget{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.handlePage)
+	mux.HandleFunc("/api/status", d.handleStatus)
+	mux.HandleFunc("/api/log", d.handleLog)
+	mux.HandleFunc("/api/graph", d.handleGraph)
+	mux.HandleFunc("/api/history", d.handleHistory)
+	go http.Serve(listener, mux)
+
+	fmt.Printf("hmake: dashboard at http://%s/\n", dashboardAddr(listener.Addr()))
+	return d, nil
+}
+
+// dashboardAddr is where a browser on this machine finds the dashboard
+func dashboardAddr(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// begin starts following a build of goals, planned as plan, with how long
+// each target took last time from the state
+func (d *dashboard) begin(mf *makefile.Makefile, goals, plan []string, history map[string]targetState) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.mf, d.goals, d.plan = mf, goals, plan
+	d.history = map[string]targetState{}
+	for name, ts := range history {
+		d.history[name] = ts
+	}
+	d.started, d.finished, d.err = time.Now(), false, ""
+	d.targets = map[string]*dashboardTarget{}
+	for _, name := range plan {
+		t := &dashboardTarget{Name: name, Status: "waiting", Dependencies: mf.Targets[name].Dependencies}
+		if ts, ok := history[name]; ok {
+			t.LastDuration = float64(ts.Duration) / float64(time.Millisecond)
+		}
+		d.targets[name] = t
+	}
+}
+
+// observe updates the dashboard with an event of the build
+func (d *dashboard) observe(e event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t := d.targets[e.Target]
+	switch {
+	case e.Event == "build_finish":
+		d.finished, d.err = true, e.Error
+		for _, t := range d.targets {
+			if t.Status == "waiting" && e.Error == "" {
+				t.Status = "up to date"
+			}
+		}
+	case t == nil:
+	case e.Event == "target_start":
+		started := e.Time
+		t.Status, t.Started = "running", &started
+	case e.Event == "output":
+		if t.log.Len() < maxDashboardLog {
+			t.log.WriteString(e.Data)
+		}
+	case e.Event == "target_finish":
+		t.Status, t.Duration, t.Error = "done", e.Duration, e.Error
+		if e.Error != "" {
+			t.Status = "failed"
+		}
+	case e.Event == "up_to_date":
+		t.Status = "up to date"
+	}
+}
+
+func (d *dashboard) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardPage)
+}
+
+func (d *dashboard) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := struct {
+		Goals    []string           `json:"goals"`
+		Started  time.Time          `json:"started"`
+		Finished bool               `json:"finished"`
+		Error    string             `json:"error,omitempty"`
+		Targets  []*dashboardTarget `json:"targets"`
+	}{d.goals, d.started, d.finished, d.err, []*dashboardTarget{}}
+	for _, name := range d.plan {
+		status.Targets = append(status.Targets, d.targets[name])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (d *dashboard) handleLog(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.targets[r.URL.Query().Get("target")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, t.log.String())
+}
+
+func (d *dashboard) handleGraph(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	mf, goals := d.mf, d.goals
+	d.mu.Unlock()
+	if mf == nil {
+		http.Error(w, "no build has started", http.StatusServiceUnavailable)
+		return
+	}
+
+	nodes := graph.Nodes(mf, goals)
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		graph.WriteDOT(w, nodes)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	graph.WriteJSON(w, nodes)
+}
+
+func (d *dashboard) handleHistory(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.history)
+}
+
+// dashboardPage shows the build, asking for its status every second
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hmake</title>
+<style>
+body { font: 14px system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+td, th { padding: 4px 12px; text-align: left; border-bottom: 1px solid #eee; }
+tr.target { cursor: pointer; }
+tr.target:hover { background: #f6f6f6; }
+.running { color: #0366d6; } .done { color: #28a745; } .failed { color: #d73a49; } .waiting, .up-to-date { color: #888; }
+.deps { color: #888; font-size: 12px; }
+pre { background: #f6f8fa; padding: 1em; max-height: 40em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>hmake <span id="goals"></span></h1>
+<p id="summary"></p>
+<table>
+<thead><tr><th>Target</th><th>Status</th><th>Time</th><th>Last time</th><th>Depends on</th></tr></thead>
+<tbody id="targets"></tbody>
+</table>
+<p><a href="/api/graph?format=dot">Dependency graph (DOT)</a> · <a href="/api/graph">JSON</a> · <a href="/api/history">History</a></p>
+<h2 id="logtitle"></h2>
+<pre id="log" hidden></pre>
+<script>
+let selected = "";
+const ms = v => v ? (v < 1000 ? Math.round(v) + "ms" : (v / 1000).toFixed(1) + "s") : "";
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+}
+async function refresh() {
+  const s = await (await fetch("/api/status")).json();
+  document.getElementById("goals").textContent = (s.goals || []).join(" ");
+  const counts = {};
+  const body = document.getElementById("targets");
+  body.textContent = "";
+  for (const t of s.targets) {
+    counts[t.status] = (counts[t.status] || 0) + 1;
+    const row = body.insertRow();
+    row.className = "target";
+    row.onclick = () => { selected = t.name; showLog(); };
+    cell(row, t.name);
+    cell(row, t.status, t.status.replace(/ /g, "-"));
+    const running = t.status === "running" ? Date.now() - Date.parse(t.started) : 0;
+    cell(row, ms(t.duration_ms || running));
+    cell(row, ms(t.last_duration_ms));
+    cell(row, t.dependencies.join(" "), "deps");
+  }
+  const parts = Object.entries(counts).map(([k, v]) => v + " " + k);
+  const state = s.finished ? (s.error ? "Failed: " + s.error : "Finished") : "Building";
+  document.getElementById("summary").textContent = state + " · " + parts.join(", ");
+  if (selected) showLog();
+  if (!s.finished) setTimeout(refresh, 1000); else setTimeout(refresh, 5000);
+}
+async function showLog() {
+  document.getElementById("logtitle").textContent = selected;
+  const log = document.getElementById("log");
+  log.hidden = false;
+  log.textContent = await (await fetch("/api/log?target=" + encodeURIComponent(selected))).text();
+}
+refresh();
+</script>
+</body>
+</html>
+`
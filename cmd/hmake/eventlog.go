@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventLog writes what happens during a build as a stream of JSON objects,
+// one per line, for wrappers and dashboards to follow. A nil eventLog
+// writes nothing.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	// observers are also given every event, as the dashboard is
+	observers []func(event)
+}
+
+// event is a line of the event log. Event says what happened:
+//
+//	parsed          the makefile was read; File and Targets
+//	target_start    a target's recipe is about to run
+//	command         a command of the recipe is about to run
+//	output          a chunk of what the recipe wrote; Stream and Data
+//	target_finish   the recipe ended; Duration and, if it failed, Error
+//	up_to_date      a goal didn't need remaking
+//	error           hmake stopped with Error
+//	build_finish    the build is over; Error if it failed
+type event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	File     string    `json:"file,omitempty"`
+	Targets  int       `json:"targets,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	Data     string    `json:"data,omitempty"`
+	Duration float64   `json:"duration_ms,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// events is the log given with --log-json, if any
+var events *eventLog
+
+// observeEvents has fn given every event of the build, whether or not they
+// are logged
+func observeEvents(fn func(event)) {
+	if events == nil {
+		events = &eventLog{}
+	}
+	events.observers = append(events.observers, fn)
+}
+
+// openEventLog opens the log at path, where "-" is standard error
+func openEventLog(path string) (*eventLog, error) {
+	var w io.Writer = os.Stderr
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &eventLog{enc: json.NewEncoder(w)}, nil
+}
+
+func (l *eventLog) emit(e event) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Time = time.Now()
+	if l.enc != nil {
+		l.enc.Encode(e)
+	}
+	for _, observe := range l.observers {
+		observe(e)
+	}
+}
+
+// emitError logs that hmake stopped because of err
+func (l *eventLog) emitError(err error) {
+	l.emit(event{Event: "error", Error: err.Error()})
+}
+
+// logWriter passes a target's output on to w, logging each chunk
+type logWriter struct {
+	w      io.Writer
+	target string
+	stream string
+}
+
+func (l *logWriter) Write(b []byte) (int, error) {
+	events.emit(event{Event: "output", Target: l.target, Stream: l.stream, Data: string(b)})
+	return l.w.Write(b)
+}
+
+// Flush flushes w, if it buffers
+func (l *logWriter) Flush() error {
+	if f, ok := l.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// unwrapLog returns the console under a target's logWriter and teeWriter,
+// for hmake's own lines
+func unwrapLog(w io.Writer) io.Writer {
+	for {
+		switch l := w.(type) {
+		case *logWriter:
+			w = l.w
+		case *teeWriter:
+			w = l.w
+		default:
+			return w
+		}
+	}
+}
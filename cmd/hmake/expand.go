@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+func init() {
+	register(Command{
+		Name:  "expand",
+		Usage: "Write out the makefile with its variables and recipes expanded",
+		Run:   runExpand,
+	})
+}
+
+func runExpand(args []string) error {
+	fs := flag.NewFlagSet("expand", flag.ExitOnError)
+	output := fs.String("o", "-", "File to write, or - for standard output")
+	fs.Parse(args)
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return mf.WriteExpanded(os.Stdout)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := mf.WriteExpanded(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+const explainUsage = `usage: hmake explain [-target name] expression...
+
+Expands an expression, such as '$(CFLAGS)', as the makefile would, and
+traces how: each variable referred to, its value as set and where it was
+set, each function called, and within each the references its value or
+arguments led to, with what each gave, ending with the result. Only the
+branch of an $(if) taken is followed, and $(shell) commands are run. With
+-target the automatic variables, such as $@ and $<, are those of the
+target's recipe.`
+
+func init() {
+	register(Command{
+		Name:  "explain",
+		Usage: "Trace the expansion of an expression, step by step",
+		Run:   runExplain,
+	})
+}
+
+func runExplain(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), explainUsage) }
+	target := fs.String("target", "", "The target whose automatic variables to expand with")
+	words := parseInterspersed(fs, args)
+	if len(words) == 0 {
+		return errors.New(explainUsage)
+	}
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+	if *target != "" {
+		if err := checkGoals(mf, []string{*target}); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	result, steps := mf.ExplainExpansion(ctx, strings.Join(words, " "), *target)
+	printExpansion(os.Stdout, steps)
+	fmt.Fprintf(os.Stdout, "result: %q\n", result)
+	return nil
+}
+
+// printExpansion writes each step indented beneath the one it was found
+// within, what it found, the steps it led to, then what it gave
+func printExpansion(w io.Writer, steps []makefile.ExpansionStep) {
+	open := []makefile.ExpansionStep{}
+	gives := func(s makefile.ExpansionStep) {
+		indent := strings.Repeat("  ", s.Depth+1)
+		if s.Result == "" {
+			fmt.Fprintf(w, "%sgives nothing\n", indent)
+		} else {
+			fmt.Fprintf(w, "%sgives %q\n", indent, s.Result)
+		}
+	}
+
+	for _, s := range steps {
+		for len(open) > 0 && open[len(open)-1].Depth >= s.Depth {
+			gives(open[len(open)-1])
+			open = open[:len(open)-1]
+		}
+		indent := strings.Repeat("  ", s.Depth)
+		fmt.Fprintf(w, "%s%s\n%s  %s\n", indent, s.Reference, indent, s.Note)
+		open = append(open, s)
+	}
+	for len(open) > 0 {
+		gives(open[len(open)-1])
+		open = open[:len(open)-1]
+	}
+}
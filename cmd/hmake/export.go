@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/ninja"
+)
+
+const exportUsage = `usage: hmake export ninja [-o build.ninja]`
+
+func init() {
+	register(Command{
+		Name:  "export",
+		Usage: "Translate the Makefile for another build tool",
+		Run:   runExport,
+	})
+}
+
+func runExport(args []string) error {
+	if len(args) == 0 || args[0] != "ninja" {
+		return errors.New(exportUsage)
+	}
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "build.ninja", "File to write, or - for standard output")
+	fs.Parse(args[1:])
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return ninja.Write(os.Stdout, mf)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := ninja.Write(f, mf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+const inputsUsage = `usage: hmake inputs [-0] [-output text|json] [target...]
+
+Lists the files building the targets reads without making them, the
+prerequisites with no rule to make them, all the way down, one per line.
+With no targets those of the default goal are listed. -0 ends each with
+a NUL instead, for xargs -0 or rsync --from0, and -output json lists
+them in a document for programs.`
+
+const outputsUsage = `usage: hmake outputs [-0] [-output text|json] [target...]
+
+Lists the files building the targets makes, one per line: the targets
+that make files, all the way down, the other outputs of their recipes,
+and any files .hmake/state.json records their recipes creating when last
+built. With no targets those of the default goal are listed. -0 ends each
+with a NUL instead, for xargs -0 or rsync --from0, and -output json lists
+them in a document for programs.`
+
+func init() {
+	register(Command{
+		Name:  "inputs",
+		Usage: "List the source files targets are built from",
+		Run:   runInputs,
+	})
+	register(Command{
+		Name:  "outputs",
+		Usage: "List the files building targets makes",
+		Run:   runOutputs,
+	})
+}
+
+func runInputs(args []string) error {
+	fs := flag.NewFlagSet("inputs", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), inputsUsage) }
+	null := fs.Bool("0", false, "End each file with a NUL instead of a newline")
+	output := outputFlag(fs)
+
+	goals := parseInterspersed(fs, args)
+	asJSON, err := wantJSON(*output)
+	if err != nil {
+		return err
+	}
+	mf, goals, err := loadGoals(goals)
+	if err != nil {
+		return err
+	}
+	return printFiles(os.Stdout, graph.Inputs(mf, goals), *null, asJSON)
+}
+
+func runOutputs(args []string) error {
+	fs := flag.NewFlagSet("outputs", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), outputsUsage) }
+	null := fs.Bool("0", false, "End each file with a NUL instead of a newline")
+	output := outputFlag(fs)
+
+	goals := parseInterspersed(fs, args)
+	asJSON, err := wantJSON(*output)
+	if err != nil {
+		return err
+	}
+	mf, goals, err := loadGoals(goals)
+	if err != nil {
+		return err
+	}
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	// What the recipes were seen to create adds to what the rules say
+	files := map[string]bool{}
+	for _, file := range graph.Outputs(mf, goals) {
+		files[file] = true
+	}
+	for _, name := range goals {
+		for dep := range graph.Deps(mf, name) {
+			for _, file := range state.Targets[dep].Outputs {
+				files[file] = true
+			}
+		}
+		for _, file := range state.Targets[name].Outputs {
+			files[file] = true
+		}
+	}
+
+	return printFiles(os.Stdout, sortedKeys(files), *null, asJSON)
+}
+
+// loadGoals reads the makefile and checks the goals given, the default
+// goal if there are none
+func loadGoals(goals []string) (*makefile.Makefile, []string, error) {
+	mf, err := loadMakefile()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(goals) == 0 {
+		goals = mf.DefaultGoal()
+	}
+	return mf, goals, checkGoals(mf, goals)
+}
+
+func printFiles(w io.Writer, files []string, null, asJSON bool) error {
+	if asJSON {
+		return printJSON(w, filesDocument{SchemaVersion: graph.SchemaVersion, Files: files})
+	}
+	end := "\n"
+	if null {
+		end = "\x00"
+	}
+	for _, file := range files {
+		fmt.Fprint(w, file, end)
+	}
+	return nil
+}
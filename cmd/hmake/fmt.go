@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/format"
+)
+
+func init() {
+	register(Command{
+		Name:  "fmt",
+		Usage: "Format makefiles in the standard style",
+		Run:   runFmt,
+	})
+}
+
+func runFmt(args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "Write the result back to the file instead of printing it")
+	check := fs.Bool("check", false, "List the files that aren't formatted, and fail if there are any")
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"Makefile"}
+	}
+
+	unformatted := 0
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		out, err := format.Source(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		switch {
+		case *check:
+			if !bytes.Equal(src, out) {
+				fmt.Println(file)
+				unformatted++
+			}
+		case *write:
+			if !bytes.Equal(src, out) {
+				if err := os.WriteFile(file, out, 0o644); err != nil {
+					return err
+				}
+			}
+		default:
+			os.Stdout.Write(out)
+		}
+	}
+
+	if unformatted > 0 {
+		return errors.New("some makefiles need formatting, run hmake fmt -w")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/graph"
+)
+
+func init() {
+	register(Command{
+		Name:  "graph",
+		Usage: "Print the dependency graph, of everything or the given targets",
+		Run:   runGraph,
+	})
+}
+
+func runGraph(args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := fs.String("format", "dot", "Output format: dot, mermaid or json")
+	output := fs.String("output", "", "The same as -format, json as with hmake's other commands")
+	goals := parseInterspersed(fs, args)
+	if *output != "" {
+		format = output
+	}
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	if err := checkGoals(mf, goals); err != nil {
+		return err
+	}
+
+	nodes := graph.Nodes(mf, goals)
+	switch *format {
+	case "dot":
+		return graph.WriteDOT(os.Stdout, nodes)
+	case "mermaid":
+		return graph.WriteMermaid(os.Stdout, nodes)
+	case "json":
+		return graph.WriteJSON(os.Stdout, nodes)
+	default:
+		return fmt.Errorf("unknown graph format %q", *format)
+	}
+}
+
+// parseInterspersed parses flags that may come before or after the other
+// arguments, as in "hmake graph app --format=dot", returning the others
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	rest := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+func init() {
+	register(Command{
+		Name:  "help",
+		Usage: "Describe the documented targets",
+		Run:   runHelp,
+	})
+}
+
+// runHelp stands in for a "help" target when the Makefile doesn't have one
+func runHelp(args []string) error {
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	helpTargets(os.Stdout, mf)
+	return nil
+}
+
+// helpTargets prints the targets documented with "## comment", aligned and
+// grouped under the "##@ Group" headings they were declared beneath
+func helpTargets(w io.Writer, mf *makefile.Makefile) {
+	groups := map[string][]string{}
+	width := 0
+	for name, t := range mf.Targets {
+		if t.Description == "" || makefile.IsSpecialTarget(name) {
+			continue
+		}
+
+		groups[t.Group] = append(groups[t.Group], name)
+		width = max(width, len(name))
+	}
+
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintf(w, "  hmake %s\n", colorize(colorCyan, "<target>"))
+
+	// Targets documented before the first heading come first
+	for _, group := range append([]string{""}, mf.Groups...) {
+		names := groups[group]
+		if len(names) == 0 {
+			continue
+		}
+		delete(groups, group)
+		sort.Strings(names)
+
+		fmt.Fprintln(w)
+		if group != "" {
+			fmt.Fprintln(w, colorize(colorBold, group))
+		}
+
+		for _, name := range names {
+			padded := fmt.Sprintf("%-*s", width, name)
+			fmt.Fprintf(w, "  %s  %s\n", colorize(colorCyan, padded), mf.Targets[name].Description)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const initUsage = `usage: hmake init [-force] [go|c|docker|generic]
+
+Writes a starter Makefile for the kind of project given, or for the kind
+the current directory looks like: go with a go.mod, docker with a
+Dockerfile, c with .c files, and generic otherwise. Its targets are
+grouped and documented for hmake help, and it has a help target of its
+own for GNU make. An existing Makefile is left alone unless -force is
+given.`
+
+func init() {
+	register(Command{
+		Name:  "init",
+		Usage: "Write a starter Makefile for a go, c, docker or generic project",
+		Run:   runInit,
+	})
+}
+
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), initUsage) }
+	force := fs.Bool("force", false, "Overwrite an existing Makefile")
+	kinds := parseInterspersed(fs, args)
+	if len(kinds) > 1 {
+		return errors.New(initUsage)
+	}
+
+	kind := detectProject()
+	if len(kinds) == 1 {
+		kind = kinds[0]
+	}
+	template, ok := initTemplates[kind]
+	if !ok {
+		return fmt.Errorf("unknown kind of project '%s'; use go, c, docker or generic", kind)
+	}
+
+	path := makefilePath()
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists; use -force to replace it", path)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	name := strings.ToLower(strings.ReplaceAll(filepath.Base(wd), " ", "-"))
+	content := strings.ReplaceAll(template, "@NAME@", name) + initHelp
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s for a %s project; run hmake help to see its targets\n", path, kind)
+	return nil
+}
+
+// detectProject guesses the kind of project in the current directory from
+// the files it has
+func detectProject() string {
+	switch {
+	case fileExists("go.mod"):
+		return "go"
+	case fileExists("Dockerfile"):
+		return "docker"
+	}
+	if matches, _ := filepath.Glob("*.c"); len(matches) > 0 {
+		return "c"
+	}
+	if matches, _ := filepath.Glob("src/*.c"); len(matches) > 0 {
+		return "c"
+	}
+	return "generic"
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// initTemplates are the starter makefiles for each kind of project, with
+// @NAME@ standing for the project's name. Each is followed by initHelp.
+var initTemplates = map[string]string{
+	"go":      initGo,
+	"c":       initC,
+	"docker":  initDocker,
+	"generic": initGeneric,
+}
+
+const initGo = `# Makefile for @NAME@. Run "hmake help" to list the targets.
+# Variables can be overridden on the command line, e.g. hmake GOFLAGS=-race test
+
+BINARY  ?= @NAME@
+BIN_DIR ?= bin
+PKG     ?= ./...
+GO      ?= go
+GOFLAGS ?=
+LDFLAGS ?= -s -w
+
+.DEFAULT_GOAL := build
+
+##@ Building
+.PHONY: build run
+build: ## Build the binary
+	$(GO) build $(GOFLAGS) -ldflags "$(LDFLAGS)" -o $(BIN_DIR)/$(BINARY) .
+
+run: build ## Build and run the binary
+	./$(BIN_DIR)/$(BINARY)
+
+##@ Testing
+.PHONY: test vet
+test: ## Run the tests
+	$(GO) test $(GOFLAGS) $(PKG)
+
+vet: ## Report suspicious code
+	$(GO) vet $(PKG)
+
+##@ Housekeeping
+.PHONY: fmt tidy clean
+fmt: ## Format the code
+	gofmt -l -w .
+
+tidy: ## Tidy the go modules
+	$(GO) mod tidy
+
+clean: ## Remove what the build made
+	rm -rf $(BIN_DIR)
+`
+
+const initC = `# Makefile for @NAME@. Run "hmake help" to list the targets.
+# Variables can be overridden on the command line, e.g. hmake CC=clang
+
+TARGET  ?= @NAME@
+CC      ?= cc
+CFLAGS  ?= -Wall -Wextra -O2
+LDFLAGS ?=
+SRCS    := $(wildcard src/*.c) $(wildcard *.c)
+PREFIX  ?= /usr/local
+
+.DEFAULT_GOAL := build
+
+##@ Building
+.PHONY: build
+build: ## Compile and link the program
+	$(CC) $(CFLAGS) -o $(TARGET) $(SRCS) $(LDFLAGS)
+
+##@ Running
+.PHONY: run
+run: build ## Build and run the program
+	./$(TARGET)
+
+##@ Housekeeping
+.PHONY: install clean
+install: build ## Install the program
+	install -d $(PREFIX)/bin
+	install -m 755 $(TARGET) $(PREFIX)/bin/$(TARGET)
+
+clean: ## Remove what the build made
+	rm -f $(TARGET)
+`
+
+const initDocker = `# Makefile for @NAME@. Run "hmake help" to list the targets.
+# Variables can be overridden on the command line, e.g. hmake TAG=v1.0 push
+
+IMAGE      ?= @NAME@
+TAG        ?= $(shell git rev-parse --short HEAD 2>/dev/null || echo latest)
+REGISTRY   ?=
+DOCKER     ?= docker
+DOCKERFILE ?= Dockerfile
+PORTS      ?=
+
+.DEFAULT_GOAL := build
+
+##@ Building
+.PHONY: build
+build: ## Build the image
+	$(DOCKER) build -f $(DOCKERFILE) -t $(IMAGE):$(TAG) .
+
+##@ Running
+.PHONY: run shell
+run: build ## Run the image
+	$(DOCKER) run --rm -it $(PORTS) $(IMAGE):$(TAG)
+
+shell: build ## Open a shell in the image
+	$(DOCKER) run --rm -it --entrypoint sh $(IMAGE):$(TAG)
+
+##@ Publishing
+.PHONY: push
+push: build ## Tag the image for the registry and push it
+	$(DOCKER) tag $(IMAGE):$(TAG) $(REGISTRY)$(IMAGE):$(TAG)
+	$(DOCKER) push $(REGISTRY)$(IMAGE):$(TAG)
+
+##@ Housekeeping
+.PHONY: clean
+clean: ## Remove the image
+	$(DOCKER) rmi $(IMAGE):$(TAG)
+`
+
+const initGeneric = `# Makefile for @NAME@. Run "hmake help" to list the targets.
+# Variables can be overridden on the command line, e.g. hmake OUT=dist
+
+OUT ?= build
+
+.DEFAULT_GOAL := build
+
+##@ Building
+.PHONY: build
+build: ## Build the project
+	mkdir -p $(OUT)
+	@echo "Replace this with the commands that build @NAME@"
+
+##@ Testing
+.PHONY: test
+test: build ## Run the tests
+	@echo "Replace this with the commands that test @NAME@"
+
+##@ Housekeeping
+.PHONY: clean
+clean: ## Remove what the build made
+	rm -rf $(OUT)
+`
+
+// initHelp is the help target every starter makefile ends with, which
+// lists the documented targets as hmake help does, for GNU make too
+const initHelp = `
+##@ Helpers
+.PHONY: help
+help: ## Display this help
+	@awk 'BEGIN {FS = ":.*##"; printf "Usage:\n  make \033[36m<target>\033[0m\n"} /^[a-zA-Z_-]+:.*?##/ { printf "  \033[36m%-15s\033[0m %s\n", $$1, $$2 } /^##@/ { printf "\n\033[1m%s\033[0m\n", substr($$0, 5) } ' $(MAKEFILE_LIST)
+`
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystems are mounted, and procCgroup
+// where the cgroups of this process are listed. Tests point them, and
+// numCPU, at a fake machine.
+var (
+	cgroupRoot = "/sys/fs/cgroup"
+	procCgroup = "/proc/self/cgroup"
+	numCPU     = runtime.NumCPU
+)
+
+// availableJobs is how many recipes "-j auto", or no -j at all, runs at
+// once: a job for each CPU this process may use, fewer if its cgroup has a
+// CPU quota, as in a container given --cpus, so that it isn't run beyond
+// its share
+func availableJobs() int {
+	jobs := numCPU()
+	if quota, ok := cgroupCPUQuota(); ok && quota < float64(jobs) {
+		// A quota of 1.5 CPUs can keep two jobs busy part of the time
+		jobs = max(int(quota+0.999), 1)
+	}
+	return jobs
+}
+
+// cgroupCPUQuota returns how many CPUs' worth of time the cgroup of this
+// process, or one above it, may use, if it has a quota, from cpu.max in
+// cgroup v2 or cpu.cfs_quota_us and cpu.cfs_period_us in v1
+func cgroupCPUQuota() (float64, bool) {
+	paths := cgroupPaths()
+	if path, ok := paths[""]; ok {
+		for dir := filepath.Join(cgroupRoot, path); strings.HasPrefix(dir, cgroupRoot); dir = filepath.Dir(dir) {
+			if fields := strings.Fields(readFirstLine(filepath.Join(dir, "cpu.max"))); len(fields) == 2 && fields[0] != "max" {
+				if quota, ok := cpuQuota(fields[0], fields[1]); ok {
+					return quota, true
+				}
+			}
+			if dir == cgroupRoot {
+				break
+			}
+		}
+	}
+
+	if path, ok := paths["cpu"]; ok {
+		// Inside a container the cgroup given is the host's, and its own is
+		// mounted at the root
+		for _, dir := range []string{filepath.Join(cgroupRoot, "cpu", path), filepath.Join(cgroupRoot, "cpu")} {
+			quota := readFirstLine(filepath.Join(dir, "cpu.cfs_quota_us"))
+			period := readFirstLine(filepath.Join(dir, "cpu.cfs_period_us"))
+			if quota, ok := cpuQuota(quota, period); ok {
+				return quota, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// cgroupPaths reads the cgroups of this process from procCgroup, by
+// controller, with "" for the unified hierarchy of cgroup v2
+func cgroupPaths() map[string]string {
+	paths := map[string]string{}
+	f, err := os.Open(procCgroup)
+	if err != nil {
+		return paths
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller,...:path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	return paths
+}
+
+// cpuQuota is a quota of time in each period as a number of CPUs. A
+// negative quota, as v1 gives for none, isn't one.
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+func readFirstLine(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSpace(line)
+}
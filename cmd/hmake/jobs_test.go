@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeMachine points availableJobs at a machine with cpus CPUs whose
+// cgroup, v2, has the quota in cpu.max
+func fakeMachine(t *testing.T, cpus int, cpuMax string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "cgroup")
+	if err := os.MkdirAll(filepath.Join(root, "ci"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ci", "cpu.max"), []byte(cpuMax+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	proc := filepath.Join(dir, "cgroup.list")
+	if err := os.WriteFile(proc, []byte("0::/ci\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRoot, oldProc, oldCPU := cgroupRoot, procCgroup, numCPU
+	cgroupRoot, procCgroup, numCPU = root, proc, func() int { return cpus }
+	t.Cleanup(func() { cgroupRoot, procCgroup, numCPU = oldRoot, oldProc, oldCPU })
+}
+
+func TestAvailableJobs(t *testing.T) {
+	for _, test := range []struct {
+		cpuMax string
+		jobs   int
+	}{
+		{"max 100000", 8},
+		{"150000 100000", 2},
+		{"50000 100000", 1},
+		{"1600000 100000", 8},
+	} {
+		fakeMachine(t, 8, test.cpuMax)
+		if jobs := availableJobs(); jobs != test.jobs {
+			t.Errorf("cpu.max %q gives %d jobs, want %d", test.cpuMax, jobs, test.jobs)
+		}
+	}
+}
+
+func TestJobsUnset(t *testing.T) {
+	newProject(t, "all:\n")
+	fakeMachine(t, 8, "200000 100000")
+
+	// No config file or HMAKE_JOBS sets the jobs either
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HMAKE_JOBS", "")
+	os.Unsetenv("HMAKE_JOBS")
+
+	fs := flag.NewFlagSet("hmake", flag.ContinueOnError)
+	fs.String("j", "auto", "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.applyFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Jobs != 2 {
+		t.Errorf("with no -j, %d jobs run at once, want the cgroup's quota of 2", cfg.Jobs)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// The documents --output=json writes. Each carries graph.SchemaVersion so
+// that programs reading them can tell a version they don't understand;
+// the text printed for people is free to change.
+
+// targetsDocument is written by hmake targets
+type targetsDocument struct {
+	SchemaVersion int          `json:"schema_version"`
+	Targets       []targetInfo `json:"targets"`
+}
+
+// targetInfo is an entry of targetsDocument
+type targetInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Phony       bool   `json:"phony"`
+}
+
+// namesDocument is written by hmake query deps and rdeps
+type namesDocument struct {
+	SchemaVersion int      `json:"schema_version"`
+	Targets       []string `json:"targets"`
+}
+
+// pathDocument is written by hmake query path
+type pathDocument struct {
+	SchemaVersion int      `json:"schema_version"`
+	Path          []string `json:"path"`
+}
+
+// filesDocument is written by hmake inputs and outputs
+type filesDocument struct {
+	SchemaVersion int      `json:"schema_version"`
+	Files         []string `json:"files"`
+}
+
+// outputFlag adds --output, which is text, for people and scripts, or
+// json, for programs
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "text", "Output format: text, or json for programs")
+}
+
+// wantJSON reports whether output asks for JSON, or fails if it's neither
+// text nor json
+func wantJSON(output string) (bool, error) {
+	switch output {
+	case "text":
+		return false, nil
+	case "json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown output format %q", output)
+	}
+}
+
+func printJSON(w io.Writer, doc any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/lint"
+)
+
+func init() {
+	for _, name := range []string{"lint", "vet"} {
+		register(Command{
+			Name:  name,
+			Usage: "Report likely mistakes in makefiles",
+			Run:   runLint,
+		})
+	}
+}
+
+func runLint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	checks := fs.String("checks", "", "Comma separated checks to run, instead of all of them")
+	list := fs.Bool("list", false, "List the available checks")
+	shell := fs.Bool("shell", false, "Also check each recipe, with its variables expanded, with shellcheck")
+	fs.Parse(args)
+
+	if *list {
+		for _, check := range lint.Checks {
+			fmt.Printf("%-15s %s\n", check.Name, check.Doc)
+		}
+		return nil
+	}
+
+	names := []string{}
+	if *checks != "" {
+		names = strings.Split(*checks, ",")
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"Makefile"}
+	}
+
+	problems := 0
+	for _, file := range files {
+		f, err := ast.ParseFile(file)
+		if err != nil {
+			return err
+		}
+
+		diagnostics, err := lint.Lint(f, names...)
+		if err != nil {
+			return err
+		}
+		if *shell {
+			found, err := lint.Shellcheck(context.Background(), f)
+			if err != nil {
+				return err
+			}
+			diagnostics = append(diagnostics, found...)
+			sort.SliceStable(diagnostics, func(i, j int) bool { return diagnostics[i].Pos.Line < diagnostics[j].Pos.Line })
+		}
+
+		for _, d := range diagnostics {
+			printWarning("%s", d)
+		}
+		problems += len(diagnostics)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	return nil
+}
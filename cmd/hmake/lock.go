@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFile is held by the hmake building in a directory, so that two builds
+// don't write the same outputs and state at once
+var lockFile = filepath.Join(".hmake", "lock")
+
+// lockHeldVariable is set in the environment of recipes to the lock file
+// their hmake holds, so that a $(MAKE) they run in the same directory
+// builds under its lock rather than waiting for it forever
+const lockHeldVariable = "HMAKE_LOCK_HELD"
+
+// errLocked is returned by tryLock when another process holds the lock
+var errLocked = errors.New("locked")
+
+// lockWorkspace takes the lock on the current directory, waiting for any
+// other hmake holding it unless noWait. The returned function releases it.
+// Within a recipe of the hmake holding it, the lock is already taken.
+func lockWorkspace(ctx context.Context, noWait bool) (func(), error) {
+	held, err := filepath.Abs(lockFile)
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv(lockHeldVariable) == held {
+		return func() {}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(lockFile), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tryLock(f)
+	if errors.Is(err, errLocked) {
+		holder := lockHolder(f)
+		if noWait {
+			f.Close()
+			return nil, fmt.Errorf("another hmake%s is building in this directory", holder)
+		}
+
+		fmt.Fprintf(os.Stderr, "hmake: waiting for another hmake%s building in this directory\n", holder)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for errors.Is(err, errLocked) {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-ticker.C:
+				err = tryLock(f)
+			}
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The process holding the lock is noted for those waiting for it
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	os.Setenv(lockHeldVariable, held)
+	return func() {
+		os.Unsetenv(lockHeldVariable)
+		f.Close()
+	}, nil
+}
+
+// lockHolder describes the process holding the lock, if it's known
+func lockHolder(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n]))); err == nil {
+		return fmt.Sprintf(" (pid %d)", pid)
+	}
+	return ""
+}
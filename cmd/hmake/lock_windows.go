@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var lockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// tryLock takes an exclusive lock on f, which is released when f is closed,
+// or returns errLocked. A byte far beyond the end of the file is locked, as
+// Windows locks keep others from reading what they cover.
+func tryLock(f *os.File) error {
+	var overlapped syscall.Overlapped
+	overlapped.OffsetHigh = 0x7fffffff
+	r, _, err := lockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLocked
+	}
+	return err
+}
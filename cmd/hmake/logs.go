@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// logDir holds the output of each target's last run
+var logDir = filepath.Join(".hmake", "logs")
+
+const logUsage = `usage: hmake log <target>
+
+Prints what the target's recipe wrote, to standard output and standard
+error, the last time it ran. Each target's output is kept in
+.hmake/logs/<target>.log as well as shown, so that it can be read on its
+own when a parallel build has interleaved it with others'.`
+
+func init() {
+	register(Command{
+		Name:  "log",
+		Usage: "Print a target's output from its last run",
+		Run:   runLog,
+	})
+}
+
+func runLog(args []string) error {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), logUsage) }
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	name := fs.Arg(0)
+	f, err := os.Open(logPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no log for %s; its recipe hasn't run", name)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// logPath is where the log of target is kept. The name is escaped so that
+// every target has a file of its own directly in logDir.
+func logPath(target string) string {
+	return filepath.Join(logDir, url.PathEscape(target)+".log")
+}
+
+// targetLogs writes the output of each target to its log as well as to the
+// console
+type targetLogs struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func newTargetLogs() *targetLogs {
+	return &targetLogs{files: map[string]*os.File{}}
+}
+
+// open starts the log of t afresh, returning writers that pass t's output
+// on to stdout and stderr and into it. If the log can't be written the
+// output is only shown.
+func (l *targetLogs) open(t string, stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if err := os.MkdirAll(logDir, 0o755); err != nil {
+		return stdout, stderr
+	}
+	f, err := os.Create(logPath(t))
+	if err != nil {
+		return stdout, stderr
+	}
+
+	l.mu.Lock()
+	l.files[t] = f
+	l.mu.Unlock()
+	return &teeWriter{w: stdout, log: f}, &teeWriter{w: stderr, log: f}
+}
+
+// close closes the log of t once its recipe has finished
+func (l *targetLogs) close(t string) {
+	l.mu.Lock()
+	f := l.files[t]
+	delete(l.files, t)
+	l.mu.Unlock()
+
+	if f != nil {
+		f.Close()
+	}
+}
+
+// teeWriter passes output on to w, copying it to a target's log
+type teeWriter struct {
+	w   io.Writer
+	log io.Writer
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	t.log.Write(b)
+	return t.w.Write(b)
+}
+
+// Flush flushes w, if it buffers
+func (t *teeWriter) Flush() error {
+	if f, ok := t.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -1,39 +1,55 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"regexp"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
-
-	"github.com/dominikbraun/graph"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/cache"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/reapi"
+	"github.com/hookenz/hmake/pkg/trace"
+	"github.com/hookenz/hmake/pkg/worker"
 )
 
 type MakeArgs struct {
-	debug   bool
-	targets []string
-}
-
-// Makefile represents a parsed Makefile
-type Makefile struct {
-	Targets   map[string]Target
-	Variables map[string]string
-	Phony     map[string]bool
-}
-
-// Target represents a target in the Makefile
-type Target struct {
-	Name         string
-	Dependencies []string
-	Commands     []string
+	debug       bool
+	listTargets bool
+	helpTargets bool
+	interactive bool
+	question    bool
+	words       []string
+	utility     bool
+	targets     []string
+	overrides   map[string]string
+	profiles    []string
+
+	// watch rebuilds the goals whenever what they depend on changes,
+	// except files matching watchIgnore
+	watch       bool
+	watchIgnore []string
+
+	config
+	buildOptions
 }
 
 var (
 	debug bool
+
+	// runner runs each recipe
+	runner = &exec.Runner{Shell: exec.DefaultShell(), Echo: commandColor}
 )
 
 func log(v ...interface{}) {
@@ -48,20 +64,12 @@ func logf(format string, args ...interface{}) {
 	}
 }
 
-// Run executes the commands of a target
-func (t *Target) Run() {
-	fmt.Println("running commands for target: ", t.Name)
-	for _, command := range t.Commands {
-		silent := strings.HasPrefix(command, "@")
-		if silent {
-			command = command[1:]
-		} else {
-			fmt.Println(command)
-		}
-
-		System(command)
-	}
-}
+// Exit codes, matching GNU make
+const (
+	exitOK       = 0
+	exitQuestion = 1 // -q found a target that needs to be rebuilt
+	exitError    = 2
+)
 
 func main() {
 	// parse command line arguments
@@ -70,194 +78,683 @@ func main() {
 	log("Debug mode: ", args.debug)
 	log("Targets: ", args.targets)
 
-	makefile := NewMakefile()
-	err := makefile.Parse("Makefile")
+	if args.utility {
+		os.Exit(runUtility(args.words))
+	}
+
+	// Variables may be set before a command, as in "hmake CC=clang explain '$(CC)'"
+	words := args.words
+	for len(words) > 0 && strings.Contains(words[0], "=") && !strings.HasPrefix(words[0], "=") {
+		words = words[1:]
+	}
+	if len(words) > 0 {
+		if cmd, ok := lookupCommand(words[0]); ok {
+			if err := cmd.Run(words[1:]); err != nil {
+				printError(err)
+				os.Exit(exitError)
+			}
+			return
+		}
+	}
+
+	// Watch mode reads the makefile again whenever it changes
+	if args.watch || (len(args.words) > 0 && args.words[0] == "watch") {
+		parseCache = makefile.NewParseCache()
+	}
+
+	mf, err := loadProfiled(args.profiles, args.Profiles)
 	if err != nil {
-		fmt.Println("Error parsing Makefile:", err)
+		events.emitError(err)
+		printError(err)
+		os.Exit(exitError)
+	}
+	events.emit(event{Event: "parsed", File: makefileName, Targets: len(mf.Targets)})
+
+	if args.listTargets {
+		_ = listTargets(os.Stdout, mf, listOptions{})
 		return
 	}
 
-	targetHash := func(t Target) string {
-		return t.Name
+	if args.helpTargets {
+		helpTargets(os.Stdout, mf)
+		return
 	}
 
-	g := graph.New(targetHash, graph.Directed(), graph.Acyclic())
-	for _, info := range makefile.Targets {
-		if info.Name == ".PHONY" {
-			continue
+	// "hmake watch target..." is "hmake --watch target...", unless the
+	// makefile has a watch target of its own
+	if len(args.words) > 0 && args.words[0] == "watch" {
+		if _, ok := mf.Targets["watch"]; !ok {
+			args.watch = true
+			args.targets = args.targets[1:]
 		}
+	}
 
-		// fmt.Println("Adding vertex: ", info.Name)
-		g.AddVertex(info)
+	goals := args.targets
+	if len(goals) == 0 && !args.interactive {
+		goals = mf.DefaultGoal()
+	}
+	if args.interactive {
+		goals, err = chooseTargets(mf)
+		if err != nil {
+			printError(err)
+			os.Exit(exitError)
+		}
 	}
 
-	for target, info := range makefile.Targets {
-		for _, dep := range info.Dependencies {
-			if target == ".PHONY" {
-				continue
-			}
+	if err := checkGoals(mf, goals); err != nil {
+		events.emitError(err)
+		printError(err)
+		os.Exit(exitError)
+	}
 
-			if err := g.AddEdge(target, dep); err != nil {
-				panic(err)
-			}
+	if args.question {
+		if graph.NeedsRebuild(mf, goals) {
+			os.Exit(exitQuestion)
 		}
+		return
 	}
 
-	for _, target := range args.targets {
-		if _, ok := makefile.Targets[target]; !ok {
-			fmt.Println("Target not found: ", target)
-			os.Exit(1)
-		}
+	ctx, stop := interruptible()
+	defer stop()
 
-		log("Target: ", target)
+	if args.watch {
+		watch(ctx, mf, goals, args)
+		return
+	}
 
-		targets := []string{}
+	err = runBuild(ctx, mf, goals, args.buildOptions)
+	if err != nil {
+		events.emit(event{Event: "build_finish", Error: err.Error()})
+	} else {
+		events.emit(event{Event: "build_finish"})
+	}
+	if err != nil {
+		// When keeping going each failure was reported as it happened
+		if errors.Is(err, context.Canceled) {
+			printError("hmake: *** Interrupted")
+		} else if !args.keepGoing {
+			printError("hmake: *** ", err)
+		}
+		os.Exit(exitError)
+	}
+}
 
-		graph.DFS(g, target, func(t string) bool {
-			targets = append(targets, t)
-			return false
-		})
+// interruptible returns a context that is cancelled by Ctrl-C or SIGTERM,
+// so that a build can stop cleanly and still save its state
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
 
-		// print reverse order
-		for i := len(targets) - 1; i >= 0; i-- {
-			// fmt.Println("  ", targets[i])
-			t := makefile.Targets[targets[i]]
-			t.Run()
+// checkGoals makes sure every goal is a target of the makefile
+func checkGoals(mf *makefile.Makefile, goals []string) error {
+	for _, target := range goals {
+		if _, ok := mf.Targets[target]; !ok {
+			msg := fmt.Sprintf("Target not found:  %s", target)
+			if suggestions := suggestTargets(mf, target); len(suggestions) > 0 {
+				msg += fmt.Sprintf("\nDid you mean '%s'?", strings.Join(suggestions, "' or '"))
+			}
+			return errors.New(msg)
 		}
 	}
+
+	return nil
 }
 
-func ParseArgs() MakeArgs {
-	var args MakeArgs
+// buildFlags are the build options the command line gave, for commands
+// that build
+var buildFlags buildOptions
 
-	// Define flags
-	debug := flag.Bool("d", false, "Enable debug mode")
-	flag.Parse()
+// buildOptions controls how build runs the recipes
+type buildOptions struct {
+	// touchState records targets as built without running their recipes
+	touchState bool
 
-	// Targets are non-flag arguments
-	targets := flag.Args()
+	// jobs is the number of recipes that may run at once
+	jobs int
 
-	args.debug = *debug
-	args.targets = targets
+	// keepGoing carries on building after a failure
+	keepGoing bool
 
-	return args
+	// dryRun prints the commands without running them
+	dryRun bool
+
+	// dropCycles breaks dependency cycles with a warning instead of failing
+	dropCycles bool
+
+	// report is a JUnit XML file to write the results of the targets to
+	report string
+
+	// provenance is a file to record how each output was made in
+	provenance string
+
+	// timing prints the critical path, slowest targets and use of the jobs
+	// after the build, and timingReport writes them to a file
+	timing       bool
+	timingReport string
+
+	// downloadCache is where downloaded prerequisites are kept
+	downloadCache string
+
+	// cache, if set, is the directory of the artifact cache
+	cache string
+
+	// cacheRemote is the URL of a shared cache behind it, which is only
+	// read from if cacheReadOnly
+	cacheRemote   string
+	cacheReadOnly bool
+
+	// noToolFingerprint leaves the programs recipes run out of deciding
+	// what is up to date
+	noToolFingerprint bool
+
+	// traceAccess warns of recipes using files their rules don't declare,
+	// and strictAccess fails them
+	traceAccess  bool
+	strictAccess bool
+
+	// summary says when to print what became of the targets at the end:
+	// "never", "always" or "auto", after builds that ran recipes on a
+	// terminal
+	summary string
+
+	// ui is how the build is shown: "full", every line of output as it's
+	// written, or "compact"
+	ui string
+
+	// strictVariables fails targets whose recipes refer to variables with
+	// no value
+	strictVariables bool
+
+	// noWait fails at once when another hmake is building in the
+	// directory, instead of waiting for it to finish
+	noWait bool
+
+	// tempDir, if set, is where each build makes a private directory for
+	// its recipes' own TMPDIRs
+	tempDir string
 }
 
-// NewMakefile initializes a new Makefile
-func NewMakefile() *Makefile {
-	return &Makefile{
-		Targets:   make(map[string]Target),
-		Variables: make(map[string]string),
+// newEngine makes the engine for a build with opts, scheduling by what
+// state recorded of the builds before
+func newEngine(mf *makefile.Makefile, opts buildOptions, state *buildState) (*build.Engine, error) {
+	engine := build.New(mf, build.Options{
+		Jobs:       opts.jobs,
+		KeepGoing:  opts.keepGoing,
+		DryRun:     opts.dryRun,
+		DropCycles: opts.dropCycles,
+
+		DownloadCache:     opts.downloadCache,
+		NoToolFingerprint: opts.noToolFingerprint,
+		TraceAccess:       opts.traceAccess || opts.strictAccess,
+		StrictAccess:      opts.strictAccess,
+		StrictVariables:   opts.strictVariables,
+		TempDir:           opts.tempDir,
+		Durations:         state.durations(),
+		Policy:            commandPolicy,
+		AuditLog:          auditLog,
+	})
+	if opts.cache != "" {
+		engine.Cache = cache.New(opts.cache)
+		engine.Cache.ReadOnly = opts.cacheReadOnly
+		if opts.cacheRemote != "" {
+			var err error
+			if engine.Cache.Remote, err = cache.NewRemote(opts.cacheRemote); err != nil {
+				return nil, err
+			}
+		}
 	}
+	// Without fingerprints nothing else can make a target out of date, and
+	// the recipes of those up to date needn't be expanded to ask
+	if !opts.noToolFingerprint {
+		engine.OutOfDate = state.toolsChanged
+	}
+	engine.Runner = runner
+	return engine, nil
 }
 
-// Parse parses a Makefile and populates the Makefile struct
-func (mf *Makefile) Parse(filename string) error {
-	file, err := os.Open(filename)
+// runBuild runs the recipes needed to bring the goals up to date
+func runBuild(ctx context.Context, mf *makefile.Makefile, goals []string, opts buildOptions) error {
+	// A dry run writes nothing, so needn't keep other builds out
+	if !opts.dryRun {
+		unlock, err := lockWorkspace(ctx, opts.noWait)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	state, err := loadState()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer state.saveAfterBuild()
+	state.fingerprint = !opts.noToolFingerprint
+	state.files = mf.FileSystem()
 
-	scanner := bufio.NewScanner(file)
-	var currentTarget string
-	var currentCommands []string
-	for scanner.Scan() {
-		line := scanner.Text()
+	engine, err := newEngine(mf, opts, state)
+	if err != nil {
+		return err
+	}
 
-		// Skip empty lines
-		if line == "" || line[0] == '#' {
-			continue
+	order := engine.Plan(goals)
+	if opts.touchState {
+		for _, name := range order {
+			t := mf.ReferTempDir(mf.Targets[name])
+			t.Commands = mf.ExpandRecipeContext(ctx, t)
+			state.starting(t)
+			state.record(t, 0, nil)
 		}
+		return nil
+	}
 
-		// If it starts with a tab, it's a command
-		if strings.HasPrefix(line, "\t") {
-			currentCommands = append(currentCommands, strings.TrimSpace(line))
-			continue
-		}
+	summary := newBuildSummary()
+	engine.Restored = summary.restore
 
-		// Check if line defines a variable
-		if matches := regexp.MustCompile(`^(\w+)\s*=\s*(.*)$`).FindStringSubmatch(line); len(matches) == 3 {
-			mf.Variables[matches[1]] = matches[2]
-			continue
+	var timing *timingReport
+	if opts.timing || opts.timingReport != "" {
+		timing = newTimingReport(mf, order, opts.jobs)
+	}
+
+	dash.begin(mf, goals, order, state.Targets)
+	tracing.begin(mf)
+	notify.begin(goals)
+
+	// A live status line only makes sense when targets run side by side
+	status = newProgress(os.Stdout, len(order), opts.jobs > 1 && isTerminal(os.Stdout) && opts.ui != "compact")
+	defer status.done()
+
+	// A compact build holds each target's output back; a dry run has only
+	// the commands to show, so is shown in full
+	if opts.ui == "compact" && !opts.dryRun {
+		compact = newCompactUI(os.Stdout, len(order), isTerminal(os.Stdout))
+		defer func() {
+			compact.done()
+			compact = nil
+		}()
+		engine.Output = func(t makefile.Target) (io.Writer, io.Writer) {
+			w := compact.start(t.Name)
+			return w, w
+		}
+	} else if opts.jobs > 1 {
+		// When several jobs may run at once each line of output is
+		// labelled with the target it came from
+		engine.Output = func(t makefile.Target) (io.Writer, io.Writer) {
+			return newPrefixWriter(os.Stdout, t.Name), newPrefixWriter(os.Stderr, t.Name)
 		}
+	}
 
-		// Otherwise, it's a target
-		if currentTarget != "" {
-			// Save previous target and commands
-			mf.Targets[currentTarget] = Target{
-				Name:         currentTarget,
-				Dependencies: mf.Targets[currentTarget].Dependencies,
-				Commands:     currentCommands,
+	// With --log-json the output of each target is logged as it's written
+	if events != nil {
+		output := engine.Output
+		engine.Output = func(t makefile.Target) (io.Writer, io.Writer) {
+			var stdout, stderr io.Writer = os.Stdout, os.Stderr
+			if output != nil {
+				stdout, stderr = output(t)
 			}
-			currentCommands = nil
+			return &logWriter{w: stdout, target: t.Name, stream: "stdout"}, &logWriter{w: stderr, target: t.Name, stream: "stderr"}
 		}
+		engine.OnCommand = func(t makefile.Target, command string) {
+			events.emit(event{Event: "command", Target: t.Name, Command: command})
+		}
+	}
 
-		parts := strings.Split(line, ":")
-		currentTarget = strings.TrimSpace(parts[0])
-		dependencies := []string{}
-
-		// Extract dependencies if available
-		if len(parts) > 1 {
-			// strip comments from the end of the dependancies list
-			deps := parts[1]
-			i := strings.Index(deps, "#")
-			if i >= 0 {
-				deps = deps[:i]
+	// Each target's output is also kept in its log, but a dry run writes
+	// nothing
+	var logs *targetLogs
+	if !opts.dryRun {
+		logs = newTargetLogs()
+		output := engine.Output
+		engine.Output = func(t makefile.Target) (io.Writer, io.Writer) {
+			var stdout, stderr io.Writer = os.Stdout, os.Stderr
+			if output != nil {
+				stdout, stderr = output(t)
 			}
-
-			for _, dep := range strings.Split(deps, " ") {
-				dep = strings.TrimSpace(dep)
-				if dep != "" {
-					dependencies = append(dependencies, strings.TrimSpace(dep))
-				}
+			if len(t.Commands) == 0 {
+				return stdout, stderr
 			}
+			return logs.open(t.Name, stdout, stderr)
 		}
+	}
 
-		mf.Targets[currentTarget] = Target{
-			Name:         currentTarget,
-			Dependencies: dependencies,
-			Commands:     nil,
+	engine.BeforeTarget = func(t makefile.Target, stdout io.Writer) {
+		state.starting(t)
+		events.emit(event{Event: "target_start", Target: t.Name})
+		if timing != nil {
+			timing.start(t)
 		}
+		counter := status.start(t.Name)
+		if compact == nil {
+			fmt.Fprintf(unwrapLog(stdout), "%s running commands for target:  %s\n", counter, targetColor(t.Name))
+		}
+	}
+
+	var report *junitReport
+	if opts.report != "" {
+		report = newJUnitReport()
 	}
 
-	// Save commands of the last target
-	if currentTarget != "" {
-		mf.Targets[currentTarget] = Target{
-			Name:         currentTarget,
-			Dependencies: mf.Targets[currentTarget].Dependencies,
-			Commands:     currentCommands,
+	engine.AfterTarget = func(t makefile.Target, d time.Duration, err error) {
+		finish := event{Event: "target_finish", Target: t.Name, Duration: float64(d) / float64(time.Millisecond)}
+		if err != nil {
+			finish.Error = err.Error()
+		}
+		events.emit(finish)
+		if logs != nil {
+			logs.close(t.Name)
+		}
+		if compact != nil {
+			compact.finish(t.Name, d, err)
+		}
+
+		if report != nil {
+			report.add(t, d, err)
+		}
+		if timing != nil {
+			timing.finish(t, d)
+		}
+		summary.add(t, d, err)
+		if err != nil {
+			annotate(t, err)
+		}
+
+		var notRemade *build.NotRemadeError
+		if errors.As(err, &notRemade) {
+			status.skip()
+			printWarning("hmake: %s", err)
+			return
+		}
+
+		// An interrupted recipe neither succeeded nor failed
+		if errors.Is(err, context.Canceled) {
+			status.finish(t.Name)
+			return
+		}
+
+		// A target with a missing prerequisite never started
+		var missing *build.MissingError
+		if errors.As(err, &missing) {
+			status.skip()
+		} else {
+			status.finish(t.Name)
+			if !opts.dryRun {
+				state.record(t, d, err)
+			}
+		}
+		if err != nil && opts.keepGoing {
+			printError("hmake: *** ", err)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	engine.Clobbered = func(clobbered *build.ClobberedError) {
+		printWarning("hmake: *** Warning: %s", clobbered)
 	}
 
-	return nil
+	engine.CycleDropped = func(cycle *graph.CycleError) {
+		printWarning("hmake: %s", cycle)
+		printWarning("hmake: Dropped the dependency of %s on %s.", cycle.Path[0], cycle.Path[1])
+	}
+
+	engine.UpToDate = func(t makefile.Target) {
+		status.skip()
+		if compact != nil {
+			compact.upToDate()
+		}
+		summary.upToDateTarget()
+		if slices.Contains(goals, t.Name) {
+			events.emit(event{Event: "up_to_date", Target: t.Name})
+			printLine(fmt.Sprintf("hmake: '%s' is up to date.", t.Name))
+		}
+	}
+
+	started := time.Now()
+	err = engine.BuildContext(ctx, goals)
+	if engine.Cache != nil {
+		engine.Cache.SaveCounts()
+	}
+	if err == nil && opts.provenance != "" && !opts.dryRun {
+		err = writeProvenance(opts.provenance, mf, goals, order, started)
+	}
+	if report != nil {
+		if reportErr := report.write(opts.report); reportErr != nil && err == nil {
+			err = reportErr
+		}
+	}
+	if opts.summary == "always" || opts.summary == "auto" && !opts.dryRun && isTerminal(os.Stdout) && summary.ran() {
+		status.done()
+		printLine(summary.String())
+	}
+	if timing != nil {
+		finished := time.Now()
+		if opts.timing {
+			status.done()
+			fmt.Println()
+			timing.write(os.Stdout, finished)
+		}
+		if opts.timingReport != "" {
+			if timingErr := timing.writeFile(opts.timingReport, finished); timingErr != nil && err == nil {
+				err = timingErr
+			}
+		}
+	}
+	return err
 }
 
-func System(cmd string) int {
-	c := exec.Command("sh", "-c", cmd)
-	c.Stdin = os.Stdin
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	err := c.Run()
+func ParseArgs() MakeArgs {
+	var args MakeArgs
+
+	// Define flags
+	debug := flag.Bool("d", false, "Enable debug mode")
+	flag.StringVar(&makefileName, "f", "Makefile", "Read this makefile, or ninja build file if it ends in .ninja, or task file if it ends in .yaml or .toml")
+	directory := flag.String("C", "", "Change to this directory before doing anything else")
+	flag.BoolVar(&inlineSubmakes, "inline-submakes", false, "Build the makefiles of recipes that are only $(MAKE) -C dir as part of this one, as one graph")
+	listTargets := flag.Bool("list-targets", false, "List the targets that can be built")
+	helpTargets := flag.Bool("help-targets", false, "Describe the documented targets")
+	interactive := flag.Bool("i", false, "Pick the targets to build interactively")
+	question := flag.Bool("q", false, "Run no recipes; exit with 1 if any target needs rebuilding")
+	touchState := flag.Bool("touch-state", false, "Record targets as built without running their recipes")
+	flag.String("j", "auto", "Number of recipes to run at once, or auto for one per CPU this process may use, within a container's CPU quota")
+	flag.String("shell", exec.DefaultShell(), "Shell used to run recipes: sh or another POSIX shell, cmd or pwsh")
+	alwaysShell := flag.Bool("always-shell", false, "Run every recipe line with the shell, even those that need nothing of it")
+	flag.String("color", "auto", "Colorize output: auto, always or never")
+	flag.String("ui", "full", "Show the build in full, or compact: a line per target, with output only from those that fail")
+	flag.String("cache-dir", "", "Directory for hmake's caches")
+	flag.Bool("cache", false, "Restore targets made before from the same commands and inputs out of the cache")
+	flag.String("cache-remote", "", "Share the cache through this http(s):// or s3:// URL")
+	flag.Bool("cache-read-only", false, "Take entries from the remote cache without uploading to it")
+	flag.String("env-file", "", "Load environment variables from a dotenv file such as .env")
+	keepGoing := flag.Bool("k", false, "Keep going when a target fails, building what doesn't depend on it")
+	dryRun := flag.Bool("n", false, "Print the commands that would be run without running them")
+	dropCycles := flag.Bool("drop-cycles", false, "Drop dependencies that form a cycle with a warning, as GNU make does")
+	profiles := flag.String("profile", "", "Comma separated profiles of variables to apply")
+	report := flag.String("report", "", "Write the results of the targets to this file as JUnit XML")
+	provenance := flag.String("provenance", "", "After a successful build, record the outputs, their inputs and commands in this JSON file")
+	summaryFlag := flag.String("summary", "auto", "Print what became of the targets at the end: never, always, or auto, on a terminal after running recipes")
+	timing := flag.Bool("timing", false, "After the build, print its critical path, slowest targets and how busy each job was")
+	timingReport := flag.String("timing-report", "", "Write what --timing prints to this file")
+	notifyFlag := flag.Bool("notify", false, "Show a desktop notification when the build finishes or fails")
+	notifyCommand := flag.String("notify-command", "", "Run this shell command when the build finishes, with HMAKE_STATUS, HMAKE_GOALS, HMAKE_ERROR and HMAKE_DURATION set")
+	notifyAfter := flag.Duration("notify-after", 0, "Only notify of builds that take at least this long, e.g. 30s")
+	chromeTrace := flag.String("chrome-trace", "", "Write when each target and command ran to this file, for Perfetto or chrome://tracing")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "Send the build as an OpenTelemetry trace to the collector at this http(s):// URL")
+	serve := flag.String("serve", "", "Serve a web dashboard of the build at this address, e.g. :8080")
+	logJSON := flag.String("log-json", "", "Write build events to this file as JSON lines, or - for standard error")
+	distribute := flag.String("distribute", "", "Run recipes on the workers listed in this file, started with hmake serve-worker")
+	noToolFingerprint := flag.Bool("no-tool-fingerprint", false, "Don't remake targets, or miss the cache, because the programs their recipes run have changed")
+	watchFlag := flag.Bool("watch", false, "Build the targets again whenever a file they depend on changes")
+	watchIgnore := flag.String("watch-ignore", "", "Comma separated patterns of files --watch ignores, e.g. '*.tmp,docs/'")
+	warnUndefinedVariables := flag.Bool("warn-undefined-variables", false, "Warn of references to variables that have no value")
+	strict := flag.Bool("strict", false, "Fail on references to variables that have no value")
+	noWait := flag.Bool("no-wait", false, "Fail at once if another hmake is building in this directory, instead of waiting for it")
+	traceAccess := flag.Bool("trace-access", false, "Warn of files recipes read or write that their rules don't declare")
+	strictAccess := flag.Bool("strict-access", false, "Like --trace-access, but fail the targets whose recipes do")
+	policy := flag.String("policy", "", "Only let recipes and $(shell) run the programs this policy file allows")
+	auditLogFlag := flag.String("audit-log", "", "Add every command recipes and $(shell) run to this file as JSON lines, or - for standard error")
+	sharedTmpdir := flag.Bool("shared-tmpdir", false, "Run recipes with hmake's own TMPDIR, instead of giving each its own, removed when it finishes")
+	remoteExec := flag.String("remote-exec", "", "Run recipes on a Remote Execution API cluster at this grpcs:// URL, falling back to running them here")
+
+	// Flags from the environment come first so the command line wins
+	cmdline := []string{}
+	for _, arg := range os.Args[1:] {
+		cmdline = append(cmdline, normalizeJobsFlag(arg))
+	}
+	all := append(makeflagsArgs(flag.CommandLine), cmdline...)
+	flag.CommandLine.Parse(all)
+
+	// "hmake -- cp a b" runs one of hmake's portable file commands
+	if rest := len(all) - flag.NArg(); rest > 0 && all[rest-1] == "--" && flag.NArg() > 0 {
+		args.utility = true
+		args.words = flag.Args()
+		return args
+	}
 
+	var err error
+	if *directory != "" {
+		err = os.Chdir(*directory)
+	}
+	cfg, cfgErr := loadConfig()
+	if err == nil {
+		err = cfgErr
+	}
 	if err == nil {
-		return 0
+		err = cfg.applyFlags(flag.CommandLine)
+	}
+	if err == nil && cfg.EnvFile != "" {
+		err = loadEnvFile(cfg.EnvFile)
+	}
+	if err == nil && *logJSON != "" {
+		events, err = openEventLog(*logJSON)
+	}
+	if err == nil && *policy != "" {
+		commandPolicy, err = exec.LoadPolicy(*policy)
+	}
+	if err == nil && *auditLogFlag != "" {
+		auditLog, err = openAuditLog(*auditLogFlag)
+	}
+	if err == nil && *summaryFlag != "never" && *summaryFlag != "auto" && *summaryFlag != "always" {
+		err = fmt.Errorf("-summary must be never, auto or always, not %q", *summaryFlag)
+	}
+	if err == nil && (*notifyFlag || *notifyCommand != "") {
+		notify = &notifier{desktop: *notifyFlag, command: *notifyCommand, after: *notifyAfter}
+		observeEvents(notify.observe)
+	}
+	if err == nil && (*chromeTrace != "" || *otlpEndpoint != "") {
+		tracing = newBuildTrace(*chromeTrace, *otlpEndpoint)
+		observeEvents(tracing.observe)
+	}
+	if err == nil && *serve != "" {
+		if dash, err = serveDashboard(*serve); err == nil {
+			observeEvents(dash.observe)
+		}
+	}
+	if err == nil && *remoteExec != "" {
+		var remote *reapi.Executor
+		if remote, err = reapi.New(*remoteExec, os.Getenv("HMAKE_REMOTE_TOKEN")); err == nil {
+			remote.Shell = cfg.Shell
+			remote.Fallback = &exec.Local{Shell: cfg.Shell}
+			runner.Executor = remote
+		}
+	}
+	if err == nil && *distribute != "" {
+		var hosts []worker.Host
+		if hosts, err = worker.ReadHosts(*distribute); err == nil {
+			pool := worker.NewPool(hosts)
+			pool.Token = os.Getenv("HMAKE_WORKER_TOKEN")
+			pool.Fallback = &exec.Local{Shell: cfg.Shell}
+			runner.Executor = pool
+
+			// Every worker is kept busy unless -j says otherwise
+			if !flagSet("j") {
+				cfg.Jobs = pool.Slots()
+			}
+		}
+	}
+	if err == nil && (*traceAccess || *strictAccess) {
+		if !trace.Supported() {
+			err = trace.ErrUnsupported
+		} else if *remoteExec != "" || *distribute != "" {
+			err = errors.New("hmake: --trace-access runs recipes here, so can't be used with --remote-exec or --distribute")
+		}
+	}
+	if err != nil {
+		printError(err)
+		os.Exit(exitError)
 	}
 
-	// Figure out the exit code
-	if ws, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok {
-		if ws.Exited() {
-			return ws.ExitStatus()
+	// Targets are non-flag arguments, apart from variable assignments
+	args.words = flag.Args()
+	targets := []string{}
+	args.overrides = map[string]string{}
+	for _, arg := range flag.Args() {
+		if name, value, ok := strings.Cut(arg, "="); ok && name != "" {
+			args.overrides[name] = value
+			continue
 		}
+		targets = append(targets, arg)
+	}
+
+	if *profiles != "" {
+		args.profiles = strings.Split(*profiles, ",")
+	}
 
-		if ws.Signaled() {
-			return -int(ws.Signal())
+	args.debug = *debug
+	args.watch = *watchFlag
+	if *watchIgnore != "" {
+		args.watchIgnore = strings.Split(*watchIgnore, ",")
+	}
+	args.listTargets = *listTargets
+	args.helpTargets = *helpTargets
+	args.interactive = *interactive
+	args.question = *question
+	args.touchState = *touchState
+	args.targets = targets
+	commandLineVariables = args.overrides
+	args.config = cfg
+	args.jobs = cfg.Jobs
+	args.keepGoing = *keepGoing
+	args.dryRun = *dryRun
+	args.dropCycles = *dropCycles
+	args.report = *report
+	args.provenance = *provenance
+	args.timing = *timing
+	args.timingReport = *timingReport
+	args.noToolFingerprint = *noToolFingerprint
+	args.traceAccess = *traceAccess
+	args.noWait = *noWait
+	// Recipes run elsewhere have temporary directories of their own there
+	if !*sharedTmpdir && *remoteExec == "" && *distribute == "" {
+		args.tempDir = os.TempDir()
+	}
+	args.strictVariables = *strict
+	if *warnUndefinedVariables {
+		undefinedVariables = "warn"
+	}
+	if *strict {
+		undefinedVariables = "error"
+	}
+	args.ui = cfg.UI
+	args.summary = *summaryFlag
+	args.strictAccess = *strictAccess
+	args.cacheRemote = cfg.CacheRemote
+	args.cacheReadOnly = cfg.CacheReadOnly
+	if cfg.CacheDir != "" {
+		args.downloadCache = filepath.Join(cfg.CacheDir, "downloads")
+		if cfg.Cache || cfg.CacheRemote != "" {
+			args.cache = filepath.Join(cfg.CacheDir, "artifacts")
 		}
 	}
+	runner.Shell = cfg.Shell
+	exec.DirectExec = exec.DirectExec && !*alwaysShell
+	useColor = colorEnabled(cfg.Color)
+
+	exportMakeflags(args)
+	buildFlags = args.buildOptions
+
+	return args
+}
 
-	return -1
+// flagSet reports whether a flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
 }
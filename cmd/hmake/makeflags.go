@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// makeflagsArgs turns the flags in HMAKEFLAGS, or failing that MAKEFLAGS,
+// into command line arguments. As with GNU make the first word may be a run
+// of single letter flags without a dash, e.g. "ks -j4". Flags hmake doesn't
+// know, and variable assignments, are ignored, as are those of MAKEFLAGS
+// that mean something else to GNU make. A bare -j, GNU make's unlimited
+// jobs, is taken as -j=auto rather than as taking the next word.
+func makeflagsArgs(fs *flag.FlagSet) []string {
+	value := os.Getenv("HMAKEFLAGS")
+	known := func(name string) bool { return fs.Lookup(name) != nil }
+	if value == "" {
+		value = os.Getenv("MAKEFLAGS")
+		known = func(name string) bool { return gnuMakeFlags[name] && fs.Lookup(name) != nil }
+	}
+
+	args := []string{}
+	for i, word := range strings.Fields(value) {
+		if word == "--" {
+			break
+		}
+
+		if i == 0 && !strings.HasPrefix(word, "-") && !strings.Contains(word, "=") {
+			for _, letter := range word {
+				args = appendKnownFlag(known, args, "-"+string(letter))
+			}
+			continue
+		}
+
+		args = appendKnownFlag(known, args, word)
+	}
+
+	return args
+}
+
+// gnuMakeFlags are the flags GNU make puts in MAKEFLAGS that mean the same
+// to hmake. Its -i, ignoring errors, is hmake's interactive picker, so
+// isn't among them.
+var gnuMakeFlags = map[string]bool{"d": true, "j": true, "k": true, "n": true, "q": true}
+
+func appendKnownFlag(known func(name string) bool, args []string, arg string) []string {
+	if !strings.HasPrefix(arg, "-") {
+		return args
+	}
+
+	arg = normalizeJobsFlag(arg)
+	if arg == "-j" {
+		arg = "-j=auto"
+	}
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	if !known(name) {
+		return args
+	}
+
+	return append(args, arg)
+}
+
+// normalizeJobsFlag rewrites the "-j4" spelling used by make, which the
+// flag package doesn't understand, as "-j=4", and "-jauto" likewise
+func normalizeJobsFlag(arg string) string {
+	if len(arg) > 2 && strings.HasPrefix(arg, "-j") && (strings.Trim(arg[2:], "0123456789") == "" || arg[2:] == "auto") {
+		return "-j=" + arg[2:]
+	}
+	return arg
+}
+
+// exportMakeflags describes the settings that recipes running hmake (or
+// make) again should inherit, in the same format makeflagsArgs reads
+func exportMakeflags(args MakeArgs) {
+	letters := ""
+	if args.keepGoing {
+		letters += "k"
+	}
+	if args.debug {
+		letters += "d"
+	}
+
+	words := []string{}
+	if letters != "" {
+		words = append(words, letters)
+	}
+	if args.jobs > 1 {
+		words = append(words, fmt.Sprintf("-j%d", args.jobs))
+	}
+
+	flags := strings.Join(words, " ")
+	os.Setenv("HMAKEFLAGS", flags)
+	os.Setenv("MAKEFLAGS", flags)
+}
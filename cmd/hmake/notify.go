@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+// notifyTimeout is how long a notification, or the hook, may take
+const notifyTimeout = 10 * time.Second
+
+// notifier tells the developer a build has finished, with a desktop
+// notification, a command of their own, or both, for --notify and
+// --notify-command
+type notifier struct {
+	mu      sync.Mutex
+	desktop bool
+	command string
+
+	// after is how long a build must take to be worth notifying of
+	after time.Duration
+
+	goals   []string
+	started time.Time
+}
+
+// notify is the notifier given with --notify or --notify-command, if any
+var notify *notifier
+
+// begin notes that a build of goals is starting
+func (n *notifier) begin(goals []string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.goals, n.started = goals, time.Now()
+}
+
+// observe notifies once the build is over
+func (n *notifier) observe(e event) {
+	if e.Event != "build_finish" {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// An interrupted build was stopped by someone who's there to see it
+	if n.started.IsZero() || e.Error == context.Canceled.Error() {
+		return
+	}
+	took := e.Time.Sub(n.started)
+	n.started = time.Time{}
+	if took < n.after {
+		return
+	}
+
+	goals := strings.Join(n.goals, " ")
+	title, message := "hmake: build finished", fmt.Sprintf("Made %s in %s", goals, round(took))
+	if e.Error != "" {
+		title, message = "hmake: build failed", fmt.Sprintf("%s after %s", e.Error, round(took))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	if n.desktop {
+		if err := notifyDesktop(ctx, title, message); err != nil {
+			printWarning("hmake: couldn't notify: %s", err)
+		}
+	}
+	if n.command != "" {
+		status := "ok"
+		if e.Error != "" {
+			status = "failed"
+		}
+		cmd := osexec.CommandContext(ctx, runner.Shell, exec.ShellArgs(runner.Shell, n.command)...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(),
+			"HMAKE_STATUS="+status,
+			"HMAKE_GOALS="+goals,
+			"HMAKE_ERROR="+e.Error,
+			fmt.Sprintf("HMAKE_DURATION=%.3f", took.Seconds()),
+		)
+		if err := cmd.Run(); err != nil {
+			printWarning("hmake: --notify-command: %s", err)
+		}
+	}
+}
+
+// notifyDesktop shows a notification with the system's own tool for it
+func notifyDesktop(ctx context.Context, title, message string) error {
+	var cmd *osexec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString(title))
+		cmd = osexec.CommandContext(ctx, "osascript", "-e", script)
+	case "windows":
+		// A balloon from a tray icon, which needs nothing beyond PowerShell
+		script := `Add-Type -AssemblyName System.Windows.Forms
+$n = New-Object System.Windows.Forms.NotifyIcon
+$n.Icon = [System.Drawing.SystemIcons]::Information
+$n.Visible = $true
+$n.ShowBalloonTip(10000, $env:HMAKE_TITLE, $env:HMAKE_MESSAGE, 'None')
+Start-Sleep -Seconds 5
+$n.Dispose()`
+		cmd = osexec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+		cmd.Env = append(os.Environ(), "HMAKE_TITLE="+title, "HMAKE_MESSAGE="+message)
+	default:
+		cmd = osexec.CommandContext(ctx, "notify-send", "--app-name=hmake", title, message)
+	}
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, osexec.ErrNotFound) {
+			return fmt.Errorf("%s isn't installed", cmd.Args[0])
+		}
+		return err
+	}
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
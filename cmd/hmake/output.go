@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ANSI colour codes used for hmake's own output
+const (
+	colorReset   = "\033[0m"
+	colorBold    = "\033[1m"
+	colorRed     = "\033[31m"
+	colorYellow  = "\033[33m"
+	colorCyan    = "\033[36m"
+	colorMagenta = "\033[35m"
+)
+
+// useColor is set from --color once the flags are parsed
+var useColor = false
+
+// colorEnabled decides whether to colorize for the --color setting. In auto
+// mode colour is used when stdout is a terminal and NO_COLOR isn't set.
+func colorEnabled(setting string) bool {
+	switch setting {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(os.Stdout)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func colorize(color, s string) string {
+	if !useColor {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func targetColor(name string) string { return colorize(colorBold+colorCyan, name) }
+
+func commandColor(command string) string { return colorize(colorMagenta, command) }
+
+// printError reports an error from hmake itself
+func printError(v ...interface{}) {
+	printLine(colorize(colorRed, fmt.Sprint(v...)))
+}
+
+// printWarning reports something that didn't stop the build
+func printWarning(format string, args ...interface{}) {
+	printLine(colorize(colorYellow, fmt.Sprintf(format, args...)))
+}
+
+// printLine prints a line of hmake's own, above the running targets of a
+// compact build
+func printLine(line string) {
+	if compact != nil {
+		compact.println(line)
+		return
+	}
+	fmt.Println(line)
+}
+
+// prefixWriter starts every line written through it with a prefix, so the
+// output of recipes running side by side can be told apart
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+// outputMu keeps lines from different prefixWriters whole
+var outputMu sync.Mutex
+
+func newPrefixWriter(w io.Writer, target string) *prefixWriter {
+	return &prefixWriter{mu: &outputMu, w: w, prefix: targetColor("["+target+"]") + " "}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes out a final line that had no newline
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := io.WriteString(p.w, status.clearLine()+p.prefix+string(line)+status.statusLine())
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+func init() {
+	register(Command{
+		Name:  "pick",
+		Usage: "Pick the targets to build interactively",
+		Run:   runPick,
+	})
+}
+
+func runPick(args []string) error {
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	goals, err := chooseTargets(mf)
+	if err != nil {
+		return err
+	}
+
+	if err := checkGoals(mf, goals); err != nil {
+		return err
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+
+	return runBuild(ctx, mf, goals, buildFlags)
+}
+
+// chooseTargets has the user pick the targets to build, in the picker on a
+// terminal, or at a prompt when hmake isn't run on one or can't put it in
+// raw mode
+func chooseTargets(mf *makefile.Makefile) ([]string, error) {
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		if restore, err := makeRaw(os.Stdin); err == nil {
+			defer restore()
+			return pickInteractive(os.Stdin, os.Stdout, mf, terminalWidth(os.Stdout))
+		}
+	}
+	return pickTargets(os.Stdin, os.Stdout, mf)
+}
+
+// pickable returns the targets that can be picked, sorted, and the length
+// of the longest name
+func pickable(mf *makefile.Makefile) ([]string, int, error) {
+	all := []string{}
+	width := 0
+	for name := range mf.Targets {
+		if !makefile.IsSpecialTarget(name) && !makefile.IsPatternRule(name) {
+			all = append(all, name)
+			width = max(width, len(name))
+		}
+	}
+	sort.Strings(all)
+
+	if len(all) == 0 {
+		return nil, 0, errors.New("no targets to pick from")
+	}
+	return all, width, nil
+}
+
+// pickTargets lists the targets and lets the user narrow them down by typing
+// a search, then choose one or more of them by number
+func pickTargets(in io.Reader, out io.Writer, mf *makefile.Makefile) ([]string, error) {
+	all, width, err := pickable(mf)
+	if err != nil {
+		return nil, err
+	}
+
+	shown := all
+	scanner := bufio.NewScanner(in)
+	for {
+		for i, name := range shown {
+			line := fmt.Sprintf("%3d) %-*s  %s", i+1, width, name, mf.Targets[name].Description)
+			fmt.Fprintln(out, strings.TrimRight(line, " "))
+		}
+		fmt.Fprint(out, "Type to search, pick by number (e.g. \"1 3\"), or press enter to quit: ")
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return nil, scanner.Err()
+		}
+
+		input := strings.TrimSpace(scanner.Text())
+		if input == "" {
+			return nil, nil
+		}
+
+		if picked, ok := pickByNumber(shown, input); ok {
+			return picked, nil
+		}
+
+		shown = []string{}
+		for _, name := range all {
+			if fuzzyMatch(input, name+" "+mf.Targets[name].Description) {
+				shown = append(shown, name)
+			}
+		}
+
+		if len(shown) == 0 {
+			fmt.Fprintf(out, "Nothing matches %q\n", input)
+			shown = all
+		}
+	}
+}
+
+// pickByNumber interprets input as a list of positions in shown
+func pickByNumber(shown []string, input string) ([]string, bool) {
+	picked := []string{}
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ' ' || r == ',' }) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > len(shown) {
+			return nil, false
+		}
+		picked = append(picked, shown[n-1])
+	}
+
+	return picked, len(picked) > 0
+}
+
+// fuzzyMatch reports whether the characters of pattern appear in s in order,
+// ignoring case
+func fuzzyMatch(pattern, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(string(r)):]
+	}
+
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"", "build", true},
+		{"bld", "build", true},
+		{"BLD", "build", true},
+		{"tst", "test Run the tests", true},
+		{"dlb", "build", false},
+		{"builds", "build", false},
+		{"ü", "Über", true},
+	} {
+		if match := fuzzyMatch(test.pattern, test.s); match != test.match {
+			t.Errorf("fuzzyMatch(%q, %q) = %v, want %v", test.pattern, test.s, match, test.match)
+		}
+	}
+}
+
+func TestPickByNumber(t *testing.T) {
+	shown := []string{"build", "lint", "test"}
+	for _, test := range []struct {
+		input  string
+		picked []string
+	}{
+		{"1", []string{"build"}},
+		{"3 1", []string{"test", "build"}},
+		{"2,3", []string{"lint", "test"}},
+		{"0", nil},
+		{"4", nil},
+		{"te", nil},
+		{"1 x", nil},
+		{" , ", nil},
+	} {
+		picked, ok := pickByNumber(shown, test.input)
+		if ok != (test.picked != nil) || !slices.Equal(picked, test.picked) {
+			t.Errorf("pickByNumber(%q) = %v, %v, want %v", test.input, picked, ok, test.picked)
+		}
+	}
+}
+
+func pickMakefile() *makefile.Makefile {
+	mf := makefile.NewMakefile()
+	for name, description := range map[string]string{
+		"build":   "Build the binaries",
+		"lint":    "Check the style",
+		"test":    "Run the tests",
+		"release": "Tag and publish",
+		"%.o":     "",
+		".PHONY":  "",
+	} {
+		mf.Targets[name] = makefile.Target{Name: name, Description: description}
+	}
+	return mf
+}
+
+func TestPickTargets(t *testing.T) {
+	// A search narrows the list, to lint, release and test, and the numbers
+	// are of what it shows
+	picked, err := pickTargets(strings.NewReader("st\n3\n"), io.Discard, pickMakefile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(picked, []string{"test"}) {
+		t.Errorf("picked %v, want test", picked)
+	}
+
+	picked, err = pickTargets(strings.NewReader("\n"), io.Discard, pickMakefile())
+	if err != nil || picked != nil {
+		t.Errorf("enter alone picked %v, %v, want nothing", picked, err)
+	}
+}
+
+func TestPickInteractive(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		keys   string
+		picked []string
+	}{
+		{"enter builds the target under the cursor", "\r", []string{"build"}},
+		{"arrow keys move the cursor", "\x1b[B\x1b[B\x1b[A\r", []string{"lint"}},
+		{"application mode arrow keys", "\x1bOB\r", []string{"lint"}},
+		{"control keys move the cursor", "\x0e\x0e\x10\r", []string{"lint"}},
+		{"the cursor stops at the ends", "\x1b[A\x1b[B\x1b[B\x1b[B\x1b[B\x1b[B\r", []string{"test"}},
+		{"typing filters the list", "tests\r", []string{"test"}},
+		{"the search can be edited", "lint\x7f\x7f\x7f\x7fpub\r", []string{"release"}},
+		{"ctrl-u clears the search", "xyz\x15\r", []string{"build"}},
+		{"tab picks several in the order picked", "\x1b[B\x1b[B\x1b[B\t\x1b[A\x1b[A\x1b[A\t\r", []string{"test", "build"}},
+		{"tab again unpicks", "\t\x1b[A\t\r", []string{"lint"}},
+		{"picks outlast the search", "rel\t\x15lint\t\r", []string{"release", "lint"}},
+		{"enter with nothing matching does nothing", "zzz\r\x15\r", []string{"build"}},
+		{"escape quits", "\t\x1b", nil},
+		{"ctrl-c quits", "\x03", nil},
+		{"the end of input quits", "te", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			picked, err := pickInteractive(strings.NewReader(test.keys), &out, pickMakefile(), 80)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(picked, test.picked) {
+				t.Errorf("picked %v, want %v", picked, test.picked)
+			}
+			if !strings.HasSuffix(out.String(), "\033[J\033[?25h") {
+				t.Errorf("the picker wasn't erased when done: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestPickerScrolls(t *testing.T) {
+	mf := makefile.NewMakefile()
+	for i := 0; i < 3*pickRows; i++ {
+		name := string(rune('a'+i/10)) + string(rune('0'+i%10))
+		mf.Targets[name] = makefile.Target{Name: name}
+	}
+
+	var out strings.Builder
+	keys := strings.Repeat("\x1b[B", pickRows+2) + "\r"
+	picked, err := pickInteractive(strings.NewReader(keys), &out, mf, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(picked, []string{"b2"}) {
+		t.Errorf("picked %v, want b2", picked)
+	}
+
+	// The last drawing shows no more rows than fit, with the cursor's at
+	// the bottom
+	draws := strings.Split(out.String(), "Search: ")
+	lines := strings.Split(draws[len(draws)-1], "\n")
+	rows, help := lines[1:pickRows+1], lines[pickRows+1]
+	if !strings.HasPrefix(rows[0], "   a3") || !strings.HasPrefix(rows[pickRows-1], ">  b2") || !strings.HasPrefix(help, "  30/30") {
+		t.Errorf("last drawing:\n%s", strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// pickRows is how many targets the picker shows at once
+const pickRows = 10
+
+// The keys the picker acts on besides the characters of a search
+const (
+	keyNone rune = -1 - iota
+	keyUp
+	keyDown
+	keyEnter
+	keyTab
+	keyBackspace
+	keyClear
+	keyQuit
+)
+
+// picker is the state of the interactive target picker: the search typed
+// so far, the targets matching it and those picked
+type picker struct {
+	mf  *makefile.Makefile
+	all []string
+
+	// nameWidth is the length of the longest name, and width how many
+	// columns the terminal has
+	nameWidth int
+	width     int
+
+	query []rune
+	shown []string
+
+	// cursor is the position in shown of the target under the cursor, and
+	// top that of the first one on the screen
+	cursor int
+	top    int
+
+	// picked are the targets chosen with tab, in the order they were
+	picked []string
+}
+
+// pickInteractive lets the user pick targets on a terminal in raw mode:
+// typing narrows down the list as it's typed, the arrow keys move the
+// cursor, tab picks the target under it and enter builds those picked, or
+// the one under the cursor if none are
+func pickInteractive(in io.Reader, out io.Writer, mf *makefile.Makefile, width int) ([]string, error) {
+	all, nameWidth, err := pickable(mf)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &picker{mf: mf, all: all, nameWidth: nameWidth, width: width}
+	p.filter()
+
+	drawn := 0
+	erase := func() {
+		if drawn > 0 {
+			fmt.Fprintf(out, "\033[%dA\033[J", drawn)
+			drawn = 0
+		}
+	}
+	// The cursor is hidden while the picker is drawn, and the picker
+	// erased once done, leaving the terminal to the build
+	fmt.Fprint(out, "\033[?25l")
+	defer fmt.Fprint(out, "\033[?25h")
+	defer erase()
+
+	r := bufio.NewReader(in)
+	for {
+		erase()
+		drawn = p.draw(out)
+
+		k, err := readKey(r)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if goals, done := p.key(k); done {
+			return goals, nil
+		}
+	}
+}
+
+// filter shows the targets that match the search, with the cursor on the
+// first of them
+func (p *picker) filter() {
+	query := string(p.query)
+	p.shown = []string{}
+	for _, name := range p.all {
+		if fuzzyMatch(query, name+" "+p.mf.Targets[name].Description) {
+			p.shown = append(p.shown, name)
+		}
+	}
+	p.cursor, p.top = 0, 0
+}
+
+// key acts on a key, reporting whether the picking is done, and if so the
+// targets picked
+func (p *picker) key(k rune) ([]string, bool) {
+	switch k {
+	case keyNone:
+	case keyQuit:
+		return nil, true
+	case keyEnter:
+		if len(p.picked) > 0 {
+			return p.picked, true
+		}
+		if len(p.shown) > 0 {
+			return []string{p.shown[p.cursor]}, true
+		}
+	case keyUp:
+		p.cursor = max(p.cursor-1, 0)
+	case keyDown:
+		p.cursor = max(min(p.cursor+1, len(p.shown)-1), 0)
+	case keyTab:
+		// Picking moves the cursor on, so that several can be picked in a row
+		if len(p.shown) > 0 {
+			name := p.shown[p.cursor]
+			if i := slices.Index(p.picked, name); i >= 0 {
+				p.picked = slices.Delete(p.picked, i, i+1)
+			} else {
+				p.picked = append(p.picked, name)
+			}
+			p.cursor = min(p.cursor+1, len(p.shown)-1)
+		}
+	case keyBackspace:
+		if len(p.query) > 0 {
+			p.query = p.query[:len(p.query)-1]
+			p.filter()
+		}
+	case keyClear:
+		p.query = nil
+		p.filter()
+	default:
+		p.query = append(p.query, k)
+		p.filter()
+	}
+
+	// Scroll to keep the cursor on the screen
+	if p.cursor < p.top {
+		p.top = p.cursor
+	}
+	if p.cursor >= p.top+pickRows {
+		p.top = p.cursor - pickRows + 1
+	}
+	return nil, false
+}
+
+// draw writes the search, the targets on the screen and a line of help,
+// returning how many lines that took
+func (p *picker) draw(out io.Writer) int {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Search: %s\033[7m \033[0m\n", string(p.query))
+
+	rows := p.shown[p.top:min(p.top+pickRows, len(p.shown))]
+	for i, name := range rows {
+		cursor, picked := " ", " "
+		if p.top+i == p.cursor {
+			cursor = ">"
+		}
+		if slices.Contains(p.picked, name) {
+			picked = "*"
+		}
+		line := fmt.Sprintf("%s%s %-*s  %s", cursor, picked, p.nameWidth, name, p.mf.Targets[name].Description)
+		line = strings.TrimRight(truncate(line, p.width-1), " ")
+		if p.top+i == p.cursor {
+			line = colorize(colorBold, line)
+		}
+		fmt.Fprintln(&b, line)
+	}
+
+	help := fmt.Sprintf("  %d/%d", len(p.shown), len(p.all))
+	if len(p.shown) == 0 {
+		help = "  Nothing matches"
+	}
+	if len(p.picked) > 0 {
+		help += fmt.Sprintf(", %d picked", len(p.picked))
+	}
+	help += "; tab picks, enter builds, esc quits"
+	fmt.Fprintln(&b, truncate(help, p.width-1))
+
+	io.WriteString(out, b.String())
+	return len(rows) + 2
+}
+
+// truncate cuts s to at most n characters, so that lines don't wrap
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:max(n, 0)])
+	}
+	return s
+}
+
+// readKey reads a key pressed on a terminal in raw mode, turning the
+// escape sequences of the arrow keys and the control characters the picker
+// uses into its keys. Other keys are keyNone.
+func readKey(r *bufio.Reader) (rune, error) {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+
+	switch c {
+	case '\r', '\n':
+		return keyEnter, nil
+	case '\t':
+		return keyTab, nil
+	case 0x7f, '\b':
+		return keyBackspace, nil
+	case 0x15: // Ctrl-U
+		return keyClear, nil
+	case 0x10: // Ctrl-P
+		return keyUp, nil
+	case 0x0e: // Ctrl-N
+		return keyDown, nil
+	case 0x03, 0x04: // Ctrl-C, Ctrl-D
+		return keyQuit, nil
+	case 0x1b:
+		// An escape sequence arrives all at once, so an escape with
+		// nothing after it is the escape key
+		if r.Buffered() == 0 {
+			return keyQuit, nil
+		}
+		if b, _ := r.ReadByte(); b != '[' && b != 'O' {
+			return keyNone, nil
+		}
+		// Parameters, then a final byte saying which key it is
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if b >= 0x40 && b <= 0x7e {
+				switch b {
+				case 'A':
+					return keyUp, nil
+				case 'B':
+					return keyDown, nil
+				}
+				return keyNone, nil
+			}
+		}
+	}
+
+	if c < ' ' {
+		return keyNone, nil
+	}
+	return c, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// commandPolicy restricts the programs builds may run, given with --policy
+var commandPolicy *exec.Policy
+
+// auditLog records every command builds run, given with --audit-log
+var auditLog *exec.AuditLog
+
+// openAuditLog opens the audit log at path, where "-" is standard error.
+// An existing log is added to, so that it covers every build.
+func openAuditLog(path string) (*exec.AuditLog, error) {
+	if path == "-" {
+		return exec.NewAuditLog(os.Stderr), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return exec.NewAuditLog(f), nil
+}
+
+// auditShell holds the commands of $(shell) to the policy and records them
+// as the makefile is read
+func auditShell(mf *makefile.Makefile) {
+	if commandPolicy == nil && auditLog == nil {
+		return
+	}
+	mf.ShellCommand = func(command string) error {
+		entry := exec.AuditEntry{Source: "shell", Command: command, Programs: exec.CommandPrograms(command)}
+		err := commandPolicy.Check(command)
+		var denied *exec.PolicyError
+		if errors.As(err, &denied) {
+			entry.Denied = denied.Reason
+		}
+		auditLog.Record(entry)
+		return err
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestProfileReadFirst(t *testing.T) {
+	newProject(t, `
+profile.release: MODE=release OPT=-O2
+OPT ?= -O0
+CFLAGS := $(OPT) -Wall
+ifeq ($(MODE),release)
+STRIP = -s
+endif
+all: $(MODE).stamp
+`)
+	t.Cleanup(func() { profileVariables = nil })
+
+	mf, err := loadProfiled([]string{"release"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for expr, want := range map[string]string{"$(CFLAGS)": "-O2 -Wall", "$(STRIP)": "-s", "$(MODE)": "release"} {
+		if got := mf.Expand(expr); got != want {
+			t.Errorf("%s is %q, want %q", expr, got, want)
+		}
+	}
+	if deps := mf.Targets["all"].Dependencies; len(deps) != 1 || deps[0] != "release.stamp" {
+		t.Errorf("all depends on %v, want release.stamp", deps)
+	}
+
+	// The command line still wins
+	commandLineVariables = map[string]string{"OPT": "-O3"}
+	t.Cleanup(func() { commandLineVariables = map[string]string{} })
+	if mf, err = loadProfiled([]string{"release"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := mf.Expand("$(CFLAGS)"); got != "-O3 -Wall" {
+		t.Errorf("CFLAGS is %q with OPT=-O3 given, want -O3 -Wall", got)
+	}
+
+	if _, err := loadProfiled([]string{"missing"}, nil); err == nil {
+		t.Error("an unknown profile was loaded")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// progress counts targets through a build, ninja style: "[12/87] foo.o".
+// When live is set a status line naming the running targets is kept at the
+// bottom of the terminal, redrawn under each line of recipe output.
+type progress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	live     bool
+	total    int
+	started  int
+	finished int
+	running  []string
+}
+
+// status is the progress of the current build, if any
+var status *progress
+
+func newProgress(w io.Writer, total int, live bool) *progress {
+	return &progress{w: w, total: total, live: live}
+}
+
+// start notes that a target has started and returns its counter
+func (p *progress) start(name string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.started++
+	p.running = append(p.running, name)
+	return fmt.Sprintf("[%d/%d]", p.started, p.total)
+}
+
+func (p *progress) finish(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.finished++
+	for i, running := range p.running {
+		if running == name {
+			p.running = append(p.running[:i], p.running[i+1:]...)
+			break
+		}
+	}
+}
+
+// skip counts a target that needn't be remade, or can't be started, as
+// done, so the counters reach the total
+func (p *progress) skip() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.started++
+	p.finished++
+}
+
+// statusLine describes the running targets, or is empty when not live
+func (p *progress) statusLine() string {
+	if p == nil || !p.live {
+		return ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.running) == 0 {
+		return ""
+	}
+	return colorize(colorBold, fmt.Sprintf("[%d/%d] running: %s", p.finished, p.total, strings.Join(p.running, ", ")))
+}
+
+// clearLine erases the status line so ordinary output can take its place
+func (p *progress) clearLine() string {
+	if p == nil || !p.live {
+		return ""
+	}
+	return "\r\033[K"
+}
+
+// done removes the status line at the end of the build
+func (p *progress) done() {
+	if p != nil && p.live {
+		io.WriteString(p.w, p.clearLine())
+	}
+}
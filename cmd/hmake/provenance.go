@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	osexec "os/exec"
+	"runtime"
+	buildinfo "runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// provenance records how each file a build produced was made, for release
+// pipelines to attest to, in the spirit of SLSA provenance
+type provenance struct {
+	Builder  builderInfo `json:"builder"`
+	Makefile string      `json:"makefile"`
+	Goals    []string    `json:"goals"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	Subjects []subject   `json:"subjects"`
+	Tools    []tool      `json:"tools"`
+}
+
+type builderInfo struct {
+	ID        string `json:"id"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// subject is an output of the build with what went into it
+type subject struct {
+	Name     string            `json:"name"`
+	Digest   map[string]string `json:"digest"`
+	Inputs   []artifact        `json:"inputs"`
+	Commands []string          `json:"commands"`
+}
+
+type artifact struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// tool is a program the recipes ran, identified by its digest
+type tool struct {
+	Name   string            `json:"name"`
+	Path   string            `json:"path"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// writeProvenance records the file targets of the plan that exist after
+// the build, with the expanded commands that make them and the programs
+// those commands run, with secrets redacted
+func writeProvenance(filename string, mf *makefile.Makefile, goals, plan []string, started time.Time) error {
+	p := provenance{
+		Builder:  builderInfo{ID: "hmake", Version: hmakeVersion(), GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH},
+		Makefile: makefileName,
+		Goals:    goals,
+		Started:  started.UTC(),
+		Finished: time.Now().UTC(),
+		Subjects: []subject{},
+		Tools:    []tool{},
+	}
+
+	redact := build.NewRedactor(mf)
+	tools := map[string]bool{}
+	for _, name := range plan {
+		if !mf.IsFileTarget(name) {
+			continue
+		}
+		digest, err := fileDigest(name)
+		if err != nil {
+			continue
+		}
+
+		t := mf.Targets[name]
+		s := subject{Name: name, Digest: digest, Inputs: []artifact{}, Commands: mf.ExpandRecipe(t)}
+		for i, command := range s.Commands {
+			s.Commands[i] = redact.String(command)
+		}
+		for _, dep := range dedupeStrings(t.Dependencies) {
+			input := artifact{Name: dep}
+			input.Digest, _ = fileDigest(dep)
+			s.Inputs = append(s.Inputs, input)
+		}
+		p.Subjects = append(p.Subjects, s)
+
+		for _, command := range s.Commands {
+			program := commandProgram(command)
+			if program == "" || tools[program] {
+				continue
+			}
+			tools[program] = true
+
+			path, err := osexec.LookPath(program)
+			if err != nil {
+				continue
+			}
+			t := tool{Name: program, Path: path}
+			t.Digest, _ = fileDigest(path)
+			p.Tools = append(p.Tools, t)
+		}
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0o644)
+}
+
+// fileDigest hashes a regular file
+func fileDigest(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// commandProgram is the program a command runs first, after make's
+// prefixes and any variable assignments
+func commandProgram(command string) string {
+	for _, word := range strings.Fields(strings.TrimLeft(command, "@-+ \t")) {
+		if !strings.Contains(word, "=") {
+			return word
+		}
+	}
+	return ""
+}
+
+func dedupeStrings(words []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			unique = append(unique, w)
+		}
+	}
+	return unique
+}
+
+// hmakeVersion is the module version hmake was built from
+func hmakeVersion() string {
+	if info, ok := buildinfo.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+const queryUsage = `usage: hmake query [-output text|json] deps <target>
+       hmake query [-output text|json] rdeps <target or file>
+       hmake query [-output text|json] path <from> <to>`
+
+func init() {
+	register(Command{
+		Name:  "query",
+		Usage: "Answer questions about the dependency graph",
+		Run:   runQuery,
+	})
+}
+
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), queryUsage) }
+	output := outputFlag(fs)
+	args = parseInterspersed(fs, args)
+	if len(args) < 2 {
+		return errors.New(queryUsage)
+	}
+	asJSON, err := wantJSON(*output)
+	if err != nil {
+		return err
+	}
+
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	if err := checkNodes(mf, args[1:]); err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "deps" && len(args) == 2:
+		return printSorted(graph.Deps(mf, args[1]), asJSON)
+
+	case args[0] == "rdeps" && len(args) == 2:
+		return printSorted(graph.ReverseDeps(mf, args[1]), asJSON)
+
+	case args[0] == "path" && len(args) == 3:
+		path := graph.Path(mf, args[1], args[2])
+		if path == nil {
+			return fmt.Errorf("%s does not depend on %s", args[1], args[2])
+		}
+		if asJSON {
+			return printJSON(os.Stdout, pathDocument{SchemaVersion: graph.SchemaVersion, Path: path})
+		}
+		fmt.Println(strings.Join(path, " -> "))
+
+	default:
+		return errors.New(queryUsage)
+	}
+
+	return nil
+}
+
+// checkNodes reports an error for the first name that is neither a target
+// nor a prerequisite, as files without rules can be asked about too
+func checkNodes(mf *makefile.Makefile, names []string) error {
+	nodes := map[string]bool{}
+	for _, node := range graph.Nodes(mf, nil) {
+		nodes[node.Name] = true
+	}
+	for _, name := range names {
+		if !nodes[name] {
+			msg := fmt.Sprintf("Not a target or prerequisite:  %s", name)
+			if suggestions := suggestTargets(mf, name); len(suggestions) > 0 {
+				msg += fmt.Sprintf("\nDid you mean '%s'?", strings.Join(suggestions, "' or '"))
+			}
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+func printSorted(names map[string]bool, asJSON bool) error {
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	if asJSON {
+		return printJSON(os.Stdout, namesDocument{SchemaVersion: graph.SchemaVersion, Targets: sorted})
+	}
+	for _, name := range sorted {
+		fmt.Println(name)
+	}
+	return nil
+}
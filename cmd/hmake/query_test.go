@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestQueryReverseDepsOfFile(t *testing.T) {
+	newProject(t, `
+app: main.o util.o
+	cc -o app main.o util.o
+main.o: main.c foo.h
+	cc -c main.c
+util.o: util.c
+	cc -c util.c
+`)
+
+	out := captureStdout(t, func() error { return runQuery([]string{"rdeps", "foo.h"}) })
+	if out != "app\nmain.o\n" {
+		t.Errorf("rdeps foo.h printed %q, want app and main.o", out)
+	}
+
+	if err := runQuery([]string{"rdeps", "nothing.h"}); err == nil {
+		t.Error("rdeps of a name the makefile doesn't have succeeded")
+	}
+}
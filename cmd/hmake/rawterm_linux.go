@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// The ioctls that get and set a terminal's settings
+const (
+	getTermios = syscall.TCGETS
+	setTermios = syscall.TCSETS
+)
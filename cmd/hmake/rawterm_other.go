@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw can't change the terminal's mode here, so targets are picked at
+// a prompt instead
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("no raw terminal mode on this system")
+}
+
+func terminalWidth(f *os.File) int {
+	return 80
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// junitReport collects the targets of a build as JUnit test cases, which
+// CI systems know how to show
+type junitReport struct {
+	mu      sync.Mutex
+	started time.Time
+	cases   []junitCase
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func newJUnitReport() *junitReport {
+	return &junitReport{started: time.Now()}
+}
+
+// add records what became of a target. A target not remade because of
+// another's failure is skipped rather than failed.
+func (r *junitReport) add(t makefile.Target, d time.Duration, err error) {
+	c := junitCase{
+		Name:      t.Name,
+		Classname: t.Pos.Filename,
+		File:      t.Pos.Filename,
+		Line:      t.Pos.Line,
+		Time:      seconds(d),
+	}
+
+	var notRemade *build.NotRemadeError
+	switch {
+	case errors.As(err, &notRemade) || errors.Is(err, context.Canceled):
+		c.Skipped = &junitMessage{Message: err.Error()}
+	case err != nil:
+		c.Failure = &junitMessage{Message: err.Error()}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cases = append(r.cases, c)
+}
+
+// write saves the report to filename
+func (r *junitReport) write(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	suite := junitSuite{
+		Name:      "hmake",
+		Tests:     len(r.cases),
+		Time:      seconds(time.Since(r.started)),
+		Timestamp: r.started.Format("2006-01-02T15:04:05"),
+		Cases:     r.cases,
+	}
+	for _, c := range r.cases {
+		if c.Failure != nil {
+			suite.Failures++
+		}
+		if c.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+
+	suites := junitSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append([]byte(xml.Header), append(data, '\n')...), 0o644)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// inGitHubActions is set when running as a GitHub Actions step
+var inGitHubActions = os.Getenv("GITHUB_ACTIONS") == "true"
+
+// annotate reports a failed target as a GitHub Actions error, which is
+// shown against the rule's line of the Makefile
+func annotate(t makefile.Target, err error) {
+	var notRemade *build.NotRemadeError
+	if !inGitHubActions || errors.As(err, &notRemade) || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	props := []string{"title=" + escapeProperty("hmake: "+t.Name)}
+	if t.Pos.Filename != "" {
+		props = append(props, "file="+escapeProperty(t.Pos.Filename), fmt.Sprintf("line=%d", t.Pos.Line))
+	}
+	fmt.Printf("::error %s::%s\n", strings.Join(props, ","), escapeData(err.Error()))
+}
+
+// escapeData and escapeProperty escape the parts of a workflow command as
+// GitHub Actions expects
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/cache"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// stateFile is where the results of previous builds are recorded
+var stateFile = filepath.Join(".hmake", "state.json")
+
+// buildState is the incremental build database: what hmake knows about each
+// target from the last time it was built
+type buildState struct {
+	Targets map[string]targetState `json:"targets"`
+
+	// fingerprint records the tools each recipe ran
+	fingerprint bool
+
+	// existed holds the files of targets that were there before their
+	// recipes ran, and weren't made by an earlier build
+	existed map[string]bool
+
+	// files is the file system the targets are built on
+	files vfs.FS
+}
+
+type targetState struct {
+	CommandHash string        `json:"command_hash"`
+	ToolHash    string        `json:"tool_hash,omitempty"`
+	Built       time.Time     `json:"built"`
+	Duration    time.Duration `json:"duration"`
+	ExitCode    int           `json:"exit_code"`
+
+	// Outputs are the files the recipe created, which hmake clean removes
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+func init() {
+	register(Command{
+		Name:  "state",
+		Usage: "Inspect or change the incremental build database",
+		Run:   runState,
+	})
+}
+
+const stateUsage = `usage: hmake state show [target...]
+       hmake state forget <target...>
+       hmake state clean`
+
+func runState(args []string) error {
+	if len(args) == 0 {
+		return errors.New(stateUsage)
+	}
+
+	if args[0] == "clean" {
+		err := os.Remove(stateFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "show":
+		names := args[1:]
+		if len(names) == 0 {
+			names = sortedKeys(state.Targets)
+		}
+
+		for _, name := range names {
+			ts, ok := state.Targets[name]
+			if !ok {
+				return fmt.Errorf("no state recorded for %s", name)
+			}
+			fmt.Printf("%s\n  built:    %s\n  duration: %s\n  exit:     %d\n  commands: %s\n",
+				name, ts.Built.Format(time.RFC3339), ts.Duration, ts.ExitCode, ts.CommandHash)
+		}
+		return nil
+
+	case "forget":
+		if len(args) < 2 {
+			return errors.New(stateUsage)
+		}
+
+		for _, name := range args[1:] {
+			delete(state.Targets, name)
+		}
+		return state.save()
+	}
+
+	return errors.New(stateUsage)
+}
+
+// loadState reads the build database, which is empty before the first build
+func loadState() (*buildState, error) {
+	state := &buildState{Targets: map[string]targetState{}, files: vfs.OS}
+
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("corrupt state file %s: %w", stateFile, err)
+	}
+	if state.Targets == nil {
+		state.Targets = map[string]targetState{}
+	}
+
+	return state, nil
+}
+
+func (s *buildState) save() error {
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file beside it and rename that into place, so that
+	// a build interrupted here leaves the last database whole
+	tmp, err := os.CreateTemp(filepath.Dir(stateFile), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), stateFile)
+}
+
+// saveAfterBuild saves the database as a build finishes, warning rather
+// than failing if it can't be written, as the build itself is done
+func (s *buildState) saveAfterBuild() {
+	if err := s.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "hmake: warning: could not save the build state: %s\n", err)
+	}
+}
+
+// starting notes which of t's files are there before its recipe runs, so
+// that files the build didn't create aren't recorded as its outputs
+func (s *buildState) starting(t makefile.Target) {
+	if s.existed == nil {
+		s.existed = map[string]bool{}
+	}
+	for _, name := range t.Files() {
+		if _, err := s.files.Stat(name); err == nil && !slices.Contains(s.Targets[t.Name].Outputs, name) {
+			s.existed[name] = true
+		}
+	}
+}
+
+// record notes the outcome of running a target's recipe
+func (s *buildState) record(t makefile.Target, duration time.Duration, err error) {
+	ts := targetState{
+		CommandHash: commandHash(t.UnexpandTempDir(t.Commands)),
+		Built:       time.Now(),
+		Duration:    duration,
+	}
+	for _, name := range t.Files() {
+		if _, err := s.files.Stat(name); err == nil && !s.existed[name] {
+			ts.Outputs = append(ts.Outputs, name)
+		}
+	}
+	if s.fingerprint {
+		ts.ToolHash = cache.ToolFingerprint(t.Commands)
+	}
+
+	var re *exec.RecipeError
+	if errors.As(err, &re) {
+		ts.ExitCode = re.ExitCode
+	}
+
+	s.Targets[t.Name] = ts
+}
+
+// toolsChanged reports whether the programs t's recipe runs have changed
+// since it was last built
+func (s *buildState) toolsChanged(t makefile.Target) bool {
+	recorded := s.Targets[t.Name].ToolHash
+	return s.fingerprint && recorded != "" && recorded != cache.ToolFingerprint(t.Commands)
+}
+
+// durations returns how long each target's recipe took when last run, for
+// the scheduler to start the slowest chains of targets first
+func (s *buildState) durations() map[string]time.Duration {
+	durations := make(map[string]time.Duration, len(s.Targets))
+	for name, ts := range s.Targets {
+		if ts.Duration > 0 {
+			durations[name] = ts.Duration
+		}
+	}
+	return durations
+}
+
+// commandHash identifies a recipe so a change to it can be detected
+func commandHash(commands []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(commands, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+func TestStateSave(t *testing.T) {
+	newProject(t, "all:\n")
+
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Targets["all"] = targetState{CommandHash: "one"}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	state.Targets["all"] = targetState{CommandHash: "two"}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.Targets["all"].CommandHash; got != "two" {
+		t.Errorf("saved state has command hash %q, want two", got)
+	}
+
+	// Nothing but the database is left behind
+	entries, err := os.ReadDir(filepath.Dir(stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(stateFile) {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf(".hmake holds %v, want only the state file", names)
+	}
+}
+
+// TestStateOutputs checks that the files a recipe made are found on the
+// build's file system, not the one hmake runs in
+func TestStateOutputs(t *testing.T) {
+	files := fstest.MapFS{"gen.h": {}}
+	state := &buildState{Targets: map[string]targetState{}, files: vfs.FromFS(files)}
+	target := makefile.Target{Name: "gen.c", Outputs: []string{"gen.h"}, Commands: []string{"./gen"}}
+
+	state.starting(target)
+	files["gen.c"] = &fstest.MapFile{}
+	state.record(target, 0, nil)
+
+	if outputs := state.Targets["gen.c"].Outputs; !slices.Equal(outputs, []string{"gen.c"}) {
+		t.Errorf("recorded outputs %v, want only gen.c, as gen.h was there before", outputs)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// suggestTargets returns the known targets closest to a mistyped name,
+// best match first
+func suggestTargets(mf *makefile.Makefile, name string) []string {
+	// Allow roughly one typo for every three characters
+	limit := max(1, len(name)/3)
+
+	type candidate struct {
+		name     string
+		distance int
+	}
+
+	candidates := []candidate{}
+	for target := range mf.Targets {
+		if makefile.IsSpecialTarget(target) || makefile.IsPatternRule(target) {
+			continue
+		}
+
+		d := editDistance(strings.ToLower(name), strings.ToLower(target))
+		if d <= limit {
+			candidates = append(candidates, candidate{target, d})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+
+	return suggestions
+}
+
+// editDistance computes the edit distance between a and b, counting a
+// swap of two adjacent characters as a single edit
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(ra)][len(rb)]
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// summarySlowest is how many of the slowest targets the summary names
+const summarySlowest = 3
+
+// buildSummary counts what became of the targets of a build, for the
+// summary printed at its end
+type buildSummary struct {
+	mu      sync.Mutex
+	started time.Time
+
+	// cpu is the CPU time children had used before the build
+	cpu time.Duration
+
+	built, restored, upToDate, failed, skipped, interrupted int
+
+	durations map[string]time.Duration
+
+	// failures are the targets that failed, in the order they did, each
+	// with its recipe's exit code if it had one
+	failures []failure
+}
+
+// failure is a target that failed, with the exit code of its recipe, or -1
+// if it failed otherwise
+type failure struct {
+	target   string
+	exitCode int
+}
+
+func newBuildSummary() *buildSummary {
+	cpu, _ := childCPUTime()
+	return &buildSummary{started: time.Now(), cpu: cpu, durations: map[string]time.Duration{}}
+}
+
+// restore notes that t was taken from the cache
+func (s *buildSummary) restore(t makefile.Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restored++
+}
+
+// add notes how t's recipe went
+func (s *buildSummary) add(t makefile.Target, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var notRemade *build.NotRemadeError
+	var missing *build.MissingError
+	switch {
+	case err == nil:
+		s.built++
+		if len(t.Commands) > 0 {
+			s.durations[t.Name] = d
+		}
+	case errors.As(err, &notRemade):
+		s.skipped++
+	case errors.Is(err, context.Canceled):
+		s.interrupted++
+	default:
+		s.failed++
+		if !errors.As(err, &missing) {
+			s.durations[t.Name] = d
+		}
+		f := failure{target: t.Name, exitCode: -1}
+		var recipe *exec.RecipeError
+		if errors.As(err, &recipe) {
+			f.exitCode = recipe.ExitCode
+		}
+		s.failures = append(s.failures, f)
+	}
+}
+
+// upToDateTarget notes that a target didn't need remaking
+func (s *buildSummary) upToDateTarget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upToDate++
+}
+
+// ran reports whether any recipe ran or failed
+func (s *buildSummary) ran() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.built+s.failed+s.interrupted > 0
+}
+
+// String is the summary, a few lines long
+func (s *buildSummary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Targets restored from the cache are counted as built too
+	counts := []string{fmt.Sprintf("%d built", s.built-s.restored)}
+	for _, c := range []struct {
+		n    int
+		what string
+	}{
+		{s.restored, "from the cache"},
+		{s.upToDate, "up to date"},
+		{s.failed, "failed"},
+		{s.skipped, "not remade"},
+		{s.interrupted, "interrupted"},
+	} {
+		if c.n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", c.n, c.what))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Summary: %s\n", strings.Join(counts, ", "))
+
+	fmt.Fprintf(&b, "  Time:    %s wall", round(time.Since(s.started)))
+	if cpu, ok := childCPUTime(); ok {
+		fmt.Fprintf(&b, ", %s CPU", round(cpu-s.cpu))
+	}
+	b.WriteString("\n")
+
+	names := make([]string, 0, len(s.durations))
+	for name := range s.durations {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if s.durations[names[i]] != s.durations[names[j]] {
+			return s.durations[names[i]] > s.durations[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > summarySlowest {
+		names = names[:summarySlowest]
+	}
+	if len(names) > 0 {
+		slowest := make([]string, len(names))
+		for i, name := range names {
+			slowest[i] = fmt.Sprintf("%s %s", name, round(s.durations[name]))
+		}
+		fmt.Fprintf(&b, "  Slowest: %s\n", strings.Join(slowest, ", "))
+	}
+
+	if len(s.failures) > 0 {
+		failed := make([]string, len(s.failures))
+		for i, f := range s.failures {
+			failed[i] = f.target
+			if f.exitCode >= 0 {
+				failed[i] += fmt.Sprintf(" (exit %d)", f.exitCode)
+			}
+		}
+		fmt.Fprintf(&b, "  Failed:  %s\n", strings.Join(failed, ", "))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
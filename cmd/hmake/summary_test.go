@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+func TestSummaryFailures(t *testing.T) {
+	s := newBuildSummary()
+	s.add(makefile.Target{Name: "lib"}, 0, nil)
+	s.add(makefile.Target{Name: "test", Commands: []string{"false"}}, 0, &exec.RecipeError{Target: "test", ExitCode: 2})
+	s.add(makefile.Target{Name: "docs"}, 0, &build.MissingError{Prerequisite: "docs.md", NeededBy: "docs"})
+	s.add(makefile.Target{Name: "all"}, 0, &build.NotRemadeError{Target: "all"})
+	s.add(makefile.Target{Name: "lint"}, 0, errors.Join(errors.New("lint"), &exec.RecipeError{Target: "lint", ExitCode: 1}))
+
+	summary := s.String()
+	if !strings.Contains(summary, "\n  Failed:  test (exit 2), docs, lint (exit 1)") {
+		t.Errorf("summary doesn't list the failures with their exit codes:\n%s", summary)
+	}
+	if !strings.HasPrefix(summary, "Summary: 1 built, 3 failed, 1 not remade\n") {
+		t.Errorf("summary counts the targets wrong:\n%s", summary)
+	}
+}
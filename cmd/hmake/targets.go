@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+type listOptions struct {
+	noFiles    bool
+	noPatterns bool
+	asJSON     bool
+}
+
+func init() {
+	register(Command{
+		Name:  "targets",
+		Usage: "List the targets that can be built",
+		Run:   runTargets,
+	})
+}
+
+func runTargets(args []string) error {
+	fs := flag.NewFlagSet("targets", flag.ExitOnError)
+	noFiles := fs.Bool("no-files", false, "Hide targets that name files")
+	noPatterns := fs.Bool("no-patterns", false, "Hide pattern rules")
+	output := outputFlag(fs)
+	fs.Parse(args)
+
+	asJSON, err := wantJSON(*output)
+	if err != nil {
+		return err
+	}
+	mf, err := loadMakefile()
+	if err != nil {
+		return err
+	}
+
+	return listTargets(os.Stdout, mf, listOptions{noFiles: *noFiles, noPatterns: *noPatterns, asJSON: asJSON})
+}
+
+// listTargets prints the buildable targets, one per line, followed by the
+// description taken from their "## comment" if they have one, or with
+// asJSON a targetsDocument
+func listTargets(w io.Writer, mf *makefile.Makefile, opts listOptions) error {
+	names := []string{}
+	for name := range mf.Targets {
+		if makefile.IsSpecialTarget(name) {
+			continue
+		}
+
+		if opts.noPatterns && makefile.IsPatternRule(name) {
+			continue
+		}
+
+		if opts.noFiles && mf.IsFileTarget(name) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if opts.asJSON {
+		doc := targetsDocument{SchemaVersion: graph.SchemaVersion, Targets: []targetInfo{}}
+		for _, name := range names {
+			doc.Targets = append(doc.Targets, targetInfo{Name: name, Description: mf.Targets[name].Description, Phony: mf.Phony[name]})
+		}
+		return printJSON(w, doc)
+	}
+	for _, name := range names {
+		if desc := mf.Targets[name].Description; desc != "" {
+			fmt.Fprintf(w, "%s\t%s\n", name, desc)
+		} else {
+			fmt.Fprintln(w, name)
+		}
+	}
+	return nil
+}
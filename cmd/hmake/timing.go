@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// slowestTargets is how many targets the timing report lists as slowest
+const slowestTargets = 10
+
+// timingReport records when each target of a build ran, to tell afterwards
+// what held the build up, for --timing and --timing-report
+type timingReport struct {
+	mu      sync.Mutex
+	mf      *makefile.Makefile
+	order   []string
+	jobs    int
+	started time.Time
+
+	targets map[string]*targetTiming
+
+	// busy is how long each job was running a recipe, and lanes which of
+	// them are running one now
+	busy  []time.Duration
+	lanes []bool
+}
+
+type targetTiming struct {
+	start    time.Time
+	duration time.Duration
+	lane     int
+}
+
+func newTimingReport(mf *makefile.Makefile, order []string, jobs int) *timingReport {
+	return &timingReport{mf: mf, order: order, jobs: jobs, started: time.Now(), targets: map[string]*targetTiming{}}
+}
+
+// start records that t's recipe started, on the first job free
+func (r *timingReport) start(t makefile.Target) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lane := len(r.lanes)
+	for i, taken := range r.lanes {
+		if !taken {
+			lane = i
+			break
+		}
+	}
+	if lane == len(r.lanes) {
+		r.lanes = append(r.lanes, false)
+		r.busy = append(r.busy, 0)
+	}
+	r.lanes[lane] = true
+	r.targets[t.Name] = &targetTiming{start: time.Now(), lane: lane}
+}
+
+// finish records that t's recipe took d
+func (r *timingReport) finish(t makefile.Target, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tt := r.targets[t.Name]
+	if tt == nil {
+		return
+	}
+	tt.duration = d
+	r.lanes[tt.lane] = false
+	r.busy[tt.lane] += d
+}
+
+// criticalPath returns the chain of targets, each depending on the one
+// before, whose recipes took longest altogether. Nothing else could start
+// the last of them sooner, however many jobs there were.
+func (r *timingReport) criticalPath() ([]string, time.Duration) {
+	// order has each target after what it depends on
+	longest := map[string]time.Duration{}
+	via := map[string]string{}
+	for _, name := range r.order {
+		var before time.Duration
+		for _, dep := range r.mf.Targets[name].Dependencies {
+			if d, ok := longest[dep]; ok && (d > before || via[name] == "") {
+				before, via[name] = d, dep
+			}
+		}
+		longest[name] = before + r.duration(name)
+	}
+
+	end := ""
+	for _, name := range r.order {
+		if end == "" || longest[name] > longest[end] {
+			end = name
+		}
+	}
+
+	path := []string{}
+	for name := end; name != ""; name = via[name] {
+		if len(r.mf.Targets[name].Commands) > 0 {
+			path = append([]string{name}, path...)
+		}
+	}
+	return path, longest[end]
+}
+
+// duration is how long name's recipe took, nothing if it wasn't run
+func (r *timingReport) duration(name string) time.Duration {
+	if tt := r.targets[name]; tt != nil {
+		return tt.duration
+	}
+	return 0
+}
+
+// write writes the report of the build that ended at end
+func (r *timingReport) write(w io.Writer, end time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wall := end.Sub(r.started)
+	var work time.Duration
+	ran := []string{}
+	for _, name := range r.order {
+		if tt := r.targets[name]; tt != nil && len(r.mf.Targets[name].Commands) > 0 {
+			work += tt.duration
+			ran = append(ran, name)
+		}
+	}
+
+	fmt.Fprintf(w, "Timing: %s of recipes in %s with -j%d\n", round(work), round(wall), r.jobs)
+	if len(ran) == 0 {
+		fmt.Fprintln(w, "  No recipes were run.")
+		return
+	}
+
+	path, length := r.criticalPath()
+	fmt.Fprintf(w, "\nCritical path (%s):\n", round(length))
+	for _, name := range path {
+		fmt.Fprintf(w, "  %8s  %s\n", round(r.duration(name)), name)
+	}
+
+	sort.SliceStable(ran, func(i, j int) bool { return r.duration(ran[i]) > r.duration(ran[j]) })
+	if len(ran) > slowestTargets {
+		ran = ran[:slowestTargets]
+	}
+	fmt.Fprintln(w, "\nSlowest targets:")
+	for _, name := range ran {
+		fmt.Fprintf(w, "  %8s  %s\n", round(r.duration(name)), name)
+	}
+
+	fmt.Fprintln(w, "\nJob utilization:")
+	for i, busy := range r.busy {
+		fmt.Fprintf(w, "  job %-3d %3.0f%%  %s\n", i+1, percent(busy, wall), strings.Repeat("#", int(percent(busy, wall)/5)))
+	}
+	for i := len(r.busy); i < r.jobs; i++ {
+		fmt.Fprintf(w, "  job %-3d   0%%\n", i+1)
+	}
+
+	if hints := r.suggestions(work, length, wall); len(hints) > 0 {
+		fmt.Fprintln(w, "\nSuggestions:")
+		for _, hint := range hints {
+			fmt.Fprintf(w, "  %s\n", hint)
+		}
+	}
+}
+
+// suggestions says what would make the build faster, from how much work it
+// did, its critical path and how long it took
+func (r *timingReport) suggestions(work, critical, wall time.Duration) []string {
+	if critical <= 0 || wall <= 0 {
+		return nil
+	}
+
+	hints := []string{}
+
+	// However many jobs there are, the build takes at least as long as its
+	// critical path, so no more of them are needed than would fit the
+	// work into it
+	useful := int(math.Ceil(float64(work) / float64(critical)))
+	switch {
+	case useful < r.jobs:
+		hints = append(hints, fmt.Sprintf("increasing -j beyond %d won't help: the critical path alone takes %s", useful, round(critical)))
+	case percent(critical, wall) < 75 && r.jobs < useful:
+		hints = append(hints, fmt.Sprintf("the critical path takes %s of %s; up to -j%d could make the build faster", round(critical), round(wall), useful))
+	}
+
+	if path, _ := r.criticalPath(); len(path) > 0 && percent(critical, wall) >= 75 {
+		slowest := path[0]
+		for _, name := range path {
+			if r.duration(name) > r.duration(slowest) {
+				slowest = name
+			}
+		}
+		hints = append(hints, fmt.Sprintf("the build is as fast as its critical path allows; speeding up %s (%s) or splitting it would help most", slowest, round(r.duration(slowest))))
+	}
+	return hints
+}
+
+// writeFile writes the report to name
+func (r *timingReport) writeFile(name string, end time.Time) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	r.write(f, end)
+	return f.Close()
+}
+
+func percent(part, whole time.Duration) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return math.Min(100, 100*float64(part)/float64(whole))
+}
+
+// round shortens d for reading
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Minute:
+		return d.Round(time.Second)
+	case d >= time.Second:
+		return d.Round(100 * time.Millisecond)
+	default:
+		return d.Round(time.Millisecond)
+	}
+}
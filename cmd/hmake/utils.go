@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/archive"
+)
+
+// utility is a portable file command run as "hmake -- name args...", so
+// recipes needn't depend on the differences between GNU, BSD and Windows
+// tools
+type utility struct {
+	usage string
+
+	// flags are the single letter options it takes, which may be combined
+	// as in "rm -rf"
+	flags string
+
+	run func(flags map[rune]bool, args []string) error
+}
+
+var utilities = map[string]utility{
+	"archive": {usage: "archive <out.tar.gz|out.tgz|out.tar|out.zip> [file...]", run: archiveUtility},
+	"cp":      {usage: "cp [-r] <source...> <destination>", flags: "r", run: cpUtility},
+	"mkdir":   {usage: "mkdir [-p] <dir...>", flags: "p", run: mkdirUtility},
+	"rm":      {usage: "rm [-rf] <file...>", flags: "rf", run: rmUtility},
+	"sha256":  {usage: "sha256 <file...>", run: sha256Utility},
+	"touch":   {usage: "touch <file...>", run: touchUtility},
+}
+
+// runUtility runs "hmake -- name args...", returning the exit code
+func runUtility(args []string) int {
+	if len(args) == 0 {
+		printUtilityUsage()
+		return exitError
+	}
+
+	u, ok := utilities[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "hmake --: unknown command %s\n", args[0])
+		printUtilityUsage()
+		return exitError
+	}
+
+	flags, rest, err := utilityFlags(args[1:], u.flags)
+	if err == nil {
+		err = u.run(flags, rest)
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "usage: hmake -- %s\n", u.usage)
+		return exitError
+	}
+	if err != nil {
+		// Failing as the commands they stand in for do
+		fmt.Fprintf(os.Stderr, "hmake -- %s: %s\n", args[0], err)
+		return 1
+	}
+	return exitOK
+}
+
+var errUsage = errors.New("usage")
+
+func printUtilityUsage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, name := range sortedKeys(utilities) {
+		fmt.Fprintf(os.Stderr, "  hmake -- %s\n", utilities[name].usage)
+	}
+}
+
+// utilityFlags takes the leading options that are among allowed
+func utilityFlags(args []string, allowed string) (map[rune]bool, []string, error) {
+	flags := map[rune]bool{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			if !strings.ContainsRune(allowed, c) {
+				return nil, nil, errUsage
+			}
+			flags[c] = true
+		}
+	}
+	return flags, args, nil
+}
+
+func archiveUtility(flags map[rune]bool, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	return archive.Create(args[0], args[1:])
+}
+
+// cpUtility copies files, keeping their permissions. With several sources,
+// or a destination that is a directory, they're copied into it.
+func cpUtility(flags map[rune]bool, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+
+	info, err := os.Stat(dest)
+	intoDir := err == nil && info.IsDir()
+	if len(sources) > 1 && !intoDir {
+		return fmt.Errorf("%s is not a directory", dest)
+	}
+
+	for _, source := range sources {
+		target := dest
+		if intoDir {
+			target = filepath.Join(dest, filepath.Base(source))
+		}
+		if err := copyPath(source, target, flags['r']); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyPath(source, target string, recursive bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyRegular(source, target, info.Mode().Perm())
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory (not copied without -r)", source)
+	}
+	if within(target, source) {
+		return fmt.Errorf("cannot copy %s into itself, %s", source, target)
+	}
+
+	return filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		to := filepath.Join(target, rel)
+		if d.IsDir() {
+			return os.MkdirAll(to, info.Mode().Perm()|0o700)
+		}
+		return copyRegular(path, to, info.Mode().Perm())
+	})
+}
+
+// within reports whether path is dir or inside it
+func within(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// copyRegular copies a file, failing rather than truncating it if source
+// and target are the same file, by the same name or another
+func copyRegular(source, target string, perm fs.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if to, err := os.Stat(target); err == nil {
+		if from, err := in.Stat(); err == nil && os.SameFile(from, to) {
+			return fmt.Errorf("%s and %s are the same file", source, target)
+		}
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(target, perm)
+}
+
+func mkdirUtility(flags map[rune]bool, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, dir := range args {
+		mkdir := os.Mkdir
+		if flags['p'] {
+			mkdir = os.MkdirAll
+		}
+		if err := mkdir(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rmUtility removes files, and directories with -r. With -f files that
+// don't exist aren't an error.
+func rmUtility(flags map[rune]bool, args []string) error {
+	if len(args) == 0 && !flags['f'] {
+		return errUsage
+	}
+	for _, name := range args {
+		info, err := os.Lstat(name)
+		if errors.Is(err, fs.ErrNotExist) && flags['f'] {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if !flags['r'] {
+				return fmt.Errorf("%s is a directory (not removed without -r)", name)
+			}
+			err = os.RemoveAll(name)
+		} else {
+			err = os.Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sha256Utility prints the digest of each file in the form sha256sum uses
+func sha256Utility(flags map[rune]bool, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, name := range args {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	}
+	return nil
+}
+
+// touchUtility creates files, or updates their modification times
+func touchUtility(flags map[rune]bool, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	now := time.Now()
+	for _, name := range args {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := os.Chtimes(name, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
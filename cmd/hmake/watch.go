@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+const (
+	// watchInterval is how often watched files are looked at
+	watchInterval = 300 * time.Millisecond
+
+	// watchDebounce is how long files must stay unchanged before a rebuild
+	// starts, so that saving several files at once rebuilds once
+	watchDebounce = 200 * time.Millisecond
+)
+
+// watch builds the goals, then builds them again whenever a file they
+// depend on changes, until ctx is done. Files matching --watch-ignore are
+// not watched. The makefile is read again when it changes.
+//
+// Services among the goals aren't built but started once what they depend
+// on has been, and restarted when a file they depend on changes.
+func watch(ctx context.Context, mf *makefile.Makefile, goals []string, args MakeArgs) {
+	services := map[string]*service{}
+	defer func() {
+		for _, s := range services {
+			s.stop()
+		}
+	}()
+
+	changed := ""
+	for {
+		err := runBuild(ctx, mf, buildGoals(mf, goals), args.buildOptions)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			events.emit(event{Event: "build_finish", Error: err.Error()})
+		} else {
+			events.emit(event{Event: "build_finish"})
+		}
+		if err != nil && !args.keepGoing {
+			printError("hmake: *** ", err)
+		}
+
+		// A service keeps running as it was until its build succeeds
+		for _, name := range goals {
+			if !mf.Services[name] || err != nil {
+				continue
+			}
+			s := services[name]
+			if s != nil && !s.exited() && !isMakefile(mf, changed) && !graph.Deps(mf, name)[changed] {
+				continue
+			}
+			if s != nil {
+				fmt.Printf("hmake: restarting %s\n", name)
+				s.stop()
+			}
+			services[name] = startService(ctx, mf, mf.Targets[name])
+		}
+
+		files := watchedFiles(mf, goals, args.watchIgnore)
+		fmt.Printf("hmake: watching %d files for changes (Ctrl-C to stop)\n", len(files))
+		changed, err = waitForChange(ctx, files)
+		if err != nil {
+			return
+		}
+		fmt.Printf("hmake: rebuild triggered by %s\n", changed)
+
+		if isMakefile(mf, changed) {
+			reloaded, err := loadProfiled(args.profiles, args.Profiles)
+			if err == nil {
+				err = checkGoals(reloaded, goals)
+			}
+			if err != nil {
+				// Keep building with the makefile as it was until it's fixed
+				printError(err)
+				continue
+			}
+			mf = reloaded
+		}
+	}
+}
+
+// buildGoals returns the goals to build in place of goals: the services
+// among them are replaced by what they depend on
+func buildGoals(mf *makefile.Makefile, goals []string) []string {
+	build := []string{}
+	for _, name := range goals {
+		if mf.Services[name] {
+			build = append(build, mf.Targets[name].Dependencies...)
+		} else {
+			build = append(build, name)
+		}
+	}
+	return build
+}
+
+// service is the running recipe of a service target
+type service struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startService runs t's recipe in the background, its output labelled with
+// its name
+func startService(ctx context.Context, mf *makefile.Makefile, t makefile.Target) *service {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &service{cancel: cancel, done: make(chan struct{})}
+	t.Commands = mf.ExpandRecipeContext(ctx, t)
+	redact := build.NewRedactor(mf)
+	t.Env = redact.Env(t.Env)
+
+	go func() {
+		defer close(s.done)
+		// The whole service is stopped, not just the shell running it
+		r := *runner
+		r.Executor = &exec.Local{Shell: runner.Shell, Group: true}
+		stdout, stderr := redact.Writer(newPrefixWriter(os.Stdout, t.Name)), redact.Writer(newPrefixWriter(os.Stderr, t.Name))
+		err := r.RunContext(ctx, t, stdout, stderr)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			printError("hmake: *** ", err)
+		}
+		fmt.Printf("hmake: %s exited; it's started again on the next change\n", t.Name)
+	}()
+	return s
+}
+
+// exited reports whether the service's recipe has finished by itself
+func (s *service) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop interrupts the service and waits for it to exit
+func (s *service) stop() {
+	s.cancel()
+	<-s.done
+}
+
+// watchedFiles returns the makefile and the files the goals depend on that
+// no recipe makes, sorted
+func watchedFiles(mf *makefile.Makefile, goals []string, ignore []string) []string {
+	seen := map[string]bool{makefilePath(): true}
+	for _, file := range mf.Included {
+		seen[file] = true
+	}
+	for _, goal := range goals {
+		for dep := range graph.Deps(mf, goal) {
+			t, ok := mf.Targets[dep]
+			if ok && (len(t.Commands) > 0 || len(t.Dependencies) > 0 || t.Fetch != nil || mf.Phony[dep]) {
+				continue
+			}
+			if !ignored(dep, ignore) {
+				seen[dep] = true
+			}
+		}
+	}
+
+	files := make([]string, 0, len(seen))
+	for name := range seen {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// isMakefile reports whether file is the makefile or one it includes
+func isMakefile(mf *makefile.Makefile, file string) bool {
+	same := func(included string) bool { return makefile.SamePath(included, file) }
+	return same(makefilePath()) || slices.ContainsFunc(mf.Included, same)
+}
+
+// ignored reports whether name matches one of the patterns, by its path or
+// its base name
+func ignored(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(name)); ok {
+			return true
+		}
+		if dir := strings.TrimSuffix(pattern, "/"); dir != pattern && strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fileVersion is what tells whether a file has changed
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func snapshot(files []string) map[string]fileVersion {
+	versions := make(map[string]fileVersion, len(files))
+	for _, name := range files {
+		if info, err := os.Stat(name); err == nil {
+			versions[name] = fileVersion{modTime: info.ModTime(), size: info.Size(), exists: true}
+		} else {
+			versions[name] = fileVersion{}
+		}
+	}
+	return versions
+}
+
+// waitForChange polls the files until one changes and then they all stay
+// unchanged for watchDebounce, returning the first that changed. It
+// returns ctx's error once ctx is done.
+func waitForChange(ctx context.Context, files []string) (string, error) {
+	before := snapshot(files)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	changed := ""
+	for changed == "" {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+
+		now := snapshot(files)
+		for _, name := range files {
+			if now[name] != before[name] {
+				changed = name
+				break
+			}
+		}
+		before = now
+	}
+
+	// Wait for the burst of changes to end
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(watchDebounce):
+		}
+
+		now := snapshot(files)
+		if equalVersions(now, before) {
+			return changed, nil
+		}
+		before = now
+	}
+}
+
+func equalVersions(a, b map[string]fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, v := range a {
+		if b[name] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+const whyUsage = `usage: hmake why [target...]
+
+Explains, without building anything, whether each target is up to date,
+and if not everything that makes it out of date, decided as a build
+would decide it: a missing file or output, a prerequisite that's newer or
+must itself be remade, or a change to the programs its recipe runs. Each
+prerequisite that must be remade is explained in turn. A change to a
+recipe since it was last built is noted too, though it doesn't make the
+target out of date. With no targets the default goal is explained.`
+
+func init() {
+	register(Command{
+		Name:  "why",
+		Usage: "Explain why targets are out of date, without building them",
+		Run:   runWhy,
+	})
+}
+
+func runWhy(args []string) error {
+	fs := flag.NewFlagSet("why", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), whyUsage) }
+
+	mf, goals, err := loadGoals(parseInterspersed(fs, args))
+	if err != nil {
+		return err
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	state.fingerprint = true
+
+	newExplainer(mf, state).explain(os.Stdout, goals)
+	return nil
+}
+
+// explainer works out why targets must be remade
+type explainer struct {
+	mf      *makefile.Makefile
+	state   *buildState
+	checker *graph.Checker
+
+	// remade holds whether each target looked at would be remade
+	remade map[string]bool
+}
+
+func newExplainer(mf *makefile.Makefile, state *buildState) *explainer {
+	return &explainer{mf: mf, state: state, checker: graph.NewChecker(mf), remade: map[string]bool{}}
+}
+
+// explain writes why each of the goals, and then each prerequisite found
+// to need remaking, is out of date, each once
+func (x *explainer) explain(w io.Writer, goals []string) {
+	queue := append([]string{}, goals...)
+	explained := map[string]bool{}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if explained[name] {
+			continue
+		}
+		explained[name] = true
+
+		t := x.mf.ReferTempDir(x.mf.Targets[name])
+		t.Commands = x.mf.ExpandRecipe(t)
+		if !x.wouldRemake(name) {
+			fmt.Fprintf(w, "%s is up to date\n", name)
+			x.recipeChanged(w, t)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s must be remade:\n", name)
+		stale := map[string]bool{}
+		for _, r := range x.checker.Reasons(name) {
+			if r.Cause == graph.StalePrerequisite {
+				stale[r.File] = true
+			}
+			x.reason(w, r)
+		}
+
+		// A prerequisite remade for its tools isn't one the checker knows
+		for _, dep := range t.Dependencies {
+			if !stale[dep] && x.wouldRemake(dep) {
+				stale[dep] = true
+				x.reason(w, graph.Reason{Cause: graph.StalePrerequisite, File: dep})
+			}
+		}
+		if x.state.toolsChanged(t) {
+			fmt.Fprintln(w, "  the programs its recipe runs have changed since it was last built")
+		}
+		x.recipeChanged(w, t)
+
+		for _, dep := range t.Dependencies {
+			if _, hasRule := x.mf.Targets[dep]; stale[dep] && hasRule {
+				queue = append(queue, dep)
+			}
+		}
+	}
+}
+
+// wouldRemake reports whether a build would remake name: if the checker
+// finds it out of date, or the programs its recipe runs, or those of its
+// prerequisites, have changed
+func (x *explainer) wouldRemake(name string) bool {
+	if remade, ok := x.remade[name]; ok {
+		return remade
+	}
+	x.remade[name] = false
+
+	t, ok := x.mf.Targets[name]
+	remade := x.checker.Stale(name)
+	if ok && !remade {
+		t.Commands = x.mf.ExpandRecipe(t)
+		remade = x.state.toolsChanged(t)
+	}
+	for _, dep := range t.Dependencies {
+		if remade {
+			break
+		}
+		remade = x.wouldRemake(dep)
+	}
+	x.remade[name] = remade
+	return remade
+}
+
+func (x *explainer) reason(w io.Writer, r graph.Reason) {
+	switch r.Cause {
+	case graph.PhonyTarget:
+		fmt.Fprintln(w, "  it's phony, so is always remade")
+	case graph.MissingFile:
+		fmt.Fprintln(w, "  it doesn't exist")
+	case graph.MissingOutput:
+		fmt.Fprintf(w, "  its output %s doesn't exist\n", r.File)
+	case graph.ChecksumMismatch:
+		fmt.Fprintln(w, "  its file doesn't have the checksum given for the download")
+	case graph.NewerPrerequisite:
+		fmt.Fprintf(w, "  its prerequisite %s is newer\n", r.File)
+	case graph.StalePrerequisite:
+		if _, hasRule := x.mf.Targets[r.File]; !hasRule {
+			fmt.Fprintf(w, "  its prerequisite %s doesn't exist and there's no rule to make it, so the build would fail\n", r.File)
+		} else {
+			fmt.Fprintf(w, "  its prerequisite %s must be remade\n", r.File)
+		}
+	}
+}
+
+// recipeChanged notes a recipe that's not what it was when last built
+func (x *explainer) recipeChanged(w io.Writer, t makefile.Target) {
+	if ts, ok := x.state.Targets[t.Name]; ok && ts.CommandHash != commandHash(t.Commands) {
+		fmt.Fprintln(w, "  its recipe has changed since it was last built, though that alone doesn't remake it")
+	}
+}
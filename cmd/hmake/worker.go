@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hookenz/hmake/pkg/worker"
+)
+
+const workerUsage = `usage: hmake serve-worker [-addr :7071] [-dir dir]
+
+Runs the commands of builds started elsewhere with --distribute=hosts.txt,
+in scratch directories under dir. Anyone who can reach the address can
+run commands, so set HMAKE_WORKER_TOKEN, to the same value on every
+machine, or keep workers on a trusted network.`
+
+func init() {
+	register(Command{
+		Name:  "serve-worker",
+		Usage: "Run commands for builds distributed from other machines",
+		Run:   runServeWorker,
+	})
+}
+
+func runServeWorker(args []string) error {
+	fs := flag.NewFlagSet("serve-worker", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), workerUsage) }
+	addr := fs.String("addr", ":7071", "Address to listen on")
+	dir := fs.String("dir", defaultWorkerDir(), "Directory for the files sent and the commands' scratch directories")
+	fs.Parse(args)
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: &worker.Server{Dir: *dir, Shell: runner.Shell, Token: os.Getenv("HMAKE_WORKER_TOKEN")}}
+	ctx, stop := interruptible()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	fmt.Printf("hmake: worker listening on %s\n", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func defaultWorkerDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "hmake", "worker")
+	}
+	return filepath.Join(os.TempDir(), "hmake-worker")
+}
@@ -0,0 +1,4 @@
+# $@, $< and $^ name the target and its prerequisites
+# files: a b
+all: a b a
+	@echo "$@ $< $^ $+"
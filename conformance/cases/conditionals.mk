@@ -0,0 +1,14 @@
+# ifeq and ifdef choose lines of the makefile
+A = yes
+ifeq ($(A),yes)
+B = equal
+else
+B = different
+endif
+ifdef UNSET
+C = defined
+else
+C = undefined
+endif
+all:
+	@echo $(B) $(C)
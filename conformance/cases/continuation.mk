@@ -0,0 +1,6 @@
+# Backslash newline continues a line
+A = one \
+    two
+all:
+	@echo $(A) \
+	  three
@@ -0,0 +1,6 @@
+# .DEFAULT_GOAL picks the default goal
+.DEFAULT_GOAL := second
+first:
+	@echo first
+second:
+	@echo second
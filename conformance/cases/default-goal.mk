@@ -0,0 +1,5 @@
+# The first target is the default goal
+first:
+	@echo first
+second:
+	@echo second
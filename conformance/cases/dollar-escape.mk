@@ -0,0 +1,3 @@
+# $$ is a dollar for the shell
+all:
+	@X=shell; echo $$X
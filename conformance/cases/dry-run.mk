@@ -0,0 +1,5 @@
+# -n prints the commands without running them
+# args: -n
+all:
+	@echo hidden
+	touch file
@@ -0,0 +1,4 @@
+# Commands are echoed unless they start with @
+all:
+	echo loud
+	@echo quiet
@@ -0,0 +1,5 @@
+# A failing command stops the build with status 2
+all:
+	@echo before
+	@false
+	@echo after
@@ -0,0 +1,4 @@
+# if, filter and filter-out choose text
+L = a.c b.h c.c
+all:
+	@echo $(if $(L),yes,no) $(if $(EMPTY),yes,no) $(filter %.c,$(L)) $(filter-out %.c,$(L))
@@ -0,0 +1,4 @@
+# words, word and filter pick from lists
+L = a.c b.h c.c
+all:
+	@echo $(words $(L)) $(word 2,$(L)) $(filter %.c,$(L))
@@ -0,0 +1,3 @@
+# subst and patsubst replace text
+all:
+	@echo $(subst a,o,banana) $(patsubst %.c,%.o,x.c y.c)
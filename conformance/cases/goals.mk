@@ -0,0 +1,6 @@
+# Goals on the command line are made in order
+# args: b a
+a:
+	@echo a
+b:
+	@echo b
@@ -0,0 +1,4 @@
+# A command starting with - may fail
+all:
+	-@false
+	@echo after
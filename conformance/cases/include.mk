@@ -0,0 +1,6 @@
+# include reads another makefile; -include skips a missing one
+# files: other.mk
+include other.mk
+-include missing.mk
+all:
+	@echo included
@@ -0,0 +1,7 @@
+# -k makes what does not depend on a failure
+# args: -k
+all: bad good
+bad:
+	@false
+good:
+	@echo good
@@ -0,0 +1,4 @@
+# A target that is not a file is made
+# files: in
+out: in
+	@echo making $@
@@ -0,0 +1,4 @@
+# A target older than a prerequisite is remade
+# files: out in
+out: in
+	@echo remade
@@ -0,0 +1,5 @@
+# Pattern rules make targets that have no rule
+# files: x.c
+%.o: %.c
+	@echo $< to $@
+all: x.o
@@ -0,0 +1,5 @@
+# Phony targets run even when a file has their name
+# files: clean
+.PHONY: clean
+clean:
+	@echo cleaning
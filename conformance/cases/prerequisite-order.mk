@@ -0,0 +1,8 @@
+# Prerequisites are made in order, the recipe's rule first
+all: two
+all: one
+	echo all
+one:
+	@echo one
+two:
+	@echo two
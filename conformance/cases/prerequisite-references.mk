@@ -0,0 +1,7 @@
+# References in prerequisites are expanded
+# args: OS=darwin
+OS = linux
+all: deps-$(OS) $(if $(CI),lint) $(filter %.o,a.o b.c)
+	@echo $^
+deps-linux deps-darwin lint a.o:
+	@echo making $@
@@ -0,0 +1,4 @@
+# $(MAKE) runs make again, here in another directory
+all:
+	@mkdir -p sub && printf 'all:\n\t@echo in sub\n' > sub/Makefile
+	@$(MAKE) -C sub
@@ -0,0 +1,4 @@
+# $(shell) gives the output of a command, newlines as spaces
+X := $(shell printf "a\\nb\\n")
+all:
+	@echo "[$(X)]"
@@ -0,0 +1,5 @@
+# Target-specific variables apply to the target's recipe
+all: X = specific
+X = global
+all:
+	@echo $(X)
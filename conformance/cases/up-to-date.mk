@@ -0,0 +1,4 @@
+# A target newer than its prerequisites is not remade
+# files: in out
+out: in
+	@echo remade
@@ -0,0 +1,7 @@
+# += appends with a space, keeping the flavor
+A = one
+A += two
+B := x
+B += y
+all:
+	@echo $(A) $(B)
@@ -0,0 +1,6 @@
+# ?= sets only variables that have no value
+A ?= set
+B = kept
+B ?= replaced
+all:
+	@echo $(A) $(B)
@@ -0,0 +1,5 @@
+# override assigns over the command line
+# args: A=command
+override A = makefile
+all:
+	@echo $(A)
@@ -0,0 +1,5 @@
+# Variables given on the command line win over the makefile's
+# args: A=command
+A = makefile
+all:
+	@echo $(A)
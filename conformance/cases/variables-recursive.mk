@@ -0,0 +1,7 @@
+# Recursive variables expand when used, simple ones when set
+A = $(B)
+B = late
+C := $(D)
+D = never
+all:
+	@echo "A=$(A) C=$(C)"
@@ -0,0 +1,4 @@
+# $(wildcard) lists the files that match
+# files: a.txt b.txt c.dat
+all:
+	@echo $(wildcard *.txt)
@@ -0,0 +1,212 @@
+// Package archive creates tar and zip archives that are the same byte for
+// byte whenever their files are, whatever the platform, so packaging steps
+// don't depend on the tar or zip installed.
+//
+// Entries are sorted by name, directories are walked, and every entry gets
+// the same modification time, owner and normalised permissions. The time is
+// taken from SOURCE_DATE_EPOCH if it is set, as reproducible builds expect,
+// or else 1980-01-01, the earliest a zip file can hold.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Create writes the files, and everything under any directories among them,
+// to the archive name. Its format follows its extension: .tar, .tar.gz or
+// .tgz, or .zip.
+func Create(name string, files []string) error {
+	entries, err := collect(name, files)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		err = writeZip(f, entries)
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		gz, _ := gzip.NewWriterLevel(f, gzip.BestCompression)
+		if err = writeTar(gz, entries); err == nil {
+			err = gz.Close()
+		}
+	case strings.HasSuffix(lower, ".tar"):
+		err = writeTar(f, entries)
+	default:
+		err = fmt.Errorf("%s: unknown archive format; use .tar, .tar.gz, .tgz or .zip", name)
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// entry is a file to archive, with its name in the archive
+type entry struct {
+	name string
+	path string
+	info fs.FileInfo
+}
+
+// collect walks the files given, sorting them by name. The archive itself
+// is left out, should it be among them.
+func collect(archive string, files []string) ([]entry, error) {
+	seen := map[string]bool{filepath.ToSlash(filepath.Clean(archive)): true}
+	entries := []entry{}
+	for _, file := range files {
+		err := filepath.Walk(file, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name := filepath.ToSlash(filepath.Clean(path))
+			if name == "." || seen[name] {
+				return nil
+			}
+			seen[name] = true
+			entries = append(entries, entry{name: strings.TrimPrefix(name, "/"), path: path, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// modTime is the time given to every entry
+func modTime() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// mode normalises permissions to 0755 for directories and executables and
+// 0644 for everything else
+func mode(info fs.FileInfo) fs.FileMode {
+	if info.IsDir() || info.Mode()&0o111 != 0 {
+		return 0o755
+	}
+	return 0o644
+}
+
+func writeTar(w io.Writer, entries []entry) error {
+	tw := tar.NewWriter(w)
+	mtime := modTime()
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:    e.name,
+			Mode:    int64(mode(e.info)),
+			ModTime: mtime,
+			Format:  tar.FormatPAX,
+		}
+
+		switch {
+		case e.info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case e.info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(e.path)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = target
+			hdr.Mode = 0o777
+		case e.info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = e.info.Size()
+		default:
+			return fmt.Errorf("%s: can only archive files, directories and symlinks", e.path)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyFile(tw, e.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, entries []entry) error {
+	zw := zip.NewWriter(w)
+	mtime := modTime()
+
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: mtime}
+		hdr.SetMode(mode(e.info))
+
+		switch {
+		case e.info.IsDir():
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			hdr.SetMode(fs.ModeDir | 0o755)
+		case e.info.Mode()&fs.ModeSymlink != 0:
+			hdr.SetMode(fs.ModeSymlink | 0o777)
+		case !e.info.Mode().IsRegular():
+			return fmt.Errorf("%s: can only archive files, directories and symlinks", e.path)
+		}
+
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case e.info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(e.path)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(fw, target); err != nil {
+				return err
+			}
+		case e.info.Mode().IsRegular():
+			if err := copyFile(fw, e.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
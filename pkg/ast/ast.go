@@ -0,0 +1,133 @@
+// Package ast declares the syntax tree of a Makefile.
+//
+// The tree is lossless: every node keeps the text it was parsed from, so
+// printing a File with Fprint reproduces the original input exactly. Tools
+// such as formatters and linters can inspect or rewrite the tree instead of
+// working on the raw text.
+package ast
+
+import "fmt"
+
+// Pos is a position in a makefile. Lines and columns start at 1.
+type Pos struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (p Pos) String() string {
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// Node is implemented by every node of the tree
+type Node interface {
+	// Pos is where the node starts
+	Pos() Pos
+
+	// Raw is the source text of the node, without its final newline. A
+	// node continued over several lines has newlines within its text.
+	Raw() string
+}
+
+// File is a parsed makefile
+type File struct {
+	Name  string
+	Nodes []Node
+
+	// NoFinalNewline is set when the last line wasn't terminated
+	NoFinalNewline bool
+}
+
+// Blank is an empty, or whitespace only, line
+type Blank struct {
+	Position Pos
+	Text     string
+}
+
+// Comment is a line holding only a comment. Text excludes the leading #.
+type Comment struct {
+	Position Pos
+	Text     string
+	Source   string
+}
+
+// Assignment sets a variable, e.g. "CFLAGS := -O2"
+type Assignment struct {
+	Position Pos
+	Name     string
+
+	// Op is one of =, :=, ::=, ?=, += or !=
+	Op    string
+	Value string
+
+	// Comment is any comment ending the line, without the #
+	Comment string
+	Source  string
+}
+
+// Rule declares targets, their prerequisites and the recipe to make them
+type Rule struct {
+	Position Pos
+	Targets  []string
+
+	// Prerequisites are the space separated words after the colon.
+	// PrerequisiteText is the same text before it was split up.
+	Prerequisites    []string
+	PrerequisiteText string
+
+	// DoubleColon is set for "target:: prerequisites"
+	DoubleColon bool
+
+	// MissingSeparator is set when the line had no colon at all, which
+	// make rejects. Its words are taken as targets.
+	MissingSeparator bool
+
+	// Comment is any comment ending the line, without the #
+	Comment string
+	Recipe  []*RecipeLine
+	Source  string
+}
+
+// RecipeLine is a command in a rule's recipe, a line starting with a tab
+type RecipeLine struct {
+	Position Pos
+
+	// Text is the command with the leading tab and surrounding space removed
+	Text   string
+	Source string
+
+	// SpaceIndented is set when the line was indented with spaces rather
+	// than a tab
+	SpaceIndented bool
+}
+
+// Directive is a line such as "include", "ifdef" or "export". A "define"
+// directive runs to its "endef" and includes the lines in between.
+type Directive struct {
+	Position Pos
+	Name     string
+	Args     string
+
+	// Body holds the lines between define and endef
+	Body   []string
+	Source string
+}
+
+func (n *Blank) Pos() Pos      { return n.Position }
+func (n *Comment) Pos() Pos    { return n.Position }
+func (n *Assignment) Pos() Pos { return n.Position }
+func (n *Rule) Pos() Pos       { return n.Position }
+func (n *RecipeLine) Pos() Pos { return n.Position }
+func (n *Directive) Pos() Pos  { return n.Position }
+
+func (n *Blank) Raw() string      { return n.Text }
+func (n *Comment) Raw() string    { return n.Source }
+func (n *Assignment) Raw() string { return n.Source }
+func (n *RecipeLine) Raw() string { return n.Source }
+func (n *Directive) Raw() string  { return n.Source }
+
+// Raw of a rule is only its first line; the recipe lines are nodes of their own
+func (n *Rule) Raw() string { return n.Source }
@@ -0,0 +1,222 @@
+package ast
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// Conditions evaluate the conditionals of a makefile as ParseConditionals
+// reads it
+type Conditions interface {
+	// Read is given the nodes parsed since it was last called, before each
+	// condition is tested and once the makefile has been read, so that
+	// the condition sees the variables they set. A rule is given once its
+	// recipe is complete.
+	Read(nodes []Node) error
+
+	// Holds reports whether the condition of an ifeq, ifneq, ifdef or
+	// ifndef directive holds. That of an "else ifeq ..." is given as an
+	// ifeq directive of its own, at the else.
+	Holds(d *Directive) (bool, error)
+}
+
+// ParseConditionals parses a makefile as ParseContext does, evaluating its
+// conditionals as they're met, as make does: the lines of the branches
+// not taken are passed over as they're read, continued lines and define
+// bodies whole, and never parsed. The File holds only the nodes read.
+func ParseConditionals(ctx context.Context, filename string, r io.Reader, c Conditions) (*File, error) {
+	return parse(ctx, filename, r, &conditionals{eval: c})
+}
+
+// conditional is an ifeq, ifneq, ifdef or ifndef being read
+type conditional struct {
+	pos Pos
+
+	// outer is whether the lines around the conditional are read, and
+	// active whether those of the branch being read are
+	outer  bool
+	active bool
+
+	// taken is whether a branch has been read, so no later one is
+	taken bool
+
+	// sawElse is whether the branch being read is a plain else
+	sawElse bool
+}
+
+// conditionals are the state of ParseConditionals
+type conditionals struct {
+	eval Conditions
+	open []conditional
+
+	// read is how many of the file's nodes have been given to Read
+	read int
+
+	// inDefine is set within the body of a define passed over, whose
+	// lines, an endif among them, aren't directives
+	inDefine bool
+}
+
+// active is whether the line being read is to be parsed
+func (c *conditionals) active() bool {
+	return len(c.open) == 0 || c.open[len(c.open)-1].active
+}
+
+// isConditional reports whether name is a directive that starts, continues
+// or ends a conditional
+func isConditional(name string) bool {
+	switch name {
+	case "ifeq", "ifneq", "ifdef", "ifndef", "else", "endif":
+		return true
+	}
+	return false
+}
+
+// conditional acts on a logical line as ParseConditionals reads it,
+// reporting whether it was a conditional directive or a line passed over,
+// so not to be parsed
+func (p *parser) conditional(physical []string) bool {
+	c := p.conds
+	if c.inDefine {
+		if firstWord(strings.TrimSuffix(physical[0], "\r")) == "endef" {
+			c.inDefine = false
+		}
+		return true
+	}
+
+	// A line starting with a tab is a recipe line, never a directive
+	line := physical[0]
+	if p.lineNo == 1 {
+		line = strings.TrimPrefix(line, "\ufeff")
+	}
+	if strings.HasPrefix(line, "\t") {
+		return !c.active()
+	}
+	lines := make([]string, len(physical))
+	for i, line := range physical {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	lines[0] = line
+	text, _ := splitComment(joinLines(lines))
+	text = strings.TrimSpace(text)
+	name := firstWord(text)
+
+	if !isConditional(name) {
+		if !c.active() && name == "define" {
+			c.inDefine = true
+		}
+		return !c.active()
+	}
+
+	d := &Directive{
+		Position: p.pos(),
+		Name:     name,
+		Args:     strings.TrimSpace(text[len(name):]),
+		Source:   strings.Join(physical, "\n"),
+	}
+	if err := c.directive(p, d); err != nil {
+		p.err = err
+	}
+	return true
+}
+
+// directive acts on a conditional directive. Conditions are evaluated as
+// they're met, with the variables as set by the lines before, as make
+// does; those of a conditional within a branch passed over aren't.
+func (c *conditionals) directive(p *parser, d *Directive) error {
+	switch d.Name {
+	case "else":
+		if len(c.open) == 0 {
+			return conditionalError(d, "extraneous 'else'")
+		}
+		cond := &c.open[len(c.open)-1]
+		if cond.sawElse {
+			return conditionalError(d, "only one 'else' per conditional")
+		}
+		// "else ifeq ..." is another branch with a condition of its own
+		name := firstWord(d.Args)
+		switch {
+		case d.Args == "":
+			cond.sawElse = true
+			cond.active = cond.outer && !cond.taken
+		case name == "ifeq" || name == "ifneq" || name == "ifdef" || name == "ifndef":
+			cond.active = false
+			if cond.outer && !cond.taken {
+				test := &Directive{Position: d.Position, Name: name, Args: strings.TrimSpace(d.Args[len(name):]), Source: d.Source}
+				ok, err := c.holds(p, test)
+				if err != nil {
+					return err
+				}
+				cond.active = ok
+			}
+		default:
+			return conditionalError(d, "extraneous text after 'else' directive")
+		}
+		cond.taken = cond.taken || cond.active
+
+	case "endif":
+		if len(c.open) == 0 {
+			return conditionalError(d, "extraneous 'endif'")
+		}
+		if d.Args != "" {
+			return conditionalError(d, "extraneous text after 'endif' directive")
+		}
+		c.open = c.open[:len(c.open)-1]
+
+	default:
+		cond := conditional{pos: d.Position, outer: c.active()}
+		if cond.outer {
+			ok, err := c.holds(p, d)
+			if err != nil {
+				return err
+			}
+			cond.active, cond.taken = ok, ok
+		}
+		c.open = append(c.open, cond)
+	}
+	return nil
+}
+
+// holds tests the condition of d, once the nodes before it are read
+func (c *conditionals) holds(p *parser, d *Directive) (bool, error) {
+	if err := c.flush(p, false); err != nil {
+		return false, err
+	}
+	return c.eval.Holds(d)
+}
+
+// flush gives Read the nodes parsed since it was last called. Unless the
+// file has been read, a rule whose recipe may go on is held back, with
+// the blank lines and comments after it.
+func (c *conditionals) flush(p *parser, done bool) error {
+	end := len(p.file.Nodes)
+	if !done && p.rule != nil {
+		for i := end - 1; i >= c.read; i-- {
+			if p.file.Nodes[i] == Node(p.rule) {
+				end = i
+				break
+			}
+		}
+	}
+	if end == c.read {
+		return nil
+	}
+	nodes := p.file.Nodes[c.read:end]
+	c.read = end
+	return c.eval.Read(nodes)
+}
+
+// end checks that every conditional was closed, once the file is read, and
+// gives Read the last of its nodes
+func (c *conditionals) end(p *parser) error {
+	if len(c.open) > 0 {
+		pos := c.open[len(c.open)-1].pos
+		return &ParseError{File: pos.Filename, Line: pos.Line, Message: "missing 'endif'"}
+	}
+	return c.flush(p, true)
+}
+
+func conditionalError(d *Directive, message string) error {
+	return &ParseError{File: d.Position.Filename, Line: d.Position.Line, Message: message}
+}
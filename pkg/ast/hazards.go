@@ -0,0 +1,111 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Spaces pasted in from web pages and documents look like spaces, or like
+// nothing at all, but make only takes spaces and tabs as separating words
+// and a tab as starting a recipe line. Where they'd change how a line is
+// read they're rejected, naming the character, rather than giving rules
+// with strange targets or recipes that don't run.
+
+// hazard describes r if it's such a character, or gives ""
+func hazard(r rune) string {
+	switch r {
+	case '\u00a0':
+		return "non-breaking space (U+00A0)"
+	case '\u202f':
+		return "narrow non-breaking space (U+202F)"
+	case '\u200b':
+		return "zero-width space (U+200B)"
+	case '\u2060':
+		return "word joiner (U+2060)"
+	case '\ufeff':
+		return "zero-width non-breaking space (U+FEFF)"
+	}
+	if r > unicode.MaxASCII && unicode.IsSpace(r) {
+		return fmt.Sprintf("Unicode space (U+%04X)", r)
+	}
+	return ""
+}
+
+// findHazard finds the first such character in s, describing it and giving
+// its column, counted in characters from 1
+func findHazard(s string) (string, int) {
+	column := 1
+	for i := 0; i < len(s); column++ {
+		if s[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 && s[i] == 0xa0 {
+			return "non-breaking space (byte 0xA0, from a Latin-1 file)", column
+		}
+		if what := hazard(r); what != "" {
+			return what, column
+		}
+		i += size
+	}
+	return "", 0
+}
+
+// indentation is the space starting s, pasted characters included
+func indentation(s string) string {
+	i := 0
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r != ' ' && r != '\t' && hazard(r) == "" && !(r == utf8.RuneError && s[i] == 0xa0) {
+			break
+		}
+		i += size
+	}
+	return s[:i]
+}
+
+// checkIndentation rejects a line indented with pasted spaces, which make
+// would take as part of the first word, so a recipe line meant to start
+// with them is read as a rule
+func (p *parser) checkIndentation(line string, lineNo int) {
+	if what, column := findHazard(indentation(line)); what != "" && p.err == nil {
+		p.err = &ParseError{File: p.file.Name, Line: lineNo, Message: fmt.Sprintf(
+			"line indented with a %s at column %d, probably pasted from a web page or document; indent with spaces, or a tab to start a recipe line", what, column)}
+	}
+}
+
+// checkWords rejects pasted spaces in text that's split into words, such
+// as the targets and prerequisites of a rule, where they'd join two words
+// into one with a space in it, or put an invisible character in a name
+func (p *parser) checkWords(text string) {
+	what, column := findHazard(text)
+	if what == "" || p.err != nil {
+		return
+	}
+	fix := "make separates words only with spaces and tabs, so retype it as a space"
+	if strings.HasPrefix(what, "zero-width") || strings.HasPrefix(what, "word joiner") {
+		fix = "it can't be seen but is part of the name, so delete it"
+	}
+	p.err = &ParseError{File: p.file.Name, Line: p.lineNo, Message: fmt.Sprintf(
+		"%s at column %d, probably pasted from a web page or document; %s", what, column, fix)}
+}
+
+// checkEncoding rejects the start of a makefile that isn't ASCII or UTF-8
+func checkEncoding(filename, first string) error {
+	if strings.HasPrefix(first, "\xff\xfe") || strings.HasPrefix(first, "\xfe\xff") {
+		return &ParseError{File: filename, Line: 1, Message: "the makefile is UTF-16 encoded; save it as UTF-8"}
+	}
+	return nil
+}
+
+// checkNUL rejects a line with a NUL byte, which a makefile never has
+func checkNUL(filename string, line string, lineNo int) error {
+	if i := strings.IndexByte(line, 0); i >= 0 {
+		return &ParseError{File: filename, Line: lineNo, Message: fmt.Sprintf(
+			"NUL byte at column %d; the makefile may be UTF-16 encoded, so save it as UTF-8, or not be a makefile at all", utf8.RuneCountInString(line[:i])+1)}
+	}
+	return nil
+}
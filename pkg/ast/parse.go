@@ -0,0 +1,562 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DrivePaths has a colon after a drive letter, as in C:/src or C:\src,
+// taken as part of the path rather than the rule's separator. It's set on
+// Windows, as GNU make does there.
+var DrivePaths = runtime.GOOS == "windows"
+
+// directives are the words that start a directive line
+var directives = map[string]bool{
+	"include":  true,
+	"-include": true,
+	"sinclude": true,
+	"ifeq":     true,
+	"ifneq":    true,
+	"ifdef":    true,
+	"ifndef":   true,
+	"else":     true,
+	"endif":    true,
+	"define":   true,
+	"endef":    true,
+	"export":   true,
+	"unexport": true,
+	"override": true,
+	"vpath":    true,
+}
+
+// ParseError reports a makefile that can't be parsed
+type ParseError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// ParseFile reads and parses the named makefile
+func ParseFile(filename string) (*File, error) {
+	return ParseFileContext(context.Background(), filename)
+}
+
+// ParseFileContext is ParseFile, giving up once ctx is done
+func ParseFileContext(ctx context.Context, filename string) (*File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseContext(ctx, filename, f)
+}
+
+// Parse parses a makefile read from r. The filename is only used for the
+// positions of the nodes.
+func Parse(filename string, r io.Reader) (*File, error) {
+	return ParseContext(context.Background(), filename, r)
+}
+
+// readBufferSize is how much of a makefile is read at a time
+const readBufferSize = 256 << 10
+
+// ParseContext is Parse, giving up once ctx is done. The makefile is parsed
+// as it's read, a logical line at a time, so only what it parses to is
+// held in memory, and lines may be of any length.
+func ParseContext(ctx context.Context, filename string, r io.Reader) (*File, error) {
+	return parse(ctx, filename, r, nil)
+}
+
+// parse is ParseContext, evaluating the conditionals with conds if it's set
+func parse(ctx context.Context, filename string, r io.Reader, conds *conditionals) (*File, error) {
+	p := &parser{file: &File{Name: filename}, conds: conds}
+
+	// physical holds the lines of the logical line being read
+	physical := []string{}
+	lineNo := 0
+	reader := &lineReader{r: r}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		line, err := reader.next()
+		if line == "" && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if strings.HasSuffix(line, "\n") {
+			line = strings.TrimSuffix(line, "\n")
+		} else {
+			p.file.NoFinalNewline = true
+		}
+		lineNo++
+		if lineNo == 1 {
+			if err := checkEncoding(filename, line); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkNUL(filename, line, lineNo); err != nil {
+			return nil, err
+		}
+		physical = append(physical, line)
+
+		// A backslash at the end of a line continues it on the next,
+		// except within the body of a define where lines are kept as is
+		if !p.inDefine() && continued(strings.TrimSuffix(line, "\r")) {
+			continue
+		}
+		p.lineNo = lineNo - len(physical) + 1
+		p.read(physical)
+		physical = physical[:0]
+		if p.err != nil {
+			return nil, p.err
+		}
+	}
+
+	// The last line continued onto nothing
+	if len(physical) > 0 {
+		p.lineNo = lineNo - len(physical) + 1
+		p.read(physical)
+		if p.err != nil {
+			return nil, p.err
+		}
+	}
+
+	if p.define != nil {
+		return nil, &ParseError{
+			File:    p.define.Position.Filename,
+			Line:    p.define.Position.Line,
+			Message: "missing 'endef' for define started here",
+		}
+	}
+	if p.conds != nil {
+		if err := p.conds.end(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.file, nil
+}
+
+// read parses a logical line, unless it's a conditional being evaluated,
+// or passed over by one
+func (p *parser) read(physical []string) {
+	if p.conds != nil && p.define == nil && p.conditional(physical) {
+		return
+	}
+	p.line(physical)
+}
+
+// inDefine is whether the line being read is in the body of a define
+func (p *parser) inDefine() bool {
+	return p.define != nil || p.conds != nil && p.conds.inDefine
+}
+
+// lineReader reads a makefile a line at a time, as bufio.Reader.ReadString
+// does, but taking the lines from blocks read as strings, so that the many
+// lines of a large makefile don't each need their own copy
+type lineReader struct {
+	r   io.Reader
+	buf string
+	err error
+}
+
+// next gives the next line, with its newline unless it's the last, and
+// io.EOF once it is
+func (lr *lineReader) next() (string, error) {
+	for {
+		if i := strings.IndexByte(lr.buf, '\n'); i >= 0 {
+			line := lr.buf[:i+1]
+			lr.buf = lr.buf[i+1:]
+			return line, nil
+		}
+		if lr.err != nil {
+			line := lr.buf
+			lr.buf = ""
+			return line, lr.err
+		}
+
+		// What's left of the last block starts the next, which is as long
+		// again, so a line longer than a block is read in few steps
+		block := make([]byte, len(lr.buf)+max(readBufferSize, len(lr.buf)))
+		copy(block, lr.buf)
+		n, err := io.ReadFull(lr.r, block[len(lr.buf):])
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		lr.buf, lr.err = string(block[:len(lr.buf)+n]), err
+	}
+}
+
+// continued reports whether line ends with an unescaped backslash
+func continued(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, "\\"))
+	return n%2 == 1
+}
+
+// joinLines joins continued lines as make does outside recipes, replacing
+// each backslash-newline and the whitespace around it with a single space
+func joinLines(lines []string) string {
+	if len(lines) == 1 {
+		return lines[0]
+	}
+
+	parts := make([]string, len(lines))
+	for i, line := range lines {
+		if i < len(lines)-1 {
+			line = strings.TrimSuffix(line, "\\")
+		}
+		if i > 0 {
+			line = strings.TrimLeft(line, " \t")
+		}
+		if i < len(lines)-1 {
+			line = strings.TrimRight(line, " \t")
+		}
+		parts[i] = line
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// recipeText joins the lines of a recipe command. As with make the
+// backslash-newlines are kept for the shell, and a tab starting a
+// continuation line is removed.
+func recipeText(lines []string) string {
+	if len(lines) == 1 {
+		return strings.TrimRight(strings.TrimLeft(lines[0], " \t"), " \t")
+	}
+
+	parts := make([]string, len(lines))
+	for i, line := range lines {
+		if i == 0 {
+			line = strings.TrimLeft(line, " \t")
+		} else {
+			line = strings.TrimPrefix(line, "\t")
+		}
+		parts[i] = line
+	}
+
+	return strings.TrimRight(strings.Join(parts, "\n"), " \t")
+}
+
+type parser struct {
+	file   *File
+	lineNo int
+
+	// rule is the rule that recipe lines belong to
+	rule *Rule
+
+	// define is the unfinished "define" directive, if any
+	define *Directive
+
+	// conds, if set, evaluates the conditionals as they're read
+	conds *conditionals
+
+	// err is set if a line can't be parsed, which stops parsing
+	err error
+
+	// words holds the words of rules, which fields gives out slices of
+	words []string
+
+	// rules, recipes and recipeSlots are allocated a chunk at a time, and
+	// given out one by one to the rules and recipe lines parsed, as a
+	// generated makefile can have millions
+	rules       []Rule
+	recipes     []RecipeLine
+	recipeSlots []*RecipeLine
+}
+
+// chunkSize is how many rules, recipe lines or words are allocated at a
+// time
+const chunkSize = 4096
+
+func (p *parser) newRule() *Rule {
+	if len(p.rules) == cap(p.rules) {
+		p.rules = make([]Rule, 0, chunkSize)
+	}
+	p.rules = p.rules[:len(p.rules)+1]
+	return &p.rules[len(p.rules)-1]
+}
+
+func (p *parser) newRecipeLine() *RecipeLine {
+	if len(p.recipes) == cap(p.recipes) {
+		p.recipes = make([]RecipeLine, 0, chunkSize)
+	}
+	p.recipes = p.recipes[:len(p.recipes)+1]
+	return &p.recipes[len(p.recipes)-1]
+}
+
+// addRecipe adds r to the recipe of the current rule. A rule's first line
+// goes in a slot of recipeSlots, with room for only the one, as most rules
+// have only one; appending another copies it.
+func (p *parser) addRecipe(r *RecipeLine) {
+	if p.rule.Recipe == nil {
+		if len(p.recipeSlots) == cap(p.recipeSlots) {
+			p.recipeSlots = make([]*RecipeLine, 0, chunkSize)
+		}
+		i := len(p.recipeSlots)
+		p.recipeSlots = p.recipeSlots[:i+1]
+		p.rule.Recipe = p.recipeSlots[i : i : i+1]
+	}
+	p.rule.Recipe = append(p.rule.Recipe, r)
+}
+
+// asciiSpace are the ASCII characters unicode.IsSpace gives
+var asciiSpace = [utf8.RuneSelf]bool{'\t': true, '\n': true, '\v': true, '\f': true, '\r': true, ' ': true}
+
+func (p *parser) pos() Pos {
+	return Pos{Filename: p.file.Name, Line: p.lineNo, Column: 1}
+}
+
+func (p *parser) add(n Node) {
+	p.file.Nodes = append(p.file.Nodes, n)
+}
+
+// line parses one logical line, made of one or more physical lines joined
+// by backslashes
+func (p *parser) line(physical []string) {
+	// Lines are read without the carriage returns of CRLF line endings, or
+	// the byte order mark some editors start a file with, which the source
+	// keeps so the file prints as it was
+	source := strings.Join(physical, "\n")
+	if p.lineNo == 1 || strings.Contains(source, "\r") {
+		physical = slices.Clone(physical)
+		for i, line := range physical {
+			physical[i] = strings.TrimSuffix(line, "\r")
+		}
+		if p.lineNo == 1 {
+			physical[0] = strings.TrimPrefix(physical[0], "\ufeff")
+		}
+	}
+
+	if p.define != nil {
+		p.define.Source += "\n" + source
+		if text := strings.Join(physical, "\n"); firstWord(text) == "endef" {
+			p.define = nil
+		} else {
+			p.define.Body = append(p.define.Body, text)
+		}
+		return
+	}
+	for i, line := range physical {
+		p.checkIndentation(line, p.lineNo+i)
+	}
+
+	line := joinLines(physical)
+	trimmed := strings.TrimSpace(line)
+
+	switch {
+	case strings.HasPrefix(line, "\t"):
+		recipe := p.newRecipeLine()
+		*recipe = RecipeLine{Position: p.pos(), Text: recipeText(physical), Source: source}
+		if p.rule != nil {
+			p.addRecipe(recipe)
+		} else {
+			// A recipe without a rule; kept so the file can be printed again
+			p.add(recipe)
+		}
+
+	case trimmed == "":
+		p.add(&Blank{Position: p.pos(), Text: source})
+
+	case trimmed[0] == '#':
+		p.add(&Comment{Position: p.pos(), Text: trimmed[1:], Source: source})
+
+	case directives[firstWord(trimmed)]:
+		text, _ := splitComment(line)
+		p.checkWords(text)
+		name := firstWord(trimmed)
+		d := &Directive{
+			Position: p.pos(),
+			Name:     name,
+			Args:     strings.TrimSpace(trimmed[len(name):]),
+			Source:   source,
+		}
+		p.add(d)
+		if name == "define" {
+			p.define = d
+		}
+		// As with make, a directive other than a conditional ends the
+		// rule before, so a recipe line after it isn't the rule's
+		if !isConditional(name) {
+			p.rule = nil
+		}
+
+	case p.rule != nil && line[0] == ' ' && isCommand(line):
+		// Indented with spaces instead of a tab, a common mistake. Make
+		// would reject it but it's plainly meant to be part of the recipe.
+		recipe := p.newRecipeLine()
+		*recipe = RecipeLine{
+			Position:      p.pos(),
+			Text:          recipeText(physical),
+			Source:        source,
+			SpaceIndented: true,
+		}
+		p.addRecipe(recipe)
+
+	default:
+		p.statement(line, source)
+	}
+}
+
+// isCommand reports whether line is neither a rule nor an assignment
+func isCommand(line string) bool {
+	text, _ := splitComment(line)
+	op, _ := findOperator(text)
+	return op == ""
+}
+
+// statement parses a line that is either an assignment or a rule
+func (p *parser) statement(line, source string) {
+	text, comment := splitComment(line)
+	op, at := findOperator(text)
+
+	if op != ":" && op != "::" && op != "" {
+		p.checkWords(text[:at])
+		p.rule = nil
+		p.add(&Assignment{
+			Position: p.pos(),
+			Name:     strings.TrimSpace(text[:at]),
+			Op:       op,
+			Value:    strings.TrimSpace(text[at+len(op):]),
+			Comment:  comment,
+			Source:   source,
+		})
+		return
+	}
+
+	p.checkWords(text)
+	rule := p.newRule()
+	*rule = Rule{Position: p.pos(), Comment: comment, Source: source, DoubleColon: op == "::"}
+	if op == "" {
+		rule.MissingSeparator = true
+		rule.Targets = p.fields(text)
+	} else {
+		rule.Targets = p.fields(text[:at])
+		rule.PrerequisiteText = strings.TrimSpace(text[at+len(op):])
+		rule.Prerequisites = p.fields(rule.PrerequisiteText)
+	}
+
+	p.rule = rule
+	p.add(rule)
+}
+
+// fields splits s into words as strings.Fields does, taking the slice from
+// one shared by the rules parsed before, as each has only a few words.
+// Its capacity is its length, so appending to it copies it.
+func (p *parser) fields(s string) []string {
+	start := len(p.words)
+	word := -1
+	for i := 0; i <= len(s); {
+		space, size := true, 1
+		if i < len(s) {
+			if c := s[i]; c < utf8.RuneSelf {
+				space = asciiSpace[c]
+			} else {
+				var r rune
+				r, size = utf8.DecodeRuneInString(s[i:])
+				space = unicode.IsSpace(r)
+			}
+		}
+		switch {
+		case space && word >= 0:
+			if len(p.words) == cap(p.words) {
+				words := make([]string, len(p.words)-start, max(chunkSize, 2*(len(p.words)-start)))
+				copy(words, p.words[start:])
+				p.words, start = words, 0
+			}
+			p.words = append(p.words, s[word:i])
+			word = -1
+		case !space && word < 0:
+			word = i
+		}
+		i += size
+	}
+	return p.words[start:len(p.words):len(p.words)]
+}
+
+// findOperator locates the first ":" or assignment operator outside of a
+// variable reference, returning it and its offset
+func findOperator(text string) (string, int) {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '(' || c == '{':
+			depth++
+		case c == ')' || c == '}':
+			depth--
+		case depth > 0:
+			continue
+		case c == ':':
+			if DrivePaths && isDriveColon(text, i) {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(text[i:], "::="):
+				return "::=", i
+			case strings.HasPrefix(text[i:], ":="):
+				return ":=", i
+			case strings.HasPrefix(text[i:], "::"):
+				return "::", i
+			}
+			return ":", i
+		case c == '=':
+			if i > 0 && strings.ContainsRune("?+!", rune(text[i-1])) {
+				return text[i-1 : i+1], i - 1
+			}
+			return "=", i
+		}
+	}
+
+	return "", -1
+}
+
+// isDriveColon reports whether the colon at text[i] follows the drive
+// letter starting a path
+func isDriveColon(text string, i int) bool {
+	if i == 0 || i+1 >= len(text) || (text[i+1] != '/' && text[i+1] != '\\') {
+		return false
+	}
+	letter := text[i-1]
+	if !('a' <= letter && letter <= 'z' || 'A' <= letter && letter <= 'Z') {
+		return false
+	}
+	return i == 1 || text[i-2] == ' ' || text[i-2] == '\t'
+}
+
+// splitComment separates a trailing comment from a line. A # escaped with
+// a backslash doesn't start a comment.
+func splitComment(line string) (string, string) {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] != '\\') {
+			return line[:i], line[i+1:]
+		}
+	}
+	return line, ""
+}
+
+// firstWord returns the first of the words of s, as strings.Fields would,
+// without splitting the rest
+func firstWord(s string) string {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	if end := strings.IndexFunc(s, unicode.IsSpace); end >= 0 {
+		return s[:end]
+	}
+	return s
+}
@@ -0,0 +1,167 @@
+package ast_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// FuzzParse checks that any makefile, however malformed, parses or fails
+// with an error, rather than panicking or hanging, with its conditionals
+// evaluated or not
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"all: main.o\n\tcc -o app main.o\n",
+		"CFLAGS = -O2 # comment\nCC := cc\nX ?= 1\nX += 2\nY != echo y\n",
+		"include a.mk b.mk\n-include $(wildcard *.mk)\n",
+		"ifeq ($(A),b)\nX = 1\nelse ifdef B\nX = 2\nelse\nX = 3\nendif\n",
+		"define X\nline\n",
+		"define X\nendef\nendef\n",
+		"a: b; echo inline\n\techo $@ \\\n\t  continued \\\n",
+		"A = \\\n\\\n\\\n",
+		"a:: b\na: | c\n%.o: %.c\n\t$(CC) -c $<\n",
+		"\t\t\trecipe with no rule\n",
+		"X = " + strings.Repeat("$(", 1000) + strings.Repeat(")", 1000) + "\n",
+		"X = " + strings.Repeat("$(", 1000) + "\n",
+		"a: b\r\n\techo crlf\r\n",
+		"\xef\xbb\xbfall:\n",
+		"\x00",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		file, err := ast.Parse("Makefile", strings.NewReader(text))
+		if err != nil {
+			return
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			if n.Pos().Line < 0 {
+				t.Fatalf("%T at line %d", n, n.Pos().Line)
+			}
+			return true
+		})
+
+		ast.ParseConditionals(context.Background(), "Makefile", strings.NewReader(text), alternate{})
+	})
+}
+
+// alternate holds the conditions of directives on odd lines
+type alternate struct{}
+
+func (alternate) Read(nodes []ast.Node) error          { return nil }
+func (alternate) Holds(d *ast.Directive) (bool, error) { return d.Position.Line%2 == 1, nil }
+
+func TestParseConditionals(t *testing.T) {
+	text := `all:
+ifeq (taken,)
+	echo one
+  ifdef skipped
+	echo skipped
+  endif
+else ifdef other
+	echo two
+else
+	echo skipped \
+endif
+endif
+define BODY
+else
+endef
+X = 1
+`
+	r := &recorder{holds: func(d *ast.Directive) bool { return d.Name == "ifeq" || d.Args == "other" }}
+	file, err := ast.ParseConditionals(context.Background(), "Makefile", strings.NewReader(text), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Nodes) != 3 || len(r.read) != 3 {
+		t.Fatalf("got %d nodes, %d read, want 3", len(file.Nodes), len(r.read))
+	}
+	rule := file.Nodes[0].(*ast.Rule)
+	if len(rule.Recipe) != 1 || rule.Recipe[0].Text != "echo one" {
+		t.Errorf("all has recipe %v, want only echo one", rule.Recipe)
+	}
+
+	for _, text := range []string{"ifdef X\n", "else\n", "endif\n", "ifdef X\nelse\nelse\nendif\n", "ifdef X\nendif junk\n"} {
+		if _, err := ast.ParseConditionals(context.Background(), "Makefile", strings.NewReader(text), alternate{}); err == nil {
+			t.Errorf("%q parsed with no error", text)
+		}
+	}
+}
+
+// recorder holds the conditions holds gives true, keeping the nodes read
+type recorder struct {
+	holds func(d *ast.Directive) bool
+	read  []ast.Node
+}
+
+func (r *recorder) Read(nodes []ast.Node) error {
+	r.read = append(r.read, nodes...)
+	return nil
+}
+
+func (r *recorder) Holds(d *ast.Directive) (bool, error) { return r.holds(d), nil }
+
+func TestLongLines(t *testing.T) {
+	value := strings.Repeat("word ", 300000) + "end"
+	file, err := ast.Parse("Makefile", strings.NewReader("X = "+value+"\nall: x\r\n\techo $(X)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Nodes) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(file.Nodes))
+	}
+	if a, ok := file.Nodes[0].(*ast.Assignment); !ok || a.Value != value {
+		t.Fatalf("got %T, want the assignment of a %d byte value", file.Nodes[0], len(value))
+	}
+	r, ok := file.Nodes[1].(*ast.Rule)
+	if !ok || len(r.Recipe) != 1 || r.Recipe[0].Text != "echo $(X)" || !file.NoFinalNewline {
+		t.Fatalf("got %#v, want the rule all with its recipe", file.Nodes[1])
+	}
+}
+
+// BenchmarkParse parses a generated makefile of about 50MB, as
+// cmd/gen-stress writes them, which should take well under a second
+func BenchmarkParse(b *testing.B) {
+	mf := stressMakefile(1200000, 5000, 4)
+	b.SetBytes(int64(len(mf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ast.Parse("stress.mk", bytes.NewReader(mf)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// stressMakefile writes the makefile go run ./cmd/gen-stress does: a chain
+// of targets depth long, and the rest each depending on a link of it and
+// fanout-1 of the targets before
+func stressMakefile(targets, depth, fanout int) []byte {
+	var w bytes.Buffer
+	fmt.Fprintln(&w, ".PHONY: all")
+	fmt.Fprintf(&w, "all: chain%d", depth-1)
+	for i := depth; i < targets; i += 100 {
+		fmt.Fprintf(&w, " t%d", i)
+	}
+	fmt.Fprintln(&w)
+
+	fmt.Fprintln(&w, "chain0:\n\t@:")
+	for i := 1; i < depth; i++ {
+		fmt.Fprintf(&w, "chain%d: chain%d\n\t@:\n", i, i-1)
+	}
+	for i := depth; i < targets; i++ {
+		fmt.Fprintf(&w, "t%d: chain%d", i, i%depth)
+		for j := 1; j < fanout && i-j*7 >= depth; j++ {
+			fmt.Fprintf(&w, " t%d", i-j*7)
+		}
+		fmt.Fprintln(&w, "\n\t@:")
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,36 @@
+package ast
+
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// Fprint writes the source of a file back out. An unmodified tree prints
+// exactly the text it was parsed from.
+func Fprint(w io.Writer, f *File) error {
+	nodes := []Node{}
+	Inspect(f, func(n Node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+
+	// Recipe lines hang off their rule but may be separated from it by
+	// blank lines and comments, so put everything back in source order
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Pos().Line < nodes[j].Pos().Line
+	})
+
+	lines := make([]string, len(nodes))
+	for i, n := range nodes {
+		lines[i] = n.Raw()
+	}
+
+	text := strings.Join(lines, "\n")
+	if len(lines) > 0 && !f.NoFinalNewline {
+		text += "\n"
+	}
+
+	_, err := io.WriteString(w, text)
+	return err
+}
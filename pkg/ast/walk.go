@@ -0,0 +1,45 @@
+package ast
+
+// Visitor is called for each node by Walk. If Visit returns a non-nil
+// Visitor, that visitor is used for the node's children.
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree depth first, visiting a rule before its recipe.
+// It accepts a *File, whose nodes are visited in order, or any other Node.
+func Walk(v Visitor, node interface{}) {
+	switch n := node.(type) {
+	case *File:
+		for _, child := range n.Nodes {
+			Walk(v, child)
+		}
+
+	case *Rule:
+		w := v.Visit(n)
+		if w == nil {
+			return
+		}
+		for _, line := range n.Recipe {
+			Walk(w, line)
+		}
+
+	case Node:
+		v.Visit(n)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect calls f for each node of the tree. If f returns false the
+// children of the node (the recipe of a rule) are skipped.
+func Inspect(node interface{}, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
@@ -0,0 +1,454 @@
+// Package build brings the targets of a makefile up to date.
+//
+// An Engine runs the recipes of the targets a build needs in dependency
+// order. Hooks let programs embedding hmake observe the build as it goes,
+// for example to show progress in a GUI.
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/cache"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/trace"
+)
+
+// Options control how a build runs
+type Options struct {
+	// Jobs is the number of recipes that may run at once
+	Jobs int
+
+	// KeepGoing carries on after a failure, building whatever doesn't
+	// depend on the target that failed
+	KeepGoing bool
+
+	// DryRun prints the commands that would be run without running them
+	DryRun bool
+
+	// DropCycles breaks cycles in the dependency graph by dropping the
+	// prerequisite that completes each, as GNU make does, instead of
+	// failing. The makefile is changed to match.
+	DropCycles bool
+
+	// DownloadCache, if set, is a directory where downloads with a checksum
+	// are kept, so they needn't be fetched again
+	DownloadCache string
+
+	// Cache, if set, keeps what targets produce, so a target made before
+	// from the same commands and inputs is restored rather than remade
+	Cache *cache.Cache
+
+	// NoToolFingerprint leaves the programs a recipe runs out of its cache
+	// key, so that upgrading a compiler doesn't invalidate the cache
+	NoToolFingerprint bool
+
+	// OutOfDate, if set, is asked about each target whose files are up to
+	// date, with its recipe expanded, and may say it must be remade anyway,
+	// for example because the tools that made it have changed since
+	OutOfDate func(t makefile.Target) bool
+
+	// TraceAccess runs recipes here under a tracer, in place of any
+	// Executor, and warns of the files a recipe reads that aren't its
+	// target's prerequisites and those it writes that aren't its target.
+	// Such targets aren't cached, as their keys don't cover their inputs.
+	TraceAccess bool
+
+	// StrictAccess, with TraceAccess, fails such targets instead
+	StrictAccess bool
+
+	// StrictVariables fails targets whose recipes refer to variables with
+	// no value, with a *makefile.UndefinedError for each
+	StrictVariables bool
+
+	// TempDir, if set, is a directory such as os.TempDir() in which each
+	// build makes a private directory, with os.MkdirTemp, and each recipe
+	// is given its own within that for temporary files, as $(TMPDIR) and
+	// TMPDIR in its environment. A recipe's directory is created empty
+	// before it runs and removed when it finishes, whether it succeeds or
+	// fails, so recipes run at once don't collide on the names of
+	// temporary files or leave them behind. It's ignored for dry runs.
+	TempDir string
+
+	// Durations are how long targets' recipes took when last run. With more
+	// than one job, targets that become ready together are started longest
+	// chain first: the one with the longest run of recipes still to come,
+	// its own and those of what depends on it, so the slow path through
+	// the build isn't left until the end. Targets with no duration count
+	// as taking no time.
+	Durations map[string]time.Duration
+
+	// Executor, if set, runs the commands instead of the Runner's own, for
+	// example to run them in a container or record them
+	Executor exec.Executor
+
+	// Policy, if set, restricts the programs recipes may run, failing the
+	// targets whose commands run others. It applies whatever the Executor.
+	Policy *exec.Policy
+
+	// AuditLog, if set, records every command recipes run, and those the
+	// Policy stopped
+	AuditLog *exec.AuditLog
+
+	// Stdout and Stderr receive the output of the build. They default to
+	// the process's own.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Output, if set, chooses where the output of each target goes instead
+	// of Stdout and Stderr. Writers with a Flush method are flushed when
+	// the target finishes.
+	Output func(t makefile.Target) (stdout, stderr io.Writer)
+}
+
+// Hooks are called as the build progresses. Any may be nil.
+type Hooks struct {
+	// BeforeTarget is called before a target's recipe runs, with the
+	// writer its output goes to
+	BeforeTarget func(t makefile.Target, stdout io.Writer)
+
+	// AfterTarget is called once a target has been made, or has failed,
+	// or has been skipped because a prerequisite failed. err is nil on
+	// success.
+	AfterTarget func(t makefile.Target, duration time.Duration, err error)
+
+	// OnCommand is called before each command of a recipe is run
+	OnCommand func(t makefile.Target, command string)
+
+	// Restored is called when a target's files were taken from the Cache
+	// instead of running its recipe, before AfterTarget
+	Restored func(t makefile.Target)
+
+	// Clobbered is called at the end of a build for each prerequisite of a
+	// target that changed after the target's recipe started. Prerequisites
+	// are only watched when it's set.
+	Clobbered func(err *ClobberedError)
+
+	// CycleDropped is called for each cycle broken with DropCycles
+	CycleDropped func(cycle *graph.CycleError)
+
+	// UpToDate is called instead of the others for a target that doesn't
+	// need remaking
+	UpToDate func(t makefile.Target)
+}
+
+// MissingError reports a prerequisite that has no rule to make it and
+// doesn't exist as a file
+type MissingError struct {
+	Prerequisite string
+	NeededBy     string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("No rule to make target '%s', needed by '%s'.", e.Prerequisite, e.NeededBy)
+}
+
+// NotRemadeError is given to AfterTarget for a target that wasn't built
+// because one of its prerequisites failed
+type NotRemadeError struct {
+	Target string
+}
+
+func (e *NotRemadeError) Error() string {
+	return fmt.Sprintf("Target '%s' not remade because of errors.", e.Target)
+}
+
+// UndeclaredError reports a target whose recipe read or wrote files its
+// rule doesn't declare, with StrictAccess
+type UndeclaredError struct {
+	Target  string
+	Inputs  []string
+	Outputs []string
+}
+
+func (e *UndeclaredError) Error() string {
+	return fmt.Sprintf("Target '%s' used undeclared files: %s", e.Target, strings.Join(append(e.Inputs, e.Outputs...), ", "))
+}
+
+// Engine builds the targets of a makefile
+type Engine struct {
+	Makefile *makefile.Makefile
+	Runner   *exec.Runner
+	Options
+	Hooks
+}
+
+// New returns an Engine for mf that runs recipes with sh
+func New(mf *makefile.Makefile, opts Options) *Engine {
+	return &Engine{Makefile: mf, Runner: exec.NewRunner(), Options: opts}
+}
+
+// Plan lists the targets a build of the goals would consider, in the order
+// they would be built
+func (e *Engine) Plan(goals []string) []string {
+	return graph.Order(e.Makefile, goals)
+}
+
+// Build runs the recipes needed to bring the goals up to date. It returns
+// the first error; when keeping going that's after everything else that
+// could be built has been.
+func (e *Engine) Build(goals []string) error {
+	return e.BuildContext(context.Background(), goals)
+}
+
+// BuildContext is Build, stopping once ctx is done. The running recipe is
+// interrupted and ctx's error returned.
+func (e *Engine) BuildContext(ctx context.Context, goals []string) error {
+	if e.DropCycles {
+		for _, cycle := range graph.DropCycles(e.Makefile) {
+			if e.CycleDropped != nil {
+				e.CycleDropped(cycle)
+			}
+		}
+	}
+
+	if cycle := graph.FindCycle(e.Makefile); cycle != nil {
+		return cycle
+	}
+
+	err := newScheduler(e, e.Plan(goals)).run(ctx)
+	if ctx.Err() == nil {
+		if hookErr := e.buildHook(ctx, goals, err); err == nil {
+			err = hookErr
+		}
+	}
+	return err
+}
+
+// buildHook runs the recipe of .ON_SUCCESS or .ON_FAILURE as the build
+// succeeded or failed, if there is one, with the goals as its prerequisites
+// and any error in HMAKE_ERROR
+func (e *Engine) buildHook(ctx context.Context, goals []string, err error) error {
+	name := makefile.OnSuccess
+	if err != nil {
+		name = makefile.OnFailure
+	}
+	redact := NewRedactor(e.Makefile)
+	t := makefile.Target{Name: name, Dependencies: goals}
+	if err != nil {
+		t.Env = map[string]string{"HMAKE_ERROR": redact.String(err.Error())}
+	}
+	stdout, stderr := e.output(t)
+	defer flush(stdout)
+	defer flush(stderr)
+
+	runner := e.runner(t, redact)
+	e.audit(&runner, redact)
+	return e.runHook(ctx, runner, name, t, stdout, stderr, redact)
+}
+
+// missingPrerequisite checks that the prerequisites of t without rules of
+// their own exist as files
+func (e *Engine) missingPrerequisite(t makefile.Target) error {
+	for _, dep := range t.Dependencies {
+		if _, ok := e.Makefile.Targets[dep]; ok {
+			continue
+		}
+		if _, err := e.Makefile.FileSystem().Stat(dep); err != nil {
+			return &MissingError{Prerequisite: dep, NeededBy: t.Name}
+		}
+	}
+
+	return nil
+}
+
+// output returns the writers t's output goes to
+func (e *Engine) output(t makefile.Target) (io.Writer, io.Writer) {
+	if e.Output != nil {
+		return e.Output(t)
+	}
+
+	stdout, stderr := e.Stdout, e.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	return stdout, stderr
+}
+
+// runTarget runs the recipe of t, between those of its hooks, with redact
+// hiding the secrets in the commands the hooks are given. It may be called
+// for several targets at once.
+func (e *Engine) runTarget(ctx context.Context, t makefile.Target, stdout, stderr io.Writer, redact *Redactor) error {
+	defer flush(stdout)
+	defer flush(stderr)
+
+	runner := e.runner(t, redact)
+	hooks := runner
+	e.audit(&hooks, redact)
+
+	if !runner.DryRun {
+		remove, err := makeTempDir(t)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+
+	if err := e.runHook(ctx, hooks, t.Name+makefile.PreHook, t, stdout, stderr, redact); err != nil {
+		return err
+	}
+	if err := e.makeTarget(ctx, t, runner, stdout, stderr, redact); err != nil {
+		return err
+	}
+	return e.runHook(ctx, hooks, t.Name+makefile.PostHook, t, stdout, stderr, redact)
+}
+
+// runner returns the Runner for t's recipe
+func (e *Engine) runner(t makefile.Target, redact *Redactor) exec.Runner {
+	runner := *e.Runner
+	runner.DryRun = runner.DryRun || e.DryRun
+	if e.Executor != nil {
+		runner.Executor = e.Executor
+	}
+	if e.OnCommand != nil {
+		runner.OnCommand = func(command string) { e.OnCommand(t, redact.String(command)) }
+	}
+	return runner
+}
+
+// audit has runner's commands checked against the Policy and recorded in
+// the AuditLog, if there are either
+func (e *Engine) audit(runner *exec.Runner, redact *Redactor) {
+	if e.Policy == nil && e.AuditLog == nil {
+		return
+	}
+	executor := runner.Executor
+	if executor == nil {
+		executor = &exec.Local{Shell: runner.Shell}
+	}
+	runner.Executor = &exec.Audited{Executor: executor, Policy: e.Policy, Log: e.AuditLog, Redact: redact.String}
+}
+
+// runHook runs the recipe of the hook target named, standing in for t, if
+// there is one
+func (e *Engine) runHook(ctx context.Context, runner exec.Runner, name string, t makefile.Target, stdout, stderr io.Writer, redact *Redactor) error {
+	hook, ok := e.Makefile.Hook(name, t)
+	if !ok {
+		return nil
+	}
+
+	commands, undefined := e.Makefile.ExpandRecipeStrict(ctx, hook)
+	var limit *makefile.ExpandLimitError
+	if errors.As(undefined, &limit) || (undefined != nil && e.StrictVariables) {
+		return undefined
+	}
+	hook.Commands = commands
+	hook.Env = redact.Env(hook.Env)
+	return runner.RunContext(ctx, hook, stdout, stderr)
+}
+
+// makeTarget runs the recipe of t with runner, after downloading it if it's
+// fetched from a URL, or restores its files from the cache
+func (e *Engine) makeTarget(ctx context.Context, t makefile.Target, runner exec.Runner, stdout, stderr io.Writer, redact *Redactor) error {
+	if t.Fetch != nil {
+		if err := e.fetch(ctx, t, stdout); err != nil {
+			return err
+		}
+	}
+
+	var tracer *trace.Executor
+	if e.TraceAccess && !runner.DryRun {
+		tracer = &trace.Executor{Shell: runner.Shell}
+		runner.Executor = tracer
+	}
+	e.audit(&runner, redact)
+
+	key := ""
+	if e.cacheable(t) && !runner.DryRun {
+		tools := ""
+		if !e.NoToolFingerprint {
+			tools = cache.ToolFingerprint(t.Commands)
+		}
+		key, _ = cache.Key(t, e.Makefile.FileSystem(), tools)
+	}
+	if key != "" {
+		if restored, err := e.Cache.Get(ctx, key, t.Files()); err != nil {
+			fmt.Fprintf(stderr, "hmake: cache: %s\n", err)
+		} else if restored {
+			fmt.Fprintf(stdout, "Restored %s from the cache\n", t.Name)
+			if e.Restored != nil {
+				e.Restored(t)
+			}
+			return nil
+		}
+	}
+
+	recipe := t
+	recipe.Env = redact.Env(t.Env)
+	if err := runner.RunContext(ctx, recipe, stdout, stderr); err != nil {
+		return err
+	}
+
+	if tracer != nil {
+		inputs, outputs := tracer.Undeclared(t.Dependencies, t.Files())
+		for _, name := range inputs {
+			fmt.Fprintf(stderr, "hmake: %s: read %s, which isn't a prerequisite\n", t.Name, name)
+		}
+		for _, name := range outputs {
+			fmt.Fprintf(stderr, "hmake: %s: wrote %s, which isn't one of its outputs\n", t.Name, name)
+		}
+		if len(inputs) > 0 || len(outputs) > 0 {
+			if e.StrictAccess {
+				return &UndeclaredError{Target: t.Name, Inputs: inputs, Outputs: outputs}
+			}
+			key = ""
+		}
+	}
+
+	// A recipe that made no file has nothing to cache, and a failure to
+	// cache only costs a rebuild later
+	if files := e.made(t); key != "" && files != nil {
+		if err := e.Cache.Put(ctx, key, files); err != nil {
+			fmt.Fprintf(stderr, "hmake: cache: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// cacheable reports whether t's output may be kept in the cache: it must
+// be a file made by a recipe
+func (e *Engine) cacheable(t makefile.Target) bool {
+	return e.Cache != nil && len(t.Commands) > 0 && t.Fetch == nil && !e.Makefile.Phony[t.Name]
+}
+
+// made returns the files t's recipe made, or nil if any is missing. A
+// target with other outputs needn't be a file itself.
+func (e *Engine) made(t makefile.Target) []string {
+	fsys := e.Makefile.FileSystem()
+	files := []string{}
+	if _, err := fsys.Stat(t.Name); err == nil {
+		files = append(files, t.Name)
+	} else if len(t.Outputs) == 0 || e.Makefile.IsFileTarget(t.Name) {
+		return nil
+	}
+
+	for _, out := range t.Outputs {
+		if _, err := fsys.Stat(out); err != nil {
+			return nil
+		}
+		files = append(files, out)
+	}
+	return files
+}
+
+func (e *Engine) afterTarget(t makefile.Target, d time.Duration, err error) {
+	if e.AfterTarget != nil {
+		e.AfterTarget(t, d, err)
+	}
+}
+
+func flush(w io.Writer) {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,305 @@
+package build_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/hmaketest"
+)
+
+// These check that targets are remade when, and in the order, GNU make
+// would remake them
+
+const objects = `
+	app: main.o util.o
+		cat main.o util.o > app
+	main.o: main.c
+		cp main.c main.o
+	util.o: util.c
+		cp util.c util.o
+`
+
+func newObjects(t *testing.T) *hmaketest.Project {
+	return hmaketest.New(t, objects, map[string]string{"main.c": "main\n", "util.c": "util\n"})
+}
+
+func TestUpToDate(t *testing.T) {
+	p := newObjects(t)
+
+	r := p.Run("app")
+	r.AssertOK(t)
+	r.AssertRan(t, "main.o", "util.o", "app")
+	p.AssertFile("app", "main\nutil\n")
+
+	r = p.Run("app")
+	r.AssertOK(t)
+	r.AssertRan(t)
+}
+
+// TestUpToDateNotExpanded checks that the recipe of a target that isn't
+// remade is never expanded, so its $(shell) commands don't run
+func TestUpToDateNotExpanded(t *testing.T) {
+	p := hmaketest.New(t, `
+		out: in
+			cp in out $(shell echo expanded >> "$(DIR)/log")
+	`, map[string]string{"in": ""})
+	dir := "DIR=" + p.Dir
+
+	p.Run("out", dir).AssertOK(t)
+	r := p.Run("out", dir)
+	r.AssertOK(t)
+	r.AssertRan(t)
+	p.AssertFile("log", "expanded\n")
+}
+
+func TestNewerPrerequisite(t *testing.T) {
+	p := newObjects(t)
+	p.Run("app").AssertOK(t)
+
+	for _, name := range []string{"main.c", "util.c", "main.o", "util.o", "app"} {
+		p.Touch(name, time.Hour)
+	}
+	p.WriteFile("util.c", "util 2\n")
+
+	r := p.Run("app")
+	r.AssertOK(t)
+	r.AssertRan(t, "util.o", "app")
+	p.AssertFile("app", "main\nutil 2\n")
+}
+
+func TestMissingTarget(t *testing.T) {
+	p := newObjects(t)
+	p.Run("app").AssertOK(t)
+
+	if err := os.Remove(filepath.Join(p.Dir, "main.o")); err != nil {
+		t.Fatal(err)
+	}
+	r := p.Run("app")
+	r.AssertOK(t)
+	r.AssertRan(t, "main.o", "app")
+}
+
+func TestPhony(t *testing.T) {
+	p := hmaketest.New(t, `
+		.PHONY: test
+		test:
+			@echo testing
+	`, map[string]string{"test": ""})
+
+	for i := 0; i < 2; i++ {
+		r := p.Run("test")
+		r.AssertOK(t)
+		r.AssertRan(t, "test")
+	}
+}
+
+func TestParallelOrder(t *testing.T) {
+	p := newObjects(t)
+	p.Options = build.Options{Jobs: 4}
+
+	r := p.Run("app")
+	r.AssertOK(t)
+	r.AssertRanBefore(t, "main.o", "app")
+	r.AssertRanBefore(t, "util.o", "app")
+	p.AssertFile("app", "main\nutil\n")
+}
+
+func TestLongestChainFirst(t *testing.T) {
+	p := hmaketest.New(t, `
+		.PHONY: all a b first slow
+		all: a b slow
+		a b first:
+			@:
+		slow: first
+			@:
+	`, nil)
+	p.Options = build.Options{Jobs: 2, Durations: map[string]time.Duration{"slow": time.Minute}}
+
+	// first starts the slowest chain, so it's started ahead of a and b
+	r := p.Run("all")
+	r.AssertOK(t)
+	r.AssertRanBefore(t, "first", "a")
+	r.AssertRanBefore(t, "first", "b")
+}
+
+func TestPool(t *testing.T) {
+	// Two recipes of the pool running at once would fail to make link.lock
+	p := hmaketest.New(t, `
+		.PHONY: all a b c other
+		.POOL: link depth=1 a b c
+		all: a b c other
+		a b c:
+			mkdir link.lock && sleep 0.05 && rmdir link.lock
+		other:
+			@:
+	`, nil)
+	p.Options = build.Options{Jobs: 4}
+
+	r := p.Run("all")
+	r.AssertOK(t)
+	if len(r.Ran) != 5 {
+		t.Fatalf("ran %v, want every target", r.Ran)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	p := hmaketest.New(t, `
+		all: broken other
+		broken:
+			false
+			touch broken
+		other: broken
+			touch other
+	`, nil)
+
+	r := p.Run("all")
+	r.AssertFailed(t)
+	r.AssertRan(t, "broken")
+	p.AssertNoFile("broken")
+	p.AssertNoFile("other")
+}
+
+func TestKeepGoing(t *testing.T) {
+	p := hmaketest.New(t, `
+		all: broken fine
+		broken:
+			false
+		fine:
+			touch fine
+	`, nil)
+	p.Options = build.Options{KeepGoing: true}
+
+	r := p.Run("all")
+	r.AssertFailed(t)
+	p.AssertFile("fine", "")
+}
+
+func TestNoRule(t *testing.T) {
+	p := hmaketest.New(t, `
+		app: missing.c
+			touch app
+	`, nil)
+
+	r := p.Run("app")
+	r.AssertFailed(t)
+	var missing *build.MissingError
+	if !errors.As(r.Err, &missing) {
+		t.Fatalf("got %v, want a *build.MissingError", r.Err)
+	}
+	p.AssertNoFile("app")
+}
+
+func TestDryRun(t *testing.T) {
+	p := newObjects(t)
+	p.Options = build.Options{DryRun: true}
+
+	r := p.Run("app")
+	r.AssertOK(t)
+	if !strings.Contains(r.Output, "cp main.c main.o") {
+		t.Fatalf("output %q doesn't print the commands", r.Output)
+	}
+	p.AssertNoFile("main.o")
+	p.AssertNoFile("app")
+}
+
+func TestTempDir(t *testing.T) {
+	p := hmaketest.New(t, `
+		all: a b
+		a b:
+			test -d "$$TMPDIR" && test -z "$$(ls -A "$$TMPDIR")"
+			touch "$$TMPDIR/left"
+			echo "$(TMPDIR)" > $@
+	`, nil)
+	p.Options = build.Options{Jobs: 2, TempDir: t.TempDir()}
+
+	p.Run("all").AssertOK(t)
+	a, err := os.ReadFile(filepath.Join(p.Dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(p.Dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(a) == string(b) {
+		t.Fatalf("a and b were both given %s", a)
+	}
+	if _, err := os.Stat(strings.TrimSpace(string(a))); err == nil {
+		t.Fatalf("%s wasn't removed", a)
+	}
+}
+
+func TestDownloadCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "tool")
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256([]byte("tool"))
+	p := hmaketest.New(t, fmt.Sprintf("tool.tar.gz: %s/tool.tar.gz sha256=%s\n", server.URL, hex.EncodeToString(sum[:])), nil)
+	cache := t.TempDir()
+	p.Options = build.Options{DownloadCache: cache}
+	chdir(t, p.Dir)
+
+	p.Run("tool.tar.gz").AssertOK(t)
+	p.AssertFile("tool.tar.gz", "tool")
+
+	// Taken from the cache, whole, when the target is missing
+	if err := os.Remove(filepath.Join(p.Dir, "tool.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	p.Run("tool.tar.gz").AssertOK(t)
+	p.AssertFile("tool.tar.gz", "tool")
+	if requests != 1 {
+		t.Fatalf("downloaded %d times, want once", requests)
+	}
+
+	// And downloaded again when the cached copy is corrupt
+	if err := os.WriteFile(filepath.Join(cache, hex.EncodeToString(sum[:])), []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(p.Dir, "tool.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	p.Run("tool.tar.gz").AssertOK(t)
+	p.AssertFile("tool.tar.gz", "tool")
+	if requests != 2 {
+		t.Fatalf("downloaded %d times, want twice", requests)
+	}
+
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".hmake-") {
+			t.Fatalf("%s was left behind", entry.Name())
+		}
+	}
+}
+
+// chdir changes to dir until the test finishes, for what the engine does
+// with files itself, such as downloads, rather than through the makefile's
+// file system
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
@@ -0,0 +1,135 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// ClobberedError reports a prerequisite of a target that changed after the
+// target's recipe started, most likely written by another recipe of the
+// same build: a sign that the makefile orders the two wrongly or not at all
+type ClobberedError struct {
+	File   string
+	Target string
+
+	// By are the targets whose recipes were running when the file changed
+	By []string
+}
+
+func (e *ClobberedError) Error() string {
+	msg := fmt.Sprintf("%s, a prerequisite of '%s', changed after its recipe started", e.File, e.Target)
+	if len(e.By) > 0 {
+		msg += fmt.Sprintf(", while '%s' ran; is a dependency between them missing?", strings.Join(e.By, "', '"))
+	}
+	return msg
+}
+
+// timestampSlack allows for file times coming from a coarser clock than
+// time.Now, so lagging it by a few milliseconds
+const timestampSlack = 20 * time.Millisecond
+
+// recipeRun is when a recipe ran, and what its prerequisites were as it
+// started and as it finished
+type recipeRun struct {
+	target     string
+	commands   bool
+	start, end time.Time
+	before     map[string]fileVersion
+	after      map[string]fileVersion
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshotInputs notes t's file prerequisites as its recipe starts, when
+// the engine has somewhere to report them clobbered
+func (s *scheduler) snapshotInputs(t makefile.Target) {
+	if s.e.Clobbered == nil || s.e.DryRun {
+		return
+	}
+
+	files := []string{}
+	for _, dep := range t.Dependencies {
+		if !s.e.Makefile.Phony[dep] {
+			files = append(files, dep)
+		}
+	}
+	s.runs[t.Name] = &recipeRun{target: t.Name, commands: len(t.Commands) > 0, start: time.Now(), before: s.versions(files)}
+}
+
+// ranUntil notes that name's recipe finished at end, and what its
+// prerequisites were then
+func (s *scheduler) ranUntil(name string, end time.Time) {
+	if run := s.runs[name]; run != nil {
+		run.end = end
+		run.after = s.versions(sortedKeys(run.before))
+	}
+}
+
+// versions stats those of files that exist
+func (s *scheduler) versions(files []string) map[string]fileVersion {
+	versions := map[string]fileVersion{}
+	for _, file := range files {
+		if info, err := s.e.Makefile.FileSystem().Stat(file); err == nil && !info.IsDir() {
+			versions[file] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return versions
+}
+
+// checkClobbered reports the prerequisites of targets made in this build
+// that have changed since their recipes started. A file changed while only
+// its target's own recipe ran was changed by that recipe, as formatters do,
+// and isn't reported.
+func (s *scheduler) checkClobbered() {
+	if s.e.Clobbered == nil {
+		return
+	}
+
+	for _, name := range sortedKeys(s.runs) {
+		run := s.runs[name]
+		if run.after == nil {
+			continue
+		}
+		now := s.versions(sortedKeys(run.after))
+		for _, file := range sortedKeys(run.after) {
+			version, ok := now[file]
+			switch {
+			case !ok:
+				continue
+			case version != run.after[file]:
+				s.e.Clobbered(&ClobberedError{File: file, Target: name, By: s.runningAt(version.modTime, run)})
+			case run.after[file] != run.before[file]:
+				if by := s.runningAt(version.modTime, run); len(by) > 0 {
+					s.e.Clobbered(&ClobberedError{File: file, Target: name, By: by})
+				}
+			}
+		}
+	}
+}
+
+// runningAt returns the targets other than except whose recipes were
+// running at t
+func (s *scheduler) runningAt(t time.Time, except *recipeRun) []string {
+	by := []string{}
+	for _, run := range s.runs {
+		if run == except || !run.commands {
+			continue
+		}
+		end := run.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		if !t.Before(run.start.Add(-timestampSlack)) && !t.After(end.Add(timestampSlack)) {
+			by = append(by, run.target)
+		}
+	}
+	sort.Strings(by)
+	return by
+}
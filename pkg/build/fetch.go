@@ -0,0 +1,181 @@
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// ChecksumError reports a download that didn't have the checksum its rule
+// gave
+type ChecksumError struct {
+	Target string
+	URL    string
+	Want   string
+	Got    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("[%s] %s has sha256 %s, not %s", e.Target, e.URL, e.Got, e.Want)
+}
+
+// fetch downloads the file t is made from. A download with a checksum is
+// kept in DownloadCache, if set, and taken from there the next time it's
+// needed.
+func (e *Engine) fetch(ctx context.Context, t makefile.Target, stdout io.Writer) error {
+	f := t.Fetch
+	fmt.Fprintf(stdout, "Downloading %s to %s\n", f.URL, t.Name)
+	if e.DryRun || e.Runner.DryRun {
+		return nil
+	}
+
+	if dir := filepath.Dir(t.Name); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	cached := ""
+	if e.DownloadCache != "" && f.SHA256 != "" {
+		cached = filepath.Join(e.DownloadCache, f.SHA256)
+		if err := copyVerified(cached, t.Name, f.SHA256); err == nil {
+			return nil
+		}
+	}
+
+	tmp, err := download(ctx, f.URL, t.Name)
+	if err != nil {
+		return fmt.Errorf("[%s] %w", t.Name, err)
+	}
+	defer os.Remove(tmp)
+
+	if f.SHA256 != "" {
+		if got, err := fileSHA256(tmp); err != nil {
+			return err
+		} else if got != f.SHA256 {
+			return &ChecksumError{Target: t.Name, URL: f.URL, Want: f.SHA256, Got: got}
+		}
+	}
+
+	if cached != "" {
+		// A failure to cache only costs a download next time
+		if os.MkdirAll(e.DownloadCache, 0o755) == nil {
+			copyFile(tmp, cached)
+		}
+	}
+	return os.Rename(tmp, t.Name)
+}
+
+// download fetches url into a temporary file beside target, so that a
+// failed download never leaves a partial target behind
+func download(ctx context.Context, url, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(target), ".hmake-download-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// copyVerified copies a cached download to target if the copy has the
+// checksum it was cached under
+func copyVerified(cached, target, sum string) error {
+	tmp, err := copyTemp(cached, target)
+	if err != nil {
+		return err
+	}
+	if got, err := fileSHA256(tmp); err != nil || got != sum {
+		os.Remove(tmp)
+		if err != nil {
+			return err
+		}
+		os.Remove(cached)
+		return fmt.Errorf("%s is corrupt", cached)
+	}
+	return rename(tmp, target)
+}
+
+// copyFile copies from to a temporary file beside to, renamed into place
+// once it's complete, so that a failed copy never leaves a partial file
+func copyFile(from, to string) error {
+	tmp, err := copyTemp(from, to)
+	if err != nil {
+		return err
+	}
+	return rename(tmp, to)
+}
+
+// copyTemp copies from to a new temporary file beside to, giving its name
+func copyTemp(from, to string) (string, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(to), ".hmake-copy-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// rename moves tmp into place as name, removing it if it can't be
+func rename(tmp, name string) error {
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
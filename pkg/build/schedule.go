@@ -0,0 +1,338 @@
+package build
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// scheduler runs the targets of a plan as their prerequisites finish,
+// keeping up to Jobs recipes running at once. Targets that become ready
+// together are started in the order of the plan, so a build with one job
+// runs in the same order every time.
+type scheduler struct {
+	e     *Engine
+	stale *graph.Checker
+
+	// index is the position of each target in the plan
+	index map[string]int
+
+	// chain is how long each target and what depends on it took to make
+	// last time, along the slowest path to a goal, if that's known
+	chain map[string]time.Duration
+
+	// waiting counts the prerequisites of each target still to finish, and
+	// dependents lists the targets waiting on each
+	waiting    map[string]int
+	dependents map[string][]string
+
+	ready   readyQueue
+	running int
+	done    chan result
+
+	// pooled counts the recipes running in each pool, and held has the
+	// ready targets of each waiting for it to have room
+	pooled map[string]int
+	held   map[string]*readyQueue
+
+	// failed holds the targets that couldn't be made
+	failed   map[string]bool
+	firstErr error
+
+	// redact hides the values of secret variables from the build's output
+	redact *Redactor
+
+	// tempRoot, if set, is the directory made for this build that its
+	// recipes' temporary directories are in
+	tempRoot string
+
+	// runs are the recipes run, to check afterwards that none changed the
+	// prerequisites of another after it had started
+	runs map[string]*recipeRun
+}
+
+// result is what became of a target that was run
+type result struct {
+	target   makefile.Target
+	duration time.Duration
+	err      error
+}
+
+func newScheduler(e *Engine, plan []string) *scheduler {
+	s := &scheduler{
+		e:          e,
+		stale:      graph.NewChecker(e.Makefile),
+		index:      map[string]int{},
+		waiting:    map[string]int{},
+		dependents: map[string][]string{},
+		done:       make(chan result),
+		pooled:     map[string]int{},
+		held:       map[string]*readyQueue{},
+		failed:     map[string]bool{},
+		runs:       map[string]*recipeRun{},
+		redact:     NewRedactor(e.Makefile),
+	}
+
+	for i, name := range plan {
+		s.index[name] = i
+	}
+
+	for _, name := range plan {
+		counted := map[string]bool{}
+		for _, dep := range e.Makefile.Targets[name].Dependencies {
+			if _, planned := s.index[dep]; planned && !counted[dep] {
+				counted[dep] = true
+				s.waiting[name]++
+				s.dependents[dep] = append(s.dependents[dep], name)
+			}
+		}
+
+	}
+
+	if e.Jobs > 1 && len(e.Durations) > 0 {
+		s.chain = map[string]time.Duration{}
+		for i := len(plan) - 1; i >= 0; i-- {
+			name := plan[i]
+			longest := time.Duration(0)
+			for _, dependent := range s.dependents[name] {
+				longest = max(longest, s.chain[dependent])
+			}
+			s.chain[name] = e.Durations[name] + longest
+		}
+	}
+
+	for _, name := range plan {
+		if s.waiting[name] == 0 {
+			s.ready = append(s.ready, s.readyTarget(name))
+		}
+	}
+	heap.Init(&s.ready)
+	return s
+}
+
+// readyTarget gives name with the keys it's ordered by in the ready queue,
+// as they were worked out for the plan
+func (s *scheduler) readyTarget(name string) readyTarget {
+	return readyTarget{name: name, chain: s.chain[name], index: s.index[name]}
+}
+
+func (s *scheduler) run(ctx context.Context) error {
+	if err := s.makeTempRoot(); err != nil {
+		return err
+	}
+	jobs := max(s.e.Jobs, 1)
+	stopping := false
+
+	for {
+		for !stopping && s.running < jobs {
+			name, ok := s.next()
+			if !ok || ctx.Err() != nil {
+				break
+			}
+			if err := s.start(ctx, name); err != nil && !s.e.KeepGoing {
+				stopping = true
+			}
+		}
+
+		if s.running == 0 {
+			break
+		}
+
+		r := <-s.done
+		s.running--
+		if r.target.Pool != "" {
+			s.release(r.target.Pool)
+		}
+		s.ranUntil(r.target.Name, time.Now())
+		s.e.afterTarget(r.target, r.duration, r.err)
+		s.finish(r.target.Name, r.err)
+
+		// Without keeping going, whatever is running is left to finish but
+		// nothing more is started
+		if r.err != nil && (!s.e.KeepGoing || ctx.Err() != nil) {
+			stopping = true
+		}
+	}
+
+	if s.tempRoot != "" {
+		os.RemoveAll(s.tempRoot)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.checkClobbered()
+	if !stopping && len(s.waiting) > 0 {
+		return fmt.Errorf("targets never became ready: %v", sortedKeys(s.waiting))
+	}
+	return s.firstErr
+}
+
+// next takes the ready target with the longest chain, or failing that the
+// one that comes first in the plan, holding those whose pools are full
+// until they have room. A pool that was never given a depth doesn't limit its targets. It
+// reports false if there's no target to take.
+func (s *scheduler) next() (string, bool) {
+	for s.ready.Len() > 0 {
+		r := heap.Pop(&s.ready).(readyTarget)
+		pool := s.e.Makefile.Targets[r.name].Pool
+		if depth, limited := s.e.Makefile.Pools[pool]; !limited || s.pooled[pool] < depth {
+			return r.name, true
+		}
+		held := s.held[pool]
+		if held == nil {
+			held = &readyQueue{}
+			s.held[pool] = held
+		}
+		heap.Push(held, r)
+	}
+	return "", false
+}
+
+// release frees the place in pool of a recipe that has finished, making
+// ready again the first of the targets held waiting for it
+func (s *scheduler) release(pool string) {
+	s.pooled[pool]--
+	if held := s.held[pool]; held != nil && held.Len() > 0 {
+		heap.Push(&s.ready, heap.Pop(held))
+	}
+}
+
+// readyTarget is a target in the ready queue
+type readyTarget struct {
+	name  string
+	chain time.Duration
+	index int
+}
+
+// readyQueue is a heap of the targets ready to run, the one to run first
+// at the top
+type readyQueue []readyTarget
+
+func (q readyQueue) Len() int { return len(q) }
+
+func (q readyQueue) Less(i, j int) bool {
+	if q[i].chain != q[j].chain {
+		return q[i].chain > q[j].chain
+	}
+	return q[i].index < q[j].index
+}
+
+func (q readyQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *readyQueue) Push(x any) { *q = append(*q, x.(readyTarget)) }
+
+func (q *readyQueue) Pop() any {
+	r := (*q)[len(*q)-1]
+	*q = (*q)[:len(*q)-1]
+	return r
+}
+
+// start runs the recipe for name if it needs remaking, or settles it
+// straight away if it doesn't or can't be, returning why it can't
+func (s *scheduler) start(ctx context.Context, name string) error {
+	delete(s.waiting, name)
+
+	t := s.withTempDir(s.e.Makefile.Targets[name])
+
+	for _, dep := range t.Dependencies {
+		if s.failed[dep] {
+			err := &NotRemadeError{Target: t.Name}
+			s.e.afterTarget(t, 0, err)
+			s.finish(name, err)
+			return err
+		}
+	}
+
+	if err := s.e.missingPrerequisite(t); err != nil {
+		s.e.afterTarget(t, 0, err)
+		s.finish(name, err)
+		return err
+	}
+
+	// Only the recipes of targets that may be remade are expanded, as
+	// expanding one can run $(shell) commands
+	stale := s.stale.Stale(name)
+	var undefined error
+	if stale || s.e.OutOfDate != nil {
+		t.Commands, undefined = s.e.Makefile.ExpandRecipeStrict(ctx, t)
+	}
+	if !stale && (s.e.OutOfDate == nil || !s.e.OutOfDate(t)) {
+		if s.e.UpToDate != nil {
+			s.e.UpToDate(t)
+		}
+		s.finish(name, nil)
+		return nil
+	}
+
+	// A recipe too large to expand is never run cut short
+	var limit *makefile.ExpandLimitError
+	if errors.As(undefined, &limit) {
+		s.e.afterTarget(t, 0, limit)
+		s.finish(name, limit)
+		return limit
+	}
+	if undefined != nil && s.e.StrictVariables {
+		s.e.afterTarget(t, 0, undefined)
+		s.finish(name, undefined)
+		return undefined
+	}
+
+	// Remade now, while only this goroutine uses the checker, so that
+	// everything depending on t is remade too
+	s.stale.Remade(name)
+
+	stdout, stderr := s.e.output(t)
+	if s.e.BeforeTarget != nil {
+		s.e.BeforeTarget(t, stdout)
+	}
+	s.snapshotInputs(t)
+
+	s.running++
+	if t.Pool != "" {
+		s.pooled[t.Pool]++
+	}
+	go func() {
+		start := time.Now()
+		err := s.e.runTarget(ctx, t, s.redact.Writer(stdout), s.redact.Writer(stderr), s.redact)
+		s.done <- result{target: t, duration: time.Since(start), err: err}
+	}()
+	return nil
+}
+
+// finish settles name, making ready the targets that were waiting only on
+// it. A failure is remembered so that they aren't remade.
+func (s *scheduler) finish(name string, err error) {
+	if err != nil {
+		s.failed[name] = true
+
+		// A target not remade because of another failure doesn't count
+		// as a failure in itself
+		if _, notRemade := err.(*NotRemadeError); !notRemade && s.firstErr == nil {
+			s.firstErr = err
+		}
+	}
+
+	for _, dependent := range s.dependents[name] {
+		s.waiting[dependent]--
+		if s.waiting[dependent] == 0 {
+			heap.Push(&s.ready, s.readyTarget(dependent))
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
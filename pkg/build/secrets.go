@@ -0,0 +1,114 @@
+package build
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// redacted replaces the value of a secret variable wherever it would be
+// shown
+const redacted = "***"
+
+// Redactor hides the values of a makefile's secret variables, declared
+// with .SECRET, from the commands a build echoes, what its recipes write
+// and what hooks are told, so that the logs of a deployment don't hold its
+// credentials. A nil Redactor changes nothing.
+type Redactor struct {
+	values   map[string]string
+	replacer *strings.Replacer
+}
+
+// NewRedactor returns the Redactor for mf's secrets, or nil if none has a
+// value
+func NewRedactor(mf *makefile.Makefile) *Redactor {
+	values := mf.SecretValues()
+	if len(values) == 0 {
+		return nil
+	}
+
+	// The longest go first, so a secret containing another is hidden whole
+	secrets := make([]string, 0, len(values))
+	for _, value := range values {
+		secrets = append(secrets, value)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+
+	pairs := []string{}
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, redacted)
+	}
+	return &Redactor{values: values, replacer: strings.NewReplacer(pairs...)}
+}
+
+// Env adds the secrets to a recipe's environment, so that its commands can
+// use them as $$NAME without their values being written into the command
+func (r *Redactor) Env(env map[string]string) map[string]string {
+	if r == nil {
+		return env
+	}
+	withSecrets := make(map[string]string, len(env)+len(r.values))
+	for name, value := range r.values {
+		withSecrets[name] = value
+	}
+	for name, value := range env {
+		withSecrets[name] = value
+	}
+	return withSecrets
+}
+
+// String returns s with the secrets in it replaced by ***
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Writer returns a writer redacting what's written to w
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return &redactWriter{w: w, r: r}
+}
+
+// redactWriter holds back each line until it's complete, so a secret
+// written in pieces is still found
+type redactWriter struct {
+	w       io.Writer
+	r       *Redactor
+	pending []byte
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	end := bytes.LastIndexByte(w.pending, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	lines := w.r.String(string(w.pending[:end+1]))
+	w.pending = append(w.pending[:0], w.pending[end+1:]...)
+	if _, err := io.WriteString(w.w, lines); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the rest of an unfinished line, then flushes the writer
+// underneath
+func (w *redactWriter) Flush() error {
+	if len(w.pending) > 0 {
+		rest := w.r.String(string(w.pending))
+		w.pending = w.pending[:0]
+		if _, err := io.WriteString(w.w, rest); err != nil {
+			return err
+		}
+	}
+	flush(w.w)
+	return nil
+}
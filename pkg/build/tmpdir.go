@@ -0,0 +1,80 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// tempDirVariables are the environment variables programs take their
+// temporary directory from
+var tempDirVariables = []string{"TMPDIR"}
+
+func init() {
+	if runtime.GOOS == "windows" {
+		tempDirVariables = append(tempDirVariables, "TMP", "TEMP")
+	}
+}
+
+// makeTempRoot creates the directory the build's recipes are given theirs
+// in, private to this build, unless there's no TempDir or nothing is run
+func (s *scheduler) makeTempRoot() error {
+	if s.e.TempDir == "" || s.e.DryRun || s.e.Runner.DryRun {
+		return nil
+	}
+	root, err := os.MkdirTemp(s.e.TempDir, "hmake-")
+	if err != nil {
+		return err
+	}
+	s.tempRoot = root
+	return nil
+}
+
+// withTempDir gives t its own directory within the build's for temporary
+// files, as $(TMPDIR) and in the environment of its commands, unless
+// there's none or the makefile sets TMPDIR itself
+func (s *scheduler) withTempDir(t makefile.Target) makefile.Target {
+	if s.tempRoot == "" || s.e.Makefile.SetsTempDir(t) {
+		return t
+	}
+
+	sum := sha256.Sum256([]byte(t.Name))
+	base := strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' || r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, t.Name)
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	t.TempDir = filepath.Join(s.tempRoot, base+"-"+hex.EncodeToString(sum[:4]))
+
+	env := maps.Clone(t.Env)
+	if env == nil {
+		env = map[string]string{}
+	}
+	for _, name := range tempDirVariables {
+		env[name] = t.TempDir
+	}
+	t.Env = env
+	return t
+}
+
+// makeTempDir creates t's temporary directory, giving a function that
+// removes it and whatever the recipe left in it
+func makeTempDir(t makefile.Target) (func(), error) {
+	if t.TempDir == "" {
+		return func() {}, nil
+	}
+	if err := os.Mkdir(t.TempDir, 0o700); err != nil {
+		return nil, err
+	}
+	return func() { os.RemoveAll(t.TempDir) }, nil
+}
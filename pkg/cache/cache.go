@@ -0,0 +1,401 @@
+// Package cache keeps the files targets produce, keyed by everything that
+// went into making them, so that a target made before from the same
+// commands and inputs can be restored instead of made again. Switching
+// branches back and forth then costs a copy rather than a rebuild.
+//
+// A cache is a directory of two parts. Files are kept under cas/ by the
+// SHA-256 of their contents, so each is stored once however many targets
+// produce it. Under ac/, each key names a manifest listing the files its
+// target produced and their digests.
+//
+// A remote Storage, such as an HTTP server or S3 bucket, shares entries
+// between machines. What is missing locally is looked for there, checked against
+// its digest and kept locally too, and what is built is uploaded to it
+// unless the cache is read only.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync/atomic"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// Cache is a local content-addressable cache of target outputs, with an
+// optional remote cache behind it
+type Cache struct {
+	Dir string
+
+	// Remote, if set, is looked in when the local cache misses and is sent
+	// what is put in the local cache
+	Remote Storage
+
+	// ReadOnly takes entries from Remote but never uploads to it, as
+	// developers' machines usually should for a cache filled by CI
+	ReadOnly bool
+
+	// hits and misses count the lookups since the cache was opened
+	hits, misses atomic.Int64
+}
+
+// New returns the cache kept in dir, which is created when first stored to
+func New(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// Manifest records the files a target produced
+type Manifest struct {
+	Outputs []Output `json:"outputs"`
+}
+
+// Output is a file a target produced
+type Output struct {
+	Path   string      `json:"path"`
+	SHA256 string      `json:"sha256"`
+	Mode   fs.FileMode `json:"mode"`
+}
+
+// Key digests what makes t: its name, its expanded commands and
+// environment, the name and contents of each of its prerequisites, and
+// tools, a fingerprint of the programs its commands run such as
+// ToolFingerprint gives. Prerequisites are read from fsys once they're up
+// to date, so anything they were made from is accounted for by their
+// contents.
+func Key(t makefile.Target, fsys vfs.FS, tools string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "target %q\n", t.Name)
+	fmt.Fprintf(h, "tools %s\n", tools)
+	// The recipe's temporary directory is in a different place in each
+	// build, but is empty wherever it is
+	for _, command := range t.UnexpandTempDir(t.Commands) {
+		fmt.Fprintf(h, "command %q\n", command)
+	}
+
+	names := make([]string, 0, len(t.Env))
+	for name := range t.Env {
+		if t.TempDir == "" || t.Env[name] != t.TempDir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "env %q=%q\n", name, t.Env[name])
+	}
+
+	for _, dep := range t.Dependencies {
+		sum, err := digest(fsys, dep)
+		if errors.Is(err, fs.ErrNotExist) {
+			// A phony prerequisite, or one that is a directory, counts by
+			// name alone
+			sum = "-"
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "input %q %s\n", dep, sum)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digest returns the SHA-256 of a regular file
+func digest(fsys vfs.FS, name string) (string, error) {
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fs.ErrNotExist
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// The local cache is laid out as a Dir storage is
+func (c *Cache) manifestPath(key string) string {
+	return Dir(c.Dir).path(Manifests, key)
+}
+
+func (c *Cache) blobPath(sum string) string {
+	return Dir(c.Dir).path(Files, sum)
+}
+
+// Get restores the outputs recorded under key, reporting whether there
+// were any. Nothing is restored unless every output is in the cache intact,
+// and only the files named by outputs are ever written.
+func (c *Cache) Get(ctx context.Context, key string, outputs []string) (bool, error) {
+	restored, err := c.get(ctx, key, outputs)
+	if restored {
+		c.hits.Add(1)
+	} else if err == nil {
+		c.misses.Add(1)
+	}
+	return restored, err
+}
+
+func (c *Cache) get(ctx context.Context, key string, outputs []string) (bool, error) {
+	remote := false
+	data, err := os.ReadFile(c.manifestPath(key))
+	if errors.Is(err, fs.ErrNotExist) && c.Remote != nil {
+		data, err = c.download(ctx, key)
+		remote = true
+	}
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, fmt.Errorf("manifest %s: %w", key, err)
+	}
+	for _, out := range m.Outputs {
+		if !slices.Contains(outputs, out.Path) {
+			return false, fmt.Errorf("manifest %s lists %s, which isn't an output", key, out.Path)
+		}
+	}
+
+	for _, out := range m.Outputs {
+		if _, err := os.Stat(c.blobPath(out.SHA256)); err == nil {
+			continue
+		}
+		if c.Remote == nil {
+			return false, nil
+		}
+		if err := c.downloadBlob(ctx, out.SHA256); errors.Is(err, ErrNotFound) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	if remote {
+		// The remote's own record of use matters to its eviction too
+		c.Remote.Touch(ctx, Manifests, key)
+		for _, out := range m.Outputs {
+			c.Remote.Touch(ctx, Files, out.SHA256)
+		}
+
+		err := writeAtomic(c.manifestPath(key), func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, out := range m.Outputs {
+		if err := c.restore(out); err != nil {
+			return false, err
+		}
+	}
+	c.touch(key, m)
+	return true, nil
+}
+
+// restore copies an output out of the cache, checking its contents on the
+// way so a corrupt entry is never restored
+func (c *Cache) restore(out Output) error {
+	if dir := filepath.Dir(out.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	in, err := os.Open(c.blobPath(out.SHA256))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(out.Path), ".hmake-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != out.SHA256 {
+		os.Remove(c.blobPath(out.SHA256))
+		return fmt.Errorf("%s is corrupt", c.blobPath(out.SHA256))
+	}
+
+	if err := os.Chmod(tmp.Name(), out.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), out.Path)
+}
+
+// Put stores the files named by outputs under key, uploading them to the
+// remote cache unless it's read only
+func (c *Cache) Put(ctx context.Context, key string, outputs []string) error {
+	m := Manifest{Outputs: []Output{}}
+	for _, path := range outputs {
+		out, err := c.store(path)
+		if err != nil {
+			return err
+		}
+		m.Outputs = append(m.Outputs, out)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = writeAtomic(c.manifestPath(key), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil || c.Remote == nil || c.ReadOnly {
+		return err
+	}
+
+	// Files go first, so that no one sees a manifest whose files are
+	// still to come
+	for _, out := range m.Outputs {
+		if err := c.upload(ctx, out.SHA256); err != nil {
+			return err
+		}
+	}
+	return c.Remote.Put(ctx, Manifests, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// maxManifest bounds the size of a manifest taken from a remote cache
+const maxManifest = 1 << 20
+
+// download fetches the manifest for key from the remote cache
+func (c *Cache) download(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.Remote.Get(ctx, Manifests, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, maxManifest))
+}
+
+// downloadBlob fetches a file from the remote cache into the local one,
+// rejecting it unless it has the digest it's stored under
+func (c *Cache) downloadBlob(ctx context.Context, sum string) error {
+	r, err := c.Remote.Get(ctx, Files, sum)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeAtomic(c.blobPath(sum), func(w io.Writer) error {
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+			return fmt.Errorf("remote cache sent %s for %s", got, sum)
+		}
+		return nil
+	})
+}
+
+// upload sends a file of the local cache to the remote one, unless it has
+// it already
+func (c *Cache) upload(ctx context.Context, sum string) error {
+	if stored, err := c.Remote.Contains(ctx, Files, sum); err != nil || stored {
+		return err
+	}
+
+	f, err := os.Open(c.blobPath(sum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return c.Remote.Put(ctx, Files, sum, f, info.Size())
+}
+
+// store copies a file into the cache, unless it's there already
+func (c *Cache) store(path string) (Output, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Output{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Output{}, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	sum, err := digest(vfs.OS, path)
+	if err != nil {
+		return Output{}, err
+	}
+	out := Output{Path: path, SHA256: sum, Mode: info.Mode().Perm()}
+
+	if _, err := os.Stat(c.blobPath(sum)); err == nil {
+		return out, nil
+	}
+	err = writeAtomic(c.blobPath(sum), func(w io.Writer) error {
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(w, in)
+		return err
+	})
+	return out, err
+}
+
+// writeAtomic writes a file through a temporary one beside it, so that
+// builds sharing the cache never see a partial file
+func writeAtomic(name string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats describe what a cache holds, and how often it has been of use
+type Stats struct {
+	Entries int
+	Files   int
+	Size    int64
+
+	// Oldest and Newest are when the least and most recently used entries
+	// were last used
+	Oldest time.Time
+	Newest time.Time
+
+	Hits   int64
+	Misses int64
+}
+
+// GCOptions limit what a cache may hold. Zero values are no limit.
+type GCOptions struct {
+	// MaxSize is the most bytes the cache may hold
+	MaxSize int64
+
+	// MaxAge removes entries unused for longer
+	MaxAge time.Duration
+}
+
+// entry is a manifest found in the cache
+type entry struct {
+	path     string
+	size     int64
+	used     time.Time
+	manifest Manifest
+}
+
+// scan reads every manifest, least recently used first, and the size of
+// every file. With clean, temporary files left behind by interrupted
+// builds are removed.
+func (c *Cache) scan(clean bool) ([]entry, map[string]int64, error) {
+	entries := []entry{}
+	err := walkFiles(filepath.Join(c.Dir, "ac"), clean, func(path string, info fs.FileInfo) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e := entry{path: path, size: info.Size(), used: info.ModTime()}
+		if json.Unmarshal(data, &e.manifest) != nil {
+			// A corrupt manifest is of no use, so goes first
+			e.used = time.Time{}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	blobs := map[string]int64{}
+	err = walkFiles(filepath.Join(c.Dir, "cas"), clean, func(path string, info fs.FileInfo) error {
+		blobs[filepath.Base(path)] = info.Size()
+		return nil
+	})
+	return entries, blobs, err
+}
+
+// walkFiles calls fn for each file under dir that isn't a temporary file
+// being written, removing those more than an hour old if clean
+func walkFiles(dir string, clean bool, fn func(path string, info fs.FileInfo) error) error {
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			if clean && time.Since(info.ModTime()) > time.Hour {
+				os.Remove(path)
+			}
+			return nil
+		}
+		return fn(path, info)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Stats reports what the cache holds
+func (c *Cache) Stats() (Stats, error) {
+	entries, blobs, err := c.scan(false)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := c.counts()
+	stats.Entries = len(entries)
+	stats.Files = len(blobs)
+	for _, e := range entries {
+		stats.Size += e.size
+	}
+	for _, size := range blobs {
+		stats.Size += size
+	}
+	if len(entries) > 0 {
+		stats.Oldest = entries[0].used
+		stats.Newest = entries[len(entries)-1].used
+	}
+	return stats, nil
+}
+
+// GC removes the least recently used entries until the cache is within
+// the limits, and the files no entry refers to. It returns how many
+// entries were removed and how many bytes that freed.
+func (c *Cache) GC(opts GCOptions) (int, int64, error) {
+	entries, blobs, err := c.scan(true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Count the entries referring to each file
+	refs := map[string]int{}
+	for _, e := range entries {
+		for _, out := range e.manifest.Outputs {
+			refs[out.SHA256]++
+		}
+	}
+
+	size := int64(0)
+	for _, e := range entries {
+		size += e.size
+	}
+	for sum, blobSize := range blobs {
+		if refs[sum] > 0 {
+			size += blobSize
+		}
+	}
+
+	removed := 0
+	freed := int64(0)
+	for _, e := range entries {
+		tooOld := opts.MaxAge > 0 && time.Since(e.used) > opts.MaxAge
+		tooBig := opts.MaxSize > 0 && size > opts.MaxSize
+		if !tooOld && !tooBig {
+			break
+		}
+
+		if err := os.Remove(e.path); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		size -= e.size
+		freed += e.size
+		for _, out := range e.manifest.Outputs {
+			refs[out.SHA256]--
+			if refs[out.SHA256] == 0 {
+				size -= blobs[out.SHA256]
+			}
+		}
+	}
+
+	for sum, blobSize := range blobs {
+		if refs[sum] > 0 {
+			continue
+		}
+		if err := os.Remove(c.blobPath(sum)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, freed, err
+		}
+		freed += blobSize
+	}
+	return removed, freed, nil
+}
+
+// touch marks an entry and its files as just used, for GC
+func (c *Cache) touch(key string, m Manifest) {
+	now := time.Now()
+	os.Chtimes(c.manifestPath(key), now, now)
+	for _, out := range m.Outputs {
+		os.Chtimes(c.blobPath(out.SHA256), now, now)
+	}
+}
+
+// counts reads the hits and misses recorded so far
+func (c *Cache) counts() Stats {
+	var stats Stats
+	if data, err := os.ReadFile(filepath.Join(c.Dir, "stats.json")); err == nil {
+		json.Unmarshal(data, &stats)
+	}
+	return Stats{Hits: stats.Hits, Misses: stats.Misses}
+}
+
+// SaveCounts adds the hits and misses since the cache was opened to those
+// recorded in it, and starts counting again
+func (c *Cache) SaveCounts() error {
+	hits, misses := c.hits.Swap(0), c.misses.Swap(0)
+	if hits == 0 && misses == 0 {
+		return nil
+	}
+
+	stats := c.counts()
+	data, err := json.Marshal(struct {
+		Hits   int64
+		Misses int64
+	}{stats.Hits + hits, stats.Misses + misses})
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(c.Dir, "stats.json"), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
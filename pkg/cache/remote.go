@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewRemote returns the Storage at a URL:
+//
+//   - http:// or https:// is a server taking GET and PUT of /ac/<key> and
+//     /cas/<sha256> below the URL, as bazel-remote and nginx with WebDAV
+//     do. Credentials may be given in the URL.
+//   - s3://bucket/prefix is an S3 bucket, with the credentials and region
+//     of the AWS_* environment variables. AWS_ENDPOINT_URL selects another
+//     S3 compatible service such as MinIO.
+//   - file:///path is a directory, such as one shared over NFS.
+func NewRemote(rawURL string) (Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &httpRemote{base: strings.TrimSuffix(rawURL, "/")}, nil
+	case "s3":
+		return newS3Remote(u)
+	case "file":
+		return Dir(u.Path), nil
+	case "grpc", "grpcs":
+		return nil, fmt.Errorf("%s: gRPC caches aren't supported; use an HTTP endpoint, which bazel-remote and most REAPI caches also serve", rawURL)
+	}
+	return nil, fmt.Errorf("%s: remote cache must be an http, https, s3 or file URL", rawURL)
+}
+
+// httpRemote is a cache server taking plain GET and PUT requests. sign, if
+// set, authenticates each request.
+type httpRemote struct {
+	base string
+	sign func(req *http.Request)
+}
+
+func (h *httpRemote) url(kind Kind, digest string) string {
+	return h.base + "/" + string(kind) + "/" + url.PathEscape(digest)
+}
+
+// do sends a request without a body
+func (h *httpRemote) do(ctx context.Context, method string, kind Kind, digest string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.url(kind, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.sign != nil {
+		h.sign(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (h *httpRemote) Get(ctx context.Context, kind Kind, digest string) (io.ReadCloser, error) {
+	resp, err := h.do(ctx, http.MethodGet, kind, digest)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("GET %s: %s", resp.Request.URL.Redacted(), resp.Status)
+}
+
+func (h *httpRemote) Contains(ctx context.Context, kind Kind, digest string) (bool, error) {
+	resp, err := h.do(ctx, http.MethodHead, kind, digest)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	// A server that doesn't answer HEAD is simply sent the entry
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// Touch does nothing, as HTTP caches and S3 lifecycle rules see each GET
+func (h *httpRemote) Touch(ctx context.Context, kind Kind, digest string) error {
+	return nil
+}
+
+func (h *httpRemote) Put(ctx context.Context, kind Kind, digest string, r io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, h.url(kind, digest), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if h.sign != nil {
+		h.sign(req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+// newS3Remote returns a remote storing entries as objects in an S3 bucket.
+// Requests are signed with AWS Signature Version 4.
+func newS3Remote(u *url.URL) (Storage, error) {
+	bucket := u.Host
+	prefix := strings.Trim(u.Path, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("%s: no bucket given", u)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// Virtual hosted buckets on AWS, path style elsewhere
+	base := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		base = strings.TrimSuffix(endpoint, "/") + "/" + bucket
+	}
+	if prefix != "" {
+		base += "/" + prefix
+	}
+
+	key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if key == "" || secret == "" {
+		return nil, fmt.Errorf("%s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", u)
+	}
+	signer := &s3Signer{key: key, secret: secret, token: os.Getenv("AWS_SESSION_TOKEN"), region: region}
+	return &httpRemote{base: base, sign: signer.sign}, nil
+}
+
+type s3Signer struct {
+	key, secret, token string
+	region             string
+}
+
+// sign adds the headers of AWS Signature Version 4 to req. The body isn't
+// signed, which S3 allows over TLS, so it needn't be read twice.
+func (s *s3Signer) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+		signed += ";x-amz-security-token"
+		headers += "x-amz-security-token:" + s.token + "\n"
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonical)
+
+	k := hmacSHA256([]byte("AWS4"+s.secret), date)
+	k = hmacSHA256(k, s.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.key, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotFound is returned by a Storage that doesn't have an entry
+var ErrNotFound = errors.New("not in the cache")
+
+// Kind is one of the two sets of entries a Storage holds
+type Kind string
+
+const (
+	// Manifests are stored by the key of the target that made them
+	Manifests Kind = "ac"
+
+	// Files are stored by the SHA-256 of their contents
+	Files Kind = "cas"
+)
+
+// Storage holds the entries of a cache shared between machines, by their
+// digests. Implementing it lets a cache be kept in any system, such as
+// Artifactory or GCS.
+type Storage interface {
+	// Get returns the entry, or ErrNotFound
+	Get(ctx context.Context, kind Kind, digest string) (io.ReadCloser, error)
+
+	// Put stores an entry of size bytes read from r
+	Put(ctx context.Context, kind Kind, digest string, r io.Reader, size int64) error
+
+	// Contains reports whether the entry is stored, so that it needn't be
+	// sent again
+	Contains(ctx context.Context, kind Kind, digest string) (bool, error)
+
+	// Touch marks the entry as just used, for systems that evict the
+	// least recently used entries. Others may do nothing.
+	Touch(ctx context.Context, kind Kind, digest string) error
+}
+
+// Dir is a Storage in a directory, laid out as a local cache is, which
+// suits a directory shared over NFS
+type Dir string
+
+func (d Dir) path(kind Kind, digest string) string {
+	if len(digest) < 2 {
+		digest = "__" + digest
+	}
+	return filepath.Join(string(d), string(kind), digest[:2], filepath.Base(digest))
+}
+
+func (d Dir) Get(ctx context.Context, kind Kind, digest string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(kind, digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d Dir) Put(ctx context.Context, kind Kind, digest string, r io.Reader, size int64) error {
+	return writeAtomic(d.path(kind, digest), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (d Dir) Contains(ctx context.Context, kind Kind, digest string) (bool, error) {
+	_, err := os.Stat(d.path(kind, digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d Dir) Touch(ctx context.Context, kind Kind, digest string) error {
+	now := time.Now()
+	err := os.Chtimes(d.path(kind, digest), now, now)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
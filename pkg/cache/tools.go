@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// shellWords are the words of shell syntax that a program may follow
+var shellWords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"do": true, "done": true, "while": true, "until": true, "for": true,
+	"case": true, "esac": true, "!": true, "{": true, "}": true,
+	"exec": true, "time": true, "command": true, "env": true,
+}
+
+// Tools returns the programs the commands run, as they're found on PATH,
+// sorted. Shell builtins and programs that aren't found are left out.
+func Tools(commands []string) []string {
+	seen := map[string]bool{}
+	tools := []string{}
+	for _, command := range commands {
+		for _, program := range programs(command) {
+			path, err := osexec.LookPath(program)
+			if err != nil || seen[path] {
+				continue
+			}
+			seen[path] = true
+			tools = append(tools, path)
+		}
+	}
+	sort.Strings(tools)
+	return tools
+}
+
+// programs returns the first word of each simple command of a shell
+// command, skipping variable assignments and shell keywords
+func programs(command string) []string {
+	command = strings.TrimLeft(command, "@-+ \t")
+	split := strings.NewReplacer("&&", "\n", "||", "\n", ";", "\n", "|", "\n", "&", "\n", "(", "\n", ")", "\n", "`", "\n")
+
+	found := []string{}
+	for _, simple := range strings.Split(split.Replace(command), "\n") {
+		for _, word := range strings.Fields(simple) {
+			if shellWords[word] || strings.Contains(word, "=") || strings.HasPrefix(word, "-") {
+				continue
+			}
+			if !strings.ContainsAny(word, "$\"'*?<>") {
+				found = append(found, word)
+			}
+			break
+		}
+	}
+	return found
+}
+
+// toolSums remembers the digest of each tool, by path, size and time, so
+// that each is read once however many recipes use it
+var toolSums = struct {
+	sync.Mutex
+	sums map[string]string
+}{sums: map[string]string{}}
+
+// ToolFingerprint digests the programs the commands run, so that upgrading
+// a compiler changes it
+func ToolFingerprint(commands []string) string {
+	h := sha256.New()
+	for _, tool := range Tools(commands) {
+		fmt.Fprintf(h, "%s %s\n", tool, toolSum(tool))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func toolSum(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "-"
+	}
+	id := fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+
+	toolSums.Lock()
+	sum, ok := toolSums.sums[id]
+	toolSums.Unlock()
+	if ok {
+		return sum
+	}
+
+	sum = "-"
+	if f, err := os.Open(path); err == nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err == nil {
+			sum = hex.EncodeToString(h.Sum(nil))
+		}
+		f.Close()
+	}
+
+	toolSums.Lock()
+	toolSums.sums[id] = sum
+	toolSums.Unlock()
+	return sum
+}
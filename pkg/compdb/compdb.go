@@ -0,0 +1,250 @@
+// Package compdb writes a clang compilation database, compile_commands.json,
+// from the C and C++ compile commands in a makefile's recipes, so that
+// editors and tools such as clangd and clang-tidy know how each file is
+// built.
+package compdb
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Entry is how one source file is compiled
+type Entry struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// Generate finds the compile commands of mf without running anything.
+// Recipes are expanded as for a build; pattern rules such as %.o: %.c are
+// applied to the prerequisites with no rule of their own that they match.
+// CC and CXX default to cc and c++, as in make. dir is the directory the
+// commands run in, given as each entry's directory.
+func Generate(mf *makefile.Makefile, dir string) []Entry {
+	defaultVariable(mf, "CC", "cc")
+	defaultVariable(mf, "CXX", "c++")
+
+	entries := []Entry{}
+	for _, t := range targets(mf) {
+		for _, command := range mf.ExpandRecipe(t) {
+			for _, args := range commands(command) {
+				entries = append(entries, compiles(dir, t.Name, args)...)
+			}
+		}
+	}
+	return entries
+}
+
+// Write writes the compilation database of mf as JSON
+func Write(w io.Writer, mf *makefile.Makefile) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(Generate(mf, dir), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func defaultVariable(mf *makefile.Makefile, name, value string) {
+	if _, ok := mf.Overrides[name]; ok {
+		return
+	}
+	if _, ok := mf.Variables[name]; ok {
+		return
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return
+	}
+	mf.Variables[name] = value
+}
+
+// targets lists the targets with recipes, including those made by pattern
+// rules, in the order they were declared
+func targets(mf *makefile.Makefile) []makefile.Target {
+	patterns := []makefile.Target{}
+	for _, name := range mf.TargetNames {
+		if makefile.IsPatternRule(name) && len(mf.Targets[name].Commands) > 0 {
+			patterns = append(patterns, mf.Targets[name])
+		}
+	}
+
+	found := []makefile.Target{}
+	seen := map[string]bool{}
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		if makefile.IsSpecialTarget(name) || makefile.IsPatternRule(name) {
+			continue
+		}
+		if len(t.Commands) > 0 {
+			found = append(found, t)
+		}
+
+		for _, dep := range t.Dependencies {
+			if _, ok := mf.Targets[dep]; ok || seen[dep] {
+				continue
+			}
+			for _, p := range patterns {
+				if stem, ok := match(p.Name, dep); ok {
+					seen[dep] = true
+					found = append(found, instantiate(p, dep, stem))
+					break
+				}
+			}
+		}
+	}
+	return found
+}
+
+// match reports whether name matches the pattern, and the stem the % stood
+// for
+func match(pattern, name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "%")
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// instantiate applies a pattern rule to make name
+func instantiate(p makefile.Target, name, stem string) makefile.Target {
+	t := makefile.Target{Name: name}
+	for _, dep := range p.Dependencies {
+		t.Dependencies = append(t.Dependencies, strings.ReplaceAll(dep, "%", stem))
+	}
+
+	// $* is the stem, which recipes often use to name the output
+	for _, command := range p.Commands {
+		t.Commands = append(t.Commands, strings.ReplaceAll(command, "$*", stem))
+	}
+	return t
+}
+
+// sourceExtensions are the files a compiler is given to compile
+var sourceExtensions = map[string]bool{
+	".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".c++": true, ".C": true,
+	".m": true, ".mm": true, ".cu": true,
+}
+
+// compiles returns an entry for each source file compiled by args, if
+// it runs a compiler
+func compiles(dir, target string, args []string) []Entry {
+	// Skip variable assignments and wrappers such as ccache
+	for len(args) > 0 && (strings.Contains(args[0], "=") || isWrapper(args[0])) {
+		args = args[1:]
+	}
+	if len(args) == 0 || !isCompiler(args[0]) {
+		return nil
+	}
+
+	output := ""
+	sources := []string{}
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" && i+1 < len(args):
+			output = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-o") && len(arg) > 2:
+			output = arg[2:]
+		case !strings.HasPrefix(arg, "-") && sourceExtensions[filepath.Ext(arg)]:
+			sources = append(sources, arg)
+		}
+	}
+	if output == "" {
+		output = target
+	}
+
+	entries := []Entry{}
+	for _, source := range sources {
+		entries = append(entries, Entry{Directory: dir, File: source, Arguments: args, Output: output})
+	}
+	return entries
+}
+
+func isWrapper(name string) bool {
+	switch filepath.Base(name) {
+	case "ccache", "sccache", "distcc", "env", "time":
+		return true
+	}
+	return false
+}
+
+// isCompiler reports whether name is a C or C++ compiler, allowing for
+// cross compilers such as arm-none-eabi-gcc and versions such as gcc-12
+func isCompiler(name string) bool {
+	base := filepath.Base(name)
+	for _, compiler := range []string{"cc", "c++", "gcc", "g++", "clang", "clang++", "tcc", "icc", "icx", "icpx", "nvcc"} {
+		if base == compiler || strings.HasSuffix(base, "-"+compiler) || strings.HasPrefix(base, compiler+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// commands splits a shell command line into the arguments of each simple
+// command in it, honouring quotes and backslashes. Prefixes make gives
+// meaning to, such as @, are removed first.
+func commands(line string) [][]string {
+	line = strings.TrimLeft(line, "@-+ \t")
+	line = strings.ReplaceAll(line, "\\\n", " ")
+
+	all := [][]string{}
+	args := []string{}
+	var word strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			args = append(args, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(args) > 0 {
+			all = append(all, args)
+		}
+		args = []string{}
+	}
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case ' ', '\t', '\n':
+			endWord()
+		case ';', '&', '|', '(', ')':
+			endCommand()
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				word.WriteByte(line[i])
+				inWord = true
+			}
+		case '\'', '"':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], c)
+			if end < 0 {
+				word.WriteString(line[i+1:])
+				i = len(line)
+				continue
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endCommand()
+	return all
+}
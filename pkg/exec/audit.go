@@ -0,0 +1,90 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditLog records every command a build runs, one JSON object per line,
+// so what a build of a makefile that isn't trusted did can be reviewed. A
+// nil AuditLog records nothing.
+type AuditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// AuditEntry is a line of the audit log
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+
+	// Source is "recipe" for a command of a recipe and "shell" for one
+	// run by $(shell) while the makefile was read
+	Source  string `json:"source"`
+	Target  string `json:"target,omitempty"`
+	Command string `json:"command"`
+
+	// Programs are those the command runs, as CommandPrograms finds them
+	Programs []string `json:"programs"`
+
+	// Denied, if set, is why the policy stopped the command running
+	Denied string `json:"denied,omitempty"`
+
+	// ExitCode and Duration are those of a recipe's command that ran
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Duration float64 `json:"duration_ms,omitempty"`
+}
+
+// NewAuditLog returns an AuditLog writing to w
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{enc: json.NewEncoder(w)}
+}
+
+// Record writes e, timestamped now
+func (l *AuditLog) Record(e AuditEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Time = time.Now()
+	l.enc.Encode(e)
+}
+
+// Audited runs commands with Executor, once Policy allows them, recording
+// each in Log. A command the policy denies fails with 126, as one the
+// shell may not execute does.
+type Audited struct {
+	Executor Executor
+	Policy   *Policy
+	Log      *AuditLog
+
+	// Redact, if set, hides secrets from the commands recorded
+	Redact func(string) string
+}
+
+func (a *Audited) Execute(ctx context.Context, cmd Cmd) int {
+	command := cmd.Command
+	if a.Redact != nil {
+		command = a.Redact(command)
+	}
+	entry := AuditEntry{Source: "recipe", Target: cmd.Target, Command: command, Programs: CommandPrograms(command)}
+
+	var denied *PolicyError
+	if err := a.Policy.Check(cmd.Command); errors.As(err, &denied) {
+		fmt.Fprintf(cmd.Stderr, "hmake: %s\n", err)
+		entry.Denied = denied.Reason
+		a.Log.Record(entry)
+		return 126
+	}
+
+	start := time.Now()
+	code := a.Executor.Execute(ctx, cmd)
+	entry.ExitCode, entry.Duration = &code, float64(time.Since(start))/float64(time.Millisecond)
+	a.Log.Record(entry)
+	return code
+}
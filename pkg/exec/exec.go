@@ -0,0 +1,132 @@
+// Package exec runs the recipes of makefile targets.
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// RecipeError reports a recipe command that exited unsuccessfully
+type RecipeError struct {
+	Target   string
+	ExitCode int
+}
+
+func (e *RecipeError) Error() string {
+	return fmt.Sprintf("[%s] Error %d", e.Target, e.ExitCode)
+}
+
+// Runner runs recipes, printing each command before handing it to an
+// Executor
+type Runner struct {
+	// Shell runs each command as "Shell -c command", or as ShellArgs has
+	// cmd and PowerShell run it
+	Shell string
+
+	// Echo formats a command before it is printed. If nil commands are
+	// printed as they are.
+	Echo func(command string) string
+
+	// DryRun prints every command, silent ones included, without running it
+	DryRun bool
+
+	// OnCommand, if set, is called before each command runs
+	OnCommand func(command string)
+
+	// Executor runs the commands. If nil they are run locally with Shell.
+	Executor Executor
+}
+
+// NewRunner returns a Runner using the DefaultShell
+func NewRunner() *Runner {
+	return &Runner{Shell: DefaultShell()}
+}
+
+// Run executes the commands of a target, stopping at the first that fails.
+// Each command is printed before it runs unless it starts with @.
+func (r *Runner) Run(t makefile.Target, stdout, stderr io.Writer) error {
+	return r.RunContext(context.Background(), t, stdout, stderr)
+}
+
+// RunContext is Run, interrupting the running command once ctx is done and
+// returning ctx's error
+func (r *Runner) RunContext(ctx context.Context, t makefile.Target, stdout, stderr io.Writer) error {
+	env := environ(t.Env)
+	for _, command := range t.Commands {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		silent := strings.HasPrefix(command, "@")
+		if silent {
+			command = command[1:]
+		}
+
+		if !silent || r.DryRun {
+			if r.Echo != nil {
+				fmt.Fprintln(stdout, r.Echo(command))
+			} else {
+				fmt.Fprintln(stdout, command)
+			}
+		}
+
+		if r.OnCommand != nil {
+			r.OnCommand(command)
+		}
+		if r.DryRun {
+			continue
+		}
+
+		if t.Dir != "" {
+			command = InDir(r.Shell, t.Dir, command)
+		}
+		cmd := Cmd{Command: command, Target: t.Name, ResponseFile: t.ResponseFile, Env: env, Inputs: t.Dependencies, Outputs: t.Files(), Stdout: stdout, Stderr: stderr}
+		if code := r.executor().Execute(ctx, cmd); code != 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return &RecipeError{Target: t.Name, ExitCode: code}
+		}
+	}
+
+	return nil
+}
+
+// Command runs cmd with the shell, returning its exit code
+func (r *Runner) Command(cmd string, stdout, stderr io.Writer) int {
+	return r.CommandContext(context.Background(), cmd, stdout, stderr)
+}
+
+// CommandContext is Command, interrupting cmd once ctx is done
+func (r *Runner) CommandContext(ctx context.Context, cmd string, stdout, stderr io.Writer) int {
+	return r.executor().Execute(ctx, Cmd{Command: cmd, Stdout: stdout, Stderr: stderr})
+}
+
+// environ turns a target's environment into "NAME=value" pairs, sorted so
+// commands see them in the same order every time
+func environ(env map[string]string) []string {
+	pairs := []string{}
+	for name, value := range env {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func (r *Runner) executor() Executor {
+	if r.Executor != nil {
+		return r.Executor
+	}
+	return &Local{Shell: r.Shell}
+}
+
+// System runs cmd with the DefaultShell, connected to hmake's own output
+func System(cmd string) int {
+	return NewRunner().Command(cmd, os.Stdout, os.Stderr)
+}
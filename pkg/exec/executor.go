@@ -0,0 +1,218 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Executor runs a single command of a recipe, returning its exit code. A
+// command that can't be started at all exits with 127, as with the shell.
+type Executor interface {
+	Execute(ctx context.Context, cmd Cmd) int
+}
+
+// Cmd is a command for an Executor to run
+type Cmd struct {
+	Command string
+
+	// Target is the target whose recipe the command is part of, if any
+	Target string
+
+	// ResponseFile lets a command too long for the command line be given
+	// its arguments in a response file whatever its program, not just
+	// those known to read them
+	ResponseFile bool
+
+	// Env holds "NAME=value" pairs to set for the command on top of the
+	// environment it would otherwise have
+	Env []string
+
+	// Inputs are the prerequisites of the command's target and Outputs the
+	// files it makes, for executors that run commands on another machine and
+	// must send it the files they need and fetch back what they make
+	Inputs  []string
+	Outputs []string
+
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// killDelay is how long a cancelled command has to exit after being
+// interrupted before it is killed
+const killDelay = 5 * time.Second
+
+// Local runs commands on this machine as "Shell -c command", or as cmd or
+// PowerShell take a command if Shell is one of them. Commands DirectArgs
+// finds need no shell are run without one, and those too long for the
+// command line are given their arguments in a response file if they can be.
+type Local struct {
+	Shell string
+
+	// Dir is the directory commands run in, the current one if empty
+	Dir string
+
+	// Group runs each command in a process group of its own, so that
+	// interrupting it reaches every process it started, not just the shell
+	Group bool
+}
+
+func (l *Local) Execute(ctx context.Context, cmd Cmd) int {
+	if len(cmd.Command) > commandLimit {
+		command, remove, err := spillArguments(l.Shell, cmd.Command, cmd.ResponseFile)
+		if err != nil {
+			fmt.Fprintf(cmd.Stderr, "hmake: response file: %s\n", err)
+		}
+		if remove != nil {
+			defer remove()
+			cmd.Command = command
+		}
+	}
+
+	var c *osexec.Cmd
+	if args := DirectArgs(l.Shell, cmd.Command); args != nil && !setsPath(cmd.Env) {
+		c = osexec.CommandContext(ctx, args[0], args[1:]...)
+	} else {
+		c = osexec.CommandContext(ctx, l.Shell, ShellArgs(l.Shell, cmd.Command)...)
+		rawCommandLine(c, l.Shell, cmd.Command)
+	}
+	c.Dir = l.Dir
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	if l.Group {
+		inGroup(c)
+	}
+	return run(c, cmd)
+}
+
+// setsPath reports whether env changes PATH, which would have the shell
+// find programs elsewhere than hmake would
+func setsPath(env []string) bool {
+	for _, pair := range env {
+		if strings.HasPrefix(pair, "PATH=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Docker runs commands in a new container of Image, with the current
+// directory mounted at the same path and used as the working directory
+type Docker struct {
+	Image string
+
+	// Shell runs each command within the container, sh if empty
+	Shell string
+}
+
+func (d *Docker) Execute(ctx context.Context, cmd Cmd) int {
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(cmd.Stderr, err)
+		return 127
+	}
+
+	shell := d.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+
+	args := []string{"run", "--rm", "-i", "-v", dir + ":" + dir, "-w", dir}
+	for _, env := range cmd.Env {
+		args = append(args, "-e", env)
+	}
+	args = append(args, d.Image, shell, "-c", cmd.Command)
+	return run(osexec.CommandContext(ctx, "docker", args...), cmd)
+}
+
+// SSH runs commands on Host with ssh, in Dir if it's set
+type SSH struct {
+	Host string
+	Dir  string
+}
+
+func (s *SSH) Execute(ctx context.Context, cmd Cmd) int {
+	command := cmd.Command
+	if s.Dir != "" {
+		command = "cd " + shellQuote(s.Dir) + " && " + command
+	}
+
+	// ssh passes on little of the environment, so it's set by the shell
+	for i := len(cmd.Env) - 1; i >= 0; i-- {
+		name, value, _ := strings.Cut(cmd.Env[i], "=")
+		command = "export " + name + "=" + shellQuote(value) + "; " + command
+	}
+	return run(osexec.CommandContext(ctx, "ssh", s.Host, command), cmd)
+}
+
+// Recorder notes the commands it's given instead of running them, which
+// suits tests and tools that want to know what a build would do
+type Recorder struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (r *Recorder) Execute(ctx context.Context, cmd Cmd) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, cmd.Command)
+	return 0
+}
+
+// Commands returns the commands recorded so far, in the order given
+func (r *Recorder) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.commands...)
+}
+
+// run runs c connected to cmd's output, returning its exit code. Once c's
+// context is done the command is interrupted, then killed if it doesn't
+// exit within killDelay.
+func run(c *osexec.Cmd, cmd Cmd) int {
+	c.Stdin = os.Stdin
+	c.Stdout = cmd.Stdout
+	c.Stderr = cmd.Stderr
+	if c.Cancel == nil {
+		c.Cancel = func() error { return interrupt(c) }
+	}
+	c.WaitDelay = killDelay
+	err := c.Run()
+
+	if err == nil {
+		return 0
+	}
+
+	// The command couldn't be started at all
+	if c.ProcessState == nil {
+		fmt.Fprintln(cmd.Stderr, err)
+		return 127
+	}
+
+	// Figure out the exit code
+	if ws, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if ws.Exited() {
+			return ws.ExitStatus()
+		}
+
+		if ws.Signaled() {
+			return -int(ws.Signal())
+		}
+	}
+
+	return -1
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+)
+
+// inGroup does nothing where there are no process groups
+func inGroup(c *osexec.Cmd) {}
+
+// interrupt interrupts c
+func interrupt(c *osexec.Cmd) error {
+	return c.Process.Signal(os.Interrupt)
+}
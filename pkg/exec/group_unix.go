@@ -0,0 +1,20 @@
+//go:build unix
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+	"syscall"
+)
+
+// inGroup starts c in a new process group, which is interrupted as a whole
+func inGroup(c *osexec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error { return syscall.Kill(-c.Process.Pid, syscall.SIGINT) }
+}
+
+// interrupt interrupts c
+func interrupt(c *osexec.Cmd) error {
+	return c.Process.Signal(os.Interrupt)
+}
@@ -0,0 +1,25 @@
+package exec
+
+import (
+	osexec "os/exec"
+	"strconv"
+	"syscall"
+)
+
+// inGroup starts c in a new process group
+func inGroup(c *osexec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// interrupt ends c and every process it started. Windows can't interrupt
+// a process, and killing c alone would leave its children running, so
+// taskkill ends the whole tree.
+func interrupt(c *osexec.Cmd) error {
+	if err := osexec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(c.Process.Pid)).Run(); err != nil {
+		return c.Process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Policy restricts the programs recipes may run, for builds of makefiles
+// that aren't trusted. Programs are matched by the patterns of Allow and
+// Deny, as filepath.Match takes them, against the name a command uses,
+// its base name and where it's found on PATH. Deny wins; with Allow set,
+// nothing else may run. A program that runs others, such as a shell or
+// xargs, is trusted with what it runs.
+type Policy struct {
+	Allow []string
+	Deny  []string
+}
+
+// PolicyError reports a command that runs a program the policy doesn't
+// allow
+type PolicyError struct {
+	Command string
+	Program string
+
+	// Reason says which rule of the policy the program fell foul of
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("'%s' isn't allowed to run: %s", e.Program, e.Reason)
+}
+
+// policyBuiltins are the shell builtins that run nothing else, which any
+// policy allows
+var policyBuiltins = map[string]bool{
+	"cd": true, "echo": true, "printf": true, "test": true, "[": true, "true": true, "false": true,
+	":": true, "export": true, "set": true, "unset": true, "exit": true, "return": true, "shift": true,
+	"read": true, "pwd": true, "wait": true, "trap": true, "umask": true, "local": true,
+}
+
+// LoadPolicy reads a policy file, whose lines each allow or deny the
+// programs matching some patterns:
+//
+//	allow go gcc /usr/bin/*
+//	deny curl wget
+//
+// # starts a comment.
+func LoadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Policy{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+
+		for _, pattern := range words[1:] {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad pattern %q", filename, lineNo, pattern)
+			}
+		}
+		switch words[0] {
+		case "allow":
+			p.Allow = append(p.Allow, words[1:]...)
+		case "deny":
+			p.Deny = append(p.Deny, words[1:]...)
+		default:
+			return nil, fmt.Errorf("%s:%d: expected allow or deny, not %q", filename, lineNo, words[0])
+		}
+	}
+	return p, scanner.Err()
+}
+
+// Check returns a *PolicyError if command runs a program the policy
+// doesn't allow. With an allowlist, a program named by a variable or a
+// pattern isn't allowed either, as there's no telling what it would be;
+// a denylist alone can't stop those.
+func (p *Policy) Check(command string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, program := range CommandPrograms(command) {
+		if policyBuiltins[program] {
+			continue
+		}
+		if strings.ContainsAny(program, "$`*?[") {
+			if len(p.Allow) > 0 {
+				return &PolicyError{Command: command, Program: program, Reason: "only programs named outright can be checked against the allowlist"}
+			}
+			continue
+		}
+
+		if pattern, ok := matchProgram(p.Deny, program); ok {
+			return &PolicyError{Command: command, Program: program, Reason: fmt.Sprintf("denied by '%s'", pattern)}
+		}
+		if _, ok := matchProgram(p.Allow, program); len(p.Allow) > 0 && !ok {
+			return &PolicyError{Command: command, Program: program, Reason: "not in the allowlist"}
+		}
+	}
+	return nil
+}
+
+// matchProgram returns the first of the patterns matching program by its
+// name, its base name or its path
+func matchProgram(patterns []string, program string) (string, bool) {
+	names := []string{program, filepath.Base(program)}
+	if path, err := osexec.LookPath(program); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			names = append(names, abs)
+		}
+	}
+
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// policyKeywords are the words of shell syntax a program may follow, and
+// the builtins that run the program named after them
+var policyKeywords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"do": true, "done": true, "while": true, "until": true, "for": true,
+	"case": true, "esac": true, "!": true, "{": true, "}": true,
+	"exec": true, "time": true, "command": true, "env": true, "nohup": true,
+}
+
+// CommandPrograms returns the program each simple command of a shell
+// command runs, those in $(...), `...` and subshells included: the first
+// word of each after any variable assignments, redirections and shell
+// keywords. Quotes are removed, but variables and patterns are left as
+// written, and a substitution standing for a program name is "$".
+func CommandPrograms(command string) []string {
+	c := &commandScanner{atStart: true}
+	command = strings.TrimLeft(command, "@-+ \t")
+	for i := 0; i < len(command); i++ {
+		ch := command[i]
+		switch {
+		case c.quote == '\'':
+			if ch == '\'' {
+				c.quote = 0
+			} else {
+				c.add(ch)
+			}
+		case ch == '\\' && i+1 < len(command):
+			i++
+			c.add(command[i])
+		case strings.HasPrefix(command[i:], "$(("):
+			// Arithmetic runs nothing
+			if end := strings.Index(command[i:], "))"); end >= 0 {
+				c.word.WriteString(command[i : i+end+2])
+				c.inWord = true
+				i += end + 1
+			}
+		case strings.HasPrefix(command[i:], "$("):
+			c.open('$')
+			i++
+		case ch == '`':
+			if len(c.nested) > 0 && c.nested[len(c.nested)-1].kind == '`' {
+				c.close()
+			} else {
+				c.open('`')
+			}
+		case c.quote == '"':
+			if ch == '"' {
+				c.quote = 0
+			} else {
+				c.add(ch)
+			}
+		case ch == '\'' || ch == '"':
+			c.quote = ch
+			c.inWord = true
+		case ch == '(':
+			c.separate()
+			c.nested = append(c.nested, nesting{kind: '('})
+		case ch == ')':
+			if len(c.nested) > 0 {
+				c.close()
+			} else {
+				c.separate()
+			}
+		case ch == ';' || ch == '&' || ch == '|' || ch == '\n':
+			c.separate()
+		case ch == ' ' || ch == '\t':
+			c.end()
+		default:
+			c.add(ch)
+		}
+	}
+	c.end()
+	return c.programs
+}
+
+// commandScanner holds the state of CommandPrograms
+type commandScanner struct {
+	programs []string
+
+	word     strings.Builder
+	inWord   bool
+	quote    byte
+	atStart  bool
+	skipNext bool
+
+	// nested are the substitutions and subshells the scanner is in, with
+	// the state outside each to return to
+	nested []nesting
+}
+
+type nesting struct {
+	kind     byte
+	word     string
+	atStart  bool
+	quote    byte
+	skipNext bool
+}
+
+func (c *commandScanner) add(ch byte) {
+	c.word.WriteByte(ch)
+	c.inWord = true
+}
+
+// end finishes a word, noting it if it's the program of a command
+func (c *commandScanner) end() {
+	if !c.inWord {
+		return
+	}
+	w := c.word.String()
+	c.word.Reset()
+	c.inWord = false
+
+	switch {
+	case !c.atStart:
+	case c.skipNext:
+		c.skipNext = false
+	case w == ">" || w == ">>" || w == "<" || w == "2>" || w == "2>>" || w == "&>":
+		c.skipNext = true
+	case strings.HasPrefix(w, ">") || strings.HasPrefix(w, "<") || strings.HasPrefix(w, "2>"):
+	case policyKeywords[w] || isAssignment(w) || strings.HasPrefix(w, "-"):
+	default:
+		c.programs = append(c.programs, w)
+		c.atStart = false
+	}
+}
+
+// separate ends a simple command, so the next word is a program
+func (c *commandScanner) separate() {
+	c.end()
+	c.atStart, c.skipNext = true, false
+}
+
+// open starts a substitution, which stands as $ in the word it's part of
+func (c *commandScanner) open(kind byte) {
+	c.nested = append(c.nested, nesting{kind: kind, word: c.word.String() + "$", atStart: c.atStart, quote: c.quote, skipNext: c.skipNext})
+	c.word.Reset()
+	c.inWord = false
+	c.atStart, c.skipNext, c.quote = true, false, 0
+}
+
+// close ends the innermost substitution or subshell
+func (c *commandScanner) close() {
+	c.end()
+	n := c.nested[len(c.nested)-1]
+	c.nested = c.nested[:len(c.nested)-1]
+	if n.kind == '(' {
+		c.atStart, c.skipNext = true, false
+		return
+	}
+	c.atStart, c.quote, c.skipNext = n.atStart, n.quote, n.skipNext
+	c.word.WriteString(n.word)
+	c.inWord = true
+}
+
+// isAssignment reports whether word sets a variable, as NAME=value
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
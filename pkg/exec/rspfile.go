@@ -0,0 +1,150 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// responseFilePrograms are those known to read arguments from "@file":
+// compilers, binutils, linkers and the JDK's tools
+var responseFilePrograms = []string{
+	"cc", "c++", "gcc", "g++", "clang", "clang++", "gfortran", "cpp",
+	"ar", "ranlib", "ld", "ld.lld", "ld.gold", "ld.bfd", "lld", "nm", "objcopy", "objdump", "strip", "as",
+	"javac", "java", "jar", "javadoc", "kotlinc",
+	"cl", "link", "lib", "clang-cl", "lld-link",
+}
+
+// readsResponseFiles reports whether program is known to read @file, as
+// with gcc, x86_64-linux-gnu-gcc and gcc-13
+func readsResponseFiles(program string) bool {
+	base := strings.TrimSuffix(strings.ToLower(filepath.Base(program)), ".exe")
+	for _, known := range responseFilePrograms {
+		if base == known || strings.HasSuffix(base, "-"+known) || strings.HasPrefix(base, known+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// spillArguments writes the arguments of command, one that's too long for
+// the command line, to a response file and returns the command given
+// "@file" instead, with a function removing the file. It does nothing,
+// returning a nil function, if command is anything but a program and its
+// arguments, perhaps run in a directory with "cd dir &&", or its program
+// isn't known to read response files and any isn't allowed. Only commands
+// for POSIX shells are spilled.
+func spillArguments(shell, command string, any bool) (string, func(), error) {
+	words, ok := commandWords(command)
+	if !ok || !posixShells[shellName(shell)] {
+		return command, nil, nil
+	}
+
+	prefix := []string{}
+	if len(words) > 3 && words[0] == "cd" && words[2] == "&&" {
+		prefix, words = words[:3], words[3:]
+	}
+	if len(words) < 2 || !(any || readsResponseFiles(words[0])) {
+		return command, nil, nil
+	}
+
+	f, err := os.CreateTemp("", "hmake-*.rsp")
+	if err != nil {
+		return command, nil, err
+	}
+	var b strings.Builder
+	for _, arg := range words[1:] {
+		b.WriteString(responseFileQuote(arg))
+		b.WriteByte('\n')
+	}
+	_, err = f.WriteString(b.String())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return command, nil, err
+	}
+
+	spilled := append(quoteWords(prefix), shellQuoteIfNeeded(words[0]), shellQuoteIfNeeded("@"+f.Name()))
+	return strings.Join(spilled, " "), func() { os.Remove(f.Name()) }, nil
+}
+
+// commandWords splits command into words as a shell would, if it's only
+// words, quoted or not, and "&&". Anything else the shell would make more
+// of, such as variables, globs or redirections, fails it.
+func commandWords(command string) ([]string, bool) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, false
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			end := strings.IndexByte(command[i+1:], '"')
+			if end < 0 || strings.ContainsAny(command[i+1:i+1+end], "$`\\") {
+				return nil, false
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '&' && !inWord && strings.HasPrefix(command[i:], "&& "):
+			words = append(words, "&&")
+			i++
+		case strings.IndexByte(shellChars, c) >= 0:
+			return nil, false
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, len(words) > 0
+}
+
+// responseFileQuote quotes arg for a response file as gcc, binutils and
+// javac read them, in double quotes with backslashes before quotes and
+// backslashes, if it has spaces or either in it
+func responseFileQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func quoteWords(words []string) []string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		if word == "&&" {
+			quoted[i] = word
+		} else {
+			quoted[i] = shellQuoteIfNeeded(word)
+		}
+	}
+	return quoted
+}
+
+// shellQuoteIfNeeded quotes s for a POSIX shell if it has anything in it
+// the shell would take specially
+func shellQuoteIfNeeded(s string) string {
+	if s != "" && !strings.ContainsAny(s, shellChars+" \t") {
+		return s
+	}
+	return shellQuote(s)
+}
@@ -0,0 +1,76 @@
+package exec
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// DirectExec has commands that need nothing of the shell run without one,
+// as GNU make does, saving starting a shell for each compile of a large
+// build. It's only done for POSIX shells, and not on Windows, where
+// programs parse their own command lines.
+var DirectExec = runtime.GOOS != "windows"
+
+// shellChars are those that mean something to a POSIX shell, so that a
+// command with any of them needs one
+const shellChars = "#;\"*?[]&|<>(){}$`^~!'\\\n"
+
+// shellBuiltins are the commands a POSIX shell runs itself, or that change
+// the shell, so can't be run as programs
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "alias": true, "bg": true, "break": true, "case": true, "cd": true,
+	"command": true, "continue": true, "eval": true, "exec": true, "exit": true, "export": true,
+	"fc": true, "fg": true, "for": true, "getopts": true, "hash": true, "if": true, "jobs": true,
+	"read": true, "readonly": true, "return": true, "set": true, "shift": true, "source": true,
+	"test": true, "times": true, "trap": true, "type": true, "ulimit": true, "umask": true,
+	"unalias": true, "unset": true, "until": true, "wait": true, "while": true,
+}
+
+// DirectArgs returns the program and arguments of command if shell would
+// only split it into words and run it, so that it can be run without the
+// shell, or nil if it needs the shell: for its special characters, a
+// builtin, or a variable set for the command
+func DirectArgs(shell, command string) []string {
+	if !DirectExec || !posixShells[shellName(shell)] || strings.ContainsAny(command, shellChars) {
+		return nil
+	}
+	words := strings.Fields(command)
+	if len(words) == 0 || shellBuiltins[words[0]] || strings.Contains(words[0], "=") {
+		return nil
+	}
+	return words
+}
+
+// posixShells are the shells DirectArgs knows the words of
+var posixShells = map[string]bool{"sh": true, "bash": true, "dash": true, "ksh": true, "zsh": true, "ash": true}
+
+// ShellArgs returns the arguments that have shell run command: "-c command"
+// for POSIX shells, and the flags cmd and PowerShell take instead
+func ShellArgs(shell, command string) []string {
+	switch shellName(shell) {
+	case "cmd":
+		return []string{"/d", "/s", "/c", command}
+	case "pwsh", "powershell":
+		return []string{"-NoProfile", "-NonInteractive", "-Command", command}
+	}
+	return []string{"-c", command}
+}
+
+// InDir returns command changed to run in dir, as shell would take it
+func InDir(shell, dir, command string) string {
+	switch shellName(shell) {
+	case "cmd":
+		return `cd /d "` + dir + `" && ` + command
+	case "pwsh", "powershell":
+		return "Set-Location -ErrorAction Stop -LiteralPath '" + strings.ReplaceAll(dir, "'", "''") + "'; " + command
+	}
+	return "cd " + shellQuote(dir) + " && " + command
+}
+
+// shellName is shell's program name, lowercased and without .exe, whether
+// it's given as a path in either style or a bare name
+func shellName(shell string) string {
+	name := filepath.Base(strings.ReplaceAll(shell, `\`, "/"))
+	return strings.TrimSuffix(strings.ToLower(name), ".exe")
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package exec
+
+import (
+	osexec "os/exec"
+)
+
+// commandLimit is how long a command may be before its arguments are put
+// in a response file, below Linux's 128KiB for the one argument "sh -c"
+// takes and macOS's 256KiB for the arguments and environment together
+const commandLimit = 100 << 10
+
+// DefaultShell returns the shell recipes run with unless another is chosen
+func DefaultShell() string {
+	return "sh"
+}
+
+// rawCommandLine does nothing where programs are given their arguments as
+// they are
+func rawCommandLine(c *osexec.Cmd, shell, command string) {}
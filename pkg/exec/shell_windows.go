@@ -0,0 +1,33 @@
+package exec
+
+import (
+	osexec "os/exec"
+	"syscall"
+)
+
+// commandLimit is how long a command may be before its arguments are put
+// in a response file, below the 32767 characters of a Windows command line
+const commandLimit = 30000
+
+// DefaultShell returns the shell recipes run with unless another is
+// chosen: sh if it's installed, as with Git for Windows or MSYS2, and cmd
+// otherwise, as GNU make does
+func DefaultShell() string {
+	if _, err := osexec.LookPath("sh"); err == nil {
+		return "sh"
+	}
+	return "cmd"
+}
+
+// rawCommandLine hands cmd the command as it was written. cmd doesn't undo
+// the quoting Go gives each argument, so /s /c takes the rest of the line,
+// between one pair of quotes.
+func rawCommandLine(c *osexec.Cmd, shell, command string) {
+	if shellName(shell) != "cmd" {
+		return
+	}
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.CmdLine = syscall.EscapeArg(shell) + ` /d /s /c "` + command + `"`
+}
@@ -0,0 +1,209 @@
+// Package format lays out makefiles in a standard style, in the way gofmt
+// does for Go.
+//
+// Trailing whitespace and runs of blank lines are removed, variable
+// assignments in a block are aligned, recipe lines indented with spaces are
+// given a tab and long prerequisite lists are wrapped.
+package format
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// MaxWidth is the width beyond which prerequisite lists are wrapped
+const MaxWidth = 80
+
+// Source formats the text of a makefile
+func Source(src []byte) ([]byte, error) {
+	f, err := ast.Parse("", bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	return Format(f), nil
+}
+
+// Format returns the formatted text of a parsed makefile
+func Format(f *ast.File) []byte {
+	out := &printer{}
+
+	nodes := sortedNodes(f)
+	for i := 0; i < len(nodes); i++ {
+		switch n := nodes[i].(type) {
+		case *ast.Blank:
+			out.blank()
+
+		case *ast.Assignment:
+			// Consecutive assignments are aligned on their operators
+			block := []*ast.Assignment{n}
+			for i+1 < len(nodes) {
+				next, ok := nodes[i+1].(*ast.Assignment)
+				if !ok {
+					break
+				}
+				block = append(block, next)
+				i++
+			}
+			out.assignments(block)
+
+		default:
+			out.node(n)
+		}
+	}
+
+	return out.bytes()
+}
+
+// sortedNodes flattens the tree into source order, recipes included
+func sortedNodes(f *ast.File) []ast.Node {
+	nodes := []ast.Node{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+
+	// Recipes belong to their rule but may be interleaved with comments
+	for i := 1; i < len(nodes); i++ {
+		for j := i; j > 0 && nodes[j].Pos().Line < nodes[j-1].Pos().Line; j-- {
+			nodes[j], nodes[j-1] = nodes[j-1], nodes[j]
+		}
+	}
+
+	return nodes
+}
+
+type printer struct {
+	lines []string
+
+	// pendingBlank is set when a blank line should precede the next line
+	pendingBlank bool
+}
+
+func (p *printer) blank() {
+	p.pendingBlank = len(p.lines) > 0
+}
+
+func (p *printer) add(line string) {
+	if p.pendingBlank {
+		p.lines = append(p.lines, "")
+		p.pendingBlank = false
+	}
+	p.lines = append(p.lines, line)
+}
+
+func (p *printer) bytes() []byte {
+	if len(p.lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(p.lines, "\n") + "\n")
+}
+
+func (p *printer) node(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Comment:
+		p.add(strings.TrimRight("#"+n.Text, " \t"))
+
+	case *ast.Rule:
+		p.rule(n)
+
+	case *ast.RecipeLine:
+		// Continuation lines of a command start with a tab, as the first does
+		lines := strings.Split(n.Text, "\n")
+		for i, line := range lines {
+			if i == len(lines)-1 {
+				line = strings.TrimRight(line, " \t")
+			}
+			p.add("\t" + line)
+		}
+
+	case *ast.Directive:
+		p.directive(n)
+	}
+}
+
+func (p *printer) directive(n *ast.Directive) {
+	line := n.Name
+	if n.Args != "" {
+		line += " " + n.Args
+	}
+	p.add(line)
+
+	if n.Name == "define" {
+		// The body of a define is its value, so it's left untouched
+		for _, body := range n.Body {
+			p.add(body)
+		}
+		p.add("endef")
+	}
+}
+
+func (p *printer) assignments(block []*ast.Assignment) {
+	width := 0
+	for _, n := range block {
+		width = max(width, len(n.Name))
+	}
+
+	for _, n := range block {
+		line := n.Name + strings.Repeat(" ", width-len(n.Name)) + " " + n.Op
+		if n.Value != "" {
+			line += " " + n.Value
+		}
+		p.add(line + comment(n.Comment))
+	}
+}
+
+func (p *printer) rule(n *ast.Rule) {
+	if n.MissingSeparator {
+		// Not valid make, so leave it for the user to fix
+		p.add(strings.TrimRight(n.Source, " \t"))
+		return
+	}
+
+	head := strings.Join(n.Targets, " ") + ":"
+	if n.DoubleColon {
+		head += ":"
+	}
+	tail := comment(n.Comment)
+
+	line := head
+	for _, prereq := range n.Prerequisites {
+		line += " " + prereq
+	}
+
+	if len(line+tail) <= MaxWidth || len(n.Prerequisites) < 2 {
+		p.add(line + tail)
+		return
+	}
+
+	// Wrap the prerequisites, filling each line as far as MaxWidth
+	lines := []string{}
+	current := head
+	for _, prereq := range n.Prerequisites {
+		if current != head && current != "\t" && len(current)+1+len(prereq)+2 > MaxWidth {
+			lines = append(lines, current+" \\")
+			current = "\t"
+		}
+
+		if current == "\t" {
+			current += prereq
+		} else {
+			current += " " + prereq
+		}
+	}
+	lines = append(lines, current+tail)
+
+	for _, line := range lines {
+		p.add(line)
+	}
+}
+
+func comment(text string) string {
+	text = strings.TrimRight(text, " \t")
+	if text == "" {
+		return ""
+	}
+	return " #" + text
+}
@@ -0,0 +1,185 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Kind is what sort of thing a node of the graph is
+type Kind string
+
+const (
+	Phony   Kind = "phony"   // declared .PHONY
+	Pattern Kind = "pattern" // a pattern rule such as %.o: %.c
+	File    Kind = "file"    // a target that makes a file
+	Task    Kind = "task"    // a target that isn't phony but doesn't look like a file
+	Source  Kind = "source"  // a prerequisite without a rule
+)
+
+// Node is a target or file in an exported graph
+type Node struct {
+	Name         string   `json:"name"`
+	Kind         Kind     `json:"kind"`
+	Dependencies []string `json:"dependencies"`
+}
+
+// Nodes lists what a build of the goals involves, each target followed by
+// the files without rules it needs, in the order they were declared. With
+// no goals every target is included.
+func Nodes(mf *makefile.Makefile, goals []string) []Node {
+	names := []string{}
+	if len(goals) == 0 {
+		for _, name := range mf.TargetNames {
+			if !makefile.IsSpecialTarget(name) {
+				names = append(names, name)
+			}
+		}
+	} else {
+		names = Order(mf, goals)
+	}
+
+	nodes := []Node{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+
+		t, ok := mf.Targets[name]
+		node := Node{Name: name, Kind: kind(mf, name, ok), Dependencies: dedupe(t.Dependencies)}
+		nodes = append(nodes, node)
+	}
+
+	for _, name := range names {
+		add(name)
+	}
+	for _, name := range names {
+		for _, dep := range mf.Targets[name].Dependencies {
+			add(dep)
+		}
+	}
+
+	return nodes
+}
+
+func kind(mf *makefile.Makefile, name string, hasRule bool) Kind {
+	switch {
+	case !hasRule:
+		return Source
+	case mf.Phony[name]:
+		return Phony
+	case makefile.IsPatternRule(name):
+		return Pattern
+	case mf.IsFileTarget(name):
+		return File
+	default:
+		return Task
+	}
+}
+
+func dedupe(words []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			unique = append(unique, w)
+		}
+	}
+	return unique
+}
+
+// dotStyles are the Graphviz attributes of each kind of node
+var dotStyles = map[Kind]string{
+	Phony:   `shape=box, style="rounded,filled", fillcolor=lightblue`,
+	Pattern: `shape=box, style="dashed,filled", fillcolor=lightyellow`,
+	File:    `shape=ellipse, style=filled, fillcolor=palegreen`,
+	Task:    `shape=box, style=filled, fillcolor=khaki`,
+	Source:  `shape=note, style=filled, fillcolor=white`,
+}
+
+// WriteDOT writes the graph of nodes in Graphviz's DOT language, with an
+// edge from each target to its prerequisites
+func WriteDOT(w io.Writer, nodes []Node) error {
+	fmt.Fprintln(w, "digraph hmake {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "\t%s [%s];\n", strconv.Quote(n.Name), dotStyles[n.Kind])
+	}
+	for _, n := range nodes {
+		for _, dep := range n.Dependencies {
+			fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(n.Name), strconv.Quote(dep))
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// mermaidStyles are the Mermaid class definitions of each kind of node
+var mermaidStyles = map[Kind]string{
+	Phony:   "fill:#add8e6,stroke:#333",
+	Pattern: "fill:#ffffe0,stroke:#333,stroke-dasharray:4",
+	File:    "fill:#98fb98,stroke:#333",
+	Task:    "fill:#f0e68c,stroke:#333",
+	Source:  "fill:#fff,stroke:#999",
+}
+
+// WriteMermaid writes the graph of nodes as a Mermaid flowchart, which can
+// be embedded in Markdown
+func WriteMermaid(w io.Writer, nodes []Node) error {
+	ids := map[string]string{}
+	for i, n := range nodes {
+		ids[n.Name] = fmt.Sprintf("n%d", i)
+	}
+
+	fmt.Fprintln(w, "graph LR")
+	for _, n := range nodes {
+		label := strings.ReplaceAll(n.Name, `"`, "#quot;")
+		fmt.Fprintf(w, "    %s[\"%s\"]:::%s\n", ids[n.Name], label, n.Kind)
+	}
+	for _, n := range nodes {
+		for _, dep := range n.Dependencies {
+			fmt.Fprintf(w, "    %s --> %s\n", ids[n.Name], ids[dep])
+		}
+	}
+	for _, kind := range []Kind{Phony, Pattern, File, Task, Source} {
+		fmt.Fprintf(w, "    classDef %s %s\n", kind, mermaidStyles[kind])
+	}
+	return nil
+}
+
+// SchemaVersion is the version of the JSON documents hmake writes for
+// programs, this package's JSONGraph and those of the hmake command's
+// --output=json. Fields may be added without changing it; it changes only
+// when one is removed, renamed or comes to mean something else.
+const SchemaVersion = 1
+
+// JSONGraph is the document written by WriteJSON:
+//
+//	{
+//	  "schema_version": 1,
+//	  "nodes": [
+//	    {"name": "app", "kind": "file", "dependencies": ["main.o"]},
+//	    {"name": "main.o", "kind": "source", "dependencies": []}
+//	  ]
+//	}
+//
+// Nodes come in the order of Nodes. Kind is one of "phony", "pattern",
+// "file", "task" or "source" and each dependency names another node.
+type JSONGraph struct {
+	SchemaVersion int    `json:"schema_version"`
+	Nodes         []Node `json:"nodes"`
+}
+
+// WriteJSON writes the graph of nodes as a JSONGraph
+func WriteJSON(w io.Writer, nodes []Node) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(JSONGraph{SchemaVersion: SchemaVersion, Nodes: nodes})
+}
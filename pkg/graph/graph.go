@@ -0,0 +1,221 @@
+// Package graph works out how the targets of a makefile depend on one
+// another and in what order they must be built.
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	dgraph "github.com/dominikbraun/graph"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// CycleError reports targets that depend on themselves. Path runs from a
+// target through its prerequisites back to the same target, and Pos[i] is
+// where Path[i+1] was listed as a prerequisite of Path[i].
+type CycleError struct {
+	Path []string
+	Pos  []ast.Pos
+}
+
+func newCycleError(mf *makefile.Makefile, path []string) *CycleError {
+	e := &CycleError{Path: path}
+	for i := 0; i+1 < len(path); i++ {
+		e.Pos = append(e.Pos, mf.Targets[path[i]].DependencyPos[path[i+1]])
+	}
+	return e
+}
+
+func (e *CycleError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Circular dependency: %s", strings.Join(e.Path, " -> "))
+	for i, pos := range e.Pos {
+		if pos.Line > 0 {
+			fmt.Fprintf(&b, "\n\t%s:%d: %s depends on %s", pos.Filename, pos.Line, e.Path[i], e.Path[i+1])
+		}
+	}
+	return b.String()
+}
+
+// New builds the dependency graph of a makefile, with an edge from each
+// target to each of its prerequisites. Prerequisites without a rule of
+// their own are files, and leaves of the graph. A prerequisite that would
+// complete a cycle is reported as a CycleError.
+func New(mf *makefile.Makefile) (dgraph.Graph[string, makefile.Target], error) {
+	if cycle := FindCycle(mf); cycle != nil {
+		return nil, cycle
+	}
+
+	targetHash := func(t makefile.Target) string {
+		return t.Name
+	}
+
+	// The cycles are found above, so needn't be looked for as each edge is
+	// added, which takes time growing with the size of the graph
+	g := dgraph.New(targetHash, dgraph.Directed(), dgraph.Acyclic())
+	for _, name := range mf.TargetNames {
+		if name == ".PHONY" {
+			continue
+		}
+
+		g.AddVertex(mf.Targets[name])
+	}
+
+	for _, target := range mf.TargetNames {
+		if target == ".PHONY" {
+			continue
+		}
+
+		for _, dep := range mf.Targets[target].Dependencies {
+			// A prerequisite without a rule is a plain file, a leaf of the
+			// graph, and one listed twice is the same prerequisite as make
+			// sees it
+			if _, ok := mf.Targets[dep]; !ok {
+				g.AddVertex(makefile.Target{Name: dep})
+			}
+
+			if err := g.AddEdge(target, dep); err != nil && !errors.Is(err, dgraph.ErrEdgeAlreadyExists) {
+				return nil, err
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// FindCycle returns the first cycle found in the makefile, or nil if there
+// are none
+func FindCycle(mf *makefile.Makefile) *CycleError {
+	var first *CycleError
+	findCycles(mf, func(cycle *CycleError) bool {
+		first = cycle
+		return false
+	})
+	return first
+}
+
+// DropCycles removes from the makefile each prerequisite that would
+// complete a cycle, as GNU make does, returning the cycles it broke
+func DropCycles(mf *makefile.Makefile) []*CycleError {
+	dropped := []*CycleError{}
+	findCycles(mf, func(cycle *CycleError) bool {
+		dropped = append(dropped, cycle)
+
+		target, dep := cycle.Path[0], cycle.Path[1]
+		t := mf.Targets[target]
+		deps := []string{}
+		for _, d := range t.Dependencies {
+			if d != dep {
+				deps = append(deps, d)
+			}
+		}
+		t.Dependencies = deps
+		mf.Targets[target] = t
+		return true
+	})
+
+	return dropped
+}
+
+// visit is a target being walked depth first, and how many of its
+// prerequisites have been
+type visit struct {
+	name string
+	deps []string
+	next int
+}
+
+// findCycles walks the graph depth first from each target in the order
+// they were declared, so which cycle is found first is the same from run
+// to run, calling found for each prerequisite leading back to a target
+// still being walked, until it returns false. The walk keeps its own stack
+// rather than recursing, so chains of any length are fine.
+func findCycles(mf *makefile.Makefile, found func(*CycleError) bool) {
+	// onStack holds where each target being walked is on the stack, and
+	// done those that have been walked
+	onStack := map[string]int{}
+	done := map[string]bool{}
+
+	for _, root := range mf.TargetNames {
+		if root == ".PHONY" || done[root] {
+			continue
+		}
+
+		stack := []*visit{{name: root, deps: mf.Targets[root].Dependencies}}
+		onStack[root] = 0
+		for len(stack) > 0 {
+			v := stack[len(stack)-1]
+			if v.next == len(v.deps) {
+				delete(onStack, v.name)
+				done[v.name] = true
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			dep := v.deps[v.next]
+			v.next++
+			if at, ok := onStack[dep]; ok {
+				// The path runs from v through dep and back to v
+				path := []string{v.name}
+				for _, w := range stack[at:] {
+					path = append(path, w.name)
+				}
+				if !found(newCycleError(mf, path)) {
+					return
+				}
+				continue
+			}
+
+			if t, ok := mf.Targets[dep]; ok && !done[dep] {
+				onStack[dep] = len(stack)
+				stack = append(stack, &visit{name: dep, deps: t.Dependencies})
+			}
+		}
+	}
+}
+
+// Order lists the targets needed by all of the goals, each once, with
+// every target after its prerequisites. Goals are taken in the order given
+// so prerequisites shared between them are built for the first that needs them.
+func Order(mf *makefile.Makefile, goals []string) []string {
+	order := []string{}
+	visited := map[string]bool{}
+
+	// Walked with a stack of its own, as the chain of prerequisites may be
+	// thousands long
+	for _, goal := range goals {
+		if visited[goal] {
+			continue
+		}
+		visited[goal] = true
+		t, ok := mf.Targets[goal]
+		if !ok {
+			continue
+		}
+
+		stack := []*visit{{name: goal, deps: t.Dependencies}}
+		for len(stack) > 0 {
+			v := stack[len(stack)-1]
+			if v.next == len(v.deps) {
+				order = append(order, v.name)
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			dep := v.deps[v.next]
+			v.next++
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			if t, ok := mf.Targets[dep]; ok {
+				stack = append(stack, &visit{name: dep, deps: t.Dependencies})
+			}
+		}
+	}
+
+	return order
+}
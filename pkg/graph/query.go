@@ -0,0 +1,175 @@
+package graph
+
+import (
+	"sort"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Deps returns everything target depends on, directly or not
+func Deps(mf *makefile.Makefile, target string) map[string]bool {
+	deps := map[string]bool{}
+	queue := []string{target}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, dep := range mf.Targets[current].Dependencies {
+			if !deps[dep] {
+				deps[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	return deps
+}
+
+// ReverseDeps returns every target that depends on target, directly or not
+func ReverseDeps(mf *makefile.Makefile, target string) map[string]bool {
+	dependents := map[string][]string{}
+	for _, name := range mf.TargetNames {
+		if makefile.IsSpecialTarget(name) {
+			continue
+		}
+		for _, dep := range mf.Targets[name].Dependencies {
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	rdeps := map[string]bool{}
+	queue := []string{target}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, name := range dependents[current] {
+			if !rdeps[name] {
+				rdeps[name] = true
+				queue = append(queue, name)
+			}
+		}
+	}
+
+	return rdeps
+}
+
+// Path finds the shortest chain of dependencies leading from one target
+// to another, or nil if from doesn't depend on to
+func Path(mf *makefile.Makefile, from, to string) []string {
+	parent := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if current == to {
+			path := []string{}
+			for n := to; n != ""; n = parent[n] {
+				path = append([]string{n}, path...)
+			}
+			return path
+		}
+
+		for _, dep := range mf.Targets[current].Dependencies {
+			if _, visited := parent[dep]; !visited {
+				parent[dep] = current
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Unreachable returns the targets, in the order they were declared, that
+// no plausible goal depends on: the default goal, phony targets and
+// targets with descriptions are goals someone might give, and anything
+// else is likely left over. Hooks run around other targets, so aren't.
+func Unreachable(mf *makefile.Makefile) []string {
+	reached := map[string]bool{}
+	reach := func(name string) {
+		reached[name] = true
+		for dep := range Deps(mf, name) {
+			reached[dep] = true
+		}
+	}
+
+	for _, goal := range mf.DefaultGoal() {
+		reach(goal)
+	}
+	for _, name := range mf.TargetNames {
+		if mf.Phony[name] || mf.Targets[name].Description != "" {
+			reach(name)
+		}
+	}
+	// The other outputs of a recipe that's needed are made along with it
+	for _, name := range mf.TargetNames {
+		if reached[name] {
+			for _, out := range mf.Targets[name].Outputs {
+				reached[out] = true
+			}
+		}
+	}
+
+	unreachable := []string{}
+	for _, name := range mf.TargetNames {
+		if !reached[name] && !makefile.IsSpecialTarget(name) && !makefile.IsPatternRule(name) && !mf.IsHook(name) {
+			unreachable = append(unreachable, name)
+		}
+	}
+	return unreachable
+}
+
+// Inputs returns the files that building the goals reads without making
+// them, sorted: the prerequisites with no rule, or with a rule that has no
+// recipe or prerequisites of its own, as headers are often given
+func Inputs(mf *makefile.Makefile, goals []string) []string {
+	inputs := []string{}
+	for name := range involved(mf, goals) {
+		t, hasRule := mf.Targets[name]
+		if !hasRule || (len(t.Commands) == 0 && len(t.Dependencies) == 0 && t.Fetch == nil && !mf.Phony[name] && !makefile.IsSpecialTarget(name)) {
+			inputs = append(inputs, name)
+		}
+	}
+	sort.Strings(inputs)
+	return inputs
+}
+
+// Outputs returns the files that building the goals makes, sorted: the
+// targets with recipes that look like files, or are there as files, and
+// the other outputs of their recipes
+func Outputs(mf *makefile.Makefile, goals []string) []string {
+	seen := map[string]bool{}
+	outputs := []string{}
+	for name := range involved(mf, goals) {
+		t, hasRule := mf.Targets[name]
+		if !hasRule || (len(t.Commands) == 0 && t.Fetch == nil) || mf.Phony[name] || makefile.IsSpecialTarget(name) {
+			continue
+		}
+		files := t.Outputs
+		if _, exists := mtime(mf.FileSystem(), name); exists || mf.IsFileTarget(name) {
+			files = t.Files()
+		}
+		for _, file := range files {
+			if !seen[file] {
+				seen[file] = true
+				outputs = append(outputs, file)
+			}
+		}
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+// involved returns the goals and everything they depend on
+func involved(mf *makefile.Makefile, goals []string) map[string]bool {
+	names := map[string]bool{}
+	for _, goal := range goals {
+		names[goal] = true
+		for dep := range Deps(mf, goal) {
+			names[dep] = true
+		}
+	}
+	return names
+}
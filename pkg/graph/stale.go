@@ -0,0 +1,213 @@
+package graph
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// NeedsRebuild reports whether any of the goals, or anything they depend
+// on, is out of date
+func NeedsRebuild(mf *makefile.Makefile, goals []string) bool {
+	c := NewChecker(mf)
+	for _, goal := range goals {
+		if c.Stale(goal) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checker works out which targets are out of date, remembering what it
+// has found so each target is only looked at once
+type Checker struct {
+	mf   *makefile.Makefile
+	seen map[string]bool
+}
+
+// NewChecker returns a Checker for the targets of mf
+func NewChecker(mf *makefile.Makefile) *Checker {
+	return &Checker{mf: mf, seen: map[string]bool{}}
+}
+
+// Stale decides whether target must be remade. Phony targets and missing
+// files always are, as is any file older than one of its prerequisites or
+// with a prerequisite that must be remade. A target with other outputs
+// must be remade if any of them is missing or older.
+func (c *Checker) Stale(target string) bool {
+	if stale, ok := c.seen[target]; ok {
+		return stale
+	}
+
+	// Prerequisites are checked with a stack of their own rather than by
+	// recursing, as the chain of them may be thousands long
+	stack := []*staleCheck{c.start(target)}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		if s.decided || s.next == len(s.deps) {
+			c.seen[s.target] = s.stale
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		dep := s.deps[s.next]
+		stale, ok := c.seen[dep]
+		if !ok {
+			stack = append(stack, c.start(dep))
+			continue
+		}
+		s.next++
+
+		if depTime, exists := mtime(c.mf.FileSystem(), dep); stale || (exists && depTime.After(s.modTime)) {
+			s.stale, s.decided = true, true
+		}
+	}
+	return c.seen[target]
+}
+
+// Remade notes that target has just been remade, so everything depending
+// on it must be too
+func (c *Checker) Remade(target string) {
+	c.seen[target] = true
+}
+
+// staleCheck is a target being checked, and how many of its prerequisites
+// have been
+type staleCheck struct {
+	target  string
+	deps    []string
+	next    int
+	modTime time.Time
+
+	// decided is set once stale is known, without checking the rest
+	decided, stale bool
+}
+
+// start begins checking target, deciding it at once unless it depends on
+// what its prerequisites are
+func (c *Checker) start(target string) *staleCheck {
+	// Assume up to date while visiting so a cycle can't go on forever
+	c.seen[target] = false
+	s := &staleCheck{target: target}
+
+	reasons, modTime := c.ownReasons(target, false)
+	if len(reasons) > 0 {
+		s.stale, s.decided = true, true
+		return s
+	}
+	s.deps, s.modTime = c.mf.Targets[target].Dependencies, modTime
+	return s
+}
+
+// Reason is something that makes a target out of date
+type Reason struct {
+	Cause Cause
+
+	// File is the output or prerequisite it's about, if any
+	File string
+}
+
+// Cause is the sort of thing that makes a target out of date
+type Cause string
+
+const (
+	PhonyTarget       Cause = "phony"              // declared .PHONY, so always remade
+	MissingFile       Cause = "missing"            // the target's file doesn't exist
+	MissingOutput     Cause = "missing output"     // one of its .OUTPUTS doesn't exist
+	ChecksumMismatch  Cause = "checksum mismatch"  // a download whose file has another checksum
+	NewerPrerequisite Cause = "newer prerequisite" // a prerequisite changed after it was made
+	StalePrerequisite Cause = "stale prerequisite" // a prerequisite that must be remade
+)
+
+// Reasons explains why target must be remade, listing everything that
+// makes it so as Stale decides, where Stale stops at the first. It's empty
+// for a target that's up to date. The prerequisites that must be remade
+// are given in the reasons, but not why they must be.
+func (c *Checker) Reasons(target string) []Reason {
+	reasons, modTime := c.ownReasons(target, true)
+
+	// A target with no time of its own has none to be older than
+	timed := !slices.ContainsFunc(reasons, func(r Reason) bool { return r.Cause == PhonyTarget || r.Cause == MissingFile })
+	for _, dep := range c.mf.Targets[target].Dependencies {
+		if c.Stale(dep) {
+			reasons = append(reasons, Reason{Cause: StalePrerequisite, File: dep})
+		} else if depTime, exists := mtime(c.mf.FileSystem(), dep); timed && exists && depTime.After(modTime) {
+			reasons = append(reasons, Reason{Cause: NewerPrerequisite, File: dep})
+		}
+	}
+	return reasons
+}
+
+// ownReasons finds what makes target out of date whatever its
+// prerequisites are, stopping at the first unless all is set, and how old
+// it is, to compare its prerequisites with
+func (c *Checker) ownReasons(target string, all bool) ([]Reason, time.Time) {
+	mf := c.mf
+	t, isTarget := mf.Targets[target]
+	if isTarget && mf.Phony[target] {
+		return []Reason{{Cause: PhonyTarget}}, time.Time{}
+	}
+
+	// A rule with other outputs may be named for what it does rather than
+	// a file, and is as old as the oldest file it makes
+	reasons := []Reason{}
+	modTime, exists := mtime(mf.FileSystem(), target)
+	if !exists && (len(t.Outputs) == 0 || mf.IsFileTarget(target)) {
+		reasons = append(reasons, Reason{Cause: MissingFile})
+		if !all {
+			return reasons, modTime
+		}
+	}
+	for _, out := range t.Outputs {
+		outTime, ok := mtime(mf.FileSystem(), out)
+		if !ok {
+			reasons = append(reasons, Reason{Cause: MissingOutput, File: out})
+			if !all {
+				return reasons, modTime
+			}
+			continue
+		}
+		if !exists || outTime.Before(modTime) {
+			modTime, exists = outTime, true
+		}
+	}
+
+	// A download is fetched again if its checksum has changed
+	if t.Fetch != nil && t.Fetch.SHA256 != "" {
+		if sum, err := fileSHA256(mf.FileSystem(), target); err != nil || sum != t.Fetch.SHA256 {
+			reasons = append(reasons, Reason{Cause: ChecksumMismatch})
+		}
+	}
+	return reasons, modTime
+}
+
+// mtime returns the modification time of a file, and whether it exists
+func mtime(fsys vfs.FS, name string) (time.Time, bool) {
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return info.ModTime(), true
+}
+
+// fileSHA256 returns the hex digest of a file
+func fileSHA256(fsys vfs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
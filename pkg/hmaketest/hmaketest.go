@@ -0,0 +1,232 @@
+// Package hmaketest helps test makefile based projects, and hmake itself.
+//
+// A Project is a makefile and the files it works on, written to a temporary
+// directory. Running it builds goals with hmake and records which targets
+// ran, in order, so a test can check them along with the files produced:
+//
+//	p := hmaketest.New(t, `
+//	app: main.o
+//		cp main.o app
+//	main.o: main.c
+//		cp main.c main.o
+//	`, map[string]string{"main.c": "int main() {}"})
+//
+//	p.Run("app").AssertRan(t, "main.o", "app")
+//	p.AssertFile("app", "int main() {}")
+//	p.Run("app").AssertRan(t)
+package hmaketest
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/build"
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/makefile"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// Project is a makefile with the files around it
+type Project struct {
+	t testing.TB
+
+	// Dir is the temporary directory the project is in
+	Dir string
+
+	// Options are used for every build
+	Options build.Options
+}
+
+// New writes the makefile and files to a new temporary directory, removed
+// when the test finishes. The makefile may be indented as a Go raw string
+// usually is; the indent of its first line is removed from every line.
+func New(t testing.TB, mf string, files map[string]string) *Project {
+	t.Helper()
+
+	p := &Project{t: t, Dir: t.TempDir()}
+	p.WriteFile("Makefile", dedent(mf))
+	for name, content := range files {
+		p.WriteFile(name, content)
+	}
+	return p
+}
+
+// WriteFile creates or replaces a file of the project, with the current
+// time as its modification time
+func (p *Project) WriteFile(name, content string) {
+	p.t.Helper()
+
+	path := filepath.Join(p.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// Touch sets the modification time of a file, relative to now
+func (p *Project) Touch(name string, age time.Duration) {
+	p.t.Helper()
+
+	when := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(p.Dir, name), when, when); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// AssertFile fails the test unless the file exists with the given content
+func (p *Project) AssertFile(name, content string) {
+	p.t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(p.Dir, name))
+	if err != nil {
+		p.t.Fatalf("%s: %v", name, err)
+	}
+	if string(data) != content {
+		p.t.Fatalf("%s contains %q, want %q", name, data, content)
+	}
+}
+
+// AssertNoFile fails the test if the file exists
+func (p *Project) AssertNoFile(name string) {
+	p.t.Helper()
+
+	if _, err := os.Stat(filepath.Join(p.Dir, name)); err == nil {
+		p.t.Fatalf("%s exists", name)
+	}
+}
+
+// Result is the outcome of a build
+type Result struct {
+	// Ran lists the targets whose recipes were run, in the order they
+	// started
+	Ran []string
+
+	// Output is everything the recipes wrote, stdout and stderr together
+	Output string
+
+	// Err is the error the build returned
+	Err error
+}
+
+// Run parses the makefile afresh and builds the goals, with overrides given
+// as "NAME=value" among them as on the command line, or the default goal
+// if there are none
+func (p *Project) Run(goals ...string) *Result {
+	p.t.Helper()
+
+	mf := makefile.NewMakefile()
+	mf.FS = vfs.FromFS(os.DirFS(p.Dir))
+	targets := []string{}
+	for _, goal := range goals {
+		if name, value, ok := strings.Cut(goal, "="); ok {
+			mf.Overrides[name] = value
+			continue
+		}
+		targets = append(targets, goal)
+	}
+	if err := mf.Parse("Makefile"); err != nil {
+		p.t.Fatalf("parsing Makefile: %v", err)
+	}
+
+	var out syncBuffer
+	opts := p.Options
+	opts.Stdout, opts.Stderr = &out, &out
+
+	r := &Result{}
+	var mu sync.Mutex
+	engine := build.New(mf, opts)
+	engine.Runner = &exec.Runner{Executor: &exec.Local{Shell: "sh", Dir: p.Dir}}
+	engine.BeforeTarget = func(t makefile.Target, stdout io.Writer) {
+		mu.Lock()
+		defer mu.Unlock()
+		r.Ran = append(r.Ran, t.Name)
+	}
+
+	if len(targets) == 0 {
+		targets = mf.DefaultGoal()
+	}
+	r.Err = engine.Build(targets)
+	r.Output = out.String()
+	return r
+}
+
+// AssertRan fails the test unless exactly the given targets ran, in order
+func (r *Result) AssertRan(t testing.TB, targets ...string) {
+	t.Helper()
+
+	if !slices.Equal(r.Ran, targets) {
+		t.Fatalf("ran %v, want %v\n%s", r.Ran, targets, r.Output)
+	}
+}
+
+// AssertRanBefore fails the test unless both targets ran, first before
+// second
+func (r *Result) AssertRanBefore(t testing.TB, first, second string) {
+	t.Helper()
+
+	i, j := slices.Index(r.Ran, first), slices.Index(r.Ran, second)
+	if i < 0 || j < 0 || i > j {
+		t.Fatalf("ran %v, want %s before %s", r.Ran, first, second)
+	}
+}
+
+// AssertOK fails the test if the build failed
+func (r *Result) AssertOK(t testing.TB) {
+	t.Helper()
+
+	if r.Err != nil {
+		t.Fatalf("build failed: %v\n%s", r.Err, r.Output)
+	}
+}
+
+// AssertFailed fails the test unless the build failed
+func (r *Result) AssertFailed(t testing.TB) {
+	t.Helper()
+
+	if r.Err == nil {
+		t.Fatalf("build succeeded, want it to fail\n%s", r.Output)
+	}
+}
+
+// syncBuffer collects the output of recipes running at the same time
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// dedent removes the indent of the first non-blank line from every line,
+// the blank lines before it and the indent of the closing backquote after
+// the last
+func dedent(s string) string {
+	lines := strings.Split(strings.TrimLeft(s, "\n"), "\n")
+	if last := len(lines) - 1; last > 0 && strings.TrimLeft(lines[last], " \t") == "" {
+		lines[last] = ""
+	}
+
+	indent := lines[0][:len(lines[0])-len(strings.TrimLeft(lines[0], " \t"))]
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,157 @@
+package lint
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// gnuSpecialTargets are GNU make's special targets other than .PHONY,
+// which hmake reads as ordinary targets that nothing builds
+var gnuSpecialTargets = map[string]bool{
+	".DEFAULT": true, ".DELETE_ON_ERROR": true, ".EXPORT_ALL_VARIABLES": true,
+	".IGNORE": true, ".INTERMEDIATE": true, ".LOW_RESOLUTION_TIME": true,
+	".NOTINTERMEDIATE": true, ".NOTPARALLEL": true, ".ONESHELL": true,
+	".POSIX": true, ".PRECIOUS": true, ".SECONDARY": true,
+	".SECONDEXPANSION": true, ".SILENT": true, ".SUFFIXES": true, ".WAIT": true,
+}
+
+// hmakeSpecialTargets are hmake's own special targets
+var hmakeSpecialTargets = map[string]bool{
+	".PHONY": true, ".OUTPUTS": true, ".POOL": true, ".SECRET": true,
+	".RESPONSE_FILE": true, ".SERVICE": true, ".INHERIT_ENV": true,
+	makefile.OnSuccess: true, makefile.OnFailure: true,
+}
+
+// assignmentOps are the operators of an assignment
+var assignmentOps = map[string]bool{"=": true, ":=": true, "::=": true, "?=": true, "+=": true, "!=": true}
+
+// Compat lists the constructs of f that hmake doesn't yet handle as GNU
+// make does, with where each is, sorted by position. Check names the sort
+// of construct, such as "function" or "directive", and Message what hmake
+// does with it instead.
+func Compat(f *ast.File) []Diagnostic {
+	p := &Pass{File: f}
+	doubleColon := map[string]bool{}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Assignment:
+			p.compatReferences(n.Pos(), n.Value)
+			if name, _, ok := strings.Cut(n.Name, " "); ok {
+				p.compat("directive", n.Pos(), "%s isn't implemented, so the variable set is named '%s'", name, n.Name)
+			}
+
+		case *ast.Rule:
+			p.compatRule(n, doubleColon)
+
+		case *ast.RecipeLine:
+			p.compatReferences(n.Pos(), n.Text)
+			if prefix := strings.TrimLeft(n.Text, "@ \t"); prefix != "" && strings.ContainsAny(prefix[:1], "-+") {
+				p.compat("recipe-prefix", n.Pos(), "the %s prefix of recipe lines isn't implemented, so it runs %s as a command", prefix[:1], strings.Fields(prefix)[0])
+			}
+
+		case *ast.Directive:
+			p.compatReferences(n.Pos(), n.Args)
+			switch {
+			case n.Name == "include" || n.Name == "-include" || n.Name == "sinclude":
+			case n.Name == "ifeq" || n.Name == "ifneq" || n.Name == "ifdef" || n.Name == "ifndef":
+			case n.Name == "else" || n.Name == "endif" || n.Name == "endef":
+			case n.Name == "define":
+				p.compat("directive", n.Pos(), "define isn't implemented, so %s isn't set", directiveVariable(n))
+			default:
+				p.compat("directive", n.Pos(), "%s isn't implemented, so the line is ignored", n.Name)
+			}
+		}
+		return true
+	})
+
+	sort.SliceStable(p.diagnostics, func(i, j int) bool {
+		return p.diagnostics[i].Pos.Line < p.diagnostics[j].Pos.Line
+	})
+	return p.diagnostics
+}
+
+// compat reports a construct hmake doesn't handle, of the sort check
+func (p *Pass) compat(check string, pos ast.Pos, format string, args ...interface{}) {
+	p.check = check
+	p.Report(pos, format, args...)
+}
+
+func (p *Pass) compatRule(n *ast.Rule, doubleColon map[string]bool) {
+	if n.MissingSeparator {
+		if len(n.Targets) > 0 && (n.Targets[0] == "undefine" || n.Targets[0] == "unexport") {
+			p.compat("directive", n.Pos(), "%s isn't implemented, so the line is ignored", n.Targets[0])
+		}
+		return
+	}
+	if len(n.Targets) == 0 || strings.HasPrefix(n.Targets[0], "profile.") {
+		return
+	}
+
+	p.compatReferences(n.Pos(), strings.Join(n.Targets, " ")+" "+n.PrerequisiteText)
+	static := slices.ContainsFunc(n.Prerequisites, func(word string) bool { return strings.HasSuffix(word, ":") })
+	for _, target := range n.Targets {
+		switch {
+		case strings.Contains(target, "$"):
+			p.compat("target-name", n.Pos(), "references in target names aren't expanded, so the target is named '%s'", target)
+		case gnuSpecialTargets[target]:
+			p.compat("special-target", n.Pos(), "%s isn't implemented, so has no effect", target)
+		case makefile.IsSpecialTarget(target) && !hmakeSpecialTargets[target] && len(n.Recipe) > 0 && !strings.Contains(target[1:], "%"):
+			p.compat("suffix-rule", n.Pos(), "suffix rules aren't implemented, so %s is an ordinary target", target)
+		case makefile.IsPatternRule(target) && !static:
+			p.compat("pattern-rule", n.Pos(), "pattern rules aren't applied when building, so files matching %s need rules of their own", target)
+		}
+		if n.DoubleColon && doubleColon[target] {
+			p.compat("double-colon", n.Pos(), "double-colon rules are taken as ordinary ones, so this recipe replaces the one before for %s", target)
+		}
+		doubleColon[target] = doubleColon[target] || n.DoubleColon
+	}
+
+	words := n.Prerequisites
+	for len(words) > 0 && (words[0] == "private" || words[0] == "override" || words[0] == "export") {
+		words = words[1:]
+	}
+	switch {
+	case len(words) == 0 || words[0] == "env" || strings.Contains(words[0], "://"):
+		// Env rules and downloads are hmake's own
+	case (len(words) > 1 && assignmentOps[words[1]]) || strings.Contains(words[0], "="):
+		name, _, _ := strings.Cut(words[0], "=")
+		p.compat("target-variable", n.Pos(), "target-specific variables aren't implemented, so %s is taken as a prerequisite", strings.TrimRight(name, ":+?!"))
+	case strings.Contains(n.PrerequisiteText, ";"):
+		p.compat("inline-recipe", n.Pos(), "recipes after ; aren't implemented, so their words are taken as prerequisites")
+	case static:
+		p.compat("static-pattern", n.Pos(), "static pattern rules aren't implemented, so the target pattern is taken as a prerequisite")
+	case slices.Contains(words, "|"):
+		p.compat("order-only", n.Pos(), "order-only prerequisites aren't implemented, so | is taken as a prerequisite")
+	}
+}
+
+// compatReferences reports the references in text hmake doesn't expand as
+// make does
+func (p *Pass) compatReferences(pos ast.Pos, text string) {
+	makefile.EachReference(text, func(inner string) {
+		name, _, isCall := strings.Cut(inner, " ")
+		switch {
+		case isCall && makefile.IsFunction(name):
+			if !makefile.IsImplemented(name) {
+				p.compat("function", pos, "$(%s) isn't implemented, so expands to nothing", name)
+			}
+		case makefile.IsAutomatic(inner) && !strings.Contains("@<^+", inner):
+			p.compat("automatic", pos, "$%s isn't implemented, so expands to nothing", automaticName(inner))
+		case !strings.Contains(inner, "$") && strings.Contains(inner, ":") && strings.Contains(inner, "="):
+			p.compat("substitution", pos, "substitution references such as $(%s) aren't implemented, so expand to nothing", inner)
+		}
+	})
+}
+
+// automaticName writes an automatic variable as it's usually referred to
+func automaticName(name string) string {
+	if len(name) > 1 {
+		return "(" + name + ")"
+	}
+	return name
+}
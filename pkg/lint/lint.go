@@ -0,0 +1,476 @@
+// Package lint finds likely mistakes in makefiles.
+package lint
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/graph"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Diagnostic is a problem found in a makefile
+type Diagnostic struct {
+	Pos     ast.Pos
+	Check   string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s (%s)", d.Pos, d.Message, d.Check)
+}
+
+// Check is one kind of problem the linter looks for
+type Check struct {
+	Name string
+	Doc  string
+	Run  func(p *Pass)
+}
+
+// Checks are run by Lint, in order
+var Checks = []Check{
+	{"undefined", "variables referred to but never defined", checkUndefined},
+	{"unused", "variables defined but never referred to", checkUnused},
+	{"duplicate", "targets given a recipe more than once", checkDuplicates},
+	{"repeated", "prerequisites listed more than once for a target", checkRepeated},
+	{"phony", "targets that aren't files but aren't declared .PHONY", checkPhony},
+	{"orphan", "targets no goal needs: not the default, phony or documented, nor needed by one", checkOrphans},
+	{"recursion", "recursive variables that refer back to themselves", checkRecursion},
+	{"prerequisites", "files used by a recipe that aren't prerequisites", checkPrerequisites},
+	{"pasted", "curly quotes, dashes and spaces pasted from documents into recipes and values", checkPasted},
+}
+
+// Pass holds what a check needs to know about the makefile being linted
+type Pass struct {
+	File     *ast.File
+	Makefile *makefile.Makefile
+
+	// Exists reports whether a file exists, so checks don't touch the
+	// filesystem directly
+	Exists func(name string) bool
+
+	diagnostics []Diagnostic
+	check       string
+}
+
+// Report records a problem at pos
+func (p *Pass) Report(pos ast.Pos, format string, args ...interface{}) {
+	p.diagnostics = append(p.diagnostics, Diagnostic{Pos: pos, Check: p.check, Message: fmt.Sprintf(format, args...)})
+}
+
+// Lint runs the checks over a parsed makefile, returning what they found
+// sorted by position. With no names given every check is run.
+func Lint(f *ast.File, names ...string) ([]Diagnostic, error) {
+	mf := makefile.NewMakefile()
+	mf.Load(f)
+
+	p := &Pass{File: f, Makefile: mf, Exists: func(name string) bool {
+		_, err := mf.FileSystem().Stat(name)
+		return err == nil
+	}}
+
+	selected := map[string]bool{}
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	for _, name := range names {
+		if !knownCheck(name) {
+			return nil, fmt.Errorf("unknown check %q", name)
+		}
+	}
+
+	for _, check := range Checks {
+		if len(selected) == 0 || selected[check.Name] {
+			p.check = check.Name
+			check.Run(p)
+		}
+	}
+
+	sort.SliceStable(p.diagnostics, func(i, j int) bool {
+		return p.diagnostics[i].Pos.Line < p.diagnostics[j].Pos.Line
+	})
+	return p.diagnostics, nil
+}
+
+func knownCheck(name string) bool {
+	for _, check := range Checks {
+		if check.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reference is a use of a variable somewhere in the makefile
+type reference struct {
+	pos  ast.Pos
+	name string
+}
+
+// references finds every variable reference in the makefile
+func (p *Pass) references() []reference {
+	refs := []reference{}
+	add := func(pos ast.Pos, text string) {
+		for _, name := range makefile.References(text) {
+			refs = append(refs, reference{pos, name})
+		}
+	}
+
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Assignment:
+			add(n.Pos(), n.Value)
+		case *ast.Rule:
+			add(n.Pos(), strings.Join(n.Targets, " ")+" "+n.PrerequisiteText)
+		case *ast.RecipeLine:
+			add(n.Pos(), n.Text)
+		case *ast.Directive:
+			add(n.Pos(), n.Args)
+			for _, line := range n.Body {
+				add(n.Pos(), line)
+			}
+		}
+		return true
+	})
+
+	return refs
+}
+
+// definitions maps each variable assigned in the makefile to its first
+// assignment
+func (p *Pass) definitions() map[string]*ast.Assignment {
+	defs := map[string]*ast.Assignment{}
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		if a, ok := n.(*ast.Assignment); ok && defs[a.Name] == nil {
+			defs[a.Name] = a
+		}
+		return true
+	})
+	return defs
+}
+
+// defined reports whether a variable gets a value from anywhere: the
+// makefile, make itself or the environment
+func (p *Pass) defined(name string, defs map[string]*ast.Assignment) bool {
+	if defs[name] != nil || makefile.IsAutomatic(name) || makefile.BuiltinVariables[name] {
+		return true
+	}
+
+	// Variables may also be set by define, export or override directives
+	for _, n := range p.File.Nodes {
+		if d, ok := n.(*ast.Directive); ok && directiveVariable(d) == name {
+			return true
+		}
+	}
+
+	_, inEnv := os.LookupEnv(name)
+	return inEnv
+}
+
+// directiveVariable returns the variable a directive defines, if any
+func directiveVariable(d *ast.Directive) string {
+	if d.Name != "define" && d.Name != "export" && d.Name != "override" {
+		return ""
+	}
+
+	end := strings.IndexAny(d.Args, " \t=:+?!")
+	if end < 0 {
+		return d.Args
+	}
+	return d.Args[:end]
+}
+
+func checkUndefined(p *Pass) {
+	defs := p.definitions()
+	reported := map[string]bool{}
+	for _, ref := range p.references() {
+		if !reported[ref.name] && !p.defined(ref.name, defs) {
+			reported[ref.name] = true
+			p.Report(ref.pos, "undefined variable %s", ref.name)
+		}
+	}
+}
+
+func checkUnused(p *Pass) {
+	used := map[string]bool{}
+	for _, ref := range p.references() {
+		used[ref.name] = true
+	}
+
+	exported := map[string]bool{}
+	for _, n := range p.File.Nodes {
+		if d, ok := n.(*ast.Directive); ok && d.Name == "export" {
+			for _, word := range strings.Fields(d.Args) {
+				exported[word] = true
+			}
+		}
+	}
+
+	defs := p.definitions()
+	for _, name := range sortedNames(defs) {
+		if !used[name] && !exported[name] {
+			p.Report(defs[name].Pos(), "variable %s is never used", name)
+		}
+	}
+}
+
+func checkDuplicates(p *Pass) {
+	first := map[string]*ast.Rule{}
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		rule, ok := n.(*ast.Rule)
+		if !ok || len(rule.Recipe) == 0 || rule.DoubleColon {
+			return false
+		}
+
+		for _, target := range rule.Targets {
+			if earlier := first[target]; earlier != nil {
+				p.Report(rule.Pos(), "recipe for %s overrides the one at line %d", target, earlier.Pos().Line)
+			} else {
+				first[target] = rule
+			}
+		}
+		return false
+	})
+}
+
+func checkRepeated(p *Pass) {
+	// seen[target][prerequisite] is the rule that first listed it
+	seen := map[string]map[string]*ast.Rule{}
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		rule, ok := n.(*ast.Rule)
+		if !ok {
+			return true
+		}
+
+		for _, target := range rule.Targets {
+			if makefile.IsSpecialTarget(target) {
+				continue
+			}
+			if seen[target] == nil {
+				seen[target] = map[string]*ast.Rule{}
+			}
+
+			for _, prereq := range rule.Prerequisites {
+				if earlier := seen[target][prereq]; earlier == rule {
+					p.Report(rule.Pos(), "%s is listed twice as a prerequisite of %s", prereq, target)
+				} else if earlier != nil {
+					p.Report(rule.Pos(), "%s is already a prerequisite of %s at line %d", prereq, target, earlier.Pos().Line)
+				} else {
+					seen[target][prereq] = rule
+				}
+			}
+		}
+		return false
+	})
+}
+
+func checkPhony(p *Pass) {
+	mf := p.Makefile
+	reported := map[string]bool{}
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		rule, ok := n.(*ast.Rule)
+		if !ok || len(rule.Recipe) == 0 {
+			return false
+		}
+
+		for _, target := range rule.Targets {
+			if makefile.IsSpecialTarget(target) || makefile.IsPatternRule(target) || strings.Contains(target, "$") {
+				continue
+			}
+
+			if !reported[target] && !mf.Phony[target] && !mf.IsFileTarget(target) && !p.Exists(target) && !createsTarget(rule) {
+				reported[target] = true
+				p.Report(rule.Pos(), "%s doesn't look like a file, declare it .PHONY", target)
+			}
+		}
+		return false
+	})
+}
+
+func checkOrphans(p *Pass) {
+	for _, name := range graph.Unreachable(p.Makefile) {
+		p.Report(p.Makefile.Targets[name].Pos, "no goal needs %s: it isn't the default goal, phony or documented, nor a prerequisite of one", name)
+	}
+}
+
+// createsTarget reports whether a recipe appears to write its target
+func createsTarget(rule *ast.Rule) bool {
+	for _, line := range rule.Recipe {
+		if strings.Contains(line.Text, "$@") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRecursion(p *Pass) {
+	recursive := map[string]*ast.Assignment{}
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		if a, ok := n.(*ast.Assignment); ok && (a.Op == "=" || a.Op == "+=") {
+			if recursive[a.Name] == nil || a.Op == "=" {
+				recursive[a.Name] = a
+			}
+		}
+		return true
+	})
+
+	// refs[name] are the recursive variables that name's value refers to
+	refs := map[string][]string{}
+	for name, a := range recursive {
+		for _, ref := range makefile.References(a.Value) {
+			if recursive[ref] != nil {
+				refs[name] = append(refs[name], ref)
+			}
+		}
+	}
+
+	reported := map[string]bool{}
+	for _, name := range sortedNames(recursive) {
+		if reported[name] {
+			continue
+		}
+
+		if path := findLoop(name, refs); path != nil {
+			for _, n := range path {
+				reported[n] = true
+			}
+			p.Report(recursive[name].Pos(), "recursive variable loop: %s", strings.Join(path, " -> "))
+		}
+	}
+}
+
+// findLoop returns a chain of references leading from start back to
+// itself, or nil
+func findLoop(start string, refs map[string][]string) []string {
+	visited := map[string]bool{}
+
+	var walk func(name string, path []string) []string
+	walk = func(name string, path []string) []string {
+		for _, next := range refs[name] {
+			if next == start {
+				return append(path, next)
+			}
+			if !visited[next] {
+				visited[next] = true
+				if loop := walk(next, append(path, next)); loop != nil {
+					return loop
+				}
+			}
+		}
+		return nil
+	}
+
+	return walk(start, []string{start})
+}
+
+func checkPrerequisites(p *Pass) {
+	mf := p.Makefile
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		rule, ok := n.(*ast.Rule)
+		if !ok || len(rule.Targets) == 0 || makefile.IsSpecialTarget(rule.Targets[0]) {
+			return false
+		}
+
+		// Check this rule's own recipe, which may have been overridden
+		target := mf.Targets[rule.Targets[0]]
+		target.Commands = nil
+		for _, line := range rule.Recipe {
+			target.Commands = append(target.Commands, line.Text)
+		}
+
+		declared := map[string]bool{}
+		for _, dep := range target.Dependencies {
+			declared[dep] = true
+		}
+		for _, name := range rule.Targets {
+			declared[name] = true
+		}
+
+		for i, command := range mf.ExpandRecipe(target) {
+			reported := map[string]bool{}
+			for _, word := range strings.Fields(command) {
+				word = strings.Trim(word, `"';()`)
+				if declared[word] || reported[word] {
+					continue
+				}
+
+				// Only files hmake could know about: ones other rules
+				// build, or that exist beside the makefile
+				t, isTarget := mf.Targets[word]
+				if (isTarget && mf.IsFileTarget(t.Name)) || (!isTarget && strings.Contains(word, ".") && p.Exists(word)) {
+					reported[word] = true
+					p.Report(rule.Recipe[i].Pos(), "recipe for %s uses %s, which isn't a prerequisite", target.Name, word)
+				}
+			}
+		}
+		return false
+	})
+}
+
+// lookalike is a character documents put in place of one the shell or
+// make gives a meaning to, and what it stands in for
+type lookalike struct {
+	name, want string
+
+	// wordStart is set for those only mistaken at the start of a word, such
+	// as a dash for an option's
+	wordStart bool
+}
+
+var lookalikes = map[rune]lookalike{
+	'\u201c': {name: "a curly quote", want: `"`},
+	'\u201d': {name: "a curly quote", want: `"`},
+	'\u2018': {name: "a curly quote", want: "'"},
+	'\u2019': {name: "a curly quote", want: "'"},
+	'\u2013': {name: "an en dash", want: "-", wordStart: true},
+	'\u2014': {name: "an em dash", want: "--", wordStart: true},
+	'\u00a0': {name: "a non-breaking space", want: "a space"},
+}
+
+func checkPasted(p *Pass) {
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.RecipeLine:
+			p.reportPasted(n.Pos(), "recipe", n.Text)
+		case *ast.Assignment:
+			p.reportPasted(n.Pos(), "value of "+n.Name, n.Value)
+		}
+		return true
+	})
+}
+
+// reportPasted reports the first lookalike in text, what's where, with
+// the word it's in
+func (p *Pass) reportPasted(pos ast.Pos, what, text string) {
+	prev := ' '
+	for i, r := range text {
+		l, ok := lookalikes[r]
+		if ok && (!l.wordStart || prev == ' ' || prev == '\t') {
+			start := strings.LastIndexAny(text[:i], " \t") + 1
+			end := strings.IndexAny(text[i+utf8.RuneLen(r):], " \t")
+			if end < 0 {
+				end = len(text)
+			} else {
+				end += i + utf8.RuneLen(r)
+			}
+			p.Report(pos, "%s has %s (U+%04X) in %s, probably pasted from a document, which the shell takes as it is; type %s instead",
+				what, l.name, r, text[start:end], l.want)
+			return
+		}
+		prev = r
+	}
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
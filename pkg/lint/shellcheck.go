@@ -0,0 +1,124 @@
+package lint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// ShellcheckProgram is the shellcheck run by Shellcheck
+var ShellcheckProgram = "shellcheck"
+
+// ErrNoShellcheck is returned by Shellcheck when shellcheck isn't installed
+var ErrNoShellcheck = errors.New("shellcheck isn't installed; see https://www.shellcheck.net")
+
+// shellcheckDialects are the shells shellcheck knows
+var shellcheckDialects = map[string]bool{"sh": true, "bash": true, "dash": true, "ksh": true}
+
+// Shellcheck runs the recipe of each target, with its variables expanded,
+// through shellcheck, reporting what it finds at the recipe's lines. The
+// recipe is checked as the shell given by the makefile's SHELL would run
+// it, or sh.
+func Shellcheck(ctx context.Context, f *ast.File) ([]Diagnostic, error) {
+	if _, err := exec.LookPath(ShellcheckProgram); err != nil {
+		return nil, ErrNoShellcheck
+	}
+
+	mf := makefile.NewMakefile()
+	if err := mf.LoadContext(ctx, f); err != nil {
+		return nil, err
+	}
+
+	dialect := "sh"
+	if shell := filepath.Base(strings.TrimSpace(mf.Variables["SHELL"])); shellcheckDialects[shell] {
+		dialect = shell
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		if len(t.Commands) == 0 {
+			continue
+		}
+
+		found, err := shellcheckRecipe(ctx, mf, t, dialect)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		diagnostics = append(diagnostics, found...)
+	}
+	return diagnostics, nil
+}
+
+// shellcheckComment is a finding in shellcheck's json1 output
+type shellcheckComment struct {
+	Line    int    `json:"line"`
+	Level   string `json:"level"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// shellcheckRecipe checks t's recipe as one script, each command starting
+// on a line of its own
+func shellcheckRecipe(ctx context.Context, mf *makefile.Makefile, t makefile.Target, dialect string) ([]Diagnostic, error) {
+	// lines holds where in the makefile each line of the script came from
+	var script strings.Builder
+	lines := []ast.Pos{}
+	for i, command := range mf.ExpandRecipeContext(ctx, t) {
+		pos := t.Pos
+		if i < len(t.CommandPos) {
+			pos = t.CommandPos[i]
+		}
+
+		command = strings.TrimPrefix(command, "@")
+		for j, line := range strings.Split(command, "\n") {
+			lines = append(lines, ast.Pos{Filename: pos.Filename, Line: pos.Line + j, Column: pos.Column})
+			script.WriteString(line)
+			script.WriteByte('\n')
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, ShellcheckProgram, "--shell="+dialect, "--format=json1", "-")
+	cmd.Stdin = strings.NewReader(script.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	// shellcheck exits with 1 when it finds something
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == 1) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+
+	var result struct {
+		Comments []shellcheckComment `json:"comments"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("reading shellcheck's output: %w", err)
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, c := range result.Comments {
+		pos := t.Pos
+		if c.Line >= 1 && c.Line <= len(lines) {
+			pos = lines[c.Line-1]
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Pos:     pos,
+			Check:   "shell",
+			Message: fmt.Sprintf("%s: SC%d: %s", c.Level, c.Code, c.Message),
+		})
+	}
+	return diagnostics, nil
+}
@@ -0,0 +1,102 @@
+package makefile
+
+import (
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// hasConditionals reports whether f has conditional directives, an else or
+// endif without an ifeq among them being an error to report
+func hasConditionals(f *ast.File) bool {
+	for _, node := range f.Nodes {
+		if d, ok := node.(*ast.Directive); ok {
+			switch d.Name {
+			case "ifeq", "ifneq", "ifdef", "ifndef", "else", "endif":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Holds evaluates the condition of an ifeq, ifneq, ifdef or ifndef, with
+// the variables as set by the lines before it
+func (l *loader) Holds(d *ast.Directive) (bool, error) {
+	mf := l.mf
+	e := mf.newExpansion(l.ctx, nil, d.Pos())
+	var result bool
+	switch d.Name {
+	case "ifdef", "ifndef":
+		// Whether the variable has a value, which isn't expanded
+		variable := strings.TrimSpace(e.expand(d.Args, 0))
+		if variable == "" || strings.ContainsAny(variable, " \t") {
+			return false, conditionalError(d, "invalid syntax in conditional")
+		}
+		value, _ := mf.lookup(variable)
+		result = (value != "") == (d.Name == "ifdef")
+	default:
+		a, b, ok := conditionArgs(d.Args)
+		if !ok {
+			return false, conditionalError(d, "invalid syntax in conditional")
+		}
+		result = (e.expand(a, 0) == e.expand(b, 0)) == (d.Name == "ifeq")
+	}
+	if e.limit != nil {
+		e.limit.Pos = d.Pos()
+		return false, e.limit
+	}
+	return result, nil
+}
+
+// conditionArgs splits the arguments of an ifeq or ifneq, written as
+// (a,b), or quoted with ' or " as "a" "b"
+func conditionArgs(args string) (string, string, bool) {
+	if strings.HasPrefix(args, "(") {
+		depth := 0
+		comma := -1
+		for i := 1; i < len(args); i++ {
+			switch args[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					if comma < 0 || strings.TrimSpace(args[i+1:]) != "" {
+						return "", "", false
+					}
+					return strings.TrimRight(args[1:comma], " \t"), strings.TrimLeft(args[comma+1:i], " \t"), true
+				}
+				depth--
+			case ',':
+				if depth == 0 && comma < 0 {
+					comma = i
+				}
+			}
+		}
+		return "", "", false
+	}
+
+	quoted := func(s string) (string, string, bool) {
+		if s == "" || (s[0] != '"' && s[0] != '\'') {
+			return "", "", false
+		}
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			return "", "", false
+		}
+		return s[1 : end+1], strings.TrimSpace(s[end+2:]), true
+	}
+	a, rest, ok := quoted(args)
+	if !ok {
+		return "", "", false
+	}
+	b, rest, ok := quoted(rest)
+	if !ok || rest != "" {
+		return "", "", false
+	}
+	return a, b, true
+}
+
+func conditionalError(d *ast.Directive, message string) error {
+	return &ast.ParseError{File: d.Position.Filename, Line: d.Position.Line, Message: message}
+}
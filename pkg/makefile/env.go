@@ -0,0 +1,172 @@
+package makefile
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// isEnvRule reports whether n declares environment variables for the
+// recipes of its targets, "target...: env NAME=value...", with no recipe
+func isEnvRule(n *ast.Rule) bool {
+	return len(n.Prerequisites) > 1 && n.Prerequisites[0] == "env" && len(n.Recipe) == 0 &&
+		strings.Contains(n.Prerequisites[1], "=")
+}
+
+// addEnvRule sets the variables of an env rule in the environment of its
+// targets' recipes, and theirs only: they aren't make variables. Values
+// are expanded as the rule is read, as with :=, and may be quoted.
+func (mf *Makefile) addEnvRule(ctx context.Context, n *ast.Rule) error {
+	e := mf.newExpansion(ctx, nil, n.Pos())
+	text := e.expand(strings.TrimSpace(strings.TrimPrefix(n.PrerequisiteText, "env")), 0)
+	if e.limit != nil {
+		e.limit.Pos = n.Pos()
+		return e.limit
+	}
+
+	words, ok := envWords(text)
+	if !ok {
+		return envError(n.Pos(), "unterminated quote in env")
+	}
+	if mf.envs == nil {
+		mf.envs = map[string]map[string]string{}
+	}
+	for _, word := range words {
+		name, value, ok := strings.Cut(word, "=")
+		if !ok || name == "" {
+			return envError(n.Pos(), fmt.Sprintf("env takes NAME=value, not '%s'", word))
+		}
+		for _, target := range n.Targets {
+			if mf.envs[target] == nil {
+				mf.envs[target] = map[string]string{}
+			}
+			mf.envs[target][name] = value
+		}
+	}
+	return nil
+}
+
+// applyEnv gives targets the environments env rules declared for them,
+// which, like .OUTPUTS, don't make targets of their own
+func (mf *Makefile) applyEnv() {
+	for name, env := range mf.envs {
+		t, ok := mf.Targets[name]
+		if !ok {
+			continue
+		}
+		merged := map[string]string{}
+		maps.Copy(merged, t.Env)
+		maps.Copy(merged, env)
+		t.Env = merged
+		mf.Targets[name] = t
+	}
+}
+
+// envWords splits text at spaces outside single or double quotes, which
+// are removed
+func envWords(text string) ([]string, bool) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, quote == 0
+}
+
+func envError(pos ast.Pos, message string) error {
+	return &ast.ParseError{File: pos.Filename, Line: pos.Line, Message: message}
+}
+
+// declareInheritEnv records ".INHERIT_ENV: target...", which may come
+// before or after the targets' rules
+func (mf *Makefile) declareInheritEnv(names []string) {
+	if mf.inheritEnv == nil {
+		mf.inheritEnv = map[string]bool{}
+	}
+	for _, name := range names {
+		mf.inheritEnv[name] = true
+	}
+}
+
+// applyInheritedEnv passes the environment of each target named by
+// .INHERIT_ENV down to its prerequisites, and theirs, for their recipes.
+// A prerequisite keeps the variables it sets itself, and otherwise takes
+// those of the nearest target above it passing them down.
+func (mf *Makefile) applyInheritedEnv() {
+	if len(mf.inheritEnv) == 0 {
+		return
+	}
+
+	// own is each target's environment before any was inherited, and
+	// distance how far above a target each inherited variable came from
+	own := map[string]map[string]string{}
+	for _, name := range mf.TargetNames {
+		own[name] = mf.Targets[name].Env
+	}
+	distance := map[string]map[string]int{}
+
+	for _, from := range mf.TargetNames {
+		if !mf.inheritEnv[from] || len(own[from]) == 0 {
+			continue
+		}
+
+		seen := map[string]bool{from: true}
+		level := mf.Targets[from].Dependencies
+		for depth := 1; len(level) > 0; depth++ {
+			next := []string{}
+			for _, name := range level {
+				t, ok := mf.Targets[name]
+				if !ok || seen[name] {
+					continue
+				}
+				seen[name] = true
+				next = append(next, t.Dependencies...)
+
+				env := map[string]string{}
+				maps.Copy(env, t.Env)
+				for k, v := range own[from] {
+					if _, set := own[name][k]; set {
+						continue
+					}
+					if d, inherited := distance[name][k]; inherited && d <= depth {
+						continue
+					}
+					env[k] = v
+					if distance[name] == nil {
+						distance[name] = map[string]int{}
+					}
+					distance[name][k] = depth
+				}
+				t.Env = env
+				mf.Targets[name] = t
+			}
+			level = next
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package makefile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// maxExpandDepth bounds how deeply variables may refer to one another,
+// which stops a variable that refers to itself from recursing forever
+const maxExpandDepth = 100
+
+// maxExpandSteps bounds how many references one expansion may follow, and
+// maxExpandSize how long its result may grow, which stops variables that
+// each refer to the one before twice from taking exponential time
+const (
+	maxExpandSteps = 1000000
+	maxExpandSize  = 64 << 20
+)
+
+// lookup finds the value of a variable. Command line overrides beat the
+// makefile, which beats the environment. HMAKE, unless set, is the hmake
+// program, for recipes to run its portable commands as $(HMAKE) -- cp,
+// and so is MAKE, for recursive makes.
+// MAKEFILE_LIST, unless set, names the makefiles read so far.
+func (mf *Makefile) lookup(name string) (string, bool) {
+	if value, ok := mf.Overrides[name]; ok {
+		return value, true
+	}
+	if value, ok := mf.Variables[name]; ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	if name == "HMAKE" || name == "MAKE" {
+		return quote(Executable), true
+	}
+	if name == "MAKEFILE_LIST" && len(mf.makefiles) > 0 {
+		return strings.Join(mf.makefiles, " "), true
+	}
+	return "", false
+}
+
+// UndefinedError reports a reference to a variable that has no value, which
+// make quietly expands to nothing
+type UndefinedError struct {
+	Name string
+
+	// Pos is where the reference was written, if known
+	Pos ast.Pos
+}
+
+func (e *UndefinedError) Error() string {
+	if e.Pos.Line == 0 {
+		return fmt.Sprintf("undefined variable '%s'", e.Name)
+	}
+	return fmt.Sprintf("%s:%d: undefined variable '%s'", e.Pos.Filename, e.Pos.Line, e.Name)
+}
+
+// ExpandLimitError reports an expansion that was given up on as it grew
+// too large, as variables that each refer to the one before twice do
+type ExpandLimitError struct {
+	// Pos is where the text whose expansion failed was written, if known
+	Pos ast.Pos
+}
+
+func (e *ExpandLimitError) Error() string {
+	if e.Pos.Line == 0 {
+		return "variable expansion too large"
+	}
+	return fmt.Sprintf("%s:%d: variable expansion too large", e.Pos.Filename, e.Pos.Line)
+}
+
+// Expand replaces the variable references in s with their values
+func (mf *Makefile) Expand(s string) string {
+	return mf.ExpandContext(context.Background(), s)
+}
+
+// ExpandContext is Expand, with ctx bounding any commands run by $(shell)
+func (mf *Makefile) ExpandContext(ctx context.Context, s string) string {
+	return mf.newExpansion(ctx, nil, ast.Pos{}).expand(s, 0)
+}
+
+// ExpandRecipe expands the commands of t, including the automatic
+// variables such as $@ and $<
+func (mf *Makefile) ExpandRecipe(t Target) []string {
+	return mf.ExpandRecipeContext(context.Background(), t)
+}
+
+// ExpandRecipeContext is ExpandRecipe, with ctx bounding any commands run
+// by $(shell)
+func (mf *Makefile) ExpandRecipeContext(ctx context.Context, t Target) []string {
+	commands, _ := mf.ExpandRecipeStrict(ctx, t)
+	return commands
+}
+
+// ExpandRecipeStrict is ExpandRecipeContext, also returning an
+// *UndefinedError for each reference to a variable with no value, and an
+// *ExpandLimitError if the recipe grew too large to expand
+func (mf *Makefile) ExpandRecipeStrict(ctx context.Context, t Target) ([]string, error) {
+	e := mf.newExpansion(ctx, automaticVariables(t), t.Pos)
+
+	commands := make([]string, len(t.Commands))
+	for i, command := range t.Commands {
+		e.pos = t.Pos
+		if i < len(t.CommandPos) {
+			e.pos = t.CommandPos[i]
+		}
+		commands[i] = e.expand(command, 0)
+		if e.limit != nil && e.limit.Pos.Line == 0 {
+			e.limit.Pos = e.pos
+		}
+	}
+
+	errs := make([]error, len(e.undefined))
+	for i, err := range e.undefined {
+		errs[i] = err
+	}
+	if e.limit != nil {
+		errs = append(errs, e.limit)
+	}
+	return commands, errors.Join(errs...)
+}
+
+func automaticVariables(t Target) map[string]string {
+	auto := map[string]string{
+		"@": t.Name,
+		"<": "",
+		"^": strings.Join(dedupe(t.Dependencies), " "),
+		"+": strings.Join(t.Dependencies, " "),
+	}
+	if len(t.Dependencies) > 0 {
+		auto["<"] = t.Dependencies[0]
+	}
+	if t.TempDir != "" {
+		auto["TMPDIR"] = t.TempDir
+	}
+	return auto
+}
+
+func dedupe(words []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			unique = append(unique, w)
+		}
+	}
+	return unique
+}
+
+// expansion is the state of expanding one piece of text
+type expansion struct {
+	ctx  context.Context
+	mf   *Makefile
+	auto map[string]string
+
+	// active holds the variables being expanded. A variable found again
+	// within its own value refers to itself and expands to nothing,
+	// rather than recursing forever.
+	active map[string]bool
+
+	// pos is where the text being expanded was written, and undefined the
+	// references found in it to variables with no value
+	pos       ast.Pos
+	undefined []*UndefinedError
+
+	// steps counts the references followed, and limit is set once there
+	// have been too many or the result is too long
+	steps int
+	limit *ExpandLimitError
+
+	// explaining is set to record each reference met in explained, level
+	// being how many are being expanded at once
+	explaining bool
+	explained  []ExpansionStep
+	level      int
+}
+
+func (mf *Makefile) newExpansion(ctx context.Context, auto map[string]string, pos ast.Pos) *expansion {
+	return &expansion{ctx: ctx, mf: mf, auto: auto, active: map[string]bool{}, pos: pos}
+}
+
+func (e *expansion) expand(s string, depth int) string {
+	if depth > maxExpandDepth || !strings.Contains(s, "$") {
+		return s
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		e.steps++
+		if e.limit == nil && (e.steps > maxExpandSteps || out.Len() > maxExpandSize) {
+			e.limit = &ExpandLimitError{}
+		}
+		if e.limit != nil {
+			return out.String()
+		}
+
+		i++
+		var name string
+		var step int
+		switch s[i] {
+		case '$':
+			out.WriteByte('$')
+			continue
+		case '(', '{':
+			end := matchingParen(s, i)
+			if end < 0 {
+				// Unterminated reference, keep it as written
+				out.WriteString(s[i-1:])
+				return out.String()
+			}
+			inner := s[i+1 : end]
+			step = e.begin(s[i-1 : end+1])
+			i = end
+			if value, ok := e.call(inner, depth); ok {
+				if e.explaining {
+					e.finish(step, value, callNote(inner))
+				}
+				out.WriteString(value)
+				continue
+			}
+			name = e.expand(inner, depth+1)
+		default:
+			step = e.begin(s[i-1 : i+1])
+			name = s[i : i+1]
+		}
+
+		value, ok := e.auto[name]
+		if ok {
+			out.WriteString(value)
+			if e.explaining {
+				e.finish(step, value, "the automatic variable "+name)
+			}
+		} else if value, ok = e.mf.lookup(name); ok && !e.active[name] {
+			// The references in a variable's value were written where it
+			// was assigned
+			pos := e.pos
+			if at, ok := e.mf.definedAt[name]; ok {
+				e.pos = at
+			}
+			e.active[name] = true
+			expanded := e.expand(value, depth+1)
+			out.WriteString(expanded)
+			delete(e.active, name)
+			e.pos = pos
+			if e.explaining {
+				e.finish(step, expanded, e.mf.variableNote(name, value))
+			}
+		} else if !ok {
+			e.undefinedVariable(name)
+			if e.explaining {
+				e.finish(step, "", name+" isn't set, so expands to nothing")
+			}
+		} else if e.explaining {
+			e.finish(step, "", name+" refers to itself, so expands to nothing here")
+		}
+	}
+
+	return out.String()
+}
+
+// undefinedVariable notes a reference to name, which has no value
+func (e *expansion) undefinedVariable(name string) {
+	if name == "" || IsAutomatic(name) || BuiltinVariables[name] || strings.ContainsAny(name, " \t:") {
+		return
+	}
+
+	err := &UndefinedError{Name: name, Pos: e.pos}
+	e.undefined = append(e.undefined, err)
+	if e.mf.Undefined != nil {
+		e.mf.Undefined(err)
+	}
+}
+
+// matchingParen finds the bracket closing the one at s[open], allowing for
+// nested references such as $(foo $(bar))
+func matchingParen(s string, open int) int {
+	opening, closing := s[open], byte(')')
+	if opening == '{' {
+		closing = '}'
+	}
+
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case opening:
+			depth++
+		case closing:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,55 @@
+package makefile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// FuzzExpand checks that reading any makefile and expanding any text with
+// its variables gives up on references nested too deeply or too many,
+// rather than recursing or growing without bound
+func FuzzExpand(f *testing.F) {
+	// Variables that refer to the next, beyond maxExpandDepth
+	var chain strings.Builder
+	for i := 0; i < maxExpandDepth+10; i++ {
+		fmt.Fprintf(&chain, "V%d = $(V%d)\n", i, i+1)
+	}
+	f.Add(chain.String(), "$(V0)")
+
+	// A reference whose name is a reference, and so on, as deeply
+	deep := strings.Repeat("$(", maxExpandDepth+10) + "X" + strings.Repeat(")", maxExpandDepth+10)
+	f.Add("X = X\n", deep)
+	f.Add("X = "+deep+"\n", "$(X)")
+
+	// Variables that each refer to the one before twice, whose expansion
+	// takes far more than maxExpandSteps references
+	doubling := "D0 = x\n"
+	for i := 1; i <= 64; i++ {
+		doubling += fmt.Sprintf("D%d = $(D%d)$(D%d)\n", i, i-1, i-1)
+	}
+	f.Add(doubling, "$(D64)")
+	f.Add(doubling+"NOW := $(D64)\n", "$(NOW)")
+	f.Add("D0 = x\nD1 := $(D0)$(D0)\nD1 += $(D1)\n", "$(D1)$(D1)")
+
+	f.Add("X = $(X)\n", "$(X)")
+	f.Add("X = a b\n", "$(if $(X),$(filter a,$(X)),$(filter-out a,$(X)))")
+	f.Add("ifeq ($(X),)\nX = $(X)$(X)\nendif\n", "${X} $$ $( $")
+	f.Add("include Makefile\n", "$(MAKEFILE_LIST)")
+
+	f.Fuzz(func(t *testing.T, text, s string) {
+		mf := NewMakefile()
+		mf.FS = vfs.FromFS(fstest.MapFS{"Makefile": {Data: []byte(text)}})
+		mf.ShellCommand = func(command string) error {
+			return errors.New("$(shell) isn't run while fuzzing")
+		}
+		if err := mf.Parse("Makefile"); err != nil {
+			return
+		}
+		mf.Expand(s)
+	})
+}
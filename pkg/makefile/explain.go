@@ -0,0 +1,85 @@
+package makefile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// ExpansionStep is a variable reference or function call met while
+// expanding text, as ExplainExpansion records them
+type ExpansionStep struct {
+	// Reference is as written, such as $(CFLAGS) or $(filter %.c,$(SRCS)),
+	// and Result what it expanded to
+	Reference string
+	Result    string
+
+	// Depth is how many other references it was found within
+	Depth int
+
+	// Note says what was found: the variable, its value and where it was
+	// set, the function called, or why it expanded to nothing
+	Note string
+}
+
+// ExplainExpansion expands s as Expand does, also returning each reference
+// followed and function called, in the order they were met, a reference's
+// steps following it. With target set to one of the makefile's targets the
+// automatic variables, such as $@, are those of its recipe.
+func (mf *Makefile) ExplainExpansion(ctx context.Context, s, target string) (string, []ExpansionStep) {
+	var auto map[string]string
+	if t, ok := mf.Targets[target]; ok {
+		auto = automaticVariables(t)
+	}
+	e := mf.newExpansion(ctx, auto, ast.Pos{})
+	e.explaining = true
+	result := e.expand(s, 0)
+	return result, e.explained
+}
+
+// begin notes a reference being expanded if explaining, giving its step
+// for finish, which is called only if explaining
+func (e *expansion) begin(reference string) int {
+	if !e.explaining {
+		return -1
+	}
+	e.explained = append(e.explained, ExpansionStep{Reference: reference, Depth: e.level})
+	e.level++
+	return len(e.explained) - 1
+}
+
+// finish notes what the reference begin gave step for expanded to
+func (e *expansion) finish(step int, result, note string) {
+	e.level--
+	e.explained[step].Result = result
+	e.explained[step].Note = note
+}
+
+// callNote describes the function call in inner
+func callNote(inner string) string {
+	name, _, _ := strings.Cut(inner, " ")
+	if _, ok := builtins[name]; !ok {
+		return fmt.Sprintf("hmake doesn't implement the function %s, so it expands to nothing", name)
+	}
+	return "the function " + name
+}
+
+// variableNote describes the variable name, giving its value before
+// expansion and where it came from, as lookup finds it
+func (mf *Makefile) variableNote(name, value string) string {
+	origin := "built in"
+	if _, ok := mf.Overrides[name]; ok {
+		origin = "the command line"
+	} else if _, ok := mf.Variables[name]; ok {
+		origin = "the makefile"
+		if at, ok := mf.definedAt[name]; ok {
+			origin = fmt.Sprintf("%s:%d", at.Filename, at.Line)
+		}
+	} else if _, ok := os.LookupEnv(name); ok {
+		origin = "the environment"
+	}
+	return fmt.Sprintf("%s = %s  (%s)", name, value, origin)
+}
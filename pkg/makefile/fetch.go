@@ -0,0 +1,46 @@
+package makefile
+
+import (
+	"slices"
+	"strings"
+)
+
+// Fetch is a file downloaded rather than made by a recipe, written as a
+// rule whose prerequisite is its URL, with the checksum it must have:
+//
+//	deps/tool.tar.gz: https://example.com/tool-1.2.tar.gz sha256=9f86d08…
+type Fetch struct {
+	URL string
+
+	// SHA256 is the hex digest the download must have, if given
+	SHA256 string
+}
+
+// IsURL reports whether a prerequisite is a URL to download
+func IsURL(name string) bool {
+	return strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://")
+}
+
+// parseFetch finds a URL, and any sha256= after it, among the prerequisites
+// of a rule, returning the others
+func parseFetch(deps []string) (*Fetch, []string) {
+	if !slices.ContainsFunc(deps, IsURL) {
+		return nil, deps
+	}
+
+	var fetch *Fetch
+	rest := []string{}
+	for i := 0; i < len(deps); i++ {
+		if !IsURL(deps[i]) {
+			rest = append(rest, deps[i])
+			continue
+		}
+
+		fetch = &Fetch{URL: deps[i]}
+		if i+1 < len(deps) && strings.HasPrefix(deps[i+1], "sha256=") {
+			fetch.SHA256 = strings.ToLower(strings.TrimPrefix(deps[i+1], "sha256="))
+			i++
+		}
+	}
+	return fetch, rest
+}
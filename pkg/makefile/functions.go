@@ -0,0 +1,176 @@
+package makefile
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// function implements a built in function given its unexpanded arguments
+type function func(e *expansion, args string, depth int) string
+
+// builtins are the functions that are implemented. Calls to the others
+// expand to nothing.
+var builtins map[string]function
+
+func init() {
+	builtins = map[string]function{
+		"archive":    archiveFunction,
+		"filter":     filterFunction(true),
+		"filter-out": filterFunction(false),
+		"git":        gitFunction,
+		"if":         ifFunction,
+		"shell":      shellFunction,
+		"wildcard":   wildcardFunction,
+	}
+}
+
+// Executable is the hmake program run by the commands $(archive) expands
+// to, by default the running program
+var Executable = executable()
+
+func executable() string {
+	path, err := os.Executable()
+	if err != nil {
+		return "hmake"
+	}
+	return path
+}
+
+// call expands the function call in inner, the text between the brackets of
+// a reference, reporting whether it was one
+func (e *expansion) call(inner string, depth int) (string, bool) {
+	name, args, ok := strings.Cut(inner, " ")
+	if !ok || !functions[name] {
+		return "", false
+	}
+
+	if fn, ok := builtins[name]; ok {
+		return fn(e, args, depth), true
+	}
+	return "", true
+}
+
+// shellFunction runs a command, as $(shell date) does, giving its output
+// with newlines turned into spaces
+func shellFunction(e *expansion, args string, depth int) string {
+	command := e.expand(args, depth+1)
+	if e.mf.ShellCommand != nil {
+		if err := e.mf.ShellCommand(command); err != nil {
+			fmt.Fprintf(os.Stderr, "hmake: %s\n", err)
+			return ""
+		}
+	}
+
+	c := exec.CommandContext(e.ctx, "sh", "-c", command)
+	c.Dir = e.mf.shellDir
+	c.Stdin = os.Stdin
+	c.Stderr = os.Stderr
+	out, _ := c.Output()
+
+	return strings.ReplaceAll(strings.TrimRight(string(out), "\n"), "\n", " ")
+}
+
+// wildcardFunction lists the files matching each of the patterns given
+func wildcardFunction(e *expansion, args string, depth int) string {
+	matches := []string{}
+	for _, pattern := range strings.Fields(e.expand(args, depth+1)) {
+		found, _ := e.mf.FileSystem().Glob(pattern)
+		matches = append(matches, found...)
+	}
+
+	return strings.Join(matches, " ")
+}
+
+// ifFunction expands $(if condition,then,else) to then if condition
+// expands to anything but spaces, else to else. Only the one chosen is
+// expanded.
+func ifFunction(e *expansion, args string, depth int) string {
+	parts := splitArgs(args, 3)
+	if strings.TrimSpace(e.expand(parts[0], depth+1)) != "" {
+		if len(parts) > 1 {
+			return e.expand(parts[1], depth+1)
+		}
+	} else if len(parts) > 2 {
+		return e.expand(parts[2], depth+1)
+	}
+	return ""
+}
+
+// filterFunction returns $(filter patterns,text), the words of text that
+// match any of the patterns, or with keep unset $(filter-out), those that
+// match none. A % in a pattern matches anything.
+func filterFunction(keep bool) function {
+	return func(e *expansion, args string, depth int) string {
+		parts := splitArgs(args, 2)
+		if len(parts) < 2 {
+			return ""
+		}
+		patterns := strings.Fields(e.expand(parts[0], depth+1))
+
+		words := []string{}
+		for _, word := range strings.Fields(e.expand(parts[1], depth+1)) {
+			if slices.ContainsFunc(patterns, func(pattern string) bool { return matchPattern(pattern, word) }) == keep {
+				words = append(words, word)
+			}
+		}
+		return strings.Join(words, " ")
+	}
+}
+
+// matchPattern reports whether word matches a make pattern, in which the
+// first % matches any text
+func matchPattern(pattern, word string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "%")
+	if !ok {
+		return pattern == word
+	}
+	return len(word) >= len(prefix)+len(suffix) && strings.HasPrefix(word, prefix) && strings.HasSuffix(word, suffix)
+}
+
+// splitArgs splits the arguments of a function at the commas outside
+// references, into at most n, the last taking any commas after
+func splitArgs(args string, n int) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(args) && len(parts) < n-1; i++ {
+		switch args[i] {
+		case '$':
+			if i+1 < len(args) && args[i+1] == '$' {
+				i++
+			} else if i+1 < len(args) && (args[i+1] == '(' || args[i+1] == '{') {
+				if end := matchingParen(args, i+1); end > 0 {
+					i = end
+				}
+			}
+		case ',':
+			parts = append(parts, args[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, args[start:])
+}
+
+// archiveFunction expands $(archive out.tar.gz,files...) to a command that
+// has hmake write a reproducible archive of the files, so that recipes
+// don't depend on the platform's tar or zip. Nothing is written until the
+// command runs.
+func archiveFunction(e *expansion, args string, depth int) string {
+	name, files, _ := strings.Cut(args, ",")
+
+	words := []string{quote(Executable), "--", "archive", quote(strings.TrimSpace(e.expand(name, depth+1)))}
+	for _, file := range strings.Fields(e.expand(files, depth+1)) {
+		words = append(words, quote(file))
+	}
+	return strings.Join(words, " ")
+}
+
+// quote quotes s for the shell if it needs it
+func quote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./=+,:@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,98 @@
+package makefile
+
+import (
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// gitInfo describes the commit the working tree is at. It's found once per
+// makefile, so that version stamps don't run git at every expansion.
+type gitInfo struct {
+	commit   string
+	short    string
+	branch   string
+	tag      string
+	describe string
+	dirty    bool
+}
+
+// gitMu guards the gitInfo of every makefile
+var gitMu sync.Mutex
+
+// gitFunction gives facts about the git checkout, as $(git commit) does:
+//
+//	commit    the full hash of HEAD
+//	short     the hash abbreviated as git does
+//	branch    the current branch, or HEAD when detached
+//	tag       the tag at HEAD, if there is one
+//	describe  git describe --tags --always --dirty, such as v1.2-3-g1a2b3c4
+//	dirty     "dirty" if there are uncommitted changes, or else nothing
+//
+// Outside a git checkout each is empty.
+func gitFunction(e *expansion, args string, depth int) string {
+	info := e.mf.gitInfo()
+
+	switch strings.TrimSpace(e.expand(args, depth+1)) {
+	case "commit":
+		return info.commit
+	case "short":
+		return info.short
+	case "branch":
+		return info.branch
+	case "tag":
+		return info.tag
+	case "describe":
+		return info.describe
+	case "dirty":
+		if info.dirty {
+			return "dirty"
+		}
+	}
+	return ""
+}
+
+// describeLong matches the output of git describe --long
+var describeLong = regexp.MustCompile(`^(.+)-([0-9]+)-g([0-9a-f]+)$`)
+
+func (mf *Makefile) gitInfo() *gitInfo {
+	gitMu.Lock()
+	defer gitMu.Unlock()
+
+	if mf.git != nil {
+		return mf.git
+	}
+	info := &gitInfo{}
+	mf.git = info
+
+	out, err := exec.Command("git", "rev-parse", "HEAD", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		return info
+	}
+	if lines := strings.Fields(string(out)); len(lines) == 2 {
+		info.commit, info.branch = lines[0], lines[1]
+	}
+
+	out, err = exec.Command("git", "describe", "--tags", "--always", "--long", "--dirty").Output()
+	if err != nil {
+		return info
+	}
+	long := strings.TrimSpace(string(out))
+	long, info.dirty = strings.CutSuffix(long, "-dirty")
+
+	// With no tags to describe from, git gives just the short hash.
+	// Without --long it describes a commit at a tag as just the tag.
+	info.describe, info.short = long, long
+	if m := describeLong.FindStringSubmatch(long); m != nil {
+		info.short = m[3]
+		if m[2] == "0" {
+			info.tag = m[1]
+			info.describe = m[1]
+		}
+	}
+	if info.dirty {
+		info.describe += "-dirty"
+	}
+	return info
+}
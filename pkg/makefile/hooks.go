@@ -0,0 +1,52 @@
+package makefile
+
+import "strings"
+
+// Hook targets have recipes that run around others rather than being made
+// for themselves. The recipe of "name.pre" runs just before name's, and
+// that of "name.post" once name's has succeeded, only when name is remade.
+// Those of .ON_SUCCESS and .ON_FAILURE run at the end of a build, as it
+// succeeded or failed.
+const (
+	PreHook   = ".pre"
+	PostHook  = ".post"
+	OnSuccess = ".ON_SUCCESS"
+	OnFailure = ".ON_FAILURE"
+)
+
+// Hook returns the recipe of the hook target named, if it has one, as a
+// target standing in for t, so that $@ and the other automatic variables
+// are t's. Its environment is t's, with the hook's own over it.
+func (mf *Makefile) Hook(name string, t Target) (Target, bool) {
+	hook, ok := mf.Targets[name]
+	if !ok || len(hook.Commands) == 0 {
+		return Target{}, false
+	}
+
+	env := map[string]string{}
+	for k, v := range t.Env {
+		env[k] = v
+	}
+	for k, v := range hook.Env {
+		env[k] = v
+	}
+	t.Commands, t.CommandPos, t.Env = hook.Commands, hook.CommandPos, env
+	t.Fetch, t.Outputs = nil, nil
+	return t, true
+}
+
+// IsHook reports whether name is a hook target: .ON_SUCCESS, .ON_FAILURE,
+// or a target's .pre or .post
+func (mf *Makefile) IsHook(name string) bool {
+	if name == OnSuccess || name == OnFailure {
+		return true
+	}
+	for _, suffix := range []string{PreHook, PostHook} {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			if _, ok := mf.Targets[base]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package makefile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// includeDirectives are those that read other makefiles. With -include or
+// sinclude, those that don't exist are skipped.
+var includeDirectives = map[string]bool{"include": true, "-include": true, "sinclude": true}
+
+// maxIncludeDepth bounds how deeply makefiles may include one another, so
+// one that includes itself is an error rather than a stack overflow
+const maxIncludeDepth = 64
+
+// include reads the makefiles an include directive names, relative to the
+// current directory as with make. They're parsed all at once, as a
+// makefile including a fragment for each module of a monorepo names
+// hundreds, then loaded one after another in the order given so that the
+// result is the same as reading them in turn. Their variables can't be
+// expanded concurrently, as each may depend on the ones before.
+func (mf *Makefile) include(ctx context.Context, d *ast.Directive, depth int) error {
+	if depth >= maxIncludeDepth {
+		return &ast.ParseError{File: d.Position.Filename, Line: d.Position.Line, Message: "includes nested too deeply; does a makefile include itself?"}
+	}
+
+	e := mf.newExpansion(ctx, nil, d.Pos())
+	words := strings.Fields(e.expand(d.Args, 0))
+	if e.limit != nil {
+		e.limit.Pos = d.Pos()
+		return e.limit
+	}
+
+	names := []string{}
+	for _, word := range words {
+		// A pattern matching nothing is kept, to be reported missing
+		if matches, err := mf.FileSystem().Glob(word); err == nil && len(matches) > 0 {
+			names = append(names, matches...)
+		} else {
+			names = append(names, word)
+		}
+	}
+
+	files := make([]*ast.File, len(names))
+	errs := make([]error, len(names))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			files[i], errs[i] = mf.parseFile(ctx, name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		switch {
+		case errors.Is(errs[i], fs.ErrNotExist) && d.Name != "include":
+			continue
+		case errors.Is(errs[i], fs.ErrNotExist):
+			return &ast.ParseError{File: d.Position.Filename, Line: d.Position.Line, Message: fmt.Sprintf("%s: No such file or directory", name)}
+		case errs[i] != nil:
+			return errs[i]
+		}
+
+		mf.Included = append(mf.Included, name)
+		if err := mf.load(ctx, files[i], depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,626 @@
+// Package makefile parses Makefiles and expands the variables within them.
+package makefile
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// Makefile represents a parsed Makefile
+type Makefile struct {
+	Targets   map[string]Target
+	Variables map[string]string
+
+	// TargetNames lists the targets in the order they were first declared
+	TargetNames []string
+
+	Phony  map[string]bool
+	Groups []string
+
+	// Services are targets whose recipes keep running, such as a
+	// development server, declared with .SERVICE. Watch mode keeps them
+	// running and restarts them when what they depend on is rebuilt.
+	Services map[string]bool
+
+	// Secrets are variables declared with .SECRET, whose values are kept
+	// out of what a build prints and records
+	Secrets map[string]bool
+
+	// Overrides are variables set on the command line, e.g. "hmake CC=clang"
+	Overrides map[string]string
+
+	// Profiles are named sets of variables selected with --profile
+	Profiles map[string]map[string]string
+
+	// FS is where makefiles are read from and targets looked for. If nil
+	// the real file system is used.
+	FS vfs.FS
+
+	// ParseCache, if set, keeps the files parsed between loads
+	ParseCache *ParseCache
+
+	// git is the checkout's commit, found when $(git) is first used
+	git *gitInfo
+
+	// outputs are the files given by .OUTPUTS for each target,
+	// responseFiles the targets named by .RESPONSE_FILE, envs the
+	// variables env rules give each target and inheritEnv the targets
+	// named by .INHERIT_ENV, applied once the targets are known
+	outputs       map[string][]string
+	responseFiles map[string]bool
+	envs          map[string]map[string]string
+	inheritEnv    map[string]bool
+
+	// Undefined, if set, is called for each reference to a variable that
+	// has no value as it's expanded, as --warn-undefined-variables reports
+	Undefined func(err *UndefinedError)
+
+	// ShellCommand, if set, is given each command $(shell) is about to run,
+	// and may stop it running with an error, which is reported instead
+	ShellCommand func(command string) error
+
+	// Overridden, if set, is called when a rule read from a makefile gives
+	// a target a recipe other than the one it already had, which the later
+	// recipe replaces
+	Overridden func(o *RecipeOverride)
+
+	// Pools are the named limits on how many of the recipes of the targets
+	// in each may run at once, lower than -j, as with ninja's pools.
+	// They're declared with ".POOL: name depth=N target...".
+	Pools map[string]int
+
+	// pools is the pool .POOL put each target in, and poolPos where each
+	// pool was first named
+	pools   map[string]string
+	poolPos map[string]ast.Pos
+
+	// Included are the makefiles read by include directives, in the order
+	// they were read
+	Included []string
+
+	// shellDir, if set, is the directory $(shell) commands run in, that
+	// of an inlined sub-make
+	shellDir string
+
+	// makefiles are the names of all the makefiles read, the first and
+	// those it included, for $(MAKEFILE_LIST)
+	makefiles []string
+
+	// definedAt is where each variable was last assigned, which is where
+	// the references in its value were written
+	definedAt map[string]ast.Pos
+}
+
+// FileSystem returns the file system the makefile's files are on
+func (mf *Makefile) FileSystem() vfs.FS {
+	if mf.FS == nil {
+		return vfs.OS
+	}
+	return mf.FS
+}
+
+// Target represents a target in the Makefile
+type Target struct {
+	Name         string
+	Dependencies []string
+	Commands     []string
+	Description  string
+	Group        string
+
+	// CommandPos is where each of Commands was written, if known
+	CommandPos []ast.Pos
+
+	// DependencyPos is where each prerequisite was first listed
+	DependencyPos map[string]ast.Pos
+
+	// Env holds environment variables set for the recipe's commands only
+	Env map[string]string
+
+	// Pos is where the target's recipe was given, or where it was first
+	// named if it has none
+	Pos ast.Pos
+
+	// Fetch, if set, is a download that makes the target
+	Fetch *Fetch
+
+	// Outputs are the other files the recipe writes besides the target,
+	// declared with ".OUTPUTS: target file..."
+	Outputs []string
+
+	// Pool, if set, is the pool of Makefile.Pools limiting how many recipes
+	// like this one run at once
+	Pool string
+
+	// Dir, if set, is the directory the recipe's commands run in, relative
+	// to the current one, as for the targets of an inlined sub-make
+	Dir string
+
+	// ResponseFile lets commands too long for the command line be given
+	// their arguments in a response file, as "program @file", whatever the
+	// program. It's declared with ".RESPONSE_FILE: target...".
+	ResponseFile bool
+
+	// TempDir, if set, is the directory the recipe has to itself for
+	// temporary files, which $(TMPDIR) expands to
+	TempDir string
+}
+
+// Files returns the files the target's recipe makes: the target and its
+// other outputs
+func (t Target) Files() []string {
+	return append([]string{t.Name}, t.Outputs...)
+}
+
+// TempDirReference is how a recipe's TempDir is written where its commands
+// must be the same wherever the directory is, as in cache keys
+const TempDirReference = "$(TMPDIR)"
+
+// UnexpandTempDir returns commands, expanded for t, with its TempDir written
+// as TempDirReference again
+func (t Target) UnexpandTempDir(commands []string) []string {
+	if t.TempDir == "" || t.TempDir == TempDirReference {
+		return commands
+	}
+	unexpanded := make([]string, len(commands))
+	for i, command := range commands {
+		unexpanded[i] = strings.ReplaceAll(command, t.TempDir, TempDirReference)
+	}
+	return unexpanded
+}
+
+// SetsTempDir reports whether the makefile gives t's recipe a temporary
+// directory itself, setting TMPDIR, TMP or TEMP, so hmake shouldn't
+func (mf *Makefile) SetsTempDir(t Target) bool {
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		_, overridden := mf.Overrides[name]
+		_, set := mf.Variables[name]
+		if _, env := t.Env[name]; overridden || set || env {
+			return true
+		}
+	}
+	return false
+}
+
+// ReferTempDir has $(TMPDIR) in t's recipe expand to TempDirReference, for
+// expanding it without a temporary directory to run in, unless the
+// makefile sets TMPDIR itself
+func (mf *Makefile) ReferTempDir(t Target) Target {
+	if t.TempDir == "" && !mf.SetsTempDir(t) {
+		t.TempDir = TempDirReference
+	}
+	return t
+}
+
+// NewMakefile initializes a new Makefile
+func NewMakefile() *Makefile {
+	return &Makefile{
+		Targets:   make(map[string]Target),
+		Variables: make(map[string]string),
+		Phony:     make(map[string]bool),
+		Services:  make(map[string]bool),
+		Overrides: make(map[string]string),
+		Profiles:  make(map[string]map[string]string),
+	}
+}
+
+// Parse parses a Makefile and populates the Makefile struct
+func (mf *Makefile) Parse(filename string) error {
+	return mf.ParseContext(context.Background(), filename)
+}
+
+// ParseContext is Parse, giving up once ctx is done
+func (mf *Makefile) ParseContext(ctx context.Context, filename string) error {
+	f, err := mf.parseFile(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	return mf.LoadContext(ctx, f)
+}
+
+// parseFile parses the named makefile, read from the makefile's file system
+func (mf *Makefile) parseFile(ctx context.Context, filename string) (*ast.File, error) {
+	if mf.ParseCache != nil {
+		return mf.ParseCache.parse(ctx, mf.FileSystem(), filename)
+	}
+
+	r, err := mf.FileSystem().Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ast.ParseContext(ctx, filename, r)
+}
+
+// Load adds the rules and variables of a parsed makefile
+func (mf *Makefile) Load(f *ast.File) {
+	mf.LoadContext(context.Background(), f)
+}
+
+// LoadContext is Load, with ctx bounding any commands run by $(shell) in
+// simply expanded variables. It stops early if ctx is done.
+func (mf *Makefile) LoadContext(ctx context.Context, f *ast.File) error {
+	if err := mf.load(ctx, f, 0); err != nil {
+		return err
+	}
+	if err := mf.expandPrerequisites(ctx); err != nil {
+		return err
+	}
+	mf.applyOutputs()
+	mf.applyResponseFiles()
+	mf.applyEnv()
+	if err := mf.applyPools(); err != nil {
+		return err
+	}
+	mf.foldPaths()
+	mf.applyInheritedEnv()
+
+	for _, name := range mf.Targets[".PHONY"].Dependencies {
+		mf.Phony[name] = true
+	}
+	return nil
+}
+
+// load adds the rules and variables of f, and of the makefiles it includes,
+// depth being how many includes deep f is
+func (mf *Makefile) load(ctx context.Context, f *ast.File, depth int) error {
+	if f.Name != "" {
+		mf.makefiles = append(mf.makefiles, f.Name)
+	}
+
+	l := &loader{mf: mf, ctx: ctx, depth: depth}
+	if !hasConditionals(f) {
+		return l.Read(f.Nodes)
+	}
+	// Which lines are read depends on the variables set by those before
+	// each conditional, so the file is read again, evaluating them as
+	// they're met
+	var source strings.Builder
+	ast.Fprint(&source, f)
+	_, err := ast.ParseConditionals(ctx, f.Name, strings.NewReader(source.String()), l)
+	return err
+}
+
+// loader adds the nodes of a makefile as they're read
+type loader struct {
+	mf    *Makefile
+	ctx   context.Context
+	depth int
+
+	// currentGroup is the group of targets the rules read go in
+	currentGroup string
+}
+
+// Read adds nodes, the next of the makefile, to the makefile
+func (l *loader) Read(nodes []ast.Node) error {
+	mf, ctx, depth := l.mf, l.ctx, l.depth
+	for _, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		switch n := node.(type) {
+		case *ast.Comment:
+			// "##@ Name" starts a group of targets for the help output
+			if strings.HasPrefix(n.Text, "#@") {
+				l.currentGroup = strings.TrimSpace(n.Text[2:])
+				mf.Groups = append(mf.Groups, l.currentGroup)
+			}
+
+		case *ast.Assignment:
+			if err := mf.assign(ctx, n); err != nil {
+				return err
+			}
+
+		case *ast.Rule:
+			if mf.parseProfile(n) {
+				continue
+			}
+			if len(n.Targets) == 1 && n.Targets[0] == ".OUTPUTS" {
+				mf.declareOutputs(n.Prerequisites)
+				continue
+			}
+			if len(n.Targets) == 1 && n.Targets[0] == ".POOL" {
+				if err := mf.declarePool(ctx, n); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(n.Targets) == 1 && n.Targets[0] == ".SECRET" {
+				mf.declareSecrets(n.Prerequisites)
+				continue
+			}
+			if len(n.Targets) == 1 && n.Targets[0] == ".RESPONSE_FILE" {
+				mf.declareResponseFiles(n.Prerequisites)
+				continue
+			}
+			if len(n.Targets) == 1 && n.Targets[0] == ".SERVICE" {
+				mf.declareServices(n.Prerequisites)
+				continue
+			}
+			if len(n.Targets) == 1 && n.Targets[0] == ".INHERIT_ENV" {
+				mf.declareInheritEnv(n.Prerequisites)
+				continue
+			}
+			if isEnvRule(n) {
+				if err := mf.addEnvRule(ctx, n); err != nil {
+					return err
+				}
+				continue
+			}
+			mf.addRule(n, l.currentGroup)
+
+		case *ast.Directive:
+			if includeDirectives[n.Name] {
+				if err := mf.include(ctx, n, depth); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// declareServices records ".SERVICE: target...". Services are phony, as
+// they make no file.
+func (mf *Makefile) declareServices(names []string) {
+	if mf.Services == nil {
+		mf.Services = map[string]bool{}
+	}
+	for _, name := range names {
+		mf.Services[name] = true
+		mf.Phony[name] = true
+	}
+}
+
+// declareSecrets records ".SECRET: VARIABLE..."
+func (mf *Makefile) declareSecrets(names []string) {
+	if mf.Secrets == nil {
+		mf.Secrets = map[string]bool{}
+	}
+	for _, name := range names {
+		mf.Secrets[name] = true
+	}
+}
+
+// SecretValues returns the values of the secret variables that have one
+func (mf *Makefile) SecretValues() map[string]string {
+	values := map[string]string{}
+	for name := range mf.Secrets {
+		if _, ok := mf.lookup(name); !ok {
+			continue
+		}
+		if value := mf.Expand("$(" + name + ")"); value != "" {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// declareOutputs records ".OUTPUTS: target file...", which may come before
+// or after the target's rule
+func (mf *Makefile) declareOutputs(words []string) {
+	if len(words) < 2 {
+		return
+	}
+	if mf.outputs == nil {
+		mf.outputs = map[string][]string{}
+	}
+	mf.outputs[words[0]] = appendNew(mf.outputs[words[0]], words[1:]...)
+}
+
+// applyOutputs gives targets the outputs declared for them, and makes each
+// output without a rule of its own depend on the target that writes it, so
+// that what needs it is remade after
+func (mf *Makefile) applyOutputs() {
+	for name, outputs := range mf.outputs {
+		if t, ok := mf.Targets[name]; ok {
+			t.Outputs = appendNew(t.Outputs, outputs...)
+			mf.Targets[name] = t
+		}
+	}
+
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		for _, out := range t.Outputs {
+			if _, ok := mf.Targets[out]; !ok {
+				mf.Targets[out] = Target{Name: out, Dependencies: []string{name}, DependencyPos: map[string]ast.Pos{name: t.Pos}, Pos: t.Pos}
+				mf.TargetNames = append(mf.TargetNames, out)
+			}
+		}
+	}
+}
+
+// declareResponseFiles records ".RESPONSE_FILE: target...", which may come
+// before or after the targets' rules
+func (mf *Makefile) declareResponseFiles(names []string) {
+	if mf.responseFiles == nil {
+		mf.responseFiles = map[string]bool{}
+	}
+	for _, name := range names {
+		mf.responseFiles[name] = true
+	}
+}
+
+func (mf *Makefile) applyResponseFiles() {
+	for name := range mf.responseFiles {
+		if t, ok := mf.Targets[name]; ok {
+			t.ResponseFile = true
+			mf.Targets[name] = t
+		}
+	}
+}
+
+// appendNew appends the words to list that aren't in it already
+func appendNew(list []string, words ...string) []string {
+	for _, word := range words {
+		if !slices.Contains(list, word) {
+			list = append(list, word)
+		}
+	}
+	return list
+}
+
+// assign sets a variable, failing only if a simply expanded value grew too
+// large to expand
+func (mf *Makefile) assign(ctx context.Context, n *ast.Assignment) error {
+	if mf.definedAt == nil {
+		mf.definedAt = map[string]ast.Pos{}
+	}
+	mf.definedAt[n.Name] = n.Pos()
+
+	switch n.Op {
+	case ":=", "::=":
+		// Simply expanded, so the value is fixed here
+		e := mf.newExpansion(ctx, nil, n.Pos())
+		mf.Variables[n.Name] = e.expand(n.Value, 0)
+		if e.limit != nil {
+			e.limit.Pos = n.Pos()
+			return e.limit
+		}
+	case "?=":
+		if _, ok := mf.lookup(n.Name); !ok {
+			mf.Variables[n.Name] = n.Value
+		}
+	case "+=":
+		if old, ok := mf.Variables[n.Name]; ok && old != "" {
+			mf.Variables[n.Name] = old + " " + n.Value
+		} else {
+			mf.Variables[n.Name] = n.Value
+		}
+	case "=":
+		mf.Variables[n.Name] = n.Value
+	}
+	return nil
+}
+
+// addRule records each target of a rule. Prerequisites given for a target
+// in several rules accumulate; the last recipe given wins.
+func (mf *Makefile) addRule(n *ast.Rule, group string) {
+	// A "## comment" after the prerequisites documents the target
+	description := ""
+	if strings.HasPrefix(n.Comment, "#") {
+		description = strings.TrimSpace(n.Comment[1:])
+	}
+
+	commands := []string{}
+	positions := []ast.Pos{}
+	for _, line := range n.Recipe {
+		commands = append(commands, line.Text)
+		positions = append(positions, line.Position)
+	}
+
+	prerequisites := n.Prerequisites
+	if strings.Contains(n.PrerequisiteText, "$") {
+		prerequisites = prerequisiteWords(n.PrerequisiteText)
+	}
+
+	for _, name := range n.Targets {
+		// A double-colon rule is meant to give its target another recipe
+		if old, ok := mf.Targets[name]; ok && len(old.Commands) > 0 && len(commands) > 0 &&
+			!n.DoubleColon && !slices.Equal(old.Commands, commands) && mf.Overridden != nil {
+			mf.Overridden(&RecipeOverride{Target: name, Pos: n.Pos(), Previous: old.Pos})
+		}
+
+		mf.AddRule(Target{
+			Name:         name,
+			Dependencies: prerequisites,
+			Commands:     commands,
+			CommandPos:   positions,
+			Description:  description,
+			Group:        group,
+		}, n.Pos())
+	}
+}
+
+// RecipeOverride reports a target given a second, different recipe at Pos,
+// replacing the one given at Previous
+type RecipeOverride struct {
+	Target   string
+	Pos      ast.Pos
+	Previous ast.Pos
+}
+
+// Lines are GNU make's warnings for the override, the new recipe's first
+func (o *RecipeOverride) Lines() []string {
+	return []string{
+		fmt.Sprintf("%s:%d: warning: overriding recipe for target '%s'", o.Pos.Filename, o.Pos.Line, o.Target),
+		fmt.Sprintf("%s:%d: warning: ignoring old recipe for target '%s'", o.Previous.Filename, o.Previous.Line, o.Target),
+	}
+}
+
+// AddRule adds a rule for a single target, as if it had been read from a
+// makefile at pos. Like several rules for the same target in a makefile,
+// prerequisites accumulate while the last recipe and description win. As
+// with GNU make, the prerequisites of the rule with the recipe come first,
+// so that $< is the first of them, and the others follow in the order
+// given, repeats and all, for $+. A prerequisite that is a URL makes the
+// target a download; see Fetch.
+func (mf *Makefile) AddRule(rule Target, pos ast.Pos) {
+	if fetch, deps := parseFetch(rule.Dependencies); fetch != nil {
+		rule.Fetch = fetch
+		rule.Dependencies = deps
+	}
+
+	t, exists := mf.Targets[rule.Name]
+	if !exists {
+		t = Target{Name: rule.Name, Dependencies: []string{}, Group: rule.Group, DependencyPos: make(map[string]ast.Pos, len(rule.Dependencies)), Pos: pos}
+		mf.TargetNames = append(mf.TargetNames, rule.Name)
+	}
+
+	for _, prereq := range rule.Dependencies {
+		if _, ok := t.DependencyPos[prereq]; !ok {
+			t.DependencyPos[prereq] = pos
+		}
+	}
+
+	if len(rule.Commands) > 0 {
+		t.Dependencies = append(append([]string{}, rule.Dependencies...), t.Dependencies...)
+		t.Commands = rule.Commands
+		t.CommandPos = rule.CommandPos
+		t.Pos = pos
+	} else {
+		t.Dependencies = append(t.Dependencies, rule.Dependencies...)
+	}
+	if rule.Description != "" {
+		t.Description = rule.Description
+	}
+	if rule.Fetch != nil {
+		t.Fetch = rule.Fetch
+	}
+	t.Outputs = appendNew(t.Outputs, rule.Outputs...)
+	if rule.Pool != "" {
+		t.Pool = rule.Pool
+	}
+	t.ResponseFile = t.ResponseFile || rule.ResponseFile
+	for name, value := range rule.Env {
+		if t.Env == nil {
+			t.Env = map[string]string{}
+		}
+		t.Env[name] = value
+	}
+
+	mf.Targets[rule.Name] = t
+}
+
+// DefaultGoal is what to build when no goals are given: the targets named
+// by .DEFAULT_GOAL, or else the first target that isn't special, a
+// pattern rule or a hook
+func (mf *Makefile) DefaultGoal() []string {
+	if goal := mf.Expand("$(.DEFAULT_GOAL)"); strings.TrimSpace(goal) != "" {
+		return strings.Fields(goal)
+	}
+
+	for _, name := range mf.TargetNames {
+		if !IsSpecialTarget(name) && !IsPatternRule(name) && !mf.IsHook(name) {
+			return []string{name}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package makefile_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/hmaketest"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// These check that makefiles are read as GNU make reads them, by what their
+// recipes print
+
+func TestVariables(t *testing.T) {
+	p := hmaketest.New(t, `
+		LATER = $(VALUE)
+		NOW := $(VALUE)
+		VALUE = set
+		DEFAULT ?= default
+		VALUE ?= ignored
+		LIST = a
+		LIST += b
+		all:
+			@echo "$(LATER) [$(NOW)] $(DEFAULT) $(VALUE) $(LIST)"
+	`, nil)
+
+	r := p.Run("all")
+	r.AssertOK(t)
+	assertOutput(t, r, "set [] default set a b\n")
+}
+
+func TestOverrides(t *testing.T) {
+	p := hmaketest.New(t, `
+		CFLAGS = -O0
+		all:
+			@echo $(CFLAGS)
+	`, nil)
+
+	r := p.Run("CFLAGS=-O2", "all")
+	r.AssertOK(t)
+	assertOutput(t, r, "-O2\n")
+}
+
+func TestAutomaticVariables(t *testing.T) {
+	p := hmaketest.New(t, `
+		out: b a b
+			@echo "$@ $< $^ $+"
+		a b:
+	`, nil)
+
+	r := p.Run("out")
+	r.AssertOK(t)
+	assertOutput(t, r, "out b b a b a b\n")
+}
+
+func TestDefaultGoal(t *testing.T) {
+	p := hmaketest.New(t, `
+		first:
+			@echo first
+		second:
+			@echo second
+	`, nil)
+
+	r := p.Run()
+	r.AssertOK(t)
+	r.AssertRan(t, "first")
+}
+
+func TestInclude(t *testing.T) {
+	p := hmaketest.New(t, `
+		include config.mk
+		-include missing.mk
+		all:
+			@echo $(FROM)
+	`, map[string]string{"config.mk": "FROM = config\n"})
+
+	r := p.Run("all")
+	r.AssertOK(t)
+	assertOutput(t, r, "config\n")
+}
+
+func TestConditionals(t *testing.T) {
+	p := hmaketest.New(t, `
+		MODE = release
+		ifeq ($(MODE),release)
+		FLAGS = -O2
+		else ifeq ($(MODE),debug)
+		FLAGS = -g
+		else
+		FLAGS =
+		endif
+		ifdef UNSET
+		DEFINED = yes
+		endif
+		ifneq "$(FLAGS)" ""
+		  ifndef DEFINED
+		NESTED = no
+		  endif
+		endif
+		all:
+			@echo "$(FLAGS) [$(DEFINED)] $(NESTED)"
+		ifeq ($(MODE),debug)
+			@echo debug recipe
+		else
+			@echo release recipe
+		endif
+	`, nil)
+
+	r := p.Run("all")
+	r.AssertOK(t)
+	assertOutput(t, r, "-O2 [] no\nrelease recipe\n")
+
+	r = p.Run("MODE=debug", "all")
+	r.AssertOK(t)
+	assertOutput(t, r, "-g [] no\ndebug recipe\n")
+}
+
+func TestConditionalErrors(t *testing.T) {
+	for _, text := range []string{
+		"ifeq (a,b)\nX = 1\n",
+		"X = 1\nendif\n",
+		"ifdef X\nelse\nelse\nendif\n",
+		"ifeq a b\nendif\n",
+	} {
+		f, err := ast.Parse("Makefile", strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parseErr *ast.ParseError
+		if err := makefile.NewMakefile().LoadContext(context.Background(), f); !errors.As(err, &parseErr) {
+			t.Errorf("%q: got %v, want a parse error", text, err)
+		}
+	}
+}
+
+func TestSkippedLines(t *testing.T) {
+	// An endif in a continued line or in the body of a define passed
+	// over doesn't end the conditional, and the rules passed over don't
+	// take the recipe lines after them
+	p := hmaketest.New(t, `
+		all:
+		ifdef UNSET
+		other:
+			@echo continued \
+		endif
+		define BODY
+		endif
+		endef
+		X = skipped \
+		    endif
+		else
+		  ifeq (a,b)
+			@echo nested
+		  else ifneq (a,a)
+			@echo nested else
+		  else
+			@echo kept
+		  endif
+		endif
+			@echo after
+	`, nil)
+
+	r := p.Run("all")
+	r.AssertOK(t)
+	assertOutput(t, r, "kept\nafter\n")
+}
+
+func assertOutput(t *testing.T, r *hmaketest.Result, want string) {
+	t.Helper()
+
+	if r.Output != want {
+		t.Fatalf("output %q, want %q", r.Output, want)
+	}
+}
@@ -0,0 +1,58 @@
+package makefile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// ParseCache keeps the files parsed by the Makefiles sharing it, each with
+// the SHA-256 of what was parsed, so that a process reading the makefile
+// again as it changes, as watch mode and the daemon do, parses again only
+// the files whose content changed. The variables and rules are still
+// loaded afresh, as a change to one file can change how the others expand.
+type ParseCache struct {
+	mu    sync.Mutex
+	files map[string]cachedFile
+}
+
+type cachedFile struct {
+	digest [sha256.Size]byte
+	file   *ast.File
+}
+
+// NewParseCache returns an empty cache
+func NewParseCache() *ParseCache {
+	return &ParseCache{files: map[string]cachedFile{}}
+}
+
+// parse returns the named file parsed, as it was last time if its content
+// is the same
+func (c *ParseCache) parse(ctx context.Context, fsys vfs.FS, filename string) (*ast.File, error) {
+	data, err := fsys.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+
+	c.mu.Lock()
+	cached, ok := c.files[filename]
+	c.mu.Unlock()
+	if ok && cached.digest == digest {
+		return cached.file, nil
+	}
+
+	f, err := ast.ParseContext(ctx, filename, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.files[filename] = cachedFile{digest: digest, file: f}
+	c.mu.Unlock()
+	return f, nil
+}
@@ -0,0 +1,67 @@
+package makefile
+
+import (
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// CaseInsensitivePaths has names that differ only in case, or in which
+// slash separates them, refer to the same file, as they do on Windows
+var CaseInsensitivePaths = runtime.GOOS == "windows"
+
+// SamePath reports whether a and b name the same file, as far as can be
+// told from the names
+func SamePath(a, b string) bool {
+	if !CaseInsensitivePaths {
+		return a == b
+	}
+	return pathKey(a) == pathKey(b)
+}
+
+// pathKey is what names of the same file have in common where case and the
+// slash don't matter
+func pathKey(name string) string {
+	return strings.ToLower(path.Clean(strings.ReplaceAll(name, `\`, "/")))
+}
+
+// foldPaths has each prerequisite spelled differently from the rule making
+// the same file name that rule, so that it's made, and checked for being
+// up to date, as that target rather than as a file nothing makes
+func (mf *Makefile) foldPaths() {
+	if !CaseInsensitivePaths {
+		return
+	}
+
+	byKey := map[string]string{}
+	for _, name := range mf.TargetNames {
+		if _, ok := byKey[pathKey(name)]; !ok {
+			byKey[pathKey(name)] = name
+		}
+	}
+
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		folded := false
+		for i, dep := range t.Dependencies {
+			if _, ok := mf.Targets[dep]; ok {
+				continue
+			}
+			target, ok := byKey[pathKey(dep)]
+			if !ok {
+				continue
+			}
+
+			if !folded {
+				t.Dependencies = slices.Clone(t.Dependencies)
+				folded = true
+			}
+			t.Dependencies[i] = target
+			if pos, ok := t.DependencyPos[dep]; ok {
+				t.DependencyPos[target] = pos
+			}
+		}
+		mf.Targets[name] = t
+	}
+}
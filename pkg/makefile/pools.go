@@ -0,0 +1,73 @@
+package makefile
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// declarePool records ".POOL: name depth=N target...", which may be split
+// across several lines naming the same pool: one giving its depth and
+// others the targets in it
+func (mf *Makefile) declarePool(ctx context.Context, n *ast.Rule) error {
+	e := mf.newExpansion(ctx, nil, n.Pos())
+	words := strings.Fields(e.expand(n.PrerequisiteText, 0))
+	if e.limit != nil {
+		e.limit.Pos = n.Pos()
+		return e.limit
+	}
+	if len(words) == 0 {
+		return poolError(n.Pos(), ".POOL needs the name of a pool")
+	}
+
+	name := words[0]
+	if mf.Pools == nil {
+		mf.Pools = map[string]int{}
+	}
+	if mf.pools == nil {
+		mf.pools = map[string]string{}
+		mf.poolPos = map[string]ast.Pos{}
+	}
+	if _, ok := mf.poolPos[name]; !ok {
+		mf.poolPos[name] = n.Pos()
+	}
+
+	for _, word := range words[1:] {
+		value, isDepth := strings.CutPrefix(word, "depth=")
+		if !isDepth {
+			mf.pools[word] = name
+			continue
+		}
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 {
+			return poolError(n.Pos(), fmt.Sprintf("invalid depth '%s' for pool '%s'; it must be at least 1", value, name))
+		}
+		mf.Pools[name] = depth
+	}
+	return nil
+}
+
+// applyPools puts the targets named by .POOL in their pools, once every
+// rule has been read, failing if a pool was never given a depth
+func (mf *Makefile) applyPools() error {
+	for name, pos := range mf.poolPos {
+		if _, ok := mf.Pools[name]; !ok {
+			return poolError(pos, fmt.Sprintf("pool '%s' has no depth; give it one with '.POOL: %s depth=N'", name, name))
+		}
+	}
+
+	for target, pool := range mf.pools {
+		if t, ok := mf.Targets[target]; ok {
+			t.Pool = pool
+			mf.Targets[target] = t
+		}
+	}
+	return nil
+}
+
+func poolError(pos ast.Pos, message string) error {
+	return &ast.ParseError{File: pos.Filename, Line: pos.Line, Message: message}
+}
@@ -0,0 +1,97 @@
+package makefile
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// prerequisiteWords splits the prerequisites of a rule at spaces, keeping
+// each reference, such as $(if $(CI),lint), whole within its word for
+// expandPrerequisites to expand once every variable has its value
+func prerequisiteWords(text string) []string {
+	words := []string{}
+	start := -1
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t':
+			if start >= 0 {
+				words = append(words, text[start:i])
+				start = -1
+			}
+			continue
+		case c == '$' && i+1 < len(text) && (text[i+1] == '(' || text[i+1] == '{'):
+			if end := matchingParen(text, i+1); end > 0 {
+				if start < 0 {
+					start = i
+				}
+				i = end
+				continue
+			}
+		case c == '$' && i+1 < len(text):
+			// $$ or a one letter variable
+			if start < 0 {
+				start = i
+			}
+			i++
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// expandPrerequisites expands the references in the prerequisites of each
+// target, once the makefiles have all been read, so that they see the
+// final value of every variable, however late it was set: deferred, where
+// GNU make expands them as it reads each rule. A reference may expand to
+// several prerequisites, or none. A URL is only seen to make a target a
+// download once expanded.
+func (mf *Makefile) expandPrerequisites(ctx context.Context) error {
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		if !slices.ContainsFunc(t.Dependencies, func(dep string) bool { return strings.Contains(dep, "$") }) {
+			continue
+		}
+
+		deps := []string{}
+		positions := map[string]ast.Pos{}
+		for _, dep := range t.Dependencies {
+			pos := t.DependencyPos[dep]
+			if !strings.Contains(dep, "$") {
+				deps = append(deps, dep)
+				if _, ok := positions[dep]; !ok {
+					positions[dep] = pos
+				}
+				continue
+			}
+
+			e := mf.newExpansion(ctx, nil, pos)
+			expanded := strings.Fields(e.expand(dep, 0))
+			if e.limit != nil {
+				e.limit.Pos = pos
+				return e.limit
+			}
+			for _, word := range expanded {
+				if _, ok := positions[word]; !ok {
+					positions[word] = pos
+				}
+			}
+			deps = append(deps, expanded...)
+		}
+
+		if t.Fetch == nil {
+			t.Fetch, deps = parseFetch(deps)
+		}
+		t.Dependencies, t.DependencyPos = deps, positions
+		mf.Targets[name] = t
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package makefile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// parseProfile records the variables set by a profile rule such as
+// "profile.release: CFLAGS=-O2 LDFLAGS=-s", returning false if the rule
+// doesn't declare a profile
+func (mf *Makefile) parseProfile(n *ast.Rule) bool {
+	if len(n.Targets) != 1 || !strings.HasPrefix(n.Targets[0], "profile.") {
+		return false
+	}
+
+	name := strings.TrimPrefix(n.Targets[0], "profile.")
+	vars := mf.Profiles[name]
+	if vars == nil {
+		vars = map[string]string{}
+		mf.Profiles[name] = vars
+	}
+
+	for _, word := range splitWords(n.PrerequisiteText) {
+		if name, value, ok := strings.Cut(word, "="); ok {
+			vars[name] = value
+		}
+	}
+
+	return true
+}
+
+// splitWords splits s at spaces, except inside single or double quotes,
+// which are removed
+func splitWords(s string) []string {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// ProfileVariables gives the variables the named profiles set, taken from
+// the makefile or the config file, the makefile's taking precedence, as do
+// the later profiles. They're meant as Overrides of the makefile read
+// again, so that its := and ?= assignments and conditionals see them.
+func (mf *Makefile) ProfileVariables(names []string, configured map[string]map[string]string) (map[string]string, error) {
+	variables := map[string]string{}
+	for _, name := range names {
+		vars, inMakefile := mf.Profiles[name]
+		fromConfig, inConfig := configured[name]
+		if !inMakefile && !inConfig {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+
+		for _, profile := range []map[string]string{fromConfig, vars} {
+			for k, v := range profile {
+				variables[k] = v
+			}
+		}
+	}
+
+	return variables, nil
+}
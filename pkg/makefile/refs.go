@@ -0,0 +1,123 @@
+package makefile
+
+import "strings"
+
+// functions are make's built in functions, and hmake's own such as
+// archive and git, which look like variable references but aren't
+var functions = map[string]bool{
+	"abspath": true, "addprefix": true, "addsuffix": true, "and": true,
+	"archive": true, "basename": true, "call": true, "dir": true, "error": true,
+	"eval": true, "file": true, "filter": true, "filter-out": true,
+	"findstring": true, "firstword": true, "flavor": true, "foreach": true,
+	"git": true, "guile": true, "if": true, "info": true, "intcmp": true,
+	"join": true, "lastword": true, "let": true, "notdir": true,
+	"or": true, "origin": true, "patsubst": true, "realpath": true,
+	"shell": true, "sort": true, "strip": true, "subst": true,
+	"suffix": true, "value": true, "warning": true, "wildcard": true,
+	"word": true, "wordlist": true, "words": true,
+}
+
+// IsFunction reports whether name is one of make's built in functions
+func IsFunction(name string) bool {
+	return functions[name]
+}
+
+// BuiltinVariables are defined by make itself, or by hmake
+var BuiltinVariables = map[string]bool{
+	"MAKE": true, "MAKEFLAGS": true, "MAKECMDGOALS": true, "MAKELEVEL": true,
+	"MAKEFILE_LIST": true, "MAKE_VERSION": true, "CURDIR": true, "SHELL": true,
+	".DEFAULT_GOAL": true, ".VARIABLES": true, "VPATH": true,
+	"AR": true, "AS": true, "CC": true, "CPP": true, "CXX": true,
+	"LD": true, "LEX": true, "RM": true, "YACC": true,
+	"HMAKE": true,
+}
+
+// IsAutomatic reports whether name is an automatic variable such as $@,
+// or one of its directory and file forms such as $(@D)
+func IsAutomatic(name string) bool {
+	if len(name) == 2 && (name[1] == 'D' || name[1] == 'F') {
+		name = name[:1]
+	}
+	return len(name) == 1 && strings.Contains("@%<?^+|*", name)
+}
+
+// References returns the names of the variables referred to in s, in the
+// order they appear. Function calls are looked into for the references in
+// their arguments, and a substitution reference such as $(SRCS:.c=.o)
+// refers to SRCS.
+func References(s string) []string {
+	refs := []string{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case '$':
+			continue
+		case '(', '{':
+			end := matchingParen(s, i)
+			if end < 0 {
+				return refs
+			}
+			refs = append(refs, referencesIn(s[i+1:end])...)
+			i = end
+		default:
+			refs = append(refs, s[i:i+1])
+		}
+	}
+
+	return refs
+}
+
+// referencesIn handles the text between the brackets of a reference
+func referencesIn(inner string) []string {
+	if name, args, ok := strings.Cut(inner, " "); ok && functions[name] {
+		return References(args)
+	}
+
+	// The name may itself be computed, as in $($(ARCH)_FLAGS)
+	if strings.Contains(inner, "$") {
+		return References(inner)
+	}
+
+	if name, _, ok := strings.Cut(inner, ":"); ok {
+		return []string{name}
+	}
+	return []string{inner}
+}
+
+// IsImplemented reports whether hmake implements the function name. Calls
+// to make's other functions expand to nothing.
+func IsImplemented(name string) bool {
+	_, ok := builtins[name]
+	return ok
+}
+
+// EachReference calls f with what's within each reference in s: "CC" for
+// $(CC), "@" for $@, "SRCS:.c=.o" for a substitution reference or the
+// whole call for a function. References nested within one follow it.
+func EachReference(s string, f func(inner string)) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case '$':
+			continue
+		case '(', '{':
+			end := matchingParen(s, i)
+			if end < 0 {
+				return
+			}
+			f(s[i+1 : end])
+			EachReference(s[i+1:end], f)
+			i = end
+		default:
+			f(s[i : i+1])
+		}
+	}
+}
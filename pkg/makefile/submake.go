@@ -0,0 +1,229 @@
+package makefile
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/vfs"
+)
+
+// submakeNames are the makefiles a sub-make looks for in its directory, in
+// the order make does
+var submakeNames = []string{"GNUmakefile", "makefile", "Makefile"}
+
+// InlineSubmakes replaces each recipe that's only "$(MAKE) -C dir goal..."
+// with the targets of dir's makefile, spliced into this one under "dir/",
+// so that the whole project builds as one graph rather than one make after
+// another. The target then depends on the goals, or on the sub-make's
+// default goal, as dir/goal. The spliced recipes are expanded as the
+// sub-make would expand them, and run in dir.
+//
+// A sub-make is left to run as it is if dir has no makefile, or if any of
+// its targets would take the name of one this makefile already has.
+func (mf *Makefile) InlineSubmakes(ctx context.Context) error {
+	return mf.inlineSubmakes(ctx, 0)
+}
+
+// inlineSubmakes is InlineSubmakes for a makefile depth sub-makes deep
+func (mf *Makefile) inlineSubmakes(ctx context.Context, depth int) error {
+	subs := map[string]*Makefile{}
+	for _, name := range slices.Clone(mf.TargetNames) {
+		t := mf.Targets[name]
+		dir, goals, ok := mf.submake(ctx, t)
+		if !ok {
+			continue
+		}
+
+		sub, loaded := subs[dir]
+		if !loaded {
+			var err error
+			if sub, err = mf.loadSubmake(ctx, dir, depth); err != nil {
+				return err
+			}
+			if sub != nil && !mf.splice(ctx, dir, sub) {
+				sub = nil
+			}
+			subs[dir] = sub
+		}
+		if sub == nil {
+			continue
+		}
+
+		if len(goals) == 0 {
+			goals = sub.DefaultGoal()
+		}
+		t.Commands, t.CommandPos = nil, nil
+		t.Dependencies = slices.Clone(t.Dependencies)
+		for _, goal := range goals {
+			dep := inDir(dir, goal)
+			t.Dependencies = append(t.Dependencies, dep)
+			if t.DependencyPos == nil {
+				t.DependencyPos = map[string]ast.Pos{}
+			}
+			t.DependencyPos[dep] = t.Pos
+		}
+		mf.Targets[name] = t
+	}
+	return nil
+}
+
+// submake reports whether t's recipe is only a sub-make that could be
+// inlined, "$(MAKE) -C dir goal...", and if so its directory and goals
+func (mf *Makefile) submake(ctx context.Context, t Target) (string, []string, bool) {
+	if len(t.Commands) != 1 {
+		return "", nil, false
+	}
+	command := strings.TrimLeft(t.Commands[0], "@+ \t")
+	rest, ok := strings.CutPrefix(command, "$(MAKE) ")
+	if !ok {
+		rest, ok = strings.CutPrefix(command, "${MAKE} ")
+	}
+	if !ok {
+		return "", nil, false
+	}
+
+	t.Commands = []string{rest}
+	expanded := mf.ExpandRecipeContext(ctx, t)[0]
+	if strings.ContainsAny(expanded, "\"'`$\\;&|<>()*?[]\n") {
+		return "", nil, false
+	}
+
+	dir, goals := "", []string{}
+	words := strings.Fields(expanded)
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		switch {
+		case (word == "-C" || word == "--directory") && i+1 < len(words) && dir == "":
+			i++
+			dir = words[i]
+		case strings.HasPrefix(word, "--directory=") && dir == "":
+			dir = strings.TrimPrefix(word, "--directory=")
+		case strings.HasPrefix(word, "-C") && len(word) > 2 && dir == "":
+			dir = word[2:]
+		case strings.HasPrefix(word, "-") || strings.Contains(word, "="):
+			// Flags and variables would make the sub-make differ from a
+			// plain one
+			return "", nil, false
+		default:
+			goals = append(goals, word)
+		}
+	}
+	if dir == "" {
+		return "", nil, false
+	}
+	return filepath.Clean(dir), goals, true
+}
+
+// loadSubmake reads the makefile in dir as a sub-make would, with the same
+// command line variables, or returns nil if there is none
+func (mf *Makefile) loadSubmake(ctx context.Context, dir string, depth int) (*Makefile, error) {
+	if depth >= maxIncludeDepth {
+		return nil, errors.New("sub-makes nested too deeply; does a makefile make itself?")
+	}
+
+	sub := NewMakefile()
+	sub.FS = vfs.Sub(mf.FileSystem(), dir)
+	sub.shellDir = filepath.Join(mf.shellDir, dir)
+	sub.ShellCommand = mf.ShellCommand
+	for name, value := range mf.Overrides {
+		sub.Overrides[name] = value
+	}
+
+	for _, name := range submakeNames {
+		_, err := sub.FileSystem().Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := sub.ParseContext(ctx, name); err != nil {
+			return nil, err
+		}
+		return sub, sub.inlineSubmakes(ctx, depth+1)
+	}
+	return nil, nil
+}
+
+// splice adds the targets of sub, the makefile in dir, under dir, and
+// reports whether it could: none of them may have a name already taken
+func (mf *Makefile) splice(ctx context.Context, dir string, sub *Makefile) bool {
+	names := []string{}
+	for _, name := range sub.TargetNames {
+		if IsSpecialTarget(name) || IsPatternRule(name) {
+			continue
+		}
+		if _, taken := mf.Targets[inDir(dir, name)]; taken {
+			return false
+		}
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		t := sub.Targets[name]
+		spliced := Target{
+			Name:        inDir(dir, name),
+			Description: t.Description,
+			Env:         t.Env,
+			Pos:         posInDir(dir, t.Pos),
+			Fetch:       t.Fetch,
+			Pool:        t.Pool,
+			Dir:         filepath.Join(dir, t.Dir),
+		}
+
+		// Expanded now, with the sub-make's variables, then escaped so
+		// that expanding them again changes nothing
+		for _, command := range sub.ExpandRecipeContext(ctx, t) {
+			spliced.Commands = append(spliced.Commands, strings.ReplaceAll(command, "$", "$$"))
+		}
+
+		for _, pos := range t.CommandPos {
+			spliced.CommandPos = append(spliced.CommandPos, posInDir(dir, pos))
+		}
+		spliced.DependencyPos = map[string]ast.Pos{}
+		for _, dep := range t.Dependencies {
+			spliced.Dependencies = append(spliced.Dependencies, inDir(dir, dep))
+			spliced.DependencyPos[inDir(dir, dep)] = posInDir(dir, t.DependencyPos[dep])
+		}
+		for _, out := range t.Outputs {
+			spliced.Outputs = append(spliced.Outputs, inDir(dir, out))
+		}
+
+		mf.Targets[spliced.Name] = spliced
+		mf.TargetNames = append(mf.TargetNames, spliced.Name)
+		if sub.Phony[name] {
+			mf.Phony[spliced.Name] = true
+		}
+
+		// A pool this makefile has too keeps the depth it gives it
+		if depth, ok := sub.Pools[t.Pool]; ok {
+			if mf.Pools == nil {
+				mf.Pools = map[string]int{}
+			}
+			if _, ok := mf.Pools[t.Pool]; !ok {
+				mf.Pools[t.Pool] = depth
+			}
+		}
+	}
+	return true
+}
+
+// inDir names a file of a sub-make in dir as the makefile including it
+// sees it. URLs and absolute paths stay as they are.
+func inDir(dir, name string) string {
+	if filepath.IsAbs(name) || strings.Contains(name, "://") {
+		return name
+	}
+	return filepath.ToSlash(filepath.Join(dir, name))
+}
+
+// posInDir is pos, in a makefile of a sub-make in dir, as seen from the
+// makefile including it
+func posInDir(dir string, pos ast.Pos) ast.Pos {
+	if pos.Filename != "" {
+		pos.Filename = inDir(dir, pos.Filename)
+	}
+	return pos
+}
@@ -0,0 +1,24 @@
+package makefile
+
+import "strings"
+
+// IsSpecialTarget reports whether name is one of make's built-in targets
+// such as .PHONY or .DEFAULT
+func IsSpecialTarget(name string) bool {
+	return strings.HasPrefix(name, ".") && !strings.Contains(name, "/")
+}
+
+// IsPatternRule reports whether name is the target of a pattern rule
+func IsPatternRule(name string) bool {
+	return strings.Contains(name, "%")
+}
+
+// IsFileTarget guesses whether a target names a file rather than a task.
+// Phony targets never do; otherwise anything that looks like a path does.
+func (mf *Makefile) IsFileTarget(name string) bool {
+	if mf.Phony[name] {
+		return false
+	}
+
+	return strings.ContainsAny(name, "./")
+}
@@ -0,0 +1,168 @@
+package makefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// tempDirMarker stands for a recipe's temporary directory while writing
+// the expanded makefile, to be written as $(TMPDIR) once $ is escaped
+const tempDirMarker = "\x00TMPDIR\x00"
+
+// WriteExpanded writes the makefile as hmake understands it: every variable
+// fully expanded and simply assigned, and every recipe expanded with its
+// automatic variables, in a makefile that builds the same way when read
+// back. Pattern rules keep their recipes as written, since their automatic
+// variables aren't known until they're used; the variables they refer to
+// are still fixed by the assignments. A target's environment is exported
+// at the start of each of its commands. Secrets are left for the
+// environment to give, and referred to by name where recipes use them, and
+// each recipe's $(TMPDIR) is left as it's written.
+func (mf *Makefile) WriteExpanded(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "# Generated by hmake expand")
+
+	names := make([]string, 0, len(mf.Variables))
+	for name := range mf.Variables {
+		if !mf.Secrets[name] {
+			names = append(names, name)
+		}
+	}
+	for name := range mf.Overrides {
+		if _, ok := mf.Variables[name]; !ok && !mf.Secrets[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) > 0 {
+		fmt.Fprintln(b)
+	}
+	for _, name := range names {
+		fmt.Fprintf(b, "%s := %s\n", name, escapeDollars(mf.Expand("$("+name+")")))
+	}
+
+	if phony := sortedKeys(mf.Phony); len(phony) > 0 {
+		fmt.Fprintf(b, "\n.PHONY: %s\n", strings.Join(phony, " "))
+	}
+	if services := sortedKeys(mf.Services); len(services) > 0 {
+		fmt.Fprintf(b, ".SERVICE: %s\n", strings.Join(services, " "))
+	}
+	if secrets := sortedKeys(mf.Secrets); len(secrets) > 0 {
+		fmt.Fprintf(b, ".SECRET: %s\n", strings.Join(secrets, " "))
+	}
+	values := mf.SecretValues()
+	secrets := make([]string, 0, len(values))
+	for name := range values {
+		secrets = append(secrets, name)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(values[secrets[i]]) > len(values[secrets[j]]) })
+	pairs := []string{}
+	for _, name := range secrets {
+		pairs = append(pairs, escapeDollars(values[name]), "$("+name+")")
+	}
+	// $(TMPDIR) is each recipe's own, only known when it runs
+	pairs = append(pairs, tempDirMarker, TempDirReference)
+	unexpandSecrets := strings.NewReplacer(pairs...)
+	pools := make([]string, 0, len(mf.Pools))
+	for name := range mf.Pools {
+		pools = append(pools, name)
+	}
+	sort.Strings(pools)
+	for _, name := range pools {
+		fmt.Fprintf(b, ".POOL: %s depth=%d\n", name, mf.Pools[name])
+	}
+
+	group := ""
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		if name == ".PHONY" {
+			continue
+		}
+
+		if t.Group != group && t.Group != "" {
+			fmt.Fprintf(b, "\n##@ %s\n", t.Group)
+		}
+		group = t.Group
+
+		fmt.Fprintf(b, "\n%s:", name)
+		if len(t.Dependencies) > 0 {
+			fmt.Fprintf(b, " %s", strings.Join(t.Dependencies, " "))
+		}
+		if t.Fetch != nil {
+			fmt.Fprintf(b, " %s", t.Fetch.URL)
+			if t.Fetch.SHA256 != "" {
+				fmt.Fprintf(b, " sha256=%s", t.Fetch.SHA256)
+			}
+		}
+		if t.Description != "" {
+			fmt.Fprintf(b, " ## %s", t.Description)
+		}
+		fmt.Fprintln(b)
+
+		commands := t.Commands
+		if !IsPatternRule(name) {
+			if !mf.SetsTempDir(t) {
+				t.TempDir = tempDirMarker
+			}
+			commands = mf.ExpandRecipe(t)
+			for i, command := range commands {
+				commands[i] = unexpandSecrets.Replace(escapeDollars(command))
+			}
+		}
+		if exports := exportEnv(t.Env); exports != "" {
+			for i, command := range commands {
+				prefix := command[:len(command)-len(strings.TrimLeft(command, "@-+"))]
+				commands[i] = prefix + exports + command[len(prefix):]
+			}
+		}
+		for _, command := range commands {
+			fmt.Fprintf(b, "\t%s\n", strings.ReplaceAll(command, "\n", "\n\t"))
+		}
+		if len(t.Outputs) > 0 {
+			fmt.Fprintf(b, ".OUTPUTS: %s %s\n", name, strings.Join(t.Outputs, " "))
+		}
+		if t.Pool != "" {
+			fmt.Fprintf(b, ".POOL: %s %s\n", t.Pool, name)
+		}
+		if t.ResponseFile {
+			fmt.Fprintf(b, ".RESPONSE_FILE: %s\n", name)
+		}
+	}
+
+	return b.Flush()
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for name := range set {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exportEnv sets a target's environment in its commands, as make has no
+// syntax of its own for it
+func exportEnv(env map[string]string) string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		value := "'" + strings.ReplaceAll(env[name], "'", `'\''`) + "'"
+		fmt.Fprintf(&b, "export %s=%s; ", name, escapeDollars(value))
+	}
+	return b.String()
+}
+
+// escapeDollars makes expanded text read back as itself
+func escapeDollars(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
@@ -0,0 +1,495 @@
+package ninja
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Parse reads a ninja build file into mf, so hmake can run ninja builds.
+// Each build statement becomes a target per output, with its command fully
+// expanded; the first output runs the command and any others depend on it.
+// Phony builds with inputs are aliases, so targets depending on them
+// depend on their inputs instead. A depfile left by an earlier build adds
+// the headers it lists as prerequisites. Order-only inputs are treated as
+// ordinary ones, which may rebuild more than ninja would but never builds
+// without them. Pools limit their builds' commands as in ninja, the console
+// pool to one at a time. Restat and the deps log aren't used: hmake checks
+// mtimes itself.
+func Parse(mf *makefile.Makefile, filename string) error {
+	p := &parser{mf: mf, vars: map[string]string{}, rules: map[string]map[string]string{}, aliases: map[string][]string{}}
+	if err := p.file(filename); err != nil {
+		return err
+	}
+
+	p.resolveAliases()
+	if len(p.defaults) > 0 {
+		mf.Variables[".DEFAULT_GOAL"] = strings.Join(p.defaults, " ")
+	}
+	return nil
+}
+
+// maxIncludeDepth bounds how deeply files may include one another, so a
+// file that includes itself is an error rather than a stack overflow
+const maxIncludeDepth = 64
+
+type parser struct {
+	mf   *makefile.Makefile
+	vars map[string]string
+
+	// depth is how many includes deep the file being read is
+	depth int
+
+	// rules holds the unexpanded bindings of each rule
+	rules map[string]map[string]string
+
+	// aliases are the inputs of each phony output
+	aliases map[string][]string
+
+	defaults []string
+}
+
+// line is a logical line of a ninja file, with its continuations joined
+type line struct {
+	pos      ast.Pos
+	text     string
+	indented bool
+}
+
+func (p *parser) file(filename string) error {
+	data, err := p.mf.FileSystem().ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	lines := splitLines(filename, string(data))
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		if l.indented {
+			return parseError(l.pos, "unexpected indent")
+		}
+
+		// The indented lines that follow are the statement's bindings
+		bindings := []line{}
+		for i+1 < len(lines) && lines[i+1].indented {
+			i++
+			bindings = append(bindings, lines[i])
+		}
+
+		keyword, rest, _ := strings.Cut(l.text, " ")
+		rest = strings.TrimSpace(rest)
+		switch keyword {
+		case "rule":
+			vars := map[string]string{}
+			for _, b := range bindings {
+				name, value, err := binding(b)
+				if err != nil {
+					return err
+				}
+				vars[name] = value
+			}
+			p.rules[rest] = vars
+
+		case "build":
+			if err := p.build(l, rest, bindings); err != nil {
+				return err
+			}
+
+		case "default":
+			for _, target := range splitPaths(rest) {
+				p.defaults = append(p.defaults, p.eval(target, p.lookupFile))
+			}
+
+		case "pool":
+			if err := p.pool(l, rest, bindings); err != nil {
+				return err
+			}
+
+		case "include", "subninja":
+			name := p.eval(rest, p.lookupFile)
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(filename), name)
+			}
+			if p.depth >= maxIncludeDepth {
+				return parseError(l.pos, fmt.Sprintf("includes nested too deeply; does %s include itself?", name))
+			}
+			p.depth++
+			err := p.file(name)
+			p.depth--
+			if err != nil {
+				return err
+			}
+
+		default:
+			name, value, err := binding(l)
+			if err != nil {
+				return err
+			}
+			p.vars[name] = p.eval(value, p.lookupFile)
+		}
+	}
+
+	return nil
+}
+
+// build handles "build outputs: rule inputs", with its bindings
+func (p *parser) build(l line, text string, bindings []line) error {
+	colon := unescapedColon(text)
+	if colon < 0 {
+		return parseError(l.pos, "expected ':' in build statement")
+	}
+
+	outputs, implicitOutputs := splitGroups(text[:colon], "|")
+	right := splitPaths(text[colon+1:])
+	if len(right) == 0 {
+		return parseError(l.pos, "expected a rule name")
+	}
+	ruleName := right[0]
+
+	// Inputs are explicit, then after | implicit, then after || order-only,
+	// then after |@ validations, which aren't needed to build
+	inputs := []string{}
+	explicit := []string{}
+	group := 0
+	for _, word := range right[1:] {
+		switch word {
+		case "|":
+			group = 1
+			continue
+		case "||":
+			group = 2
+			continue
+		case "|@":
+			group = 3
+			continue
+		}
+		if group == 3 {
+			continue
+		}
+		inputs = append(inputs, word)
+		if group == 0 {
+			explicit = append(explicit, word)
+		}
+	}
+
+	eval := func(paths []string) []string {
+		out := make([]string, len(paths))
+		for i, path := range paths {
+			out[i] = p.eval(path, p.lookupFile)
+		}
+		return out
+	}
+	outputs, implicitOutputs = eval(outputs), eval(implicitOutputs)
+	inputs, explicit = eval(inputs), eval(explicit)
+
+	// A build's own bindings are expanded as they're read
+	local := map[string]string{}
+	for _, b := range bindings {
+		name, value, err := binding(b)
+		if err != nil {
+			return err
+		}
+		local[name] = p.eval(value, func(name string) string {
+			if value, ok := local[name]; ok {
+				return value
+			}
+			return p.lookupFile(name)
+		})
+	}
+
+	if ruleName == "phony" {
+		for _, out := range outputs {
+			if len(inputs) > 0 {
+				p.aliases[out] = inputs
+			}
+			p.mf.AddRule(makefile.Target{Name: out, Dependencies: inputs}, l.pos)
+		}
+		return nil
+	}
+
+	rule, ok := p.rules[ruleName]
+	if !ok {
+		return parseError(l.pos, fmt.Sprintf("unknown build rule '%s'", ruleName))
+	}
+
+	// Rule bindings are expanded for each build, seeing $in, $out and the
+	// build's bindings
+	var lookup func(string) string
+	seen := map[string]bool{}
+	lookup = func(name string) string {
+		switch name {
+		case "in":
+			return strings.Join(explicit, " ")
+		case "in_newline":
+			return strings.Join(explicit, "\n")
+		case "out":
+			return strings.Join(outputs, " ")
+		}
+		if value, ok := local[name]; ok {
+			return value
+		}
+		if value, ok := rule[name]; ok && !seen[name] {
+			seen[name] = true
+			defer delete(seen, name)
+			return p.eval(value, lookup)
+		}
+		return p.vars[name]
+	}
+
+	command := lookup("command")
+	description := lookup("description")
+	pool := lookup("pool")
+	if pool == "console" {
+		p.definePool(pool, 1)
+	}
+	if _, ok := p.mf.Pools[pool]; pool != "" && !ok {
+		return parseError(l.pos, fmt.Sprintf("unknown pool name '%s'", pool))
+	}
+	deps := append(append([]string{}, inputs...), p.depfile(lookup("depfile"))...)
+
+	all := append(append([]string{}, outputs...), implicitOutputs...)
+	for i, out := range all {
+		t := makefile.Target{Name: out, Description: description}
+		if i == 0 {
+			// hmake expands recipes as make does, so $ must be escaped
+			t.Commands = []string{strings.ReplaceAll(command, "$", "$$")}
+			t.Dependencies = deps
+			t.Outputs = all[1:]
+			t.Pool = pool
+		} else {
+			t.Dependencies = []string{all[0]}
+		}
+		p.mf.AddRule(t, l.pos)
+	}
+	return nil
+}
+
+// pool handles "pool name" and its depth binding
+func (p *parser) pool(l line, name string, bindings []line) error {
+	depth := 0
+	for _, b := range bindings {
+		key, value, err := binding(b)
+		if err != nil {
+			return err
+		}
+		if key != "depth" {
+			return parseError(b.pos, fmt.Sprintf("unexpected variable '%s'", key))
+		}
+		depth, err = strconv.Atoi(p.eval(value, p.lookupFile))
+		if err != nil || depth < 1 {
+			return parseError(b.pos, "invalid pool depth")
+		}
+	}
+	if depth == 0 {
+		return parseError(l.pos, "expected 'depth =' line")
+	}
+	p.definePool(name, depth)
+	return nil
+}
+
+func (p *parser) definePool(name string, depth int) {
+	if p.mf.Pools == nil {
+		p.mf.Pools = map[string]int{}
+	}
+	p.mf.Pools[name] = depth
+}
+
+// depfile reads the prerequisites from a depfile left by an earlier build,
+// such as one written by gcc -MD. Headers that have since gone are left
+// out, as they can no longer be needed.
+func (p *parser) depfile(name string) []string {
+	if name == "" {
+		return nil
+	}
+
+	data, err := p.mf.FileSystem().ReadFile(name)
+	if err != nil {
+		return nil
+	}
+
+	deps := []string{}
+	text := strings.ReplaceAll(string(data), "\\\n", " ")
+	for _, rule := range strings.Split(text, "\n") {
+		_, prereqs, ok := strings.Cut(rule, ": ")
+		if !ok {
+			continue
+		}
+		for _, dep := range strings.Fields(prereqs) {
+			if _, err := p.mf.FileSystem().Stat(dep); err == nil {
+				deps = append(deps, dep)
+			}
+		}
+	}
+	return deps
+}
+
+// resolveAliases replaces prerequisites that are phony aliases with what
+// they stand for, so an alias doesn't make everything depending on it
+// rebuild every time
+func (p *parser) resolveAliases() {
+	var resolve func(name string, seen map[string]bool) []string
+	resolve = func(name string, seen map[string]bool) []string {
+		inputs, ok := p.aliases[name]
+		if !ok || seen[name] {
+			return []string{name}
+		}
+		seen[name] = true
+
+		resolved := []string{}
+		for _, input := range inputs {
+			resolved = append(resolved, resolve(input, seen)...)
+		}
+		return resolved
+	}
+
+	for _, name := range p.mf.TargetNames {
+		if _, alias := p.aliases[name]; alias {
+			continue
+		}
+
+		t := p.mf.Targets[name]
+		deps := []string{}
+		for _, dep := range t.Dependencies {
+			deps = append(deps, resolve(dep, map[string]bool{})...)
+		}
+		t.Dependencies = deps
+		p.mf.Targets[name] = t
+	}
+}
+
+func (p *parser) lookupFile(name string) string {
+	return p.vars[name]
+}
+
+// eval expands the variable references and escapes of a ninja value
+func (p *parser) eval(s string, lookup func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch c := s[i]; {
+		case c == '$' || c == ' ' || c == ':':
+			b.WriteByte(c)
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				b.WriteString(s[i-1:])
+				return b.String()
+			}
+			b.WriteString(lookup(s[i+1 : i+end]))
+			i += end
+		case isVarChar(c):
+			start := i
+			for i < len(s) && isVarChar(s[i]) {
+				i++
+			}
+			b.WriteString(lookup(s[start:i]))
+			i--
+		default:
+			b.WriteByte('$')
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isVarChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// splitLines breaks a ninja file into logical lines, joining those ending
+// with "$" to the next and dropping comments and blank lines
+func splitLines(filename, data string) []line {
+	lines := []line{}
+	physical := strings.Split(data, "\n")
+	for i := 0; i < len(physical); i++ {
+		pos := ast.Pos{Filename: filename, Line: i + 1, Column: 1}
+		text := strings.TrimSuffix(physical[i], "\r")
+		for continued(text) && i+1 < len(physical) {
+			i++
+			text = text[:len(text)-1] + strings.TrimLeft(strings.TrimSuffix(physical[i], "\r"), " ")
+		}
+
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		lines = append(lines, line{pos: pos, text: trimmed, indented: text[0] == ' '})
+	}
+	return lines
+}
+
+// continued reports whether a line ends with an unescaped $
+func continued(text string) bool {
+	n := len(text) - len(strings.TrimRight(text, "$"))
+	return n%2 == 1
+}
+
+// binding splits "name = value"
+func binding(l line) (string, string, error) {
+	name, value, ok := strings.Cut(l.text, "=")
+	if !ok {
+		return "", "", parseError(l.pos, "expected '='")
+	}
+	return strings.TrimSpace(name), strings.TrimSpace(value), nil
+}
+
+// splitPaths splits a list of paths on the spaces that aren't escaped
+func splitPaths(s string) []string {
+	paths := []string{}
+	current := ""
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s):
+			current += s[i : i+2]
+			i++
+		case s[i] == ' ':
+			if current != "" {
+				paths = append(paths, current)
+			}
+			current = ""
+		default:
+			current += string(s[i])
+		}
+	}
+	if current != "" {
+		paths = append(paths, current)
+	}
+	return paths
+}
+
+// splitGroups splits paths in two at a separator word such as "|"
+func splitGroups(s, sep string) ([]string, []string) {
+	paths := splitPaths(s)
+	for i, p := range paths {
+		if p == sep {
+			return paths[:i], paths[i+1:]
+		}
+	}
+	return paths, nil
+}
+
+// unescapedColon finds the first ":" not escaped as "$:"
+func unescapedColon(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '$':
+			i++
+		case ':':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseError(pos ast.Pos, msg string) error {
+	return &ast.ParseError{File: pos.Filename, Line: pos.Line, Message: msg}
+}
@@ -0,0 +1,110 @@
+// Package ninja translates between makefiles and ninja build files.
+package ninja
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Write lowers the makefile to a ninja build file. Each target with a
+// recipe gets a rule of its own running the expanded commands in turn, and
+// targets with no recipe become phony. Ninja has no pattern rules, so those
+// are left out with a comment saying so. Pools become ninja pools.
+func Write(w io.Writer, mf *makefile.Makefile) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "# Generated by hmake export ninja from the Makefile")
+	fmt.Fprintln(b, "ninja_required_version = 1.3")
+
+	pools := make([]string, 0, len(mf.Pools))
+	for name := range mf.Pools {
+		pools = append(pools, name)
+	}
+	sort.Strings(pools)
+	for _, name := range pools {
+		if name != "console" {
+			fmt.Fprintf(b, "\npool %s\n  depth = %d\n", name, mf.Pools[name])
+		}
+	}
+
+	rules := 0
+	for _, name := range mf.TargetNames {
+		t := mf.Targets[name]
+		switch {
+		case makefile.IsSpecialTarget(name):
+			continue
+		case makefile.IsPatternRule(name):
+			fmt.Fprintf(b, "\n# pattern rule %s can't be expressed in ninja\n", name)
+			continue
+		}
+
+		inputs := escapePaths(dedupe(t.Dependencies))
+		commands := mf.ExpandRecipe(t)
+		if len(commands) == 0 {
+			fmt.Fprintf(b, "\nbuild %s: phony%s\n", escapePath(name), inputs)
+			continue
+		}
+
+		rules++
+		fmt.Fprintf(b, "\nrule r%d\n", rules)
+		fmt.Fprintf(b, "  command = %s\n", escape(command(commands)))
+		fmt.Fprintf(b, "  description = %s\n", escape(name))
+		if t.Pool != "" {
+			fmt.Fprintf(b, "  pool = %s\n", t.Pool)
+		}
+		fmt.Fprintf(b, "build %s: r%d%s\n", escapePath(name), rules, inputs)
+	}
+
+	if defaults := mf.DefaultGoal(); len(defaults) > 0 {
+		fmt.Fprintf(b, "\ndefault%s\n", escapePaths(defaults))
+	}
+
+	return b.Flush()
+}
+
+// command joins a recipe into a single shell command that, like make,
+// stops at the first command to fail
+func command(commands []string) string {
+	parts := make([]string, len(commands))
+	for i, c := range commands {
+		c = strings.TrimPrefix(c, "@")
+		c = strings.ReplaceAll(c, "\\\n", " ")
+		parts[i] = "(" + c + ")"
+	}
+	return strings.Join(parts, " && ")
+}
+
+// escape protects the $ signs of a ninja variable's value
+func escape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// escapePath protects the characters with meaning in a ninja build line
+func escapePath(s string) string {
+	return strings.NewReplacer("$", "$$", " ", "$ ", ":", "$:").Replace(s)
+}
+
+// escapePaths escapes each path, each preceded by a space
+func escapePaths(paths []string) string {
+	var b strings.Builder
+	for _, p := range paths {
+		b.WriteString(" " + escapePath(p))
+	}
+	return b.String()
+}
+
+func dedupe(words []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			unique = append(unique, w)
+		}
+	}
+	return unique
+}
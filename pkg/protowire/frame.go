@@ -0,0 +1,41 @@
+package protowire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxMessage bounds the size of a gRPC message ReadFrame accepts
+const MaxMessage = 64 << 20
+
+// Frame prefixes msg as a gRPC message: uncompressed, with its length
+func Frame(msg []byte) []byte {
+	framed := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(msg)))
+	return append(framed, msg...)
+}
+
+// ReadFrame reads the next gRPC message from r, giving io.EOF if there are
+// no more
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrTruncated
+	} else if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed gRPC messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > MaxMessage {
+		return nil, fmt.Errorf("gRPC message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, ErrTruncated
+	}
+	return msg, nil
+}
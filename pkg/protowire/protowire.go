@@ -0,0 +1,123 @@
+// Package protowire encodes and decodes protocol buffers by hand, and
+// frames them as gRPC messages, for hmake's gRPC client and server without
+// generated code.
+package protowire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Message encodes a protocol buffer. Fields are appended in the order
+// written; callers write them in field number order, so that messages
+// digested as blobs, such as the Remote Execution API's Directory, come
+// out in canonical form.
+type Message []byte
+
+// Tag appends the key of a field, its number and wire type
+func (m *Message) Tag(field, wire int) {
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|uint64(wire))
+}
+
+// Varint appends a varint field, unless v is zero, its default
+func (m *Message) Varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	m.Tag(field, 0)
+	*m = binary.AppendUvarint(*m, v)
+}
+
+// Bool appends a bool field, unless it's false
+func (m *Message) Bool(field int, v bool) {
+	if v {
+		m.Varint(field, 1)
+	}
+}
+
+// Double appends a double field, unless v is zero
+func (m *Message) Double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	m.Tag(field, 1)
+	*m = binary.LittleEndian.AppendUint64(*m, math.Float64bits(v))
+}
+
+// Bytes appends a length delimited field, such as a nested message
+func (m *Message) Bytes(field int, b []byte) {
+	m.Tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// String appends a string field, unless it's empty
+func (m *Message) String(field int, s string) {
+	if s != "" {
+		m.Bytes(field, []byte(s))
+	}
+}
+
+// Message appends a nested message field, even an empty one
+func (m *Message) Message(field int, nested Message) {
+	m.Bytes(field, nested)
+}
+
+// Field is a decoded field: a varint, the bits of a fixed size number such
+// as a double, or the bytes of a length delimited
+// field such as a string or a nested message
+type Field struct {
+	Num    int
+	Varint uint64
+	Data   []byte
+}
+
+// ErrTruncated is returned by Decode for a message cut short
+var ErrTruncated = errors.New("truncated protocol buffer")
+
+// Decode splits a protocol buffer into its fields
+func Decode(b []byte) ([]Field, error) {
+	fields := []Field{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrTruncated
+		}
+		b = b[n:]
+
+		f := Field{Num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.Varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, ErrTruncated
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, ErrTruncated
+			}
+			f.Varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, ErrTruncated
+			}
+			f.Data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case 5:
+			if len(b) < 4 {
+				return nil, ErrTruncated
+			}
+			f.Varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return nil, fmt.Errorf("unsupported protocol buffer wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
@@ -0,0 +1,113 @@
+package protowire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var nested Message
+	nested.String(1, "inner")
+
+	var m Message
+	m.Varint(1, 300)
+	m.Bool(2, true)
+	m.Double(3, 1.5)
+	m.String(4, "text")
+	m.Bytes(5, []byte{0, 1, 2})
+	m.Message(6, nested)
+	m.Message(7, nil)
+	m.Varint(8, math.MaxUint64)
+
+	fields, err := Decode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Field{
+		{Num: 1, Varint: 300},
+		{Num: 2, Varint: 1},
+		{Num: 3, Varint: math.Float64bits(1.5)},
+		{Num: 4, Data: []byte("text")},
+		{Num: 5, Data: []byte{0, 1, 2}},
+		{Num: 6, Data: nested},
+		{Num: 7, Data: []byte{}},
+		{Num: 8, Varint: math.MaxUint64},
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(want))
+	}
+	for i, f := range fields {
+		if f.Num != want[i].Num || f.Varint != want[i].Varint || !bytes.Equal(f.Data, want[i].Data) {
+			t.Errorf("field %d is %+v, want %+v", i, f, want[i])
+		}
+	}
+
+	inner, err := Decode(fields[5].Data)
+	if err != nil || len(inner) != 1 || string(inner[0].Data) != "inner" {
+		t.Errorf("nested message decodes to %+v, %v", inner, err)
+	}
+}
+
+func TestDefaultsOmitted(t *testing.T) {
+	var m Message
+	m.Varint(1, 0)
+	m.Bool(2, false)
+	m.Double(3, 0)
+	m.String(4, "")
+	if len(m) != 0 {
+		t.Fatalf("default values encode to %x, want nothing", []byte(m))
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	var first Message
+	first.String(1, "a string")
+	m := append(Message{}, first...)
+	m.Varint(2, 1<<40)
+	for n := 1; n < len(m); n++ {
+		_, err := Decode(m[:n])
+		if n == len(first) {
+			// Cut between fields, what's left is still a message
+			if err != nil {
+				t.Errorf("cut after the first field: %v", err)
+			}
+		} else if !errors.Is(err, ErrTruncated) {
+			t.Errorf("cut at %d: got %v, want ErrTruncated", n, err)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(Frame([]byte("first")))
+	stream.Write(Frame(nil))
+	stream.Write(Frame([]byte("last")))
+
+	for _, want := range []string{"first", "", "last"} {
+		msg, err := ReadFrame(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != want {
+			t.Fatalf("read %q, want %q", msg, want)
+		}
+	}
+	if _, err := ReadFrame(&stream); err != io.EOF {
+		t.Fatalf("got %v at the end, want io.EOF", err)
+	}
+
+	framed := Frame([]byte("cut short"))
+	if _, err := ReadFrame(bytes.NewReader(framed[:len(framed)-1])); !errors.Is(err, ErrTruncated) {
+		t.Errorf("got %v for a cut short message, want ErrTruncated", err)
+	}
+	framed[0] = 1
+	if _, err := ReadFrame(bytes.NewReader(framed)); err == nil {
+		t.Error("a compressed message was read")
+	}
+	if _, err := ReadFrame(bytes.NewReader([]byte{0, 0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.Error("a message larger than MaxMessage was read")
+	}
+}
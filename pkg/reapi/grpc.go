@@ -0,0 +1,89 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/hookenz/hmake/pkg/protowire"
+)
+
+// conn makes gRPC calls over HTTP/2. net/http negotiates HTTP/2 only over
+// TLS, so clusters must be reached with TLS.
+type conn struct {
+	base   string
+	client *http.Client
+
+	// header is sent with every call, e.g. for authorization
+	header http.Header
+}
+
+// grpcError is a call that failed with a gRPC status
+type grpcError struct {
+	method  string
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("%s: %s (code %d)", e.method, e.message, e.code)
+}
+
+// call sends req to method, such as "/google.bytestream.ByteStream/Read",
+// returning every message of the response, of which a unary call has one
+func (c *conn) call(ctx context.Context, method string, req []byte) ([][]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+method, bytes.NewReader(protowire.Frame(req)))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		httpReq.Header[name] = values
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	if resp.ProtoMajor < 2 {
+		return nil, fmt.Errorf("%s: server doesn't speak HTTP/2", method)
+	}
+
+	messages := [][]byte{}
+	for {
+		msg, err := protowire.ReadFrame(resp.Body)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", method, err)
+		}
+		messages = append(messages, msg)
+	}
+
+	// A call that fails straight away puts its status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, fmt.Errorf("%s: no gRPC status in response", method)
+		}
+		if unescaped, err := url.PathUnescape(message); err == nil {
+			message = unescaped
+		}
+		return nil, &grpcError{method: method, code: code, message: message}
+	}
+	return messages, nil
+}
@@ -0,0 +1,56 @@
+package reapi
+
+import "github.com/hookenz/hmake/pkg/protowire"
+
+// Digest identifies a blob by the SHA-256 of its contents and its size
+type Digest struct {
+	Hash string
+	Size int64
+}
+
+func (d Digest) encode() []byte {
+	var m protowire.Message
+	m.String(1, d.Hash)
+	m.Varint(2, uint64(d.Size))
+	return m
+}
+
+func decodeDigest(b []byte) (Digest, error) {
+	fields, err := protowire.Decode(b)
+	if err != nil {
+		return Digest{}, err
+	}
+	var d Digest
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			d.Hash = string(f.Data)
+		case 2:
+			d.Size = int64(f.Varint)
+		}
+	}
+	return d, nil
+}
+
+// rpcStatus is a google.rpc.Status
+type rpcStatus struct {
+	code    int
+	message string
+}
+
+func decodeStatus(b []byte) (rpcStatus, error) {
+	fields, err := protowire.Decode(b)
+	if err != nil {
+		return rpcStatus{}, err
+	}
+	var s rpcStatus
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			s.code = int(int32(f.Varint))
+		case 2:
+			s.message = string(f.Data)
+		}
+	}
+	return s, nil
+}
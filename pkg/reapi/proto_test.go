@@ -0,0 +1,163 @@
+package reapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/hookenz/hmake/pkg/protowire"
+)
+
+func digestOf(data []byte) Digest {
+	sum := sha256.Sum256(data)
+	return Digest{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+}
+
+func TestDigestRoundTrip(t *testing.T) {
+	for _, d := range []Digest{digestOf(nil), digestOf([]byte("contents"))} {
+		got, err := decodeDigest(d.encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != d {
+			t.Errorf("decoded %+v, want %+v", got, d)
+		}
+	}
+}
+
+func TestDecodeStatus(t *testing.T) {
+	var m protowire.Message
+	m.Varint(1, uint64(5))
+	m.String(2, "not found")
+	s, err := decodeStatus(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.code != 5 || s.message != "not found" {
+		t.Errorf("decoded %+v", s)
+	}
+
+	// A negative int32 is sent as a ten byte varint
+	m = nil
+	m.Varint(1, uint64(1<<64-1))
+	if s, _ := decodeStatus(m); s.code != -1 {
+		t.Errorf("decoded code %d, want -1", s.code)
+	}
+}
+
+func TestTreeEncode(t *testing.T) {
+	build := func(order []string) (Digest, map[Digest][]byte) {
+		root := newTree()
+		for _, name := range order {
+			root.dir("src/lib").files[name] = fileNode{data: []byte(name)}
+			root.dir("b").files[name] = fileNode{data: []byte(name), executable: true}
+		}
+		blobs := map[Digest][]byte{}
+		d := root.encode(func(b []byte) Digest {
+			d := digestOf(b)
+			blobs[d] = b
+			return d
+		})
+		return d, blobs
+	}
+
+	d1, blobs := build([]string{"x.c", "a.c", "m.h"})
+	d2, _ := build([]string{"m.h", "x.c", "a.c"})
+	if d1 != d2 {
+		t.Fatalf("the same tree encoded to %v and %v", d1, d2)
+	}
+
+	// The root lists b before src, and each directory its files in order
+	fields, err := protowire.Decode(blobs[d1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, f := range fields {
+		if f.Num != 2 {
+			t.Fatalf("the root has field %d, want only directories", f.Num)
+		}
+		node, err := protowire.Decode(f.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, string(node[0].Data))
+		if _, err := decodeDigest(node[1].Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dirs) != 2 || dirs[0] != "b" || dirs[1] != "src" {
+		t.Fatalf("the root lists %q, want [b src]", dirs)
+	}
+
+	b := fields[0]
+	node, _ := protowire.Decode(b.Data)
+	sub, _ := decodeDigest(node[1].Data)
+	files, err := protowire.Decode(blobs[sub])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		file, err := protowire.Decode(f.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, string(file[0].Data))
+		if len(file) != 3 || file[2].Num != 4 || file[2].Varint != 1 {
+			t.Errorf("%s isn't marked executable", file[0].Data)
+		}
+	}
+	if len(names) != 3 || names[0] != "a.c" || names[1] != "m.h" || names[2] != "x.c" {
+		t.Errorf("b lists %q, want [a.c m.h x.c]", names)
+	}
+}
+
+func TestDecodeOutputFile(t *testing.T) {
+	contents := []byte("#!/bin/sh\n")
+	var m protowire.Message
+	m.String(1, "out/tool")
+	m.Message(2, digestOf(contents).encode())
+	m.Bool(4, true)
+	m.Bytes(5, contents)
+
+	out, err := decodeOutputFile(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.path != "out/tool" || out.digest != digestOf(contents) || !out.executable || !bytes.Equal(out.contents, contents) {
+		t.Errorf("decoded %+v", out)
+	}
+
+	m.Bytes(2, []byte{0x0a, 0x40})
+	if _, err := decodeOutputFile(m); err == nil {
+		t.Error("a truncated digest decoded")
+	}
+}
+
+func TestReadBlob(t *testing.T) {
+	data := []byte("blob")
+	var m protowire.Message
+	m.Message(1, digestOf(data).encode())
+	m.Bytes(2, data)
+	var status protowire.Message
+	m.Message(3, status)
+
+	blobs := map[Digest][]byte{}
+	if err := readBlob(m, blobs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blobs[digestOf(data)], data) {
+		t.Errorf("read %q", blobs[digestOf(data)])
+	}
+
+	var missing protowire.Message
+	missing.Message(1, digestOf([]byte("missing")).encode())
+	status.Varint(1, 5)
+	status.String(2, "not found")
+	missing.Message(3, status)
+	if err := readBlob(missing, blobs); err == nil {
+		t.Error("a blob the cluster couldn't find was read")
+	}
+}
@@ -0,0 +1,711 @@
+// Package reapi runs recipe commands on a build cluster speaking the Bazel
+// Remote Execution API, such as Buildfarm, Buildbarn or BuildBuddy.
+//
+// Each command becomes an action whose input root holds its target's
+// prerequisites, and the target itself if it exists already, and whose
+// output is the target. The files are uploaded to the cluster's
+// content-addressable storage, the action is executed there, and the
+// output and the command's stdout and stderr are fetched back. Commands
+// that read files other than their prerequisites won't find them.
+//
+// The client speaks gRPC over HTTP/2 with TLS, sending blobs in batches
+// rather than by ByteStream, so a single file may be at most a few
+// megabytes. Whatever can't be run remotely, because the cluster is
+// unavailable or the action isn't self-contained, is run by Fallback.
+package reapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hookenz/hmake/pkg/exec"
+	"github.com/hookenz/hmake/pkg/protowire"
+)
+
+// Executor runs commands as remote actions
+type Executor struct {
+	// Instance is the instance name of the cluster, which many leave empty
+	Instance string
+
+	// Shell runs each command as "Shell -c command" on the worker, sh if
+	// empty
+	Shell string
+
+	// Platform are the properties workers must have, such as OSFamily or
+	// container-image
+	Platform map[string]string
+
+	// Fallback, if set, runs the commands that can't be run remotely
+	Fallback exec.Executor
+
+	conn
+
+	// unreachable is set once the cluster can't be reached, after which
+	// every command goes to Fallback
+	unreachable atomic.Bool
+}
+
+// New returns an Executor for the cluster at a URL such as
+// grpcs://buildfarm.example.com:8980/instance?OSFamily=linux. The path is
+// the instance name and the query the platform properties. A token, if
+// given, is sent as a bearer token.
+func New(rawURL, token string) (*Executor, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "grpcs", "https":
+	case "grpc", "http":
+		return nil, fmt.Errorf("%s: remote execution needs TLS; use grpcs://", rawURL)
+	default:
+		return nil, fmt.Errorf("%s: remote executor must be a grpcs:// URL", rawURL)
+	}
+
+	e := &Executor{
+		Instance: strings.Trim(u.Path, "/"),
+		Platform: map[string]string{},
+		conn: conn{
+			base: "https://" + u.Host,
+			client: &http.Client{Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{NextProtos: []string{"h2"}},
+			}},
+			header: http.Header{},
+		},
+	}
+	for name, values := range u.Query() {
+		e.Platform[name] = values[len(values)-1]
+	}
+	if token != "" {
+		e.header.Set("Authorization", "Bearer "+token)
+	}
+	return e, nil
+}
+
+// Execute runs cmd on the cluster, or with Fallback if that fails
+func (e *Executor) Execute(ctx context.Context, cmd exec.Cmd) int {
+	if e.unreachable.Load() && e.Fallback != nil {
+		return e.Fallback.Execute(ctx, cmd)
+	}
+
+	code, err := e.remote(ctx, cmd)
+	if err == nil {
+		return code
+	}
+	if ctx.Err() != nil {
+		return 1
+	}
+
+	// A failure to connect, rather than an error from the cluster, would
+	// only happen again
+	var status *grpcError
+	if !errors.As(err, &status) {
+		e.unreachable.Store(true)
+	}
+
+	if e.Fallback == nil {
+		fmt.Fprintf(cmd.Stderr, "hmake: remote execution failed: %s\n", err)
+		return 127
+	}
+	fmt.Fprintf(cmd.Stderr, "hmake: remote execution failed, running locally: %s\n", err)
+	return e.Fallback.Execute(ctx, cmd)
+}
+
+const (
+	casService  = "/build.bazel.remote.execution.v2.ContentAddressableStorage/"
+	execService = "/build.bazel.remote.execution.v2.Execution/"
+)
+
+// maxBatch bounds the blobs sent or fetched in one call, below the 4MB
+// limit most servers put on a gRPC message
+const maxBatch = 4<<20 - 64<<10
+
+// remote runs cmd as an action, returning its exit code
+func (e *Executor) remote(ctx context.Context, cmd exec.Cmd) (int, error) {
+	blobs := map[Digest][]byte{}
+	add := func(data []byte) Digest {
+		sum := sha256.Sum256(data)
+		d := Digest{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		blobs[d] = data
+		return d
+	}
+
+	root := newTree()
+	for _, name := range append(append([]string{}, cmd.Inputs...), cmd.Outputs...) {
+		if err := root.addPath(name); err != nil {
+			return 0, err
+		}
+	}
+	rootDigest := root.encode(add)
+
+	shell := e.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	var command protowire.Message
+	for _, arg := range []string{shell, "-c", cmd.Command} {
+		command.Bytes(1, []byte(arg))
+	}
+	env := append([]string{}, cmd.Env...)
+	sort.Strings(env)
+	for _, pair := range env {
+		name, value, _ := strings.Cut(pair, "=")
+		var v protowire.Message
+		v.String(1, name)
+		v.String(2, value)
+		command.Bytes(2, v)
+	}
+	outputs := []string{}
+	for _, out := range cmd.Outputs {
+		if rel, ok := relative(out); ok {
+			outputs = append(outputs, rel)
+		}
+	}
+	sort.Strings(outputs)
+	for _, out := range outputs {
+		command.Bytes(3, []byte(out))
+	}
+	platform := e.platform()
+	command.Bytes(5, platform)
+
+	var action protowire.Message
+	action.Bytes(1, add(command).encode())
+	action.Bytes(2, rootDigest.encode())
+	action.Bytes(10, platform)
+	actionDigest := add(action)
+
+	if err := e.upload(ctx, blobs); err != nil {
+		return 0, err
+	}
+
+	result, err := e.execute(ctx, actionDigest)
+	if err != nil {
+		return 0, err
+	}
+	return e.collect(ctx, result, cmd)
+}
+
+// platform encodes the Platform properties, sorted by name
+func (e *Executor) platform() protowire.Message {
+	names := make([]string, 0, len(e.Platform))
+	for name := range e.Platform {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var platform protowire.Message
+	for _, name := range names {
+		var p protowire.Message
+		p.String(1, name)
+		p.String(2, e.Platform[name])
+		platform.Bytes(1, p)
+	}
+	return platform
+}
+
+// relative cleans a path of the build, which must lie within the current
+// directory to be part of an input root
+func relative(name string) (string, bool) {
+	name = path.Clean(filepath.ToSlash(name))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// tree is a directory of an input root
+type tree struct {
+	files map[string]fileNode
+	dirs  map[string]*tree
+}
+
+type fileNode struct {
+	data       []byte
+	executable bool
+}
+
+func newTree() *tree {
+	return &tree{files: map[string]fileNode{}, dirs: map[string]*tree{}}
+}
+
+// addPath adds a file, or a directory and everything in it, to the tree.
+// Names that don't exist, such as phony prerequisites, are left out.
+func (t *tree) addPath(name string) error {
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	rel, ok := relative(name)
+	if !ok {
+		return fmt.Errorf("%s is outside the working directory", name)
+	}
+
+	return filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		r := rel
+		if p != name {
+			sub, err := filepath.Rel(name, p)
+			if err != nil {
+				return err
+			}
+			r = path.Join(rel, filepath.ToSlash(sub))
+		}
+
+		if d.IsDir() {
+			t.dir(r)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s: can only send files and directories", p)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		t.dir(path.Dir(r)).files[path.Base(r)] = fileNode{data: data, executable: info.Mode()&0o111 != 0}
+		return nil
+	})
+}
+
+// dir returns the directory at a slash separated path, creating it
+func (t *tree) dir(p string) *tree {
+	if p == "." {
+		return t
+	}
+	for _, name := range strings.Split(p, "/") {
+		sub, ok := t.dirs[name]
+		if !ok {
+			sub = newTree()
+			t.dirs[name] = sub
+		}
+		t = sub
+	}
+	return t
+}
+
+// encode turns the tree into Directory messages, giving each file and
+// directory to add to be stored as a blob, and returns its digest
+func (t *tree) encode(add func([]byte) Digest) Digest {
+	var dir protowire.Message
+	for _, name := range sortedKeys(t.files) {
+		f := t.files[name]
+		var node protowire.Message
+		node.String(1, name)
+		node.Bytes(2, add(f.data).encode())
+		node.Bool(4, f.executable)
+		dir.Bytes(1, node)
+	}
+	for _, name := range sortedKeys(t.dirs) {
+		var node protowire.Message
+		node.String(1, name)
+		node.Bytes(2, t.dirs[name].encode(add).encode())
+		dir.Bytes(2, node)
+	}
+	return add(dir)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// upload sends the cluster the blobs it doesn't have yet
+func (e *Executor) upload(ctx context.Context, blobs map[Digest][]byte) error {
+	var find protowire.Message
+	find.String(1, e.Instance)
+	for d := range blobs {
+		find.Bytes(2, d.encode())
+	}
+	resp, err := e.unary(ctx, casService+"FindMissingBlobs", find)
+	if err != nil {
+		return err
+	}
+	fields, err := protowire.Decode(resp)
+	if err != nil {
+		return err
+	}
+
+	var batch protowire.Message
+	size := 0
+	send := func() error {
+		if size == 0 {
+			return nil
+		}
+		err := e.updateBlobs(ctx, batch)
+		batch, size = nil, 0
+		return err
+	}
+
+	batch.String(1, e.Instance)
+	for _, f := range fields {
+		if f.Num != 2 {
+			continue
+		}
+		d, err := decodeDigest(f.Data)
+		if err != nil {
+			return err
+		}
+		data, ok := blobs[d]
+		if !ok {
+			continue
+		}
+		if len(data) > maxBatch {
+			return fmt.Errorf("a file of %d bytes is too large to send", len(data))
+		}
+		if size+len(data) > maxBatch {
+			if err := send(); err != nil {
+				return err
+			}
+			batch.String(1, e.Instance)
+		}
+
+		var req protowire.Message
+		req.Bytes(1, d.encode())
+		req.Bytes(2, data)
+		batch.Bytes(2, req)
+		size += len(data) + 100
+	}
+	return send()
+}
+
+// updateBlobs makes a BatchUpdateBlobs call, checking each blob was stored
+func (e *Executor) updateBlobs(ctx context.Context, batch protowire.Message) error {
+	resp, err := e.unary(ctx, casService+"BatchUpdateBlobs", batch)
+	if err != nil {
+		return err
+	}
+	fields, err := protowire.Decode(resp)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.Num != 1 {
+			continue
+		}
+		blob, err := protowire.Decode(f.Data)
+		if err != nil {
+			return err
+		}
+		for _, bf := range blob {
+			if bf.Num != 2 {
+				continue
+			}
+			if status, err := decodeStatus(bf.Data); err != nil {
+				return err
+			} else if status.code != 0 {
+				return fmt.Errorf("storing a blob: %s (code %d)", status.message, status.code)
+			}
+		}
+	}
+	return nil
+}
+
+// unary makes a call with a single response
+func (e *Executor) unary(ctx context.Context, method string, req protowire.Message) ([]byte, error) {
+	messages, err := e.call(ctx, method, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, fmt.Errorf("%s: %d responses", method, len(messages))
+	}
+	return messages[0], nil
+}
+
+// execute runs an action, waiting for its ActionResult
+func (e *Executor) execute(ctx context.Context, action Digest) ([]byte, error) {
+	var req protowire.Message
+	req.String(1, e.Instance)
+	req.Bytes(6, action.encode())
+
+	// Execute streams the operation's progress; the last message is done
+	ops, err := e.call(ctx, execService+"Execute", req)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("Execute: no operation")
+	}
+	fields, err := protowire.Decode(ops[len(ops)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	var done bool
+	var response []byte
+	for _, f := range fields {
+		switch f.Num {
+		case 3:
+			done = f.Varint != 0
+		case 4:
+			status, err := decodeStatus(f.Data)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("execution failed: %s (code %d)", status.message, status.code)
+		case 5:
+			// An Any holding an ExecuteResponse
+			anyFields, err := protowire.Decode(f.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, af := range anyFields {
+				if af.Num == 2 {
+					response = af.Data
+				}
+			}
+		}
+	}
+	if !done || response == nil {
+		return nil, errors.New("Execute: the operation didn't finish")
+	}
+
+	fields, err = protowire.Decode(response)
+	if err != nil {
+		return nil, err
+	}
+	var result []byte
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			result = f.Data
+		case 3:
+			status, err := decodeStatus(f.Data)
+			if err != nil {
+				return nil, err
+			}
+			if status.code != 0 {
+				return nil, fmt.Errorf("execution failed: %s (code %d)", status.message, status.code)
+			}
+		}
+	}
+	if result == nil {
+		return nil, errors.New("Execute: no action result")
+	}
+	return result, nil
+}
+
+// outputFile is an OutputFile of an ActionResult
+type outputFile struct {
+	path       string
+	digest     Digest
+	executable bool
+	contents   []byte
+}
+
+// collect writes the outputs and output of an ActionResult, returning the
+// command's exit code
+func (e *Executor) collect(ctx context.Context, result []byte, cmd exec.Cmd) (int, error) {
+	fields, err := protowire.Decode(result)
+	if err != nil {
+		return 0, err
+	}
+
+	var outputs []outputFile
+	var exitCode int
+	var stdout, stderr []byte
+	var stdoutDigest, stderrDigest *Digest
+	for _, f := range fields {
+		switch f.Num {
+		case 2:
+			out, err := decodeOutputFile(f.Data)
+			if err != nil {
+				return 0, err
+			}
+			outputs = append(outputs, out)
+		case 4:
+			exitCode = int(int32(f.Varint))
+		case 5:
+			stdout = f.Data
+		case 6, 8:
+			d, err := decodeDigest(f.Data)
+			if err != nil {
+				return 0, err
+			}
+			if f.Num == 6 {
+				stdoutDigest = &d
+			} else {
+				stderrDigest = &d
+			}
+		case 7:
+			stderr = f.Data
+		}
+	}
+
+	wanted := []Digest{}
+	for _, out := range outputs {
+		if out.contents == nil && out.digest.Size > 0 {
+			wanted = append(wanted, out.digest)
+		}
+	}
+	if stdout == nil && stdoutDigest != nil && stdoutDigest.Size > 0 {
+		wanted = append(wanted, *stdoutDigest)
+	}
+	if stderr == nil && stderrDigest != nil && stderrDigest.Size > 0 {
+		wanted = append(wanted, *stderrDigest)
+	}
+	blobs, err := e.readBlobs(ctx, wanted)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, out := range outputs {
+		data := out.contents
+		if data == nil {
+			data = blobs[out.digest]
+		}
+		if err := writeOutput(out, data); err != nil {
+			return 0, err
+		}
+	}
+
+	if stdout == nil && stdoutDigest != nil {
+		stdout = blobs[*stdoutDigest]
+	}
+	if stderr == nil && stderrDigest != nil {
+		stderr = blobs[*stderrDigest]
+	}
+	cmd.Stdout.Write(stdout)
+	cmd.Stderr.Write(stderr)
+	return exitCode, nil
+}
+
+func decodeOutputFile(b []byte) (outputFile, error) {
+	fields, err := protowire.Decode(b)
+	if err != nil {
+		return outputFile{}, err
+	}
+	var out outputFile
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			out.path = string(f.Data)
+		case 2:
+			if out.digest, err = decodeDigest(f.Data); err != nil {
+				return out, err
+			}
+		case 4:
+			out.executable = f.Varint != 0
+		case 5:
+			out.contents = f.Data
+		}
+	}
+	return out, nil
+}
+
+// writeOutput writes an output file fetched from the cluster, checking it
+// has the digest the result gave
+func writeOutput(out outputFile, data []byte) error {
+	rel, ok := relative(out.path)
+	if !ok {
+		return fmt.Errorf("the cluster returned %s, outside the working directory", out.path)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != out.digest.Hash {
+		return fmt.Errorf("the cluster returned %s with the wrong digest", out.path)
+	}
+
+	name := filepath.FromSlash(rel)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	mode := fs.FileMode(0o644)
+	if out.executable {
+		mode = 0o755
+	}
+	os.Remove(name)
+	return os.WriteFile(name, data, mode)
+}
+
+// readBlobs fetches blobs from the cluster's storage
+func (e *Executor) readBlobs(ctx context.Context, digests []Digest) (map[Digest][]byte, error) {
+	blobs := map[Digest][]byte{}
+	for len(digests) > 0 {
+		var req protowire.Message
+		req.String(1, e.Instance)
+		size := 0
+		n := 0
+		for ; n < len(digests); n++ {
+			if digests[n].Size > maxBatch {
+				return nil, fmt.Errorf("an output of %d bytes is too large to fetch", digests[n].Size)
+			}
+			if n > 0 && size+int(digests[n].Size) > maxBatch {
+				break
+			}
+			req.Bytes(2, digests[n].encode())
+			size += int(digests[n].Size)
+		}
+		digests = digests[n:]
+
+		resp, err := e.unary(ctx, casService+"BatchReadBlobs", req)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := protowire.Decode(resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			if f.Num != 1 {
+				continue
+			}
+			if err := readBlob(f.Data, blobs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// readBlob decodes a response of BatchReadBlobs into blobs
+func readBlob(b []byte, blobs map[Digest][]byte) error {
+	fields, err := protowire.Decode(b)
+	if err != nil {
+		return err
+	}
+	var d Digest
+	var data []byte
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			if d, err = decodeDigest(f.Data); err != nil {
+				return err
+			}
+		case 2:
+			data = f.Data
+		case 3:
+			status, err := decodeStatus(f.Data)
+			if err != nil {
+				return err
+			}
+			if status.code != 0 {
+				return fmt.Errorf("fetching %s: %s (code %d)", d.Hash, status.message, status.code)
+			}
+		}
+	}
+	blobs[d] = data
+	return nil
+}
@@ -0,0 +1,260 @@
+// Package taskfile reads tasks declared in YAML or TOML, an alternative to
+// a Makefile for projects that want a task runner without make's rules
+// about tabs and whitespace.
+//
+// An Hmakefile.yaml looks like
+//
+//	default: build
+//	vars:
+//	  BIN: app
+//	tasks:
+//	  generate:
+//	    commands: go generate ./...
+//	  build:
+//	    description: Build the binary
+//	    deps: [generate]
+//	    env:
+//	      CGO_ENABLED: "0"
+//	    commands:
+//	      - go build -o $(BIN) .
+//
+// and the same in Hmakefile.toml
+//
+//	default = "build"
+//
+//	[vars]
+//	BIN = "app"
+//
+//	[tasks.build]
+//	description = "Build the binary"
+//	deps = ["generate"]
+//	commands = ["go build -o $(BIN) ."]
+//
+//	[tasks.build.env]
+//	CGO_ENABLED = "0"
+//
+// Tasks become targets of a makefile.Makefile, so commands are expanded as
+// make recipes are: $(VAR) refers to a variable and $$ is a literal $.
+// Tasks are phony, always run when needed, unless they say "phony: false"
+// because they make a file of the same name.
+package taskfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+	"github.com/hookenz/hmake/pkg/makefile"
+)
+
+// Names are the task files looked for when there's no Makefile
+var Names = []string{"Hmakefile.yaml", "Hmakefile.yml", "Hmakefile.toml"}
+
+// IsTaskfile reports whether filename is named as a YAML or TOML file
+func IsTaskfile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// Parse reads a task file into mf, as YAML or TOML according to its name
+func Parse(mf *makefile.Makefile, filename string) error {
+	data, err := mf.FileSystem().ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var root *node
+	if strings.EqualFold(filepath.Ext(filename), ".toml") {
+		root, err = parseTOML(filename, string(data))
+	} else {
+		root, err = parseYAML(filename, string(data))
+	}
+	if err != nil {
+		return err
+	}
+
+	l := &loader{mf: mf, filename: filename}
+	return l.load(root)
+}
+
+// node is a parsed value: a string, a list or a mapping with its keys in
+// the order they were written
+type node struct {
+	line int
+
+	kind  nodeKind
+	str   string
+	list  []*node
+	keys  []string
+	items map[string]*node
+}
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	listNode
+	mapNode
+)
+
+func newMap(line int) *node {
+	return &node{line: line, kind: mapNode, items: map[string]*node{}}
+}
+
+func (n *node) set(key string, value *node) {
+	if _, ok := n.items[key]; !ok {
+		n.keys = append(n.keys, key)
+	}
+	n.items[key] = value
+}
+
+type loader struct {
+	mf       *makefile.Makefile
+	filename string
+}
+
+func (l *loader) errorf(n *node, format string, args ...interface{}) error {
+	return &ast.ParseError{File: l.filename, Line: n.line, Message: fmt.Sprintf(format, args...)}
+}
+
+func (l *loader) pos(n *node) ast.Pos {
+	return ast.Pos{Filename: l.filename, Line: n.line, Column: 1}
+}
+
+func (l *loader) load(root *node) error {
+	if root.kind != mapNode {
+		return l.errorf(root, "expected a mapping with the tasks")
+	}
+
+	for _, key := range root.keys {
+		value := root.items[key]
+		switch key {
+		case "default":
+			goals, err := l.strings(value)
+			if err != nil {
+				return err
+			}
+			l.mf.Variables[".DEFAULT_GOAL"] = strings.Join(goals, " ")
+
+		case "vars":
+			vars, err := l.mapping(value)
+			if err != nil {
+				return err
+			}
+			for name, value := range vars {
+				l.mf.Variables[name] = value
+			}
+
+		case "tasks":
+			if value.kind != mapNode {
+				return l.errorf(value, "tasks must be a mapping of names to tasks")
+			}
+			for _, name := range value.keys {
+				if err := l.task(name, value.items[name]); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return l.errorf(value, "unknown key %q", key)
+		}
+	}
+
+	return nil
+}
+
+func (l *loader) task(name string, n *node) error {
+	t := makefile.Target{Name: name, Dependencies: []string{}}
+	phony := true
+
+	if n.kind == scalarNode && n.str == "" {
+		// A task with nothing to it, such as "all:" with only deps
+		n = newMap(n.line)
+	}
+	if n.kind != mapNode {
+		return l.errorf(n, "task %s must be a mapping", name)
+	}
+
+	for _, key := range n.keys {
+		value := n.items[key]
+		var err error
+		switch key {
+		case "description", "desc":
+			t.Description, err = l.scalar(value)
+		case "deps":
+			t.Dependencies, err = l.strings(value)
+		case "commands", "cmds":
+			t.Commands, err = l.strings(value)
+			for i, command := range t.Commands {
+				// A block string ends with a new line the shell doesn't need
+				t.Commands[i] = strings.TrimSuffix(command, "\n")
+			}
+		case "env":
+			t.Env, err = l.mapping(value)
+		case "phony":
+			var s string
+			s, err = l.scalar(value)
+			phony = s != "false"
+		default:
+			err = l.errorf(value, "unknown key %q in task %s", key, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	l.mf.AddRule(t, l.pos(n))
+	if phony {
+		l.mf.Phony[name] = true
+	}
+	return nil
+}
+
+func (l *loader) scalar(n *node) (string, error) {
+	if n.kind != scalarNode {
+		return "", l.errorf(n, "expected a single value")
+	}
+	return n.str, nil
+}
+
+// strings accepts either a list of strings or a single one
+func (l *loader) strings(n *node) ([]string, error) {
+	switch n.kind {
+	case scalarNode:
+		if n.str == "" {
+			return []string{}, nil
+		}
+		return []string{n.str}, nil
+	case listNode:
+		values := []string{}
+		for _, item := range n.list {
+			s, err := l.scalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	return nil, l.errorf(n, "expected a list")
+}
+
+func (l *loader) mapping(n *node) (map[string]string, error) {
+	if n.kind != mapNode {
+		return nil, l.errorf(n, "expected a mapping")
+	}
+
+	values := map[string]string{}
+	for _, key := range n.keys {
+		s, err := l.scalar(n.items[key])
+		if err != nil {
+			return nil, err
+		}
+		values[key] = s
+	}
+	return values, nil
+}
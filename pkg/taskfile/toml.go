@@ -0,0 +1,343 @@
+package taskfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// The TOML understood covers what task files need: tables and dotted keys,
+// basic and literal strings including multi-line ones, arrays and inline
+// tables. Numbers, booleans and dates are kept as the text written, and
+// arrays of tables aren't supported.
+
+type tomlParser struct {
+	filename string
+	data     string
+	pos      int
+	line     int
+}
+
+func parseTOML(filename, data string) (*node, error) {
+	p := &tomlParser{filename: filename, data: strings.ReplaceAll(data, "\r\n", "\n"), line: 1}
+	root := newMap(1)
+	table := root
+
+	for {
+		p.skipSpace(true)
+		if p.pos == len(p.data) {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			if strings.HasPrefix(p.data[p.pos:], "[[") {
+				return nil, p.errorf("arrays of tables aren't supported")
+			}
+			p.pos++
+			keys, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ']' after table name")
+			}
+			p.pos++
+			if table, err = p.table(root, keys); err != nil {
+				return nil, err
+			}
+		} else if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+
+		p.skipSpace(false)
+		if p.pos < len(p.data) && p.peek() != '\n' {
+			return nil, p.errorf("expected a new line")
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return &ast.ParseError{File: p.filename, Line: p.line, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *tomlParser) peek() byte {
+	if p.pos == len(p.data) {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// skipSpace moves past spaces and comments, and new lines too if asked
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+// table finds or makes the table named by keys under root
+func (p *tomlParser) table(root *node, keys []string) (*node, error) {
+	n := root
+	for _, key := range keys {
+		next, ok := n.items[key]
+		if !ok {
+			next = newMap(p.line)
+			n.set(key, next)
+		}
+		if next.kind != mapNode {
+			return nil, p.errorf("%s is already defined as a value", key)
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// keyValue reads "key = value" into table
+func (p *tomlParser) keyValue(table *node) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+
+	p.skipSpace(false)
+	if p.peek() != '=' {
+		return p.errorf("expected '=' after %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpace(false)
+
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	parent, err := p.table(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := parent.items[last]; ok {
+		return p.errorf("%s is defined more than once", strings.Join(keys, "."))
+	}
+	parent.set(last, value)
+	return nil
+}
+
+// key reads a key that may be dotted and quoted, such as a."b.c"
+func (p *tomlParser) key() ([]string, error) {
+	keys := []string{}
+	for {
+		p.skipSpace(false)
+
+		var key string
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			s, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := p.pos
+			for p.pos < len(p.data) && isBareKeyChar(p.data[p.pos]) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, p.errorf("expected a key")
+			}
+			key = p.data[start:p.pos]
+		}
+		keys = append(keys, key)
+
+		p.skipSpace(false)
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) value() (*node, error) {
+	line := p.line
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return &node{line: line, kind: scalarNode, str: s}, nil
+
+	case c == '[':
+		p.pos++
+		n := &node{line: line, kind: listNode}
+		for {
+			p.skipSpace(true)
+			if p.peek() == ']' {
+				p.pos++
+				return n, nil
+			}
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, item)
+
+			p.skipSpace(true)
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case ']':
+			default:
+				return nil, p.errorf("expected ',' or ']' in array")
+			}
+		}
+
+	case c == '{':
+		p.pos++
+		n := newMap(line)
+		p.skipSpace(false)
+		if p.peek() == '}' {
+			p.pos++
+			return n, nil
+		}
+		for {
+			if err := p.keyValue(n); err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case '}':
+				p.pos++
+				return n, nil
+			default:
+				return nil, p.errorf("expected ',' or '}' in inline table")
+			}
+		}
+	}
+
+	// A number, boolean or date, kept as written
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(" \t\n#,]}", rune(p.data[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, p.errorf("expected a value")
+	}
+	return &node{line: line, kind: scalarNode, str: p.data[start:p.pos]}, nil
+}
+
+// str reads a basic or literal string, either of which may be multi-line
+func (p *tomlParser) str() (string, error) {
+	quote := p.data[p.pos]
+	delim := string(quote)
+	if strings.HasPrefix(p.data[p.pos:], strings.Repeat(delim, 3)) {
+		delim = strings.Repeat(delim, 3)
+	}
+	multiline := len(delim) == 3
+	p.pos += len(delim)
+
+	// A new line straight after the opening quotes isn't part of the string
+	if multiline && p.peek() == '\n' {
+		p.pos++
+		p.line++
+	}
+
+	var b strings.Builder
+	for p.pos < len(p.data) {
+		if strings.HasPrefix(p.data[p.pos:], delim) {
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+
+		c := p.data[p.pos]
+		switch {
+		case c == '\n':
+			if !multiline {
+				return "", p.errorf("unterminated string")
+			}
+			p.line++
+			b.WriteByte(c)
+			p.pos++
+
+		case c == '\\' && quote == '"':
+			p.pos++
+			if err := p.escape(&b, multiline); err != nil {
+				return "", err
+			}
+
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// escape writes the character of the escape after a backslash
+func (p *tomlParser) escape(b *strings.Builder, multiline bool) error {
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'n':
+		b.WriteByte('\n')
+	case 't':
+		b.WriteByte('\t')
+	case 'r':
+		b.WriteByte('\r')
+	case 'b':
+		b.WriteByte('\b')
+	case 'f':
+		b.WriteByte('\f')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.data) {
+			return p.errorf("invalid unicode escape")
+		}
+		var r rune
+		if _, err := fmt.Sscanf(p.data[p.pos:p.pos+n], "%x", &r); err != nil {
+			return p.errorf("invalid unicode escape")
+		}
+		b.WriteRune(r)
+		p.pos += n
+	case ' ', '\t', '\n':
+		// A backslash ending a line of a multi-line string joins it to the
+		// next, dropping the white space between
+		if !multiline {
+			return p.errorf("invalid escape '\\%c'", c)
+		}
+		p.pos--
+		for p.pos < len(p.data) && strings.ContainsRune(" \t\n", rune(p.data[p.pos])) {
+			if p.data[p.pos] == '\n' {
+				p.line++
+			}
+			p.pos++
+		}
+	default:
+		return p.errorf("invalid escape '\\%c'", c)
+	}
+	return nil
+}
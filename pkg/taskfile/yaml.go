@@ -0,0 +1,382 @@
+package taskfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hookenz/hmake/pkg/ast"
+)
+
+// The YAML understood is the subset task files need: mappings and lists
+// by indentation, flow lists such as [a, b], quoted and plain strings,
+// literal (|) and folded (>) block strings, and comments. Anchors, tags
+// and multiple documents aren't supported.
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string // without the indent or a trailing comment
+	raw    string
+}
+
+type yamlParser struct {
+	filename string
+	lines    []yamlLine
+	i        int
+}
+
+func parseYAML(filename, data string) (*node, error) {
+	p := &yamlParser{filename: filename}
+	for i, raw := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimLeft(raw, " ")
+		p.lines = append(p.lines, yamlLine{
+			number: i + 1,
+			indent: len(raw) - len(trimmed),
+			text:   strings.TrimSpace(stripComment(trimmed)),
+			raw:    raw,
+		})
+	}
+
+	p.skipBlank()
+	if p.i == len(p.lines) {
+		return newMap(1), nil
+	}
+	if strings.HasPrefix(p.lines[p.i].text, "---") {
+		p.i++
+		p.skipBlank()
+	}
+
+	root, err := p.block(p.lines[p.i].indent)
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipBlank()
+	if p.i < len(p.lines) {
+		return nil, p.errorf(p.lines[p.i], "unexpected indent")
+	}
+	return root, nil
+}
+
+func (p *yamlParser) errorf(l yamlLine, msg string) error {
+	return &ast.ParseError{File: p.filename, Line: l.number, Message: msg}
+}
+
+// skipBlank moves past blank and comment lines
+func (p *yamlParser) skipBlank() {
+	for p.i < len(p.lines) && p.lines[p.i].text == "" {
+		p.i++
+	}
+}
+
+// block parses the mapping or list whose lines are indented by indent
+func (p *yamlParser) block(indent int) (*node, error) {
+	l := p.lines[p.i]
+	if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.list(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) list(indent int) (*node, error) {
+	n := &node{line: p.lines[p.i].number, kind: listNode}
+	for p.skipBlank(); p.i < len(p.lines); p.skipBlank() {
+		l := p.lines[p.i]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent || !(l.text == "-" || strings.HasPrefix(l.text, "- ")) {
+			return nil, p.errorf(l, "expected a list item")
+		}
+
+		rest := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		switch {
+		case rest == "":
+			// The item is the block on the following lines
+			p.i++
+			item, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, item)
+
+		case isMappingEntry(rest):
+			// "- key: value" starts a mapping indented to the key
+			offset := len(l.raw) - len(strings.TrimLeft(l.raw[l.indent+1:], " "))
+			p.lines[p.i].indent = offset
+			p.lines[p.i].text = rest
+			item, err := p.mapping(offset)
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, item)
+
+		default:
+			item, err := p.scalarValue(l, rest, indent)
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, item)
+		}
+	}
+	return n, nil
+}
+
+func (p *yamlParser) mapping(indent int) (*node, error) {
+	n := newMap(p.lines[p.i].number)
+	for p.skipBlank(); p.i < len(p.lines); p.skipBlank() {
+		l := p.lines[p.i]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indent")
+		}
+
+		key, value, ok := cutMappingEntry(l.text)
+		if !ok {
+			return nil, p.errorf(l, "expected key: value")
+		}
+
+		if value == "" {
+			p.i++
+			item, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			n.set(key, item)
+			continue
+		}
+
+		item, err := p.scalarValue(l, value, indent)
+		if err != nil {
+			return nil, err
+		}
+		n.set(key, item)
+	}
+	return n, nil
+}
+
+// nested parses the block indented more than indent on the lines that
+// follow, or an empty value if there isn't one
+func (p *yamlParser) nested(indent int) (*node, error) {
+	p.skipBlank()
+	if p.i == len(p.lines) || p.lines[p.i].indent <= indent {
+		// A list may be written at the same indent as its key
+		if p.i < len(p.lines) && p.lines[p.i].indent == indent && strings.HasPrefix(p.lines[p.i].text, "- ") {
+			return p.list(indent)
+		}
+		line := p.lines[p.i-1].number
+		return &node{line: line, kind: scalarNode}, nil
+	}
+	return p.block(p.lines[p.i].indent)
+}
+
+// scalarValue parses the value on line l, moving on to the next line. A
+// block string takes the lines indented more than indent.
+func (p *yamlParser) scalarValue(l yamlLine, value string, indent int) (*node, error) {
+	p.i++
+
+	switch {
+	case value == "|" || value == "|-" || value == ">" || value == ">-":
+		return p.blockString(l, value, indent), nil
+
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") {
+			return nil, p.errorf(l, "unterminated list")
+		}
+		n := &node{line: l.number, kind: listNode}
+		for _, item := range splitFlow(value[1 : len(value)-1]) {
+			s, err := unquote(item)
+			if err != nil {
+				return nil, p.errorf(l, err.Error())
+			}
+			n.list = append(n.list, &node{line: l.number, kind: scalarNode, str: s})
+		}
+		return n, nil
+
+	case value == "{}":
+		return newMap(l.number), nil
+	}
+
+	s, err := unquote(value)
+	if err != nil {
+		return nil, p.errorf(l, err.Error())
+	}
+	return &node{line: l.number, kind: scalarNode, str: s}, nil
+}
+
+// blockString collects a literal or folded string from the raw lines
+// indented more than indent
+func (p *yamlParser) blockString(l yamlLine, style string, indent int) *node {
+	lines := []string{}
+	blockIndent := -1
+	for ; p.i < len(p.lines); p.i++ {
+		raw := p.lines[p.i].raw
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if p.lines[p.i].indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = p.lines[p.i].indent
+		}
+		lines = append(lines, raw[min(blockIndent, p.lines[p.i].indent):])
+	}
+
+	// Trailing blank lines aren't part of the string
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	sep := "\n"
+	if strings.HasPrefix(style, ">") {
+		sep = " "
+	}
+	s := strings.Join(lines, sep)
+	if !strings.HasSuffix(style, "-") {
+		s += "\n"
+	}
+	return &node{line: l.number, kind: scalarNode, str: s}
+}
+
+func isMappingEntry(text string) bool {
+	_, _, ok := cutMappingEntry(text)
+	return ok
+}
+
+// cutMappingEntry splits "key: value" at the first ": " outside quotes, or
+// a line ending in ":"
+func cutMappingEntry(text string) (string, string, bool) {
+	if text == "" || text[0] == '"' || text[0] == '\'' {
+		key, err := unquotePrefix(text)
+		if err != nil {
+			return "", "", false
+		}
+		rest := strings.TrimSpace(text[len(key.raw):])
+		if rest == ":" || strings.HasPrefix(rest, ": ") {
+			return key.value, strings.TrimSpace(rest[1:]), true
+		}
+		return "", "", false
+	}
+
+	if strings.HasSuffix(text, ":") && !strings.Contains(text, ": ") {
+		return strings.TrimSpace(text[:len(text)-1]), "", true
+	}
+	key, value, ok := strings.Cut(text, ": ")
+	if !ok || strings.HasPrefix(text, "[") {
+		return "", "", false
+	}
+	return strings.TrimSpace(key), strings.TrimSpace(value), true
+}
+
+// stripComment removes a comment, a # at the start or after a space, that
+// isn't inside quotes
+func stripComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// splitFlow splits the items of a flow list on the commas outside quotes
+func splitFlow(s string) []string {
+	items := []string{}
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// quoted is a quoted string at the start of some text
+type quoted struct {
+	raw   string
+	value string
+}
+
+// unquote returns the value of a scalar, which may be quoted
+func unquote(s string) (string, error) {
+	if s == "" || s[0] != '"' && s[0] != '\'' {
+		return s, nil
+	}
+
+	q, err := unquotePrefix(s)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(s[len(q.raw):]) != "" {
+		return "", fmt.Errorf("unexpected text after %s", q.raw)
+	}
+	return q.value, nil
+}
+
+// unquotePrefix reads the quoted string at the start of s. Double quotes
+// take backslash escapes; in single quotes a quote is written twice.
+func unquotePrefix(s string) (quoted, error) {
+	if s == "" || s[0] != '"' && s[0] != '\'' {
+		return quoted{}, fmt.Errorf("expected a quoted string")
+	}
+
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == quote:
+			return quoted{raw: s[:i+1], value: b.String()}, nil
+		case c == '\\' && quote == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return quoted{}, fmt.Errorf("unterminated string")
+}
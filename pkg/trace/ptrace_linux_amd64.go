@@ -0,0 +1,292 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+const supported = true
+
+const (
+	// waitNoThread waits only for the children of the calling thread, so
+	// that the processes other goroutines started aren't reaped
+	waitNoThread = 0x20000000
+
+	ptraceExitKill = 0x100000
+
+	ptraceOptions = syscall.PTRACE_O_TRACESYSGOOD | syscall.PTRACE_O_TRACEFORK | syscall.PTRACE_O_TRACEVFORK |
+		syscall.PTRACE_O_TRACECLONE | syscall.PTRACE_O_TRACEEXEC | ptraceExitKill
+
+	syscallStop = syscall.SIGTRAP | 0x80
+
+	atFDCWD = -100
+
+	// cwd is atFDCWD as a register holds it
+	cwd = 1<<64 - 100
+)
+
+// System calls of interest, on amd64
+const (
+	sysOpen      = 2
+	sysRename    = 82
+	sysCreat     = 85
+	sysOpenat    = 257
+	sysRenameat  = 264
+	sysRenameat2 = 316
+	sysOpenat2   = 437
+)
+
+// killDelay is how long a cancelled command has to exit after being
+// interrupted before it is killed
+const killDelay = 5 * time.Second
+
+// run runs argv under ptrace, calling record for each file that it or any
+// of its children open, and returns its exit code
+func run(ctx context.Context, argv []string, dir string, env []string, cmd exec.Cmd, record func(path string, write bool)) int {
+	path, err := osexec.LookPath(argv[0])
+	if err != nil {
+		fmt.Fprintln(cmd.Stderr, err)
+		return 127
+	}
+
+	var copying sync.WaitGroup
+	stdout, closeStdout := output(cmd.Stdout, &copying)
+	stderr, closeStderr := output(cmd.Stderr, &copying)
+	defer copying.Wait()
+	defer closeStdout()
+	defer closeStderr()
+
+	// Every ptrace request must come from the thread that started tracing,
+	// so the thread is given over to it and discarded afterwards
+	code := make(chan int)
+	go func() {
+		runtime.LockOSThread()
+
+		p, err := os.StartProcess(path, argv, &os.ProcAttr{
+			Dir:   dir,
+			Env:   env,
+			Files: []*os.File{os.Stdin, stdout, stderr},
+			Sys:   &syscall.SysProcAttr{Ptrace: true},
+		})
+		if err != nil {
+			fmt.Fprintln(cmd.Stderr, err)
+			code <- 127
+			return
+		}
+		closeStdout()
+		closeStderr()
+
+		stop := cancel(ctx, p.Pid)
+		code <- trace(p.Pid, record)
+		stop()
+		p.Release()
+	}()
+	return <-code
+}
+
+// output returns a file for a child process to write to that ends up in w,
+// and a function to close it once the child has started
+func output(w io.Writer, copying *sync.WaitGroup) (*os.File, func()) {
+	if f, ok := w.(*os.File); ok {
+		return f, func() {}
+	}
+
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, func() {}
+	}
+	copying.Add(1)
+	go func() {
+		defer copying.Done()
+		io.Copy(w, r)
+		r.Close()
+	}()
+
+	var once sync.Once
+	return pw, func() { once.Do(func() { pw.Close() }) }
+}
+
+// cancel interrupts pid once ctx is done, then kills it if it doesn't exit
+// within killDelay. The returned function stops watching.
+func cancel(ctx context.Context, pid int) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		syscall.Kill(pid, syscall.SIGINT)
+
+		select {
+		case <-done:
+		case <-time.After(killDelay):
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}()
+	return func() { close(done) }
+}
+
+// trace follows pid, stopped as it started, and every process it starts
+// until they've all exited, returning pid's exit code
+func trace(pid int, record func(path string, write bool)) int {
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, syscall.WALL, nil); err != nil || !ws.Stopped() {
+		return -1
+	}
+	if err := syscall.PtraceSetOptions(pid, ptraceOptions); err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		return -1
+	}
+	syscall.PtraceSyscall(pid, 0)
+
+	code := -1
+	inSyscall := map[int]bool{pid: false}
+	for {
+		stopped, err := syscall.Wait4(-1, &ws, syscall.WALL|waitNoThread, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			break
+		}
+
+		switch {
+		case ws.Exited() || ws.Signaled():
+			if stopped == pid {
+				if ws.Exited() {
+					code = ws.ExitStatus()
+				} else {
+					code = -int(ws.Signal())
+				}
+			}
+			delete(inSyscall, stopped)
+			continue
+
+		case !ws.Stopped():
+			continue
+		}
+
+		signal := 0
+		entering, known := inSyscall[stopped]
+		switch sig := ws.StopSignal(); {
+		case sig == syscallStop:
+			inSyscall[stopped] = !entering
+			if entering {
+				syscallExit(stopped, record)
+			}
+
+		case sig == syscall.SIGTRAP && ws.TrapCause() > 0:
+			// A fork, clone or exec, whose new process is followed
+			// automatically
+
+		case sig == syscall.SIGSTOP && !known:
+			// A new process, stopped as it starts
+			inSyscall[stopped] = false
+
+		default:
+			signal = int(sig)
+		}
+		syscall.PtraceSyscall(stopped, signal)
+	}
+	return code
+}
+
+// syscallExit records the file opened by the system call pid is returning
+// from, if it succeeded
+func syscallExit(pid int, record func(path string, write bool)) {
+	var regs syscall.PtraceRegs
+	if syscall.PtraceGetRegs(pid, &regs) != nil || int64(regs.Rax) < 0 {
+		return
+	}
+
+	var path string
+	write := false
+	switch regs.Orig_rax {
+	case sysOpen:
+		path = resolve(pid, cwd, regs.Rdi)
+		write = writing(regs.Rsi)
+	case sysCreat:
+		path = resolve(pid, cwd, regs.Rdi)
+		write = true
+	case sysOpenat:
+		path = resolve(pid, regs.Rdi, regs.Rsi)
+		write = writing(regs.Rdx)
+	case sysOpenat2:
+		// The flags are the first field of struct open_how
+		path = resolve(pid, regs.Rdi, regs.Rsi)
+		buf := make([]byte, 8)
+		if n, _ := syscall.PtracePeekData(pid, uintptr(regs.Rdx), buf); n == len(buf) {
+			write = writing(binary.LittleEndian.Uint64(buf))
+		}
+	case sysRename:
+		path = resolve(pid, cwd, regs.Rsi)
+		write = true
+	case sysRenameat, sysRenameat2:
+		path = resolve(pid, regs.Rdx, regs.R10)
+		write = true
+	default:
+		return
+	}
+
+	if path != "" {
+		record(path, write)
+	}
+}
+
+// writing reports whether a file opened with flags may be written
+func writing(flags uint64) bool {
+	return flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&(syscall.O_CREAT|syscall.O_TRUNC) != 0
+}
+
+// resolve reads the path at addr in pid's memory and makes it absolute,
+// relative to the directory dirfd refers to
+func resolve(pid int, dirfd, addr uint64) string {
+	path := readString(pid, uintptr(addr))
+	if path == "" {
+		return ""
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+
+	link := fmt.Sprintf("/proc/%d/fd/%d", pid, int32(dirfd))
+	if int32(dirfd) == atFDCWD {
+		link = fmt.Sprintf("/proc/%d/cwd", pid)
+	}
+	base, err := os.Readlink(link)
+	if err != nil || !filepath.IsAbs(base) {
+		return ""
+	}
+	return filepath.Join(base, path)
+}
+
+// readString reads the NUL terminated string at addr in pid's memory
+func readString(pid int, addr uintptr) string {
+	s := []byte{}
+	buf := make([]byte, 64)
+	for len(s) < syscall.PathMax {
+		n, err := syscall.PtracePeekData(pid, addr, buf)
+		if i := bytes.IndexByte(buf[:n], 0); i >= 0 {
+			return string(append(s, buf[:i]...))
+		}
+		if err != nil || n == 0 {
+			break
+		}
+		s = append(s, buf[:n]...)
+		addr += uintptr(n)
+	}
+	return ""
+}
@@ -0,0 +1,15 @@
+//go:build !linux || !amd64
+
+package trace
+
+import (
+	"context"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+const supported = false
+
+func run(ctx context.Context, argv []string, dir string, env []string, cmd exec.Cmd, record func(path string, write bool)) int {
+	return 127
+}
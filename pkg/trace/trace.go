@@ -0,0 +1,143 @@
+// Package trace runs recipes while watching which files they open, so that
+// the inputs and outputs a makefile declares can be checked against those a
+// recipe really uses. A recipe that reads an undeclared file can't safely
+// be cached or run remotely, as its result may depend on more than its key.
+//
+// Tracing uses ptrace and needs no helper programs, but is only supported
+// on Linux on amd64.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+// ErrUnsupported is returned where tracing isn't supported
+var ErrUnsupported = fmt.Errorf("tracing file access isn't supported on this platform")
+
+// Supported reports whether tracing works on this platform
+func Supported() bool {
+	return supported
+}
+
+// Executor runs commands locally as "Shell -c command", recording the files
+// they and their children open. One Executor is used for each target, so
+// that what its commands open can be compared with what it declares.
+type Executor struct {
+	Shell string
+
+	// Dir is the directory commands run in, the current one if empty. Files
+	// outside it are of no interest.
+	Dir string
+
+	mu     sync.Mutex
+	reads  map[string]bool
+	writes map[string]bool
+}
+
+func (x *Executor) Execute(ctx context.Context, cmd exec.Cmd) int {
+	if !supported {
+		fmt.Fprintln(cmd.Stderr, ErrUnsupported)
+		return 127
+	}
+
+	env := os.Environ()
+	if len(cmd.Env) > 0 {
+		env = append(env, cmd.Env...)
+	}
+	return run(ctx, []string{x.Shell, "-c", cmd.Command}, x.Dir, env, cmd, x.record)
+}
+
+// record notes that path, an absolute path, was opened for reading or
+// writing
+func (x *Executor) record(path string, write bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.reads == nil {
+		x.reads = map[string]bool{}
+		x.writes = map[string]bool{}
+	}
+	if write {
+		x.writes[path] = true
+	} else {
+		x.reads[path] = true
+	}
+}
+
+// Undeclared returns the files within Dir that the commands run so far read
+// without them being among inputs or outputs, and those they left behind
+// without them being among outputs. Directories, files the commands made
+// themselves, and files they removed again are left out. Paths are relative
+// to Dir, as inputs and outputs are.
+func (x *Executor) Undeclared(inputs, outputs []string) (reads, writes []string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dir := x.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, nil
+	}
+
+	declared := func(names []string) map[string]bool {
+		set := map[string]bool{}
+		for _, name := range names {
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			if rel, ok := relative(root, name); ok {
+				set[rel] = true
+			}
+		}
+		return set
+	}
+	ins, outs := declared(inputs), declared(outputs)
+
+	for path := range x.writes {
+		rel, ok := relative(root, path)
+		if !ok || outs[rel] || !isFile(path) {
+			continue
+		}
+		writes = append(writes, rel)
+	}
+	for path := range x.reads {
+		rel, ok := relative(root, path)
+		if !ok || ins[rel] || outs[rel] || x.writes[path] || !isFile(path) {
+			continue
+		}
+		reads = append(reads, rel)
+	}
+
+	sort.Strings(reads)
+	sort.Strings(writes)
+	return reads, writes
+}
+
+// relative returns path relative to root, resolving symbolic links where
+// the file exists, if it's within root
+func relative(root, path string) (string, bool) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
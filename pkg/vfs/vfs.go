@@ -0,0 +1,137 @@
+// Package vfs is the file system hmake reads makefiles and checks targets
+// on.
+//
+// Everything that touches files goes through an FS, so a build can be run
+// against an in-memory tree, for hermetic tests, or an overlay of several.
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FS gives access to the files of a build. Unlike io/fs.FS, names are
+// operating system paths and may be absolute or start with "..".
+type FS interface {
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+
+	// Glob returns the names matching a pattern, as filepath.Glob does
+	Glob(pattern string) ([]string, error)
+}
+
+// OS is the real file system
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error)     { return os.Open(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+func (osFS) ReadFile(name string) ([]byte, error)  { return os.ReadFile(name) }
+func (osFS) Glob(pattern string) ([]string, error) { return filepath.Glob(pattern) }
+
+// FromFS adapts an io/fs.FS, such as an fstest.MapFS, taking its root as
+// the current directory. Names that lead outside of it don't exist.
+func FromFS(fsys fs.FS) FS {
+	return ioFS{fsys}
+}
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+// clean turns a path relative to the current directory into an io/fs name
+func clean(name string) (string, bool) {
+	name = path.Clean(filepath.ToSlash(name))
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+	return name, true
+}
+
+func (f ioFS) Open(name string) (fs.File, error) {
+	if clean, ok := clean(name); ok {
+		return f.fsys.Open(clean)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f ioFS) Stat(name string) (fs.FileInfo, error) {
+	if clean, ok := clean(name); ok {
+		return fs.Stat(f.fsys, clean)
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f ioFS) ReadFile(name string) ([]byte, error) {
+	if clean, ok := clean(name); ok {
+		return fs.ReadFile(f.fsys, clean)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f ioFS) Glob(pattern string) ([]string, error) {
+	clean, ok := clean(pattern)
+	if !ok {
+		return nil, nil
+	}
+
+	matches, err := fs.Glob(f.fsys, clean)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep a leading "./" so the names read as they were asked for
+	if strings.HasPrefix(pattern, "./") {
+		for i, m := range matches {
+			matches[i] = "./" + m
+		}
+	}
+	return matches, nil
+}
+
+// Sub returns the files of fsys within dir, taking dir as the current
+// directory. Absolute names are left as they are.
+func Sub(fsys FS, dir string) FS {
+	if dir == "" || dir == "." {
+		return fsys
+	}
+	return subFS{fsys, dir}
+}
+
+type subFS struct {
+	fsys FS
+	dir  string
+}
+
+func (f subFS) join(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(f.dir, name)
+}
+
+func (f subFS) Open(name string) (fs.File, error)     { return f.fsys.Open(f.join(name)) }
+func (f subFS) Stat(name string) (fs.FileInfo, error) { return f.fsys.Stat(f.join(name)) }
+func (f subFS) ReadFile(name string) ([]byte, error)  { return f.fsys.ReadFile(f.join(name)) }
+
+func (f subFS) Glob(pattern string) ([]string, error) {
+	matches, err := f.fsys.Glob(f.join(pattern))
+	if err != nil || filepath.IsAbs(pattern) {
+		return matches, err
+	}
+
+	for i, m := range matches {
+		if rel, err := filepath.Rel(f.dir, m); err == nil {
+			matches[i] = rel
+		}
+		if strings.HasPrefix(pattern, "./") {
+			matches[i] = "./" + matches[i]
+		}
+	}
+	return matches, nil
+}
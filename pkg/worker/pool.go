@@ -0,0 +1,335 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+// Host is a worker machine and the number of commands it may run at once
+type Host struct {
+	Addr  string
+	Slots int
+}
+
+// ReadHosts reads a hosts file, with a worker's address and optionally its
+// number of slots on each line, as in "build1:7071 8". # starts a comment.
+func ReadHosts(name string) ([]Host, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := []Host{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		h := Host{Addr: fields[0], Slots: 1}
+		if len(fields) > 1 {
+			slots, err := strconv.Atoi(fields[1])
+			if err != nil || slots < 1 || len(fields) > 2 {
+				return nil, fmt.Errorf("%s:%d: expected an address and a number of slots", name, lineNo)
+			}
+			h.Slots = slots
+		}
+		hosts = append(hosts, h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s lists no hosts", name)
+	}
+	return hosts, nil
+}
+
+// Pool runs commands on worker servers
+type Pool struct {
+	// Token, if set, is sent to the servers as a bearer token
+	Token string
+
+	// Fallback, if set, runs the commands that can't be sent to a worker:
+	// those reading files outside the project, and all of them once no
+	// worker can be reached
+	Fallback exec.Executor
+
+	Client *http.Client
+
+	mu    sync.Mutex
+	freed *sync.Cond
+	hosts []*host
+
+	// madeOn is the host each output fetched back was made on
+	madeOn map[string]*host
+}
+
+type host struct {
+	Host
+	running     int
+	unreachable bool
+}
+
+// NewPool returns a Pool of the hosts given
+func NewPool(hosts []Host) *Pool {
+	p := &Pool{Client: http.DefaultClient, madeOn: map[string]*host{}}
+	p.freed = sync.NewCond(&p.mu)
+	for _, h := range hosts {
+		if !strings.Contains(h.Addr, "://") {
+			h.Addr = "http://" + h.Addr
+		}
+		p.hosts = append(p.hosts, &host{Host: h})
+	}
+	return p
+}
+
+// Slots is the number of commands the pool can run at once
+func (p *Pool) Slots() int {
+	slots := 0
+	for _, h := range p.hosts {
+		slots += h.Slots
+	}
+	return slots
+}
+
+// Execute runs cmd on a worker, or with Fallback if that's not possible
+func (p *Pool) Execute(ctx context.Context, cmd exec.Cmd) int {
+	inputs, err := gather(append(append([]string{}, cmd.Inputs...), cmd.Outputs...))
+	if err != nil {
+		return p.fallback(ctx, cmd, err)
+	}
+
+	for {
+		h := p.acquire(cmd.Inputs)
+		if h == nil {
+			return p.fallback(ctx, cmd, errors.New("no worker can be reached"))
+		}
+
+		// A worker that can't be reached is given up on and the command
+		// tried elsewhere; one that refuses the command is likely to refuse
+		// it anywhere
+		result, err := p.send(ctx, h, cmd, inputs)
+		var refused *statusError
+		p.release(h, err != nil && !errors.As(err, &refused) && ctx.Err() == nil)
+		if ctx.Err() != nil {
+			return 1
+		}
+		if refused != nil {
+			fmt.Fprintf(cmd.Stderr, "hmake: worker %s: %s\n", h.Addr, err)
+			return p.fallback(ctx, cmd, err)
+		}
+		if err != nil {
+			fmt.Fprintf(cmd.Stderr, "hmake: worker %s can't be reached: %s\n", h.Addr, err)
+			continue
+		}
+
+		for _, out := range result.Outputs {
+			if err := p.writeOutput(out, cmd.Outputs, h); err != nil {
+				fmt.Fprintf(cmd.Stderr, "hmake: worker %s: %s\n", h.Addr, err)
+				return 1
+			}
+		}
+		cmd.Stdout.Write(result.Stdout)
+		cmd.Stderr.Write(result.Stderr)
+		return result.ExitCode
+	}
+}
+
+func (p *Pool) fallback(ctx context.Context, cmd exec.Cmd, err error) int {
+	if p.Fallback == nil {
+		fmt.Fprintf(cmd.Stderr, "hmake: can't distribute command: %s\n", err)
+		return 127
+	}
+	return p.Fallback.Execute(ctx, cmd)
+}
+
+// acquire takes a slot on a host, waiting for one to be free. The host
+// that made the most of the inputs is preferred, then the least busy. It
+// returns nil if no host can be reached.
+func (p *Pool) acquire(inputs []string) *host {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		var best *host
+		bestMade := -1
+		reachable := false
+		for _, h := range p.hosts {
+			if h.unreachable {
+				continue
+			}
+			reachable = true
+			if h.running >= h.Slots {
+				continue
+			}
+
+			made := 0
+			for _, in := range inputs {
+				if p.madeOn[in] == h {
+					made++
+				}
+			}
+			if made > bestMade || made == bestMade && h.running < best.running {
+				best, bestMade = h, made
+			}
+		}
+
+		if !reachable {
+			return nil
+		}
+		if best != nil {
+			best.running++
+			return best
+		}
+		p.freed.Wait()
+	}
+}
+
+// release gives back a slot, giving up on the host if it failed
+func (p *Pool) release(h *host, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.running--
+	if failed {
+		h.unreachable = true
+	}
+	p.freed.Broadcast()
+}
+
+// gather reads the files named, walking directories. Names that don't exist,
+// such as phony prerequisites, are left out.
+func gather(names []string) ([]File, error) {
+	files := []File{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if _, ok := relative(name); !ok {
+			return nil, fmt.Errorf("%s is outside the working directory", name)
+		}
+
+		err := filepath.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || seen[path] {
+				return err
+			}
+			seen[path] = true
+			f, err := readFile(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// send runs cmd on h, sending only the inputs it hasn't been sent before
+func (p *Pool) send(ctx context.Context, h *host, cmd exec.Cmd, inputs []File) (*Result, error) {
+	query := missingRequest{SHA256: []string{}}
+	for _, in := range inputs {
+		query.SHA256 = append(query.SHA256, in.SHA256)
+	}
+	var missing missingRequest
+	if err := p.post(ctx, h, "/missing", query, &missing); err != nil {
+		return nil, err
+	}
+	needed := map[string]bool{}
+	for _, sum := range missing.SHA256 {
+		needed[sum] = true
+	}
+
+	job := Job{Command: cmd.Command, Env: cmd.Env, Inputs: []File{}, Outputs: []string{}}
+	for _, in := range inputs {
+		if !needed[in.SHA256] {
+			in.Data = nil
+		}
+		job.Inputs = append(job.Inputs, in)
+	}
+	for _, out := range cmd.Outputs {
+		if _, ok := relative(out); ok {
+			job.Outputs = append(job.Outputs, out)
+		}
+	}
+
+	var result Result
+	if err := p.post(ctx, h, "/run", job, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (p *Pool) post(ctx context.Context, h *host, path string, body, reply interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Addr+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	return readJSON(resp, reply)
+}
+
+// writeOutput writes a file a worker made, which must be one of the
+// command's outputs and have the digest the worker gave
+func (p *Pool) writeOutput(out File, outputs []string, h *host) error {
+	wanted := false
+	for _, name := range outputs {
+		wanted = wanted || name == out.Path
+	}
+	if !wanted {
+		return fmt.Errorf("sent %s, which isn't an output", out.Path)
+	}
+	if digest(out.Data) != out.SHA256 {
+		return fmt.Errorf("sent %s with the wrong digest", out.Path)
+	}
+
+	if dir := filepath.Dir(out.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	os.Remove(out.Path)
+	if err := os.WriteFile(out.Path, out.Data, out.Mode.Perm()); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.madeOn[out.Path] = h
+	p.mu.Unlock()
+	return nil
+}
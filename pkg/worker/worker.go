@@ -0,0 +1,266 @@
+// Package worker spreads the commands of a build across machines.
+//
+// A Server, run on each machine with "hmake serve-worker", runs commands
+// it's sent in a scratch directory holding the files they need, and sends
+// back the files they make. A Pool is an exec.Executor handing commands to
+// the servers listed in a hosts file. Files are sent by their SHA-256, and
+// a server keeps those it has been sent, so each reaches each machine once.
+// The Pool sends a command to the machine that built its prerequisites
+// when it can, so chains of targets stay together and independent parts of
+// the graph go to different machines.
+package worker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hookenz/hmake/pkg/exec"
+)
+
+// File is a file sent with a job or back from one. Data is only sent when
+// the other side doesn't already have SHA256.
+type File struct {
+	Path   string      `json:"path"`
+	SHA256 string      `json:"sha256"`
+	Mode   fs.FileMode `json:"mode"`
+	Data   []byte      `json:"data,omitempty"`
+}
+
+// Job is a command for a worker to run, with the files it reads and the
+// names of those it makes
+type Job struct {
+	Command string   `json:"command"`
+	Env     []string `json:"env,omitempty"`
+	Inputs  []File   `json:"inputs"`
+	Outputs []string `json:"outputs"`
+}
+
+// Result is what became of a Job
+type Result struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   []byte `json:"stdout,omitempty"`
+	Stderr   []byte `json:"stderr,omitempty"`
+	Outputs  []File `json:"outputs"`
+}
+
+// missingRequest asks which of some files a worker lacks; the reply has
+// the same form
+type missingRequest struct {
+	SHA256 []string `json:"sha256"`
+}
+
+// Server runs jobs sent over HTTP: POST /missing with the digests of a
+// job's inputs, then POST /run with the job
+type Server struct {
+	// Dir holds the files the server has been sent, and a scratch
+	// directory for each job
+	Dir string
+
+	// Shell runs each command, sh if empty
+	Shell string
+
+	// Token, if set, must be sent by clients as a bearer token
+	Token string
+
+	mu sync.Mutex
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(s.Token)) != 1 {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/missing":
+		var req missingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		missing := missingRequest{SHA256: []string{}}
+		for _, sum := range req.SHA256 {
+			if _, err := os.Stat(s.blobPath(sum)); err != nil {
+				missing.SHA256 = append(missing.SHA256, sum)
+			}
+		}
+		json.NewEncoder(w).Encode(missing)
+	case "/run":
+		var job Job
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := s.run(r, job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) blobPath(sum string) string {
+	if len(sum) < 2 {
+		sum = "__"
+	}
+	return filepath.Join(s.Dir, "cas", sum[:2], filepath.Base(sum))
+}
+
+// run lays out a job's inputs in a scratch directory, runs its command
+// there and collects its outputs
+func (s *Server) run(r *http.Request, job Job) (*Result, error) {
+	if err := os.MkdirAll(filepath.Join(s.Dir, "jobs"), 0o755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Join(s.Dir, "jobs"), "job-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, in := range job.Inputs {
+		if err := s.place(dir, in); err != nil {
+			return nil, err
+		}
+	}
+	for _, out := range job.Outputs {
+		if _, ok := relative(out); !ok {
+			return nil, fmt.Errorf("output %s is outside the working directory", out)
+		}
+	}
+
+	shell := s.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	var stdout, stderr strings.Builder
+	local := &exec.Local{Shell: shell, Dir: dir}
+	code := local.Execute(r.Context(), exec.Cmd{Command: job.Command, Env: job.Env, Stdout: &stdout, Stderr: &stderr})
+
+	result := &Result{ExitCode: code, Stdout: []byte(stdout.String()), Stderr: []byte(stderr.String()), Outputs: []File{}}
+	for _, out := range job.Outputs {
+		rel, _ := relative(out)
+		f, err := readFile(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			// The command may not have made it, which the build will notice
+			continue
+		}
+		f.Path = out
+		result.Outputs = append(result.Outputs, f)
+	}
+	return result, nil
+}
+
+// place writes an input into a job's directory, taking its contents from
+// the job or from the files sent before, and keeping new ones
+func (s *Server) place(dir string, in File) error {
+	rel, ok := relative(in.Path)
+	if !ok {
+		return fmt.Errorf("input %s is outside the working directory", in.Path)
+	}
+	name := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	// An empty file is sent without data
+	data := in.Data
+	if data == nil && in.SHA256 == digest(nil) {
+		data = []byte{}
+	} else if data == nil {
+		var err error
+		if data, err = os.ReadFile(s.blobPath(in.SHA256)); err != nil {
+			return fmt.Errorf("input %s wasn't sent", in.Path)
+		}
+	}
+	if digest(data) != in.SHA256 {
+		return fmt.Errorf("input %s doesn't have its digest", in.Path)
+	}
+
+	if in.Data != nil {
+		s.mu.Lock()
+		err := os.MkdirAll(filepath.Dir(s.blobPath(in.SHA256)), 0o755)
+		if err == nil {
+			err = os.WriteFile(s.blobPath(in.SHA256), data, 0o644)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(name, data, in.Mode.Perm())
+}
+
+// relative cleans a path of the build, which must lie within the current
+// directory to be sent to another machine
+func relative(name string) (string, bool) {
+	name = path.Clean(filepath.ToSlash(name))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// readFile reads a regular file with its digest and mode
+func readFile(name string) (File, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return File{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return File{}, fmt.Errorf("%s is not a regular file", name)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return File{}, err
+	}
+	return File{Path: name, SHA256: digest(data), Mode: info.Mode().Perm(), Data: data}, nil
+}
+
+// digest returns the hex SHA-256 of data
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// statusError is a request a worker refused or failed
+type statusError struct {
+	status  string
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.status + ": " + e.message
+}
+
+// readJSON decodes a JSON response, or turns an unsuccessful one into a
+// statusError
+func readJSON(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{status: resp.Status, message: strings.TrimSpace(string(body))}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}